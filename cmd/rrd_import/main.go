@@ -0,0 +1,139 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/serde"
+)
+
+var stats struct {
+	sync.Mutex
+	totalSqlOps, totalCount, totalPoints int
+}
+
+type Config struct {
+	mode       string // import or export
+	dbConnect  string
+	root       string
+	rrdDir     string
+	namePrefix string
+	specStr    string
+	rraSpecs   []rrd.RRASpec
+	staleDays  int
+	workers    int
+	batch      int
+	name       string
+	dsName     string
+	out        string
+}
+
+func main() {
+
+	var cfg Config
+
+	flag.StringVar(&cfg.mode, "mode", "import", "import or export")
+	flag.StringVar(&cfg.dbConnect, "dbconnect", "host=/var/run/postgresql dbname=tgres sslmode=disable", "db connect string")
+	flag.StringVar(&cfg.rrdDir, "rrd-dir", "/var/lib/rrd", "location where all RRD files are stored, names are relative to it")
+	flag.StringVar(&cfg.root, "root", "", "location of files to be imported (.rrd or rrdtool dump .xml), should be subdirectory of rrd-dir, defaults to rrd-dir")
+	flag.StringVar(&cfg.namePrefix, "prefix", "", "series name prefix (no trailing dot)")
+	flag.IntVar(&cfg.staleDays, "stale-days", 0, "Max days since last update before we ignore this file (0 = process all)")
+	flag.StringVar(&cfg.specStr, "spec", "", "RRAs (config file format, comma-separated) to use for new DSs (Blank = same as the RRD file)")
+	flag.IntVar(&cfg.workers, "workers", 4, "Number of concurrent db workers")
+	flag.IntVar(&cfg.batch, "batch", 100, "Number of files per flush")
+	flag.StringVar(&cfg.name, "name", "", "name of the series to export")
+	flag.StringVar(&cfg.dsName, "ds-name", "value", "RRDTool DS name of the exported series")
+	flag.StringVar(&cfg.out, "out", "", "file to export to (Blank = stdout)")
+
+	flag.Parse()
+
+	if cfg.mode != "import" && cfg.mode != "export" {
+		fmt.Printf("Please specify -mode import or export\n")
+		return
+	}
+	if cfg.mode == "export" && cfg.name == "" {
+		fmt.Printf("Please specify -name of the series to export\n")
+		return
+	}
+
+	if cfg.root == "" {
+		cfg.root = cfg.rrdDir
+	}
+	if cfg.batch < 1 {
+		cfg.batch = 1
+	}
+
+	if cfg.specStr != "" {
+		for _, s := range strings.Split(cfg.specStr, ",") {
+			spec, err := rrd.ParseRRASpec(s)
+			if err == nil && spec.Span%spec.Step != 0 {
+				err = fmt.Errorf("span (%v) must be a multiple of step (%v)", spec.Span, spec.Step)
+			}
+			if err != nil {
+				fmt.Printf("Error parsing spec: %v\n", err)
+				return
+			}
+			cfg.rraSpecs = append(cfg.rraSpecs, spec)
+		}
+		fmt.Printf("All newly created DSs will have these RRAs: %q\n", cfg.specStr)
+	}
+
+	prefix := os.Getenv("TGRES_DB_PREFIX")
+	db, err := serde.InitDb(cfg.dbConnect, prefix)
+	if err != nil {
+		fmt.Printf("Error connecting to database: %v\n", err)
+		return
+	}
+
+	if cfg.mode == "export" {
+		var out io.Writer = os.Stdout
+		if cfg.out != "" {
+			fp, err := os.Create(cfg.out)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer fp.Close()
+			out = fp
+		}
+		if err := exportDS(db.Fetcher(), cfg.name, &cfg, out); err != nil {
+			fmt.Fprintf(os.Stderr, "Error exporting %q: %v\n", cfg.name, err)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	ch := make(chan *verticalCache)
+
+	for i := 0; i < cfg.workers; i++ {
+		wg.Add(1)
+		go vcacheFlusher(ch, db.Flusher(), &wg)
+	}
+
+	importFiles(db, ch, &cfg)
+
+	close(ch)
+	wg.Wait() // Wait for flushers to exit.
+
+	fmt.Printf("DONE: GRAND TOTAL %d points across %d series in %d SQL ops.\n", stats.totalPoints, stats.totalCount, stats.totalSqlOps)
+}
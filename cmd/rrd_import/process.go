@@ -0,0 +1,277 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/serde"
+)
+
+var (
+	cfFromRRD = map[string]rrd.Consolidation{
+		"AVERAGE": rrd.WMEAN,
+		"MIN":     rrd.MIN,
+		"MAX":     rrd.MAX,
+		"LAST":    rrd.LAST,
+	}
+	cfToRRD = map[rrd.Consolidation]string{
+		rrd.WMEAN:  "AVERAGE",
+		rrd.SKETCH: "AVERAGE", // a SKETCH RRA is a WMEAN one
+		rrd.MIN:    "MIN",
+		rrd.MAX:    "MAX",
+		rrd.LAST:   "LAST",
+	}
+)
+
+// rraLoader is implemented by serdes which can load all the data of
+// an RRA (see dsl.NamedDSFetcher).
+type rraLoader interface {
+	LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error)
+}
+
+func importFiles(db serde.SerDe, ch chan *verticalCache, cfg *Config) {
+	var (
+		paths []string
+		seq   int
+	)
+	filepath.Walk(cfg.root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && (strings.HasSuffix(path, ".rrd") || strings.HasSuffix(path, ".xml")) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	fmt.Printf("Found %d RRD files in %v\n", len(paths), cfg.root)
+
+	vcache := newVerticalCache(seq)
+	for n, path := range paths {
+		count, err := importFile(db.Fetcher(), vcache, path, cfg)
+		if err != nil {
+			fmt.Printf("Skipping %v due to error: %v\n", path, err)
+			continue
+		}
+		stats.Lock()
+		stats.totalCount += count
+		stats.Unlock()
+
+		if (n+1)%cfg.batch == 0 {
+			fmt.Printf("+++ Sending vcache [%v] to flusher (%d of %d files).\n", vcache.ts, n+1, len(paths))
+			ch <- vcache
+			seq++
+			vcache = newVerticalCache(seq)
+		}
+	}
+	if len(vcache.dps) > 0 || len(vcache.dss) > 0 {
+		fmt.Printf("+++ Sending vcache [%v] to flusher.\n", vcache.ts)
+		ch <- vcache
+	}
+}
+
+// importFile creates (unless they exist) a DS for every DS of the RRD
+// file and adds the data to vcache. The data of each RRA is resampled
+// from the RRAs of the file, which need not match. Returns the number
+// of DSs imported.
+func importFile(db serde.Fetcher, vcache *verticalCache, path string, cfg *Config) (int, error) {
+	f, err := readRRDFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if cfg.staleDays > 0 && time.Now().Sub(f.lastUpdate) > time.Duration(cfg.staleDays*24)*time.Hour {
+		return 0, fmt.Errorf("last updated %v, more than %d days ago", f.lastUpdate, cfg.staleDays)
+	}
+
+	name := nameFromPath(path, cfg.rrdDir, cfg.namePrefix)
+	count := 0
+	for n, rds := range f.dss {
+		spec, srcs, err := specFromRRD(f, n)
+		if err != nil {
+			fmt.Printf("Skipping DS %q in %v: %v\n", rds.name, path, err)
+			continue
+		}
+		if cfg.rraSpecs != nil {
+			spec.RRAs = cfg.rraSpecs
+		}
+		for _, rraSpec := range spec.RRAs {
+			if rraSpec.Step%spec.Step != 0 {
+				return count, fmt.Errorf("RRA step (%v) must be a multiple of DS step (%v)", rraSpec.Step, spec.Step)
+			}
+		}
+
+		dsName := name
+		if len(f.dss) > 1 {
+			dsName += "." + rds.name
+		}
+
+		// NB: If the DS exists, our spec is ignored
+		ds, err := db.FetchOrCreateDataSource(serde.Ident{"name": dsName}, spec)
+		if err != nil {
+			return count, err
+		}
+
+		dbds := ds.(*serde.DbDataSource)
+		for _, rra := range dbds.RRAs() {
+			dbrra := rra.(*serde.DbRoundRobinArchive)
+			origLatest := dbrra.Latest()
+			dbrra.RoundRobinArchiver = rrd.Resample(dbrra.Spec(), dbds.Step(), srcs)
+			vcache.updateDps(dbrra, origLatest)
+		}
+
+		// Only flush the DS if LastUpdate has advanced,
+		// otherwise leave as is.
+		if dbds.Created() || f.lastUpdate.After(dbds.LastUpdate()) {
+			vcache.updateDss(dbds, f.lastUpdate)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// specFromRRD returns the spec of DS n of the RRD file along with its
+// RRAs (as plain RRAs containing the data). Holt-Winters RRAs have no
+// equivalent and are ignored.
+func specFromRRD(f *rrdFile, n int) (*rrd.DSSpec, []rrd.RoundRobinArchiver, error) {
+	rds := f.dss[n]
+	dsType, err := rrd.ParseDSType(rds.dsType)
+	if err != nil {
+		return nil, nil, err
+	}
+	spec := &rrd.DSSpec{
+		Step:      f.step,
+		Heartbeat: rds.heartbeat,
+		Type:      dsType,
+		Min:       math.Inf(-1),
+		Max:       math.Inf(1),
+	}
+	if !math.IsNaN(rds.min) {
+		spec.Min = rds.min
+	}
+	if !math.IsNaN(rds.max) {
+		spec.Max = rds.max
+	}
+
+	var srcs []rrd.RoundRobinArchiver
+	for i := range f.rras {
+		r := &f.rras[i]
+		cf, ok := cfFromRRD[r.cf]
+		if !ok || len(r.rows) == 0 {
+			continue
+		}
+		step, size := f.step*time.Duration(r.pdpPerRow), int64(len(r.rows))
+		rraSpec := rrd.RRASpec{
+			Function: cf,
+			Step:     step,
+			Span:     step * time.Duration(size),
+			Xff:      float32(r.xff),
+		}
+		spec.RRAs = append(spec.RRAs, rraSpec)
+
+		rraSpec.Latest = f.lastRow(r)
+		rraSpec.DPs = make(map[int64]float64, size)
+		for k, row := range r.rows {
+			if v := row[n]; !math.IsNaN(v) {
+				t := rraSpec.Latest.Add(-time.Duration(size-1-int64(k)) * step)
+				rraSpec.DPs[rrd.SlotIndex(t, step, size)] = v
+			}
+		}
+		srcs = append(srcs, rrd.NewRoundRobinArchive(rraSpec))
+	}
+	if len(srcs) == 0 {
+		return nil, nil, fmt.Errorf("no RRAs with a supported consolidation function")
+	}
+	return spec, srcs, nil
+}
+
+// exportDS writes the DS named name in the "rrdtool dump" XML format,
+// suitable for "rrdtool restore". RRAs which RRDTool does not support
+// (other consolidation functions, calendar slots) are left out.
+func exportDS(db serde.Fetcher, name string, cfg *Config, out io.Writer) error {
+	ds, err := db.FetchOrCreateDataSource(serde.Ident{"name": name}, nil)
+	if err != nil {
+		return err
+	}
+	if ds == nil {
+		return fmt.Errorf("DS %q not found", name)
+	}
+	loader, ok := db.(rraLoader)
+	if !ok {
+		return fmt.Errorf("loading RRA data is not supported by this serde")
+	}
+	if ds.Step() < time.Second || ds.Step()%time.Second != 0 {
+		return fmt.Errorf("DS step (%v) must be whole seconds", ds.Step())
+	}
+
+	spec := ds.Spec()
+	rds := rrdDS{
+		name:      cfg.dsName,
+		dsType:    ds.Type().String(),
+		heartbeat: ds.Heartbeat(),
+		min:       math.NaN(),
+		max:       math.NaN(),
+	}
+	if !math.IsInf(spec.Min, 0) {
+		rds.min = spec.Min
+	}
+	if !math.IsInf(spec.Max, 0) {
+		rds.max = spec.Max
+	}
+	f := &rrdFile{step: ds.Step(), lastUpdate: ds.LastUpdate(), dss: []rrdDS{rds}}
+
+	for _, rra := range ds.RRAs() {
+		cf, ok := cfToRRD[rra.Spec().Function]
+		if !ok || rra.Slots().IsCalendar() || rra.Step()%ds.Step() != 0 {
+			fmt.Fprintf(os.Stderr, "Skipping RRA %v %v:%v, not supported by RRDTool.\n", rra.Spec().Function, rra.Step(), rra.Spec().Span)
+			continue
+		}
+		if rra, err = loader.LoadRRAData(rra); err != nil {
+			return err
+		}
+
+		r := rrdRRA{cf: cf, pdpPerRow: int64(rra.Step() / ds.Step()), xff: float64(rra.Spec().Xff)}
+		step, size := rra.Step(), rra.Size()
+		last, oldest := f.lastRow(&r), rra.Latest().Add(-step*time.Duration(size))
+		for k := int64(0); k < size; k++ {
+			v := math.NaN()
+			if t := last.Add(-time.Duration(size-1-k) * step); !t.After(rra.Latest()) && t.After(oldest) {
+				if dp, ok := rra.DPs()[rrd.SlotIndex(t, step, size)]; ok {
+					v = dp
+				}
+			}
+			r.rows = append(r.rows, []float64{v})
+		}
+		f.rras = append(f.rras, r)
+	}
+	return writeXML(out, f)
+}
+
+func nameFromPath(path, rrdDir, prefix string) string {
+	rel, err := filepath.Rel(rrdDir, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	basename := strings.TrimSuffix(strings.TrimSuffix(rel, ".rrd"), ".xml")
+	name := strings.Replace(basename, string(filepath.Separator), ".", -1)
+	if prefix != "" {
+		name = prefix + "." + name
+	}
+	return name
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/serde"
+)
+
+// testDB is a memory serde whose RRAs are DbRoundRobinArchives, as
+// importFile expects. After the vertical cache is flushed, i.e. once
+// lastUpdate is set, the DS has the last update of the file, as it
+// would in the database.
+type testDB struct {
+	serde.Fetcher
+	lastUpdate time.Time
+}
+
+type flushedDS struct {
+	rrd.DataSourcer
+	lastUpdate time.Time
+}
+
+func (ds *flushedDS) LastUpdate() time.Time { return ds.lastUpdate }
+
+func (db *testDB) FetchOrCreateDataSource(ident serde.Ident, spec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	ds, err := db.Fetcher.FetchOrCreateDataSource(ident, spec)
+	if ds == nil || err != nil {
+		return ds, err
+	}
+	rras := ds.RRAs()
+	for i, rra := range rras {
+		if _, ok := rra.(*serde.DbRoundRobinArchive); !ok {
+			rras[i] = &serde.DbRoundRobinArchive{RoundRobinArchiver: rra}
+		}
+	}
+	ds.SetRRAs(rras)
+	if !db.lastUpdate.IsZero() {
+		return &flushedDS{ds, db.lastUpdate}, nil
+	}
+	return ds, nil
+}
+
+func (*testDB) LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error) {
+	return rra, nil
+}
+
+func Test_importExport(t *testing.T) {
+	orig, err := readRRDFile("testdata/example.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := &testDB{Fetcher: serde.NewMemSerDe().Fetcher()}
+	vcache := newVerticalCache(0)
+	cfg := &Config{rrdDir: "testdata", namePrefix: "rrd"}
+	count, err := importFile(db, vcache, "testdata/example.xml", cfg)
+	if err != nil || count != 2 {
+		t.Fatalf("importFile: expected 2 DSs, got %d: %v", count, err)
+	}
+
+	in, _ := db.FetchOrCreateDataSource(serde.Ident{"name": "rrd.example.in"}, nil)
+	if in == nil {
+		t.Fatal("DS rrd.example.in not created")
+	}
+	spec := in.Spec()
+	if spec.Step != 5*time.Minute || spec.Heartbeat != 10*time.Minute || spec.Type != rrd.COUNTER || spec.Min != 0 || !math.IsInf(spec.Max, 1) {
+		t.Errorf("unexpected spec: %+v", spec)
+	}
+	if len(spec.RRAs) != 2 ||
+		spec.RRAs[0].Function != rrd.WMEAN || spec.RRAs[0].Step != 5*time.Minute || spec.RRAs[0].Span != 30*time.Minute ||
+		spec.RRAs[1].Function != rrd.MAX || spec.RRAs[1].Step != 15*time.Minute || spec.RRAs[1].Span != time.Hour {
+		t.Errorf("unexpected RRAs: %+v", spec.RRAs)
+	}
+
+	ds := in.(*serde.DbDataSource)
+	lu, _ := vcache.dss[ds.Seg()][ds.Idx()].(time.Time)
+	if !lu.Equal(orig.lastUpdate) {
+		t.Errorf("expected last update %v in the vcache, got %v", orig.lastUpdate, lu)
+	}
+	db.lastUpdate = lu // the vcache is flushed
+
+	for n, name := range []string{"in", "out"} {
+		var buf bytes.Buffer
+		cfg.dsName = name
+		if err := exportDS(db, "rrd.example."+name, cfg, &buf); err != nil {
+			t.Fatalf("exportDS(%s): %v", name, err)
+		}
+		got, err := readXML(&buf)
+		if err != nil {
+			t.Fatalf("readXML(%s): %v", name, err)
+		}
+
+		// The original with only DS n
+		expect := &rrdFile{step: orig.step, lastUpdate: orig.lastUpdate, dss: orig.dss[n : n+1]}
+		for _, rra := range orig.rras {
+			r := rra
+			r.rows = nil
+			for _, row := range rra.rows {
+				r.rows = append(r.rows, row[n:n+1])
+			}
+			expect.rras = append(expect.rras, r)
+		}
+		compareRRDFiles(t, "export "+name, expect, got)
+	}
+
+	if err := exportDS(db, "rrd.example.foo", cfg, &bytes.Buffer{}); err == nil {
+		t.Errorf("exportDS of a non-existent DS: expected an error")
+	}
+}
+
+func Test_nameFromPath(t *testing.T) {
+	for _, c := range []struct{ path, dir, prefix, expect string }{
+		{"/var/lib/munin/example.com/load.rrd", "/var/lib/munin", "", "example.com.load"},
+		{"/var/lib/munin/example.com/load.xml", "/var/lib/munin", "munin", "munin.example.com.load"},
+	} {
+		if got := nameFromPath(c.path, c.dir, c.prefix); got != c.expect {
+			t.Errorf("nameFromPath(%q, %q, %q): expected %q, got %q", c.path, c.dir, c.prefix, c.expect, got)
+		}
+	}
+}
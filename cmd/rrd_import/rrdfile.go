@@ -0,0 +1,225 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// Random notes on RRDTool files.
+//
+// An RRD file has one or more DSs (in the rrdtool sense, i.e. named
+// columns) which share the step and the RRAs. Each DS becomes a
+// separate Tgres DS with the same RRAs.
+//
+// The binary format is a dump of C structs in native byte order and
+// alignment, there is no portable way to read it. We support the
+// 64-bit layout (byte order is detected using the float cookie),
+// files from other platforms can be converted with "rrdtool dump" on
+// the machine they were created on and imported as XML.
+//
+// Like Tgres, RRDTool timestamps mark the end of a slot. The most
+// recent row of an RRA ends at last_up rounded down to the RRA step.
+// Values are stored as rates (i.e. after the DS type conversion),
+// same as in Tgres.
+
+// rrdFile is the content of an RRD file, read either from the binary
+// format or from the XML of "rrdtool dump".
+type rrdFile struct {
+	step       time.Duration
+	lastUpdate time.Time
+	dss        []rrdDS
+	rras       []rrdRRA
+}
+
+type rrdDS struct {
+	name      string
+	dsType    string // GAUGE, COUNTER, DERIVE, ABSOLUTE or COMPUTE
+	heartbeat time.Duration
+	min, max  float64 // NaN means no bound
+}
+
+type rrdRRA struct {
+	cf        string // AVERAGE, MIN, MAX, LAST or one of the Holt-Winters CFs
+	pdpPerRow int64
+	xff       float64
+	rows      [][]float64 // [row][ds], oldest first
+}
+
+// lastRow returns the end of the most recent slot of the RRA.
+func (f *rrdFile) lastRow(rra *rrdRRA) time.Time {
+	step := int64(f.step/time.Second) * rra.pdpPerRow
+	lu := f.lastUpdate.Unix()
+	return time.Unix(lu-lu%step, 0)
+}
+
+func readRRDFile(path string) (*rrdFile, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	if strings.HasSuffix(path, ".xml") {
+		return readXML(fp)
+	}
+	return readBinary(fp)
+}
+
+const (
+	rrdFloatCookie = 8.642135e130
+	rrdHeadSize    = 128 // stat_head_t
+)
+
+// rrdReader reads the (64-bit) C structs of a binary RRD file. The
+// first error sticks, subsequent reads return zero values.
+type rrdReader struct {
+	b   []byte
+	off int
+	bo  binary.ByteOrder
+	err error
+}
+
+func (r *rrdReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if r.off+n > len(r.b) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	r.off += n
+	return r.b[r.off-n : r.off]
+}
+
+func (r *rrdReader) skip(n int) { r.bytes(n) }
+
+func (r *rrdReader) align() {
+	if n := r.off % 8; n != 0 {
+		r.skip(8 - n)
+	}
+}
+
+func (r *rrdReader) str(n int) string {
+	b := r.bytes(n)
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func (r *rrdReader) uint() int64 {
+	if b := r.bytes(8); b != nil {
+		return int64(r.bo.Uint64(b))
+	}
+	return 0
+}
+
+func (r *rrdReader) float() float64 {
+	if b := r.bytes(8); b != nil {
+		return math.Float64frombits(r.bo.Uint64(b))
+	}
+	return math.NaN()
+}
+
+func readBinary(in io.Reader) (*rrdFile, error) {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < rrdHeadSize || string(b[:4]) != "RRD\x00" {
+		return nil, fmt.Errorf("not an RRD file")
+	}
+	version := string(b[4:8])
+	if version < "0001" || version > "0004" {
+		return nil, fmt.Errorf("unsupported RRD version: %q", version)
+	}
+
+	r := &rrdReader{b: b, off: 16}
+	for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if math.Float64frombits(bo.Uint64(b[16:24])) == rrdFloatCookie {
+			r.bo = bo
+		}
+	}
+	if r.bo == nil {
+		return nil, fmt.Errorf("unsupported RRD file layout (not 64-bit?), use rrdtool dump and import the XML")
+	}
+	r.skip(8) // float cookie
+
+	// stat_head_t
+	dsCnt, rraCnt := int(r.uint()), int(r.uint())
+	f := &rrdFile{step: time.Duration(r.uint()) * time.Second}
+	r.skip(10 * 8) // par
+
+	// ds_def_t
+	for i := 0; i < dsCnt && r.err == nil; i++ {
+		ds := rrdDS{name: r.str(20), dsType: r.str(20)}
+		ds.heartbeat = time.Duration(r.uint()) * time.Second
+		ds.min, ds.max = r.float(), r.float()
+		r.skip(7 * 8)
+		f.dss = append(f.dss, ds)
+	}
+
+	// rra_def_t
+	rowCnts := make([]int64, rraCnt)
+	for i := 0; i < rraCnt && r.err == nil; i++ {
+		rra := rrdRRA{cf: r.str(20)}
+		r.align()
+		rowCnts[i], rra.pdpPerRow = r.uint(), r.uint()
+		rra.xff = r.float()
+		r.skip(9 * 8)
+		f.rras = append(f.rras, rra)
+	}
+
+	// live_head_t
+	f.lastUpdate = time.Unix(r.uint(), 0)
+	if version >= "0003" {
+		r.skip(8) // last_up_usec
+	}
+
+	r.skip(dsCnt * (32 + 10*8))       // pdp_prep_t
+	r.skip(rraCnt * dsCnt * (10 * 8)) // cdp_prep_t
+
+	// rra_ptr_t
+	curRows := make([]int64, rraCnt)
+	for i := range curRows {
+		curRows[i] = r.uint()
+	}
+
+	// The data, the row after cur_row is the oldest.
+	for i := 0; i < rraCnt && r.err == nil; i++ {
+		rows := make([][]float64, rowCnts[i])
+		for n := range rows {
+			row := make([]float64, dsCnt)
+			for j := range row {
+				row[j] = r.float()
+			}
+			rows[(int64(n)+rowCnts[i]-curRows[i]-1)%rowCnts[i]] = row
+		}
+		f.rras[i].rows = rows
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("error reading RRD file: %v", r.err)
+	}
+	return f, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The .rrd files in testdata contain the same data as example.xml,
+// in the layout of the platforms they are named after (see
+// testdata/README.txt).
+
+func sameFloat(a, b float64) bool {
+	return a == b || math.IsNaN(a) && math.IsNaN(b)
+}
+
+func compareRRDFiles(t *testing.T, what string, expect, got *rrdFile) {
+	if got.step != expect.step || !got.lastUpdate.Equal(expect.lastUpdate) {
+		t.Errorf("%s: expected step %v lastUpdate %v, got %v %v", what, expect.step, expect.lastUpdate, got.step, got.lastUpdate)
+	}
+	if len(got.dss) != len(expect.dss) || len(got.rras) != len(expect.rras) {
+		t.Fatalf("%s: expected %d DSs %d RRAs, got %d %d", what, len(expect.dss), len(expect.rras), len(got.dss), len(got.rras))
+	}
+	for i, e := range expect.dss {
+		g := got.dss[i]
+		if g.name != e.name || g.dsType != e.dsType || g.heartbeat != e.heartbeat || !sameFloat(g.min, e.min) || !sameFloat(g.max, e.max) {
+			t.Errorf("%s: DS %d: expected %+v, got %+v", what, i, e, g)
+		}
+	}
+	for i, e := range expect.rras {
+		g := got.rras[i]
+		if g.cf != e.cf || g.pdpPerRow != e.pdpPerRow || g.xff != e.xff || len(g.rows) != len(e.rows) {
+			t.Errorf("%s: RRA %d: expected %v %d %v (%d rows), got %v %d %v (%d rows)", what, i,
+				e.cf, e.pdpPerRow, e.xff, len(e.rows), g.cf, g.pdpPerRow, g.xff, len(g.rows))
+			continue
+		}
+		for k, row := range e.rows {
+			for j, v := range row {
+				if !sameFloat(g.rows[k][j], v) {
+					t.Errorf("%s: RRA %d row %d DS %d: expected %v, got %v", what, i, k, j, v, g.rows[k][j])
+				}
+			}
+		}
+	}
+}
+
+func Test_readXML(t *testing.T) {
+	f, err := readRRDFile("testdata/example.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.step != 5*time.Minute || f.lastUpdate.Unix() != 1500000100 {
+		t.Errorf("expected step 5m lastUpdate 1500000100, got %v %v", f.step, f.lastUpdate.Unix())
+	}
+	if len(f.dss) != 2 || f.dss[0].name != "in" || f.dss[0].dsType != "COUNTER" || f.dss[1].max != 100 || !math.IsNaN(f.dss[1].min) {
+		t.Errorf("unexpected DSs: %+v", f.dss)
+	}
+	if len(f.rras) != 2 || f.rras[1].cf != "MAX" || f.rras[1].pdpPerRow != 3 || len(f.rras[1].rows) != 4 {
+		t.Fatalf("unexpected RRAs: %+v", f.rras)
+	}
+	if last := f.lastRow(&f.rras[1]); last.Unix() != 1499999400 {
+		t.Errorf("lastRow: expected 1499999400, got %v", last.Unix())
+	}
+	if v := f.rras[0].rows[5]; v[0] != 5.5 || !math.IsNaN(v[1]) {
+		t.Errorf("expected the latest AVERAGE row to be [5.5 NaN], got %v", v)
+	}
+
+	for _, bad := range []string{
+		`<rrd><step>x</step></rrd>`,
+		`<rrd><step>300</step><lastupdate>0</lastupdate><rra><pdp_per_row>0</pdp_per_row></rra></rrd>`,
+		`<rrd><step>300</step><lastupdate>0</lastupdate><ds><minimal_heartbeat>600</minimal_heartbeat><min>0</min><max>1</max></ds>` +
+			`<rra><cf>MAX</cf><pdp_per_row>1</pdp_per_row><database><row><v>1</v><v>2</v></row></database></rra></rrd>`,
+	} {
+		if _, err := readXML(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error for %s", bad)
+		}
+	}
+}
+
+func Test_readBinary(t *testing.T) {
+	expect, err := readRRDFile("testdata/example.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, _ := filepath.Glob("testdata/*.rrd")
+	if len(paths) == 0 {
+		t.Fatal("no .rrd files in testdata")
+	}
+	for _, path := range paths {
+		got, err := readRRDFile(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		compareRRDFiles(t, path, expect, got)
+	}
+}
+
+func Test_readBinary_errors(t *testing.T) {
+	head := func(version string, cookieOff int) []byte {
+		b := make([]byte, 512)
+		copy(b, "RRD\x00"+version)
+		binary.LittleEndian.PutUint64(b[cookieOff:], math.Float64bits(rrdFloatCookie))
+		return b
+	}
+	for _, c := range []struct {
+		what string
+		b    []byte
+		err  string
+	}{
+		{"not rrd", []byte(strings.Repeat("x", 200)), "not an RRD file"},
+		{"version", head("0005", 16), "unsupported RRD version"},
+		{"32-bit", head("0003", 12), "unsupported RRD file layout"}, // i386 aligns doubles to 4
+	} {
+		if _, err := readBinary(bytes.NewReader(c.b)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected %q, got %v", c.what, c.err, err)
+		}
+	}
+
+	// truncated
+	b, err := ioutil.ReadFile("testdata/example-x86_64.rrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readBinary(bytes.NewReader(b[:len(b)-8])); err == nil || !strings.Contains(err.Error(), "unexpected EOF") {
+		t.Errorf("truncated: expected unexpected EOF, got %v", err)
+	}
+}
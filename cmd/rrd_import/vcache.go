@@ -0,0 +1,191 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/serde"
+)
+
+// This is the vertical cache of whisper_import, except that slots
+// (and therefore versions) are computed by rrd.Slots so that
+// calendar RRAs work too.
+
+type crossRRAPoints map[int64]float64
+
+type verticalCacheSegment struct {
+	rows map[int64]crossRRAPoints
+	// The latest timestamp for RRAs, keyed by RRA idx.
+	latests map[int64]interface{} // rra.latest
+	slots   map[int64]rrd.Slots
+}
+
+type verticalCache struct {
+	ts  int // just some number for identification
+	dps map[bundleKey]*verticalCacheSegment
+	dss map[int64]map[int64]interface{}
+}
+
+type bundleKey struct {
+	bundleId, seg int64
+}
+
+func newVerticalCache(ts int) *verticalCache {
+	return &verticalCache{
+		ts:  ts,
+		dps: make(map[bundleKey]*verticalCacheSegment),
+		dss: make(map[int64]map[int64]interface{}),
+	}
+}
+
+func (vc *verticalCache) updateDps(rra serde.DbRoundRobinArchiver, origLatest time.Time) {
+
+	seg, idx := rra.Seg(), rra.Idx()
+	key := bundleKey{rra.BundleId(), seg}
+
+	segment := vc.dps[key]
+	if segment == nil {
+		segment = &verticalCacheSegment{
+			rows:    make(map[int64]crossRRAPoints),
+			latests: make(map[int64]interface{}),
+			slots:   make(map[int64]rrd.Slots),
+		}
+		vc.dps[key] = segment
+	}
+
+	latest, slots := rra.Latest(), rra.Slots()
+	segment.slots[idx] = slots
+
+	for i, v := range rra.DPs() {
+		// It is possible for the actual (i.e. what was in the
+		// database) latest to be ahead of us. If that is the case, we
+		// need to make sure not to update "future" slots by accident.
+		if !origLatest.IsZero() && slots.Time(i, origLatest).After(latest) {
+			continue
+		}
+		if segment.rows[i] == nil {
+			segment.rows[i] = make(crossRRAPoints)
+		}
+		segment.rows[i][idx] = v
+	}
+
+	// Only update latests if our latest is later than actual latest
+	if latest.After(origLatest) {
+		segment.latests[idx] = latest
+	} else {
+		segment.latests[idx] = origLatest
+	}
+}
+
+// Update DS state data
+func (vc *verticalCache) updateDss(ds serde.DbDataSourcer, lastUpdate time.Time) {
+
+	seg, idx := ds.Seg(), ds.Idx()
+
+	segment := vc.dss[seg]
+	if segment == nil {
+		segment = make(map[int64]interface{})
+		vc.dss[seg] = segment
+	}
+
+	segment[idx] = lastUpdate
+}
+
+func (vc *verticalCache) flush(db serde.Flusher) {
+	var sqlOps, points int
+
+	for k, segment := range vc.dps {
+		// Build a map of latest i and version according to latests
+		ivers := latestIVers(segment.latests, segment.slots)
+
+		for i, row := range segment.rows {
+			idps, vers := dataPointsWithVersions(row, i, ivers)
+			so, err := db.FlushDataPoints(k.bundleId, k.seg, i, idps, vers, nil)
+			if err != nil {
+				fmt.Printf("[db] [%v] Error flushing DP segment %v:%v: %v\n", vc.ts, k.bundleId, k.seg, err)
+				break
+			}
+			sqlOps += so
+			points += len(row)
+		}
+
+		so, err := db.FlushRRAStates(k.bundleId, k.seg, segment.latests, nil, nil, nil, nil, nil)
+		if err != nil {
+			fmt.Printf("[db] [%v] Error flushing RRA segment %v:%v: %v\n", vc.ts, k.bundleId, k.seg, err)
+		}
+		sqlOps += so
+	}
+
+	for k, lu := range vc.dss {
+		so, err := db.FlushDSStates(k, lu, nil, nil, nil, nil)
+		if err != nil {
+			fmt.Printf("[db] [%v] Error flushing DS state: %v\n", vc.ts, err)
+		}
+		sqlOps += so
+	}
+
+	fmt.Printf("[db] [%v] Vcache flush complete, %d points in %d SQL ops.\n", vc.ts, points, sqlOps)
+	stats.Lock()
+	stats.totalPoints += points
+	stats.totalSqlOps += sqlOps
+	stats.Unlock()
+}
+
+func vcacheFlusher(ch chan *verticalCache, db serde.Flusher, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for vcache := range ch {
+		vcache.flush(db)
+	}
+}
+
+type iVer struct {
+	i   int64
+	ver int
+}
+
+func (iv *iVer) version(i int64) int {
+	version := iv.ver
+	if i > iv.i {
+		version--
+		if version < 0 {
+			version = 32767
+		}
+	}
+	return version
+}
+
+func latestIVers(latests map[int64]interface{}, slots map[int64]rrd.Slots) map[int64]*iVer {
+	result := make(map[int64]*iVer, len(latests))
+	for idx, ilatest := range latests {
+		latest := ilatest.(time.Time)
+		result[idx] = &iVer{i: slots[idx].Index(latest), ver: slots[idx].Version(latest)}
+	}
+	return result
+}
+
+func dataPointsWithVersions(in crossRRAPoints, i int64, ivs map[int64]*iVer) (dps, vers map[int64]interface{}) {
+	dps = make(map[int64]interface{}, len(in))
+	vers = make(map[int64]interface{}, len(in))
+	for idx, dp := range in {
+		dps[idx] = dp
+		vers[idx] = ivs[idx].version(i)
+	}
+	return dps, vers
+}
@@ -0,0 +1,197 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The XML format of "rrdtool dump", used both to import and export
+// (which "rrdtool restore" can read). Numbers are kept as strings
+// because rrdtool pads them with spaces.
+
+type xmlRRD struct {
+	XMLName    xml.Name `xml:"rrd"`
+	Version    string   `xml:"version"`
+	Step       string   `xml:"step"`
+	LastUpdate string   `xml:"lastupdate"`
+	DSs        []xmlDS  `xml:"ds"`
+	RRAs       []xmlRRA `xml:"rra"`
+}
+
+type xmlDS struct {
+	Name       string `xml:"name"`
+	Type       string `xml:"type"`
+	Heartbeat  string `xml:"minimal_heartbeat"`
+	Min        string `xml:"min"`
+	Max        string `xml:"max"`
+	LastDS     string `xml:"last_ds"`
+	Value      string `xml:"value"`
+	UnknownSec string `xml:"unknown_sec"`
+}
+
+type xmlRRA struct {
+	CF        string       `xml:"cf"`
+	PdpPerRow string       `xml:"pdp_per_row"`
+	Xff       string       `xml:"params>xff"`
+	CDPPrep   []xmlCDPPrep `xml:"cdp_prep>ds"`
+	Rows      []xmlRow     `xml:"database>row"`
+}
+
+type xmlCDPPrep struct {
+	Value             string `xml:"value"`
+	UnknownDatapoints string `xml:"unknown_datapoints"`
+}
+
+type xmlRow struct {
+	V []string `xml:"v"`
+}
+
+func readXML(in io.Reader) (*rrdFile, error) {
+	var (
+		x   xmlRRD
+		err error
+	)
+	if err = xml.NewDecoder(in).Decode(&x); err != nil {
+		return nil, err
+	}
+
+	f := &rrdFile{}
+	var n int64
+	if n, err = xmlInt(x.Step); err != nil {
+		return nil, fmt.Errorf("invalid step: %v", err)
+	}
+	f.step = time.Duration(n) * time.Second
+	if n, err = xmlInt(x.LastUpdate); err != nil {
+		return nil, fmt.Errorf("invalid lastupdate: %v", err)
+	}
+	f.lastUpdate = time.Unix(n, 0)
+
+	for _, xds := range x.DSs {
+		ds := rrdDS{name: strings.TrimSpace(xds.Name), dsType: strings.TrimSpace(xds.Type)}
+		if n, err = xmlInt(xds.Heartbeat); err != nil {
+			return nil, fmt.Errorf("DS %q: invalid minimal_heartbeat: %v", ds.name, err)
+		}
+		ds.heartbeat = time.Duration(n) * time.Second
+		if ds.min, err = xmlFloat(xds.Min); err != nil {
+			return nil, fmt.Errorf("DS %q: invalid min: %v", ds.name, err)
+		}
+		if ds.max, err = xmlFloat(xds.Max); err != nil {
+			return nil, fmt.Errorf("DS %q: invalid max: %v", ds.name, err)
+		}
+		f.dss = append(f.dss, ds)
+	}
+
+	for i, xrra := range x.RRAs {
+		rra := rrdRRA{cf: strings.TrimSpace(xrra.CF)}
+		if rra.pdpPerRow, err = xmlInt(xrra.PdpPerRow); err != nil || rra.pdpPerRow < 1 {
+			return nil, fmt.Errorf("RRA %d: invalid pdp_per_row: %q", i, xrra.PdpPerRow)
+		}
+		if rra.xff, err = xmlFloat(xrra.Xff); err != nil {
+			rra.xff = 0.5 // Holt-Winters RRAs have no xff
+		}
+		for _, xrow := range xrra.Rows {
+			if len(xrow.V) != len(f.dss) {
+				return nil, fmt.Errorf("RRA %d: expected %d values per row, got %d", i, len(f.dss), len(xrow.V))
+			}
+			row := make([]float64, len(xrow.V))
+			for j, v := range xrow.V {
+				if row[j], err = xmlFloat(v); err != nil {
+					return nil, fmt.Errorf("RRA %d: invalid value: %v", i, err)
+				}
+			}
+			rra.rows = append(rra.rows, row)
+		}
+		f.rras = append(f.rras, rra)
+	}
+	return f, nil
+}
+
+// writeXML writes f in the "rrdtool dump" format. The PDP and CDP
+// preparation areas are written empty, i.e. the current (incomplete)
+// step of every DS and RRA starts out unknown.
+func writeXML(out io.Writer, f *rrdFile) error {
+	lu := f.lastUpdate.Unix()
+	step := int64(f.step / time.Second)
+	x := xmlRRD{
+		Version:    "0003",
+		Step:       strconv.FormatInt(step, 10),
+		LastUpdate: strconv.FormatInt(lu, 10),
+	}
+	for _, ds := range f.dss {
+		x.DSs = append(x.DSs, xmlDS{
+			Name:       ds.name,
+			Type:       ds.dsType,
+			Heartbeat:  strconv.FormatInt(int64(ds.heartbeat/time.Second), 10),
+			Min:        fmtXMLFloat(ds.min),
+			Max:        fmtXMLFloat(ds.max),
+			LastDS:     "U",
+			Value:      fmtXMLFloat(0),
+			UnknownSec: strconv.FormatInt(lu%step, 10),
+		})
+	}
+	for _, rra := range f.rras {
+		xrra := xmlRRA{
+			CF:        rra.cf,
+			PdpPerRow: strconv.FormatInt(rra.pdpPerRow, 10),
+			Xff:       fmtXMLFloat(rra.xff),
+			CDPPrep:   make([]xmlCDPPrep, len(f.dss)),
+			Rows:      make([]xmlRow, len(rra.rows)),
+		}
+		for i := range xrra.CDPPrep {
+			xrra.CDPPrep[i] = xmlCDPPrep{Value: fmtXMLFloat(math.NaN()), UnknownDatapoints: "0"}
+		}
+		for i, row := range rra.rows {
+			xrra.Rows[i].V = make([]string, len(row))
+			for j, v := range row {
+				xrra.Rows[i].V[j] = fmtXMLFloat(v)
+			}
+		}
+		x.RRAs = append(x.RRAs, xrra)
+	}
+
+	if _, err := io.WriteString(out, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(out)
+	enc.Indent("", "\t")
+	if err := enc.Encode(&x); err != nil {
+		return err
+	}
+	_, err := io.WriteString(out, "\n")
+	return err
+}
+
+func xmlInt(s string) (int64, error) {
+	return strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+}
+
+func xmlFloat(s string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSpace(s), 64)
+}
+
+func fmtXMLFloat(f float64) string {
+	if math.IsNaN(f) {
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'e', 10, 64)
+}
@@ -125,7 +125,7 @@ func (vc verticalCache) flush(db serde.Flusher) error {
 
 	fmt.Printf("[db] [%v] Flushing %d DS states ...\n", vc.ts, len(vc.dss))
 	for k, lu := range vc.dss {
-		ops, err := db.FlushDSStates(k, lu, nil, nil)
+		ops, err := db.FlushDSStates(k, lu, nil, nil, nil, nil)
 		if err != nil {
 			fmt.Printf("[db] [%v] EROR flushing DS state: %v\n", vc.ts, err)
 		}
@@ -159,7 +159,7 @@ func flushSegment(db serde.Flusher, wg *sync.WaitGroup, st *vstats, k bundleKey,
 
 	for i, row := range segment.rows {
 		idps, vers := dataPointsWithVersions(row, i, ivers)
-		so, err := db.FlushDataPoints(k.bundleId, k.seg, i, idps, vers)
+		so, err := db.FlushDataPoints(k.bundleId, k.seg, i, idps, vers, nil)
 		if err != nil {
 			fmt.Printf("[db] [%v] Error flushing DP segment %v:%v: %v\n", ts, k.bundleId, k.seg, err)
 			return
@@ -181,7 +181,7 @@ func flushSegment(db serde.Flusher, wg *sync.WaitGroup, st *vstats, k bundleKey,
 
 	if len(segment.latests) > 0 {
 		fmt.Printf("[db] [%v] flushing RRA state for segment %v:%v...\n", ts, k.bundleId, k.seg)
-		so, err := db.FlushRRAStates(k.bundleId, k.seg, segment.latests, nil, nil)
+		so, err := db.FlushRRAStates(k.bundleId, k.seg, segment.latests, nil, nil, nil, nil, nil)
 		if err != nil {
 			fmt.Printf("[db] [%v] Error flushing RRA segment %v:%v: %v\n", ts, k.bundleId, k.seg, err)
 			return
@@ -19,14 +19,15 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/jdcio/tgres/dsl"
 	"github.com/jdcio/tgres/misc"
 	"github.com/jdcio/tgres/rrd"
 	"github.com/jdcio/tgres/serde"
@@ -48,7 +49,13 @@ type Config struct { // Needs to be exported for TOML to work
 	StatsdUdpListenSpec      string   `toml:"statsd-udp-listen-spec"`
 	HttpListenSpec           string   `toml:"http-listen-spec"`
 	HttpAllowOrigin          string   `toml:"http-allow-origin"`
+	HttpStreamMaxClients     int      `toml:"http-stream-max-clients"`
+	HttpStreamMaxSeries      int      `toml:"http-stream-max-series"`
 	QueryCacheSize           int      `toml:"query-cache-size"`
+	QueryTimeout             duration `toml:"query-timeout"`
+	QueryMaxSeries           int      `toml:"query-max-series"`
+	QueryMaxPoints           int      `toml:"query-max-points"`
+	Macros                   []string `toml:"macros"`
 	Workers                  int
 	DSs                      []ConfigDSSpec `toml:"ds"`
 	StatFlush                duration       `toml:"stat-flush-interval"`
@@ -69,11 +76,30 @@ func (d *duration) UnmarshalText(text []byte) (err error) {
 	return err
 }
 
+type dsType struct{ rrd.DSType }
+
+func (t *dsType) UnmarshalText(text []byte) (err error) {
+	t.DSType, err = rrd.ParseDSType(string(text))
+	return err
+}
+
+type fillPolicy struct{ rrd.FillPolicy }
+
+func (f *fillPolicy) UnmarshalText(text []byte) (err error) {
+	f.FillPolicy, err = rrd.ParseFillPolicy(string(text))
+	return err
+}
+
 // Needs to be exported for TOML
 type ConfigDSSpec struct {
 	Regexp    regex
 	Step      duration
 	Heartbeat duration
+	Type      dsType
+	Fill      fillPolicy
+	Min       *float64
+	Max       *float64
+	Fields    []string
 	RRAs      []ConfigRRASpec
 }
 type ConfigRRASpec struct {
@@ -81,54 +107,32 @@ type ConfigRRASpec struct {
 	Step     time.Duration
 	Span     time.Duration
 	Xff      float64
+	Season   time.Duration // Holt-Winters CFs only
+	Calendar misc.CalendarInterval
+	Location *time.Location
 }
 
 func (r *ConfigRRASpec) UnmarshalText(text []byte) error {
-	r.Xff = 0.5
-	parts := strings.SplitN(string(text), ":", 4)
-	if len(parts) < 2 || len(parts) > 4 {
-		return fmt.Errorf("Invalid RRA specification (not enough or too many elements): %q", string(text))
-	}
-
-	// If first character of first part is a digit, assume we're
-	// skipping CF and default to WMEAN.
-	if len(parts[0]) > 0 && strings.Contains("0123456789", string(parts[0][0])) {
-		parts = append([]string{"WMEAN"}, parts...)
-	}
-
-	switch strings.ToUpper(parts[0]) {
-	case "WMEAN":
-		r.Function = rrd.WMEAN
-	case "MIN":
-		r.Function = rrd.MIN
-	case "MAX":
-		r.Function = rrd.MAX
-	case "LAST":
-		r.Function = rrd.LAST
-	default:
-		return fmt.Errorf("Invalid consolidation: %q (valid funcs: wmean, min, max, last)", parts[0])
-	}
-
-	var err error
-	if r.Step, err = misc.BetterParseDuration(parts[1]); err != nil {
-		return fmt.Errorf("Invalid Step: %q (%v)", parts[1], err)
-	}
-	if r.Span, err = misc.BetterParseDuration(parts[2]); err != nil {
-		return fmt.Errorf("Invalid Size: %q (%v)", parts[2], err)
-	}
-	if (r.Span.Nanoseconds() % r.Step.Nanoseconds()) != 0 {
-		newSpan := time.Duration(r.Span.Nanoseconds()/r.Step.Nanoseconds()*r.Step.Nanoseconds()) * time.Nanosecond
-		log.Printf("Span (%q) is not a multiple of step (%q), auto adjusting span to %v.", parts[2], parts[1], newSpan)
-		r.Span = newSpan
+	spec, err := rrd.ParseRRASpec(string(text))
+	if err != nil {
+		return err
+	}
+	if (spec.Span.Nanoseconds() % spec.Step.Nanoseconds()) != 0 {
+		newSpan := time.Duration(spec.Span.Nanoseconds()/spec.Step.Nanoseconds()*spec.Step.Nanoseconds()) * time.Nanosecond
+		log.Printf("Span (%v) is not a multiple of step (%v), auto adjusting span to %v.", spec.Span, spec.Step, newSpan)
+		spec.Span = newSpan
 		if newSpan.Nanoseconds() == 0 {
 			return fmt.Errorf("invalid Size (%v)", newSpan)
 		}
 	}
-	if len(parts) == 4 {
-		var err error
-		if r.Xff, err = strconv.ParseFloat(parts[3], 64); err != nil {
-			return fmt.Errorf("Invalid XFF: %q (%v)", parts[3], err)
-		}
+	*r = ConfigRRASpec{
+		Function: spec.Function,
+		Step:     spec.Step,
+		Span:     spec.Span,
+		Xff:      float64(spec.Xff),
+		Season:   spec.Season,
+		Calendar: spec.Calendar,
+		Location: spec.Location,
 	}
 	return nil
 }
@@ -266,6 +270,56 @@ func (c *Config) processStatsNamePrefix() error {
 	return nil
 }
 
+func (c *Config) processQueryLimits() error {
+	if c.QueryTimeout.Duration <= 0 {
+		log.Printf("Query time is unlimited (query-timeout).")
+	} else {
+		log.Printf("Query time is limited to %v (query-timeout).", c.QueryTimeout.Duration)
+	}
+	if c.QueryMaxSeries <= 0 {
+		log.Printf("Number of series per query target is unlimited (query-max-series).")
+	} else {
+		log.Printf("Number of series per query target is limited to %d (query-max-series).", c.QueryMaxSeries)
+	}
+	if c.QueryMaxPoints <= 0 {
+		log.Printf("Number of points per query is unlimited (query-max-points).")
+	} else {
+		log.Printf("Number of points per query is limited to %d (query-max-points).", c.QueryMaxPoints)
+	}
+	return nil
+}
+
+func (c *Config) processMacros() error {
+	for _, def := range c.Macros {
+		m, err := dsl.DefineMacro(def)
+		if err != nil {
+			return fmt.Errorf("Invalid macro: %v", err)
+		}
+		log.Printf("Macro defined: %v", m)
+	}
+	return nil
+}
+
+func (c *Config) processHttpStream() error {
+	if c.HttpStreamMaxClients == 0 {
+		c.HttpStreamMaxClients = 64
+	}
+	if c.HttpStreamMaxSeries == 0 {
+		c.HttpStreamMaxSeries = 256
+	}
+	if c.HttpStreamMaxClients < 0 {
+		log.Printf("Number of streaming HTTP clients is unlimited (http-stream-max-clients).")
+	} else {
+		log.Printf("Number of streaming HTTP clients is limited to %d (http-stream-max-clients).", c.HttpStreamMaxClients)
+	}
+	if c.HttpStreamMaxSeries < 0 {
+		log.Printf("Number of series per HTTP stream is unlimited (http-stream-max-series).")
+	} else {
+		log.Printf("Number of series per HTTP stream is limited to %d (http-stream-max-series).", c.HttpStreamMaxSeries)
+	}
+	return nil
+}
+
 func (c *Config) processWorkers() error {
 	if c.Workers == 0 {
 		return fmt.Errorf("workers missing, must be an integer")
@@ -277,6 +331,14 @@ func (c *Config) processWorkers() error {
 func (c *Config) processDSSpec() error {
 	// TODO validate function, regular expression, all that
 	for _, ds := range c.DSs {
+		if ds.Min != nil && ds.Max != nil && *ds.Min >= *ds.Max {
+			return fmt.Errorf("DS %q: min (%v) must be less than max (%v).", ds.Regexp.String(), *ds.Min, *ds.Max)
+		}
+		for i, f := range ds.Fields {
+			if f == "" || strings.Contains(f, ":") || rrd.FieldIndex(ds.Fields[:i], f) >= 0 {
+				return fmt.Errorf("DS %q: invalid field %q, fields must be unique, non-empty and cannot contain ':'.", ds.Regexp.String(), f)
+			}
+		}
 		for _, rra := range ds.RRAs {
 			if (rra.Step.Nanoseconds() % c.MinStep.Nanoseconds()) != 0 {
 				return fmt.Errorf("DS %q: invalid Step (%v), must be one or multiple min-step (%v).", ds.Regexp.String(), rra.Step, c.MinStep)
@@ -309,14 +371,29 @@ func convertDSSpec(dsSpec *ConfigDSSpec) *rrd.DSSpec {
 	serdeDSSpec := &rrd.DSSpec{
 		Step:      dsSpec.Step.Duration,
 		Heartbeat: dsSpec.Heartbeat.Duration,
+		Type:      dsSpec.Type.DSType,
+		Fill:      dsSpec.Fill.FillPolicy,
+		Fields:    dsSpec.Fields,
 		RRAs:      make([]rrd.RRASpec, len(dsSpec.RRAs)),
 	}
+	if dsSpec.Min != nil || dsSpec.Max != nil {
+		serdeDSSpec.Min, serdeDSSpec.Max = math.Inf(-1), math.Inf(1)
+		if dsSpec.Min != nil {
+			serdeDSSpec.Min = *dsSpec.Min
+		}
+		if dsSpec.Max != nil {
+			serdeDSSpec.Max = *dsSpec.Max
+		}
+	}
 	for i, r := range dsSpec.RRAs {
 		serdeDSSpec.RRAs[i] = rrd.RRASpec{
 			Function: r.Function,
 			Step:     r.Step,
 			Span:     r.Span,
 			Xff:      float32(r.Xff),
+			Season:   r.Season,
+			Calendar: r.Calendar,
+			Location: r.Location,
 		}
 	}
 	return serdeDSSpec
@@ -333,6 +410,9 @@ type configer interface {
 	processPgSegmentWidth() error
 	processStatFlushInterval() error
 	processStatsNamePrefix() error
+	processQueryLimits() error
+	processMacros() error
+	processHttpStream() error
 	processWorkers() error
 	processDSSpec() error
 }
@@ -369,6 +449,15 @@ var processConfig = func(c configer, wd string) error {
 	if err := c.processStatsNamePrefix(); err != nil {
 		return err
 	}
+	if err := c.processQueryLimits(); err != nil {
+		return err
+	}
+	if err := c.processMacros(); err != nil {
+		return err
+	}
+	if err := c.processHttpStream(); err != nil {
+		return err
+	}
 	if err := c.processWorkers(); err != nil {
 		return err
 	}
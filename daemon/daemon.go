@@ -206,7 +206,11 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 
 	// Create and run the Service Manager
 	rcache := dsl.NewNamedDSFetcher(db.Fetcher(), rcvr.DsCache(), cfg.QueryCacheSize)
-	serviceMgr := newServiceManager(rcvr, rcache, cfg)
+	if el := db.EventListener(); el != nil {
+		// The receiver registers its own listener, this one must come after it
+		el.RegisterDeleteListener(rcache.Forget)
+	}
+	serviceMgr := newServiceManager(rcvr, rcache, db.Fetcher(), cfg)
 	if err := serviceMgr.run(gracefulProtos); err != nil {
 		log.Printf("Could not run the service manager: %v", err)
 		return
@@ -16,6 +16,7 @@
 package daemon
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -113,7 +114,7 @@ func (m *fakeSerde) EventListener() serde.EventListener
 func (m *fakeSerde) DbAddresser() serde.DbAddresser                             { return m }
 func (f *fakeSerde) FetchDataSourceById(id int64) (rrd.DataSourcer, error)      { return nil, nil }
 func (m *fakeSerde) Search(query serde.SearchQuery) (serde.SearchResult, error) { return nil, nil }
-func (f *fakeSerde) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+func (f *fakeSerde) FetchSeries(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
 	return nil, nil
 }
 func (*fakeSerde) ListDbClientIps() ([]string, error) { return nil, nil }
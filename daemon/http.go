@@ -29,19 +29,47 @@ import (
 	"github.com/jdcio/tgres/graceful"
 	h "github.com/jdcio/tgres/http"
 	"github.com/jdcio/tgres/receiver"
+	"github.com/jdcio/tgres/serde"
 )
 
-func httpServer(addr string, l net.Listener, rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, origHdr string) {
+func httpServer(addr string, l net.Listener, rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, db serde.Fetcher, origHdr string, limits *h.QueryLimits, streamMaxClients, streamMaxSeries int) {
 
 	// Not sure why, but we need both trailing slash and not versions. It has
 	// something to do with whether you use Grafana direct or proxy modes.
 	http.HandleFunc("/metrics/find", setOriginHdr(h.GraphiteMetricsFindHandler(rcache), origHdr))
 	http.HandleFunc("/metrics/find/", setOriginHdr(h.GraphiteMetricsFindHandler(rcache), origHdr))
-	http.HandleFunc("/render", setOriginHdr(h.GraphiteRenderHandler(rcache), origHdr))
-	http.HandleFunc("/render/", setOriginHdr(h.GraphiteRenderHandler(rcache), origHdr))
+	http.HandleFunc("/render", setOriginHdr(h.GraphiteRenderHandler(rcache, limits), origHdr))
+	http.HandleFunc("/render/", setOriginHdr(h.GraphiteRenderHandler(rcache, limits), origHdr))
 	http.HandleFunc("/events/get_data", setOriginHdr(h.GraphiteAnnotationsHandler(rcache), origHdr))
 	http.HandleFunc("/events/get_data/", setOriginHdr(h.GraphiteAnnotationsHandler(rcache), origHdr))
 
+	// Grafana JSON datasource, the URL for it in Grafana is http://host:port/grafana
+	http.HandleFunc("/grafana/", setOriginHdr(h.GrafanaTestHandler("/grafana/"), origHdr))
+	http.HandleFunc("/grafana/search", setOriginHdr(h.GrafanaSearchHandler(rcache), origHdr))
+	http.HandleFunc("/grafana/query", setOriginHdr(h.GrafanaQueryHandler(rcache, limits), origHdr))
+	http.HandleFunc("/grafana/annotations", setOriginHdr(h.GrafanaAnnotationsHandler(rcache, limits), origHdr))
+	http.HandleFunc("/grafana/tag-keys", setOriginHdr(h.GrafanaTagKeysHandler(rcache), origHdr))
+	http.HandleFunc("/grafana/tag-values", setOriginHdr(h.GrafanaTagValuesHandler(rcache), origHdr))
+
+	// Live updates as Server-Sent Events
+	http.HandleFunc("/stream", setOriginHdr(h.StreamHandler(rcache, limits, streamMaxClients, streamMaxSeries), origHdr))
+
+	// Data source administration
+	http.HandleFunc("/admin/ds", h.AdminDSHandler(db))
+	http.HandleFunc("/admin/ds/delete", h.AdminDSDeleteHandler(db, rcache))
+	http.HandleFunc("/admin/ds/heartbeat", h.AdminDSHeartbeatHandler(db))
+	http.HandleFunc("/admin/ds/migrate", h.AdminDSMigrateHandler(db, rcvr))
+	http.HandleFunc("/admin/ds/rra/add", h.AdminRRAAddHandler(db))
+	http.HandleFunc("/admin/ds/rra/remove", h.AdminRRARemoveHandler(db))
+
+	// DSL macros
+	http.HandleFunc("/macros", h.MacrosHandler())
+	http.HandleFunc("/macros/define", h.MacroDefineHandler())
+	http.HandleFunc("/macros/delete", h.MacroDeleteHandler())
+
+	// DSL function signatures, for editors
+	http.HandleFunc("/functions", setOriginHdr(h.FunctionsHandler(), origHdr))
+
 	http.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintf(w, "OK\n") })
 
 	http.HandleFunc("/pixel", h.PixelHandler(rcvr))
@@ -65,11 +93,15 @@ func httpServer(addr string, l net.Listener, rcvr *receiver.Receiver, rcache dsl
 type wwwServer struct {
 	rcvr       *receiver.Receiver
 	rcache     dsl.NamedDSFetcher
+	db         serde.Fetcher
 	blstr      *blaster.Blaster
 	listener   *graceful.Listener
 	listenSpec string
 	originHdr  string
+	limits     *h.QueryLimits
 	stop       int32
+
+	streamMaxClients, streamMaxSeries int
 }
 
 func (g *wwwServer) File() *os.File {
@@ -120,11 +152,19 @@ func (g *wwwServer) Start(file *os.File) error {
 
 	log.Printf("HTTP protocol Listening on %s\n", processListenSpec(g.listenSpec))
 
-	go httpServer(g.listenSpec, g.listener, g.rcvr, g.rcache, g.originHdr)
+	go httpServer(g.listenSpec, g.listener, g.rcvr, g.rcache, g.db, g.originHdr, g.limits, g.streamMaxClients, g.streamMaxSeries)
 
 	return nil
 }
 
+func queryLimits(cfg *Config) *h.QueryLimits {
+	return &h.QueryLimits{
+		Timeout:   cfg.QueryTimeout.Duration,
+		MaxSeries: cfg.QueryMaxSeries,
+		MaxPoints: cfg.QueryMaxPoints,
+	}
+}
+
 func setOriginHdr(h http.HandlerFunc, hdr string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if hdr != "" {
@@ -0,0 +1,96 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/serde"
+)
+
+// Migrate applies the spec of the matching [[ds]] config section to
+// each of the existing data sources named in names (see
+// serde.DataSourceAdmin.MigrateDataSource). It is meant to be run
+// from the command line after the config has been changed, a running
+// Tgres is notified of the change and reloads the DS. Data which that
+// Tgres has not yet written to the database is not resampled, use
+// /admin/ds/migrate on it to migrate a DS which is being updated.
+func Migrate(cfgPath string, names []string) error {
+	cfg, err := readConfig(cfgPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read config %q: %v", cfgPath, err)
+	}
+	if err := cfg.processDbConnectString(); err != nil {
+		return err
+	}
+	if err := cfg.processMinStep(); err != nil {
+		return err
+	}
+	if err := cfg.processDSSpec(); err != nil {
+		return err
+	}
+
+	db, err := initDb(cfg.DbConnectString)
+	if err != nil {
+		return fmt.Errorf("Error connecting to the DB: %v", err)
+	}
+	return migrate(db.Fetcher(), cfg, names)
+}
+
+// migrate checks all of names before migrating any, so that a name
+// which does not exist, is not matched by the config or whose fields
+// differ does not leave the migration half done.
+func migrate(db serde.Fetcher, cfg *Config, names []string) error {
+	adm, ok := db.(serde.DataSourceAdmin)
+	if !ok {
+		return fmt.Errorf("DS migration is not supported by this serde")
+	}
+
+	specs := make([]*rrd.DSSpec, len(names))
+	for i, name := range names {
+		ident := serde.Ident{"name": name}
+		spec := cfg.FindMatchingDSSpec(ident)
+		if spec == nil {
+			return fmt.Errorf("No [[ds]] config section matches %q, nothing migrated", name)
+		}
+		ds, err := db.FetchOrCreateDataSource(ident, nil)
+		if err != nil {
+			return fmt.Errorf("Error fetching %q, nothing migrated: %v", name, err)
+		}
+		if ds == nil {
+			return fmt.Errorf("Data source %q not found, nothing migrated", name)
+		}
+		if strings.Join(ds.Fields(), ":") != strings.Join(spec.Fields, ":") {
+			return fmt.Errorf("Fields of %q cannot be changed from %v to %v, nothing migrated", name, ds.Fields(), spec.Fields)
+		}
+		specs[i] = spec
+	}
+
+	for i, name := range names {
+		ds, err := adm.MigrateDataSource(serde.Ident{"name": name}, specs[i])
+		if err == nil && ds == nil {
+			err = fmt.Errorf("not found (deleted?)")
+		}
+		if err != nil {
+			return fmt.Errorf("Error migrating %q (%d of %d migrated): %v", name, i, len(names), err)
+		}
+		log.Printf("Migrated %q: step %v, heartbeat %v, %d RRAs.", name, ds.Step(), ds.Heartbeat(), len(ds.RRAs()))
+	}
+	return nil
+}
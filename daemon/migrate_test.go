@@ -0,0 +1,86 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/serde"
+)
+
+func Test_migrate(t *testing.T) {
+	db := serde.NewMemSerDe()
+	spec := &rrd.DSSpec{Step: time.Minute, Heartbeat: 2 * time.Minute,
+		RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour}}}
+	for _, name := range []string{"mig.a", "mig.b", "other.c"} {
+		if _, err := db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fspec := *spec
+	fspec.Fields = []string{"x", "y"}
+	if _, err := db.FetchOrCreateDataSource(serde.Ident{"name": "mig.f"}, &fspec); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{DSs: []ConfigDSSpec{{
+		Regexp:    regex{regexp.MustCompile(`^mig\.`)},
+		Step:      duration{time.Minute},
+		Heartbeat: duration{10 * time.Minute},
+		RRAs:      []ConfigRRASpec{{Function: rrd.WMEAN, Step: 5 * time.Minute, Span: time.Hour}},
+	}}}
+	migrated := func(name string) bool {
+		ds, _ := db.FetchOrCreateDataSource(serde.Ident{"name": name}, nil)
+		return ds != nil && ds.Heartbeat() == 10*time.Minute && ds.RRAs()[0].Step() == 5*time.Minute
+	}
+
+	// a failing name anywhere in the list means none are migrated
+	for _, c := range []struct {
+		names []string
+		err   string
+	}{
+		{[]string{"mig.a", "mig.nosuch"}, `"mig.nosuch" not found`},
+		{[]string{"mig.a", "other.c"}, `No [[ds]] config section matches "other.c"`},
+		{[]string{"mig.a", "mig.f"}, `Fields of "mig.f" cannot be changed`},
+	} {
+		err := migrate(db.Fetcher(), cfg, c.names)
+		if err == nil || !strings.Contains(err.Error(), c.err) || !strings.Contains(err.Error(), "nothing migrated") {
+			t.Errorf("%v: expected an error containing %q, got %v", c.names, c.err, err)
+		}
+		if migrated("mig.a") {
+			t.Fatalf("%v: mig.a should not have been migrated", c.names)
+		}
+	}
+
+	if err := migrate(db.Fetcher(), cfg, []string{"mig.a", "mig.b"}); err != nil {
+		t.Fatal(err)
+	}
+	if !migrated("mig.a") || !migrated("mig.b") {
+		t.Errorf("expected mig.a and mig.b to be migrated")
+	}
+	if migrated("other.c") {
+		t.Errorf("other.c should not have been migrated")
+	}
+
+	// a serde without admin support
+	if err := migrate(struct{ serde.Fetcher }{db.Fetcher()}, cfg, []string{"mig.a"}); err == nil {
+		t.Errorf("expected an error for a serde without DataSourceAdmin")
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/jdcio/tgres/dsl"
 	"github.com/jdcio/tgres/graceful"
 	"github.com/jdcio/tgres/receiver"
+	"github.com/jdcio/tgres/serde"
 )
 
 type trService interface {
@@ -38,7 +39,7 @@ type serviceManager struct {
 	services serviceMap
 }
 
-func newServiceManager(rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, cfg *Config) *serviceManager {
+func newServiceManager(rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, db serde.Fetcher, cfg *Config) *serviceManager {
 	return &serviceManager{rcvr: rcvr,
 		services: serviceMap{
 			"gt":  &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteTextListenSpec, timeout: 30 * time.Second},
@@ -46,7 +47,7 @@ func newServiceManager(rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, cfg *
 			"gp":  &graphitePickleServiceManager{rcvr: rcvr, listenSpec: cfg.GraphitePickleListenSpec},
 			"st":  &statsdTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdTextListenSpec, timeout: 30 * time.Second},
 			"su":  &statsdTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdUdpListenSpec, udp: true},
-			"www": &wwwServer{rcvr: rcvr, rcache: rcache, listenSpec: cfg.HttpListenSpec, originHdr: cfg.HttpAllowOrigin},
+			"www": &wwwServer{rcvr: rcvr, rcache: rcache, db: db, listenSpec: cfg.HttpListenSpec, originHdr: cfg.HttpAllowOrigin, limits: queryLimits(cfg), streamMaxClients: cfg.HttpStreamMaxClients, streamMaxSeries: cfg.HttpStreamMaxSeries},
 		},
 	}
 }
@@ -15,7 +15,12 @@
 
 package dsl
 
-import "github.com/jdcio/tgres/series"
+import (
+	"time"
+
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/series"
+)
 
 // A Series which supports Alias()
 type AliasSeries interface {
@@ -27,6 +32,7 @@ type AliasSeries interface {
 type aliasSeries struct {
 	series.Series
 	alias string
+	cf    rrd.Consolidation // of the RRA the series is from
 }
 
 func (as *aliasSeries) Alias(s ...string) string {
@@ -63,3 +69,31 @@ func (as *aliasSummarySeries) Alias(s ...string) string {
 func newAliasSummarySeries(s AliasSeries) *aliasSummarySeries {
 	return &aliasSummarySeries{SummarySeries: &series.SummarySeries{s}, alias: s.Alias()}
 }
+
+// materialized is what (besides the values) it takes to make a
+// series.SliceSeries of a series read into memory.
+type materialized struct {
+	start time.Time
+	step  time.Duration
+	alias string
+}
+
+// materialize reads all of s into memory. The series can be iterated
+// over again afterwards.
+func materialize(s AliasSeries) ([]float64, materialized) {
+	var (
+		data []float64
+		m    = materialized{alias: s.Alias()}
+	)
+	for s.Next() {
+		if m.start.IsZero() {
+			m.start = s.CurrentTime()
+		}
+		data = append(data, s.CurrentValue())
+	}
+	s.Close()
+	if m.step = s.GroupBy(); m.step == 0 {
+		m.step = s.Step()
+	}
+	return data, m
+}
@@ -0,0 +1,121 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"go/ast"
+	"go/token"
+	"strings"
+	"time"
+
+	"github.com/jdcio/tgres/rrd"
+)
+
+// consolidateBy() determines which RRA its series are fetched from,
+// e.g. consolidateBy(foo.bar, 'max') prefers a MAX RRA of foo.bar if
+// there is one. Since the series are fetched before consolidateBy()
+// itself is called, the AST is examined beforehand, every call within
+// a consolidateBy() fetches using its CF (innermost one wins).
+
+// cfSpan is the source span of a consolidateBy() call.
+type cfSpan struct {
+	pos, end token.Pos
+	cf       rrd.Consolidation
+}
+
+// consolidationFuncs maps consolidateBy() function names to RRA CFs.
+var consolidationFuncs = map[string]rrd.Consolidation{
+	"average": rrd.WMEAN,
+	"avg":     rrd.WMEAN,
+	"sum":     rrd.SUM,
+	"min":     rrd.MIN,
+	"max":     rrd.MAX,
+	"first":   rrd.FIRST,
+	"last":    rrd.LAST,
+	"count":   rrd.COUNT,
+	"stddev":  rrd.STDDEV,
+	// Holt-Winters RRAs, not in Graphite
+	"hwpredict":   rrd.HWPREDICT,
+	"seasonal":    rrd.SEASONAL,
+	"devseasonal": rrd.DEVSEASONAL,
+	"failures":    rrd.FAILURES,
+}
+
+// consolidateBySpans finds all the consolidateBy() calls in tr.
+func consolidateBySpans(tr ast.Expr) []cfSpan {
+	var result []cfSpan
+	ast.Inspect(tr, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		var name string
+		switch fn := call.Fun.(type) {
+		case *ast.Ident:
+			name = fn.Name
+		case *ast.SelectorExpr: // chained
+			name = fn.Sel.Name
+		}
+		if name != "consolidateBy" {
+			return true
+		}
+		if len(call.Args) == 0 {
+			return true
+		}
+		// The function name is always the last argument
+		var fname string
+		switch arg := call.Args[len(call.Args)-1].(type) {
+		case *ast.BasicLit:
+			if arg.Kind == token.STRING {
+				fname = unEscapeBadChars(arg.Value[1 : len(arg.Value)-1])
+				fname = strings.TrimPrefix(fname, "consolidationFunc=")
+			}
+		case *ast.Ident:
+			fname = arg.Name
+		}
+		if cf, ok := consolidationFuncs[fname]; ok {
+			result = append(result, cfSpan{call.Pos(), call.End(), cf})
+		}
+		return true
+	})
+	return result
+}
+
+// cfAt returns the CF of the innermost consolidateBy() call which
+// includes pos, or the default CF of this context.
+func (dc *dslCtx) cfAt(pos token.Pos) rrd.Consolidation {
+	cf, width := dc.dftCF, token.Pos(-1)
+	for _, s := range dc.cfSpans {
+		if s.pos <= pos && pos < s.end && (width == -1 || s.end-s.pos < width) {
+			cf, width = s.cf, s.end-s.pos
+		}
+	}
+	return cf
+}
+
+// bestRRA returns the RRA of field (0 for a single value DS) that
+// FetchSeries() would most likely pick, and whether ds is cached.
+func bestRRA(ds rrd.DataSourcer, field int, from, to time.Time, maxPoints int64, cf rrd.Consolidation) (rrd.RoundRobinArchiver, bool) {
+	wds, cached := ds.(*watchedDs)
+	if cached {
+		wds.RLock()
+		defer wds.RUnlock()
+	}
+	if fds := ds.Field(field); fds != nil {
+		return fds.BestRRAByCF(from, to, maxPoints, cf), cached
+	}
+	return nil, cached
+}
@@ -16,6 +16,7 @@
 package dsl
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -33,6 +34,7 @@ type dsLRU struct {
 	dl        rraDataLoader
 	ch        chan DataPoint
 	dsc       watcher
+	subs      map[string]map[chan struct{}]bool // keyed by ident string
 	cap       int
 	evictions int
 	hits      int
@@ -41,8 +43,9 @@ type dsLRU struct {
 
 type DataPoint struct {
 	serde.Ident
-	T time.Time
-	V float64
+	Field int // multi-value DS only, see rrd.DataSource.Fields()
+	T     time.Time
+	V     float64
 }
 
 // Returns a new dsCache object.
@@ -54,6 +57,7 @@ func newDsLRU(db dsFetcher, dsc watcher, cap int) *dsLRU {
 		dl:    dl,
 		ch:    make(chan DataPoint, 256),
 		dsc:   dsc,
+		subs:  make(map[string]map[chan struct{}]bool),
 		Mutex: &sync.Mutex{},
 		cap:   cap,
 	}
@@ -90,18 +94,64 @@ func (d *dsLRU) worker() {
 				if len(wds.pending) > 0 {
 					// process pending first, if any
 					for _, dp := range wds.pending {
-						wds.ProcessDataPoint(dp.V, dp.T)
+						wds.processDataPoint(dp)
 					}
 					wds.pending = nil
 				}
 				// finally process the dp that just came in
-				wds.ProcessDataPoint(dp.V, dp.T)
+				wds.processDataPoint(dp)
 			}
 			wds.Unlock()
+			d.notify(dp.Ident)
 		}
 	}
 }
 
+// subscribe registers ch to be notified whenever a data point for
+// ident is processed by the LRU. Notifications are coalesced: if ch
+// is full, the notification is dropped, ch should therefore be
+// buffered.
+func (d *dsLRU) subscribe(ident serde.Ident, ch chan struct{}) {
+	d.Lock()
+	defer d.Unlock()
+	key := ident.String()
+	if d.subs[key] == nil {
+		d.subs[key] = make(map[chan struct{}]bool)
+	}
+	d.subs[key][ch] = true
+}
+
+func (d *dsLRU) unsubscribe(ident serde.Ident, ch chan struct{}) {
+	d.Lock()
+	defer d.Unlock()
+	key := ident.String()
+	if subs := d.subs[key]; subs != nil {
+		delete(subs, ch)
+		if len(subs) == 0 {
+			delete(d.subs, key)
+		}
+	}
+}
+
+func (d *dsLRU) notify(ident serde.Ident) {
+	d.Lock()
+	defer d.Unlock()
+	for ch, _ := range d.subs[ident.String()] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// forget removes the DS from the LRU (if it is there), it will be
+// loaded again next time it is requested.
+func (d *dsLRU) forget(ident serde.Ident) {
+	if d.Cache != nil {
+		d.Remove(ident.String())
+	}
+}
+
 type lruStateSaver interface {
 	SaveDSLCacheKeys(idents []serde.Ident) error
 	LoadDSLCacheKeys() ([]serde.Ident, error)
@@ -258,17 +308,21 @@ func (d *dsLRU) loadDs(wds *watchedDs, wg *sync.WaitGroup) {
 	wds.Unlock()
 }
 
-func (d *dsLRU) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+func (d *dsLRU) FetchSeries(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
 	var wds *watchedDs
 	if wds, _ = ds.(*watchedDs); wds == nil {
 		// Not a watchedDs, fallback to non-cache behavior
-		return d.db.FetchSeries(ds, from, to, maxPoints)
+		return d.db.FetchSeries(ctx, ds, from, to, maxPoints)
 	}
 
 	wds.RLock()
 	defer wds.RUnlock()
 
-	rra := wds.BestRRA(from, to, maxPoints)
+	fds := serde.FieldDataSource(ctx, wds)
+	if fds == nil {
+		return nil, fmt.Errorf("FetchSeries (ds_lru.go): DS has no field %q", serde.FieldFromContext(ctx))
+	}
+	rra := fds.BestRRAByCF(from, to, maxPoints, serde.ConsolidationFromContext(ctx))
 	if rra == nil {
 		return nil, fmt.Errorf("FetchSeries (ds_lru.go): No adequate RRA found for DS from: %v to: %v maxPoints: %v", from, to, maxPoints)
 	}
@@ -281,7 +335,32 @@ func (d *dsLRU) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints in
 	s.TimeRange(from, to)
 	s.MaxPoints(maxPoints)
 
-	return s, nil
+	return series.NewContextSeries(ctx, s), nil
+}
+
+// FetchSketches returns a copy of the SKETCH RRA of a cached DS, a DS
+// which is not cached is passed on to the database.
+func (d *dsLRU) FetchSketches(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (rrd.RoundRobinArchiver, error) {
+	var wds *watchedDs
+	if wds, _ = ds.(*watchedDs); wds == nil {
+		if sf, ok := d.db.(serde.SketchFetcher); ok {
+			return sf.FetchSketches(ctx, ds, from, to, maxPoints)
+		}
+		return nil, fmt.Errorf("FetchSketches (ds_lru.go): sketches are not supported")
+	}
+
+	wds.RLock()
+	defer wds.RUnlock()
+
+	fds := serde.FieldDataSource(ctx, wds)
+	if fds == nil {
+		return nil, fmt.Errorf("FetchSketches (ds_lru.go): DS has no field %q", serde.FieldFromContext(ctx))
+	}
+	rra := fds.BestRRAByCF(from, to, maxPoints, rrd.SKETCH)
+	if rra == nil || rra.Spec().Function != rrd.SKETCH {
+		return nil, fmt.Errorf("FetchSketches (ds_lru.go): DS has no SKETCH RRA")
+	}
+	return rra.Copy(), nil
 }
 
 type watchedDs struct {
@@ -292,6 +371,13 @@ type watchedDs struct {
 	pending []DataPoint
 }
 
+func (wds *watchedDs) processDataPoint(dp DataPoint) error {
+	if len(wds.Fields()) > 0 {
+		return wds.ProcessFieldDataPoint(dp.Field, dp.V, dp.T)
+	}
+	return wds.ProcessDataPoint(dp.V, dp.T)
+}
+
 type watchedRRA struct {
 	rrd.RoundRobinArchiver
 	*sync.RWMutex
@@ -21,40 +21,55 @@
 //
 // For example, consider
 //
-//   scale(foo.bar.baz, 2)
+//	scale(foo.bar.baz, 2)
 //
 // is a valid Go expression. foo.bar.baz is called a selector
 // expression. However,
 //
-//   scale(foo.1bar.baz, 2)
+//	scale(foo.1bar.baz, 2)
 //
 // is not valid because an identifier cannot begin with a digit. In
 // any case,
 //
-//   scale("foo.1bar.b*", 2)
+//	scale("foo.1bar.b*", 2)
 //
 // is always valid, and is the preferred method.
 //
 // Tgres DSL also supports function chaining, e.g.:
 //
-//   group("foo.*").scale(2)
+//	group("foo.*").scale(2)
 //
 // Internally this is done by taking the return value of the
 // preceeding function and inserting it as the first argument to the
 // current one, thus the above expression is equivalent to:
 //
-//   scale(group("foo.*", 2))
+//	scale(group("foo.*", 2))
 //
+// Series can also be combined with each other and with numbers using
+// the arithmetic operators + - * / and the comparison operators == !=
+// < <= > >=, e.g.:
+//
+//	sumSeries("a.*") / scale(b, 60)
+//
+// The * - == != <= and >= operators must be surrounded by spaces,
+// otherwise they are taken to be part of a series name. See infix.go
+// for how series are matched and aligned.
 package dsl
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/serde"
 )
 
 type dslCtx struct {
@@ -63,44 +78,131 @@ type dslCtx struct {
 	from, to  time.Time
 	maxPoints int64
 	ctxDSFetcher
+	ctx       context.Context
+	maxSeries int   // 0 means no limit
+	nSeries   int   // series fetched so far
+	limitErr  error // reported as is, without wrapping
+	explain   *Explain
+	fetched   []AliasSeries // closed if parse() fails
+
+	// RRA CF to fetch series with, see consolidateBy()
+	cf      rrd.Consolidation
+	dftCF   rrd.Consolidation
+	cfSpans []cfSpan
+}
+
+// A LimitError is returned when a query exceeds a resource limit.
+type LimitError struct {
+	What  string
+	Limit int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("query limit exceeded: more than %d %s", e.Limit, e.What)
 }
 
 // Parse a DSL expression given by src and other params.
 func ParseDsl(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64) (SeriesMap, error) {
-	return newDslCtx(db, src, from, to, maxPoints).parse()
+	return ParseDslContext(context.Background(), db, src, from, to, maxPoints, 0)
+}
+
+// ParseDslContext is same as ParseDsl, only ctx is passed on to the
+// fetcher and the resulting series, which stop iterating once ctx is
+// done, and the number of series fetched is limited to maxSeries (0
+// is no limit). If ctx is done while parsing, ctx.Err() is
+// returned, if maxSeries is exceeded, the error is a *LimitError.
+func ParseDslContext(ctx context.Context, db ctxDSFetcher, src string, from, to time.Time, maxPoints int64, maxSeries int) (SeriesMap, error) {
+	dc := newDslCtx(db, src, from, to, maxPoints)
+	dc.ctx, dc.maxSeries = ctx, maxSeries
+	return dc.parse()
 }
 
 func newDslCtx(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64) *dslCtx {
 	return &dslCtx{
 		src:          src,
-		escSrc:       fixBackSlashes(fixQuotes(escapeBadChars(src))),
+		escSrc:       escapeSrc(src),
 		from:         from,
 		to:           to,
 		maxPoints:    maxPoints,
-		ctxDSFetcher: db}
+		ctxDSFetcher: db,
+		ctx:          context.Background()}
+}
+
+// escapeSrc makes src parseable by parser.ParseExpr(), see
+// escapeBadChars() and below.
+func escapeSrc(src string) string {
+	return fixBackSlashes(fixKeywordStrings(fixQuotes(escapeBadChars(src))))
 }
 
 // Parse a DSL context. Returns a SeriesMap or error.
 func (dc *dslCtx) parse() (SeriesMap, error) {
 
+	// Errors found by validation refer to the source as given, so it
+	// happens before macro expansion and is reported as is.
+	mm := currentMacros()
+	if err := validate(dc.src, dc.escSrc, mm); err != nil {
+		return nil, err
+	}
+
+	// Macros are expanded in the source, the AST walk below relies on
+	// the positions in it.
+	escSrc, err := expandMacros(mm, dc.escSrc, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %q: %v", dc.src, err)
+	}
+	dc.escSrc = escSrc
+
 	// parser.ParseExpr produces an AST in accordance with Go syntax,
 	// which is just fine in our case.
 	tr, err := parser.ParseExpr(dc.escSrc)
 	if err != nil {
 		return nil, fmt.Errorf("Error parsing %q: %v", dc.src, err)
 	}
+	if tr, err = infixCalls(tr); err != nil {
+		return nil, fmt.Errorf("Error parsing %q: %v", dc.src, err)
+	}
+	dc.cf, dc.cfSpans = dc.dftCF, consolidateBySpans(tr)
 
 	fv := &funcVisitor{dc, &callStack{}, nil, 0, -1, nil}
 
 	ast.Walk(fv, tr)
 
-	if fv.err != nil {
-		return nil, fmt.Errorf("ParseDsl(): %v", fv.err)
+	// Whatever was fetched so far is not returned on error, and
+	// series of a DB have to be closed.
+	err = dc.limitErr
+	if err == nil {
+		err = dc.ctx.Err()
+	}
+	if err == nil && fv.err != nil {
+		err = fmt.Errorf("ParseDsl(): %v", fv.err)
+	}
+	if err != nil {
+		for _, s := range dc.fetched {
+			s.Close()
+		}
+		dc.fetched = nil
+		return nil, err
 	}
 
 	return fv.ret, nil
 }
 
+// evalSubExpr evaluates src (e.g. a template in applyByNode()) in a
+// new context with the same parameters as dc. The series fetched
+// count against the dc series limit.
+func (dc *dslCtx) evalSubExpr(src string) (SeriesMap, error) {
+	sub := newDslCtx(dc.ctxDSFetcher, src, dc.from, dc.to, dc.maxPoints)
+	sub.ctx, sub.maxSeries, sub.nSeries = dc.ctx, dc.maxSeries, dc.nSeries
+	sub.dftCF, sub.explain = dc.cf, dc.explain
+	result, err := sub.parse()
+	dc.nSeries = sub.nSeries
+	dc.fetched = append(dc.fetched, sub.fetched...)
+	if sub.limitErr != nil {
+		dc.limitErr = sub.limitErr
+	}
+	return result, err
+}
+
 func (dc *dslCtx) seriesFromSeriesOrIdent(what interface{}) (SeriesMap, error) {
 	switch obj := what.(type) {
 	case SeriesMap:
@@ -111,12 +213,28 @@ func (dc *dslCtx) seriesFromSeriesOrIdent(what interface{}) (SeriesMap, error) {
 	return nil, fmt.Errorf("seriesFromSeriesOrIdent(): unknown type: %T of %v", what, what)
 }
 
+// seriesFromPattern fetches the series of all the DSs matching
+// pattern. A field of multi-value DSs is "pattern:field", unless
+// pattern as is matches something.
 func (dc *dslCtx) seriesFromPattern(pattern string, from, to time.Time) (SeriesMap, error) {
+	var field string
 	idents := dc.identsFromPattern(pattern)
+	if i := strings.LastIndex(pattern, ":"); len(idents) == 0 && i > 0 {
+		field, idents = pattern[i+1:], dc.identsFromPattern(pattern[:i])
+	}
+	if err := dc.addSeries(len(idents)); err != nil {
+		return nil, err
+	}
 	result := make(SeriesMap)
 	for name, ident := range idents {
+		if err := dc.ctx.Err(); err != nil {
+			result.close()
+			return nil, err
+		}
+		start := time.Now()
 		ds, err := dc.FetchOrCreateDataSource(ident, nil)
 		if err != nil {
+			result.close()
 			return nil, fmt.Errorf("seriesFromPattern(): Error %v", err)
 		}
 		if ds == nil {
@@ -124,15 +242,53 @@ func (dc *dslCtx) seriesFromPattern(pattern string, from, to time.Time) (SeriesM
 			// TODO: The DSL should support warnings, this is a good case for it
 			continue
 		}
-		dps, err := dc.FetchSeries(ds, from, to, dc.maxPoints)
+		ctx, n := dc.fetchCtx(), 0
+		if field != "" {
+			if n = rrd.FieldIndex(ds.Fields(), field); n < 0 {
+				continue // no such field
+			}
+			ctx, name = serde.WithField(ctx, field), name+":"+field
+		}
+		dps, err := dc.FetchSeries(ctx, ds, from, to, dc.maxPoints)
 		if err != nil {
+			result.close()
 			return nil, fmt.Errorf("seriesFromPattern(): Error %v", err)
 		}
-		result[name] = &aliasSeries{Series: dps}
+		if dc.explain != nil {
+			dc.explain.fetch(pattern, name, ident, ds, n, dps, from, to, dc.maxPoints, dc.cf, time.Now().Sub(start))
+		}
+		as := &aliasSeries{Series: dps}
+		if rra, _ := bestRRA(ds, n, from, to, dc.maxPoints, dc.cf); rra != nil {
+			as.cf = rra.Spec().Function
+		}
+		result[name] = as
+	}
+	for _, s := range result {
+		dc.fetched = append(dc.fetched, s)
 	}
 	return result, nil
 }
 
+// fetchCtx is the context passed to FetchSeries(), which carries the
+// CF requested by consolidateBy(), if any.
+func (dc *dslCtx) fetchCtx() context.Context {
+	if dc.cf == rrd.WMEAN {
+		return dc.ctx
+	}
+	return serde.WithConsolidation(dc.ctx, dc.cf)
+}
+
+// addSeries accounts for n more series about to be fetched and
+// returns a *LimitError if this exceeds maxSeries.
+func (dc *dslCtx) addSeries(n int) error {
+	dc.nSeries += n
+	if dc.maxSeries > 0 && dc.nSeries > dc.maxSeries {
+		dc.limitErr = &LimitError{What: "series", Limit: int64(dc.maxSeries)}
+		return dc.limitErr
+	}
+	return nil
+}
+
 type funcCall struct {
 	ast  *ast.CallExpr
 	args []interface{}
@@ -232,7 +388,12 @@ func (v *funcVisitor) processStack() ast.Visitor {
 			name = fn.Name
 		}
 
-		ret, v.err = seriesFromFunction(v.dc, name, c.args)
+		v.dc.cf = v.dc.cfAt(c.ast.Pos())
+		if v.dc.explain != nil {
+			ret, v.err = v.dc.explain.call(v.dc, name, c.args)
+		} else {
+			ret, v.err = seriesFromFunction(v.dc, name, c.args)
+		}
 	}
 
 	v.ret, _ = ret.(SeriesMap)
@@ -265,15 +426,35 @@ func (v *funcVisitor) Visit(node ast.Node) ast.Visitor {
 
 // Simple trick to avoid "*" which is not valid Go syntax
 
+// Operators surrounded by spaces, e.g. "a.b * 2", are operators and
+// are not escaped, see infix.go.
+var infixOperator = regexp.MustCompile(` (\*|-|==|!=|<=|>=) `)
+
 func escapeBadChars(target string) string {
+	var (
+		buf  bytes.Buffer
+		last int
+	)
+	for _, loc := range infixOperator.FindAllStringIndex(target, -1) {
+		buf.WriteString(escapeBadPart(target[last:loc[0]]))
+		buf.WriteString(target[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	buf.WriteString(escapeBadPart(target[last:]))
+	return buf.String()
+}
+
+func escapeBadPart(target string) string {
 	s := strings.Replace(target, "*", "__ASTERISK__", -1)
 	s = strings.Replace(s, "=", "__ASSIGN__", -1)
+	s = strings.Replace(s, ":", "__COLON__", -1)
 	return strings.Replace(s, "-", "__DASH__", -1)
 }
 
 func unEscapeBadChars(target string) string {
 	s := strings.Replace(target, "__ASTERISK__", "*", -1)
 	s = strings.Replace(s, "__ASSIGN__", "=", -1)
+	s = strings.Replace(s, "__COLON__", ":", -1)
 	return strings.Replace(s, "__DASH__", "-", -1)
 }
 
@@ -285,6 +466,15 @@ func fixQuotes(target string) string {
 	return strings.Replace(target, "'", "\"", -1)
 }
 
+// A keyword argument with a string value, e.g. units="b", is not
+// valid Go either, it becomes a single string, "units=b", which is
+// what keyword arguments are anyway.
+var keywordString = regexp.MustCompile(`(\w+)__ASSIGN__"([^"]*)"`)
+
+func fixKeywordStrings(target string) string {
+	return keywordString.ReplaceAllString(target, `"${1}__ASSIGN__${2}"`)
+}
+
 func fixBackSlashes(target string) string {
 	return strings.Replace(target, "\\", "\\\\", -1)
 }
@@ -0,0 +1,252 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/serde"
+	"github.com/jdcio/tgres/series"
+)
+
+// An Explain records how an expression was evaluated: the tree of
+// function calls, the series fetched by every call along with the
+// RRA chosen for it and the parameters of its cursor. Each function
+// call also keeps track of time spent in it and how many data points
+// it produced, these are only known once the resulting series have
+// been iterated over.
+type Explain struct {
+	Expr    string       `json:"expr"`
+	Root    *ExplainNode `json:"root"`
+	current *ExplainNode
+	results []explainResult
+}
+
+// ExplainNode is a single function call.
+type ExplainNode struct {
+	Func     string
+	Args     []string
+	Children []*ExplainNode
+	Fetches  []*ExplainFetch
+	Series   int           // number of series returned
+	CallTime time.Duration // time spent in the function itself
+	Error    string
+	points   int64 // points produced, updated atomically
+	iterTime int64 // nanoseconds spent iterating, including children
+}
+
+// Points returns the number of data points produced by this call.
+func (n *ExplainNode) Points() int64 { return atomic.LoadInt64(&n.points) }
+
+// IterTime returns the time spent iterating over the series returned
+// by this call, including the time spent in its children.
+func (n *ExplainNode) IterTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&n.iterTime))
+}
+
+func (n *ExplainNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Func     string          `json:"func"`
+		Args     []string        `json:"args"`
+		Series   int             `json:"series"`
+		Points   int64           `json:"points"`
+		CallTime string          `json:"call_time"`
+		IterTime string          `json:"iter_time"`
+		Error    string          `json:"error,omitempty"`
+		Fetches  []*ExplainFetch `json:"fetches,omitempty"`
+		Children []*ExplainNode  `json:"children,omitempty"`
+	}{n.Func, n.Args, n.Series, n.Points(), n.CallTime.String(), n.IterTime().String(),
+		n.Error, n.Fetches, n.Children})
+}
+
+// ExplainFetch describes a single series fetched from a data source.
+type ExplainFetch struct {
+	Pattern   string                 `json:"pattern"`
+	Name      string                 `json:"name"`
+	Ident     serde.Ident            `json:"ident"`
+	Cached    bool                   `json:"cached"` // data is in memory (LRU)
+	RRA       *ExplainRRA            `json:"rra,omitempty"`
+	From      time.Time              `json:"from"`
+	To        time.Time              `json:"to"`
+	MaxPoints int64                  `json:"max_points"`
+	Cursor    map[string]interface{} `json:"cursor,omitempty"`
+	FetchTime string                 `json:"fetch_time"`
+}
+
+// ExplainRRA is the RRA chosen by DataSource.BestRRAByCF().
+type ExplainRRA struct {
+	CF     string    `json:"cf"`
+	Step   string    `json:"step"`
+	Span   string    `json:"span"`
+	Latest time.Time `json:"latest"`
+}
+
+// A series which can describe its underlying cursor (such as an SQL
+// query).
+type cursorExplainer interface {
+	ExplainCursor() map[string]interface{}
+}
+
+type explainResult struct {
+	sm   SeriesMap
+	node *ExplainNode
+}
+
+// ExplainDsl is same as ParseDslContext, but also returns an
+// Explain. Note that point counts and iteration times in the Explain
+// are only populated as the resulting series are iterated over.
+func ExplainDsl(ctx context.Context, db ctxDSFetcher, src string, from, to time.Time, maxPoints int64, maxSeries int) (SeriesMap, *Explain, error) {
+	dc := newDslCtx(db, src, from, to, maxPoints)
+	dc.ctx, dc.maxSeries = ctx, maxSeries
+	dc.explain = &Explain{Expr: src}
+	sm, err := dc.parse()
+	return sm, dc.explain, err
+}
+
+// call calls the function and records it in the tree.
+func (e *Explain) call(dc *dslCtx, name string, args []interface{}) (SeriesMap, error) {
+	node := &ExplainNode{Func: name}
+	for _, arg := range args {
+		if sm, ok := arg.(SeriesMap); ok {
+			if child := e.nodeOf(sm); child != nil {
+				node.Children = append(node.Children, child)
+				node.Args = append(node.Args, child.Func+"(...)")
+				continue
+			}
+		}
+		node.Args = append(node.Args, fmt.Sprintf("%v", arg))
+	}
+
+	// A call made while another one is in progress is part of a
+	// sub-expression (e.g. an applyByNode() template), it becomes a
+	// child of the call in progress. Otherwise the outermost call is
+	// the last one to complete and thus ends up as the root.
+	parent := e.current
+	if parent != nil {
+		parent.Children = append(parent.Children, node)
+	}
+	e.current = node
+	start := time.Now()
+	sm, err := seriesFromFunction(dc, name, args)
+	node.CallTime = time.Now().Sub(start)
+	e.current = parent
+	if parent == nil {
+		e.Root = node
+	}
+
+	if err != nil {
+		node.Error = err.Error()
+		return sm, err
+	}
+
+	node.Series = len(sm)
+	for name, s := range sm {
+		sm[name] = &explainSeries{AliasSeries: s, node: node}
+	}
+	e.results = append(e.results, explainResult{sm, node})
+	return sm, nil
+}
+
+// nodeOf finds the call which returned sm. Some functions return the
+// SeriesMap they were given, therefore the most recent call wins.
+func (e *Explain) nodeOf(sm SeriesMap) *ExplainNode {
+	p := reflect.ValueOf(sm).Pointer()
+	for i := len(e.results) - 1; i >= 0; i-- {
+		if reflect.ValueOf(e.results[i].sm).Pointer() == p {
+			return e.results[i].node
+		}
+	}
+	return nil
+}
+
+// fetch records a series fetched by the current call.
+func (e *Explain) fetch(pattern, name string, ident serde.Ident, ds rrd.DataSourcer, field int, s series.Series, from, to time.Time, maxPoints int64, cf rrd.Consolidation, dur time.Duration) {
+	f := &ExplainFetch{
+		Pattern:   pattern,
+		Name:      name,
+		Ident:     ident,
+		MaxPoints: maxPoints,
+		FetchTime: dur.String(),
+	}
+	f.From, f.To = s.TimeRange()
+	if f.From.IsZero() && f.To.IsZero() {
+		f.From, f.To = from, to
+	}
+
+	var rra rrd.RoundRobinArchiver
+	rra, f.Cached = bestRRA(ds, field, from, to, maxPoints, cf)
+	if rra != nil {
+		spec := rra.Spec()
+		f.RRA = &ExplainRRA{
+			CF:     spec.Function.String(),
+			Step:   spec.Step.String(),
+			Span:   spec.Span.String(),
+			Latest: rra.Latest(),
+		}
+	}
+
+	if ce, ok := s.(cursorExplainer); ok {
+		f.Cursor = ce.ExplainCursor()
+	} else {
+		f.Cursor = map[string]interface{}{
+			"step_ms":     s.Step().Nanoseconds() / 1e6,
+			"group_by_ms": s.GroupBy().Nanoseconds() / 1e6,
+			"max_points":  s.MaxPoints(),
+		}
+	}
+
+	if e.current != nil {
+		e.current.Fetches = append(e.current.Fetches, f)
+	}
+}
+
+// explainSeries counts points and time spent in Next().
+type explainSeries struct {
+	AliasSeries
+	node *ExplainNode
+}
+
+// Group preserves the grouping (if any) of the underlying series.
+func (s *explainSeries) Group() string {
+	if g, ok := s.AliasSeries.(grouper); ok {
+		return g.Group()
+	}
+	return ""
+}
+
+// Position preserves the position (if any) of the underlying series.
+func (s *explainSeries) Position() int {
+	if p, ok := s.AliasSeries.(positioner); ok {
+		return p.Position()
+	}
+	return -1
+}
+
+func (s *explainSeries) Next() bool {
+	start := time.Now()
+	ok := s.AliasSeries.Next()
+	atomic.AddInt64(&s.node.iterTime, int64(time.Now().Sub(start)))
+	if ok {
+		atomic.AddInt64(&s.node.points, 1)
+	}
+	return ok
+}
@@ -34,6 +34,7 @@ type fsFindCache struct {
 	db  serde.DataSourceSearcher
 	key string // name of the ident key, required
 	*fsFindNode
+	idents map[string]serde.Ident // all leaf idents by name
 }
 
 type fsFindNode struct {
@@ -67,6 +68,22 @@ func (n *fsFindNode) insert(parts []string, pos int, ident serde.Ident) {
 	}
 }
 
+func (n *fsFindNode) remove(parts []string, pos int) {
+	key := parts[pos]
+	child := n.names[key]
+	if child == nil {
+		return
+	}
+	if pos < len(parts)-1 {
+		child.remove(parts, pos+1)
+	} else {
+		child.ident = nil
+	}
+	if child.ident == nil && child.empty() {
+		delete(n.names, key)
+	}
+}
+
 func (n *fsFindNode) empty() bool {
 	return len(n.names) == 0
 }
@@ -101,12 +118,38 @@ func (f *fsFindCache) insert(ident serde.Ident) error {
 	if name := ident[f.key]; name != "" {
 		parts := strings.Split(name, ".")
 		f.fsFindNode.insert(parts, 0, ident)
+		f.idents[name] = ident
 	} else {
 		return fmt.Errorf("insert: '%s' tag missing for DS ident: %s", f.key, ident.String())
 	}
 	return nil
 }
 
+func (f *fsFindCache) remove(ident serde.Ident) {
+	if name := ident[f.key]; name != "" {
+		f.Lock()
+		defer f.Unlock()
+		f.fsFindNode.remove(strings.Split(name, "."), 0)
+		delete(f.idents, name)
+	}
+}
+
+// allIdents returns every leaf ident in the cache, sorted by name.
+func (f *fsFindCache) allIdents() []serde.Ident {
+	f.RLock()
+	defer f.RUnlock()
+	names := make([]string, 0, len(f.idents))
+	for name := range f.idents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]serde.Ident, 0, len(names))
+	for _, name := range names {
+		result = append(result, f.idents[name])
+	}
+	return result
+}
+
 type FsFindNode struct {
 	Name       string
 	Leaf       bool
@@ -114,6 +157,12 @@ type FsFindNode struct {
 	ident      serde.Ident
 }
 
+// Ident returns the ident of a leaf node, or nil if the node is not a
+// leaf.
+func (n *FsFindNode) Ident() serde.Ident {
+	return n.ident
+}
+
 type fsNodes []*FsFindNode
 
 // sort.Interface
@@ -133,6 +182,7 @@ func newFsFindCache(db serde.DataSourceSearcher, key string) *fsFindCache {
 		db:         db,
 		key:        key,
 		fsFindNode: &fsFindNode{},
+		idents:     make(map[string]serde.Ident),
 	}
 }
 
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"math/rand"
 	"regexp"
 	"sort"
 	"strconv"
@@ -26,6 +27,7 @@ import (
 	"time"
 
 	"github.com/jdcio/tgres/misc"
+	"github.com/jdcio/tgres/rrd"
 	"github.com/jdcio/tgres/series"
 )
 
@@ -55,10 +57,22 @@ type dslCtxFuncType func(*dslCtx, []interface{}) (SeriesMap, error)
 type dslCtxFuncMap map[string]dslCtxFuncType
 
 var dslCtxFuncs = dslCtxFuncMap{ // functions that require the dslCtx to do their stuff
+	"infix":                      dslInfix, // see infix.go
+	"histogramQuantile":          dslHistogramQuantile,
+	"histogramHeatmap":           dslHistogramHeatmap,
+	"sketchQuantile":             dslSketchQuantile,
 	"sumSeriesWithWildcards":     dslSumSeriesWithWildcards,
 	"averageSeriesWithWildcards": dslAverageSeriesWithWildcards,
 	"groupByNode":                dslGroupByNode,
 	"timeStack":                  dslTimeStack,
+	"aggregateWithWildcards":     dslAggregateWithWildcards,
+}
+
+func init() {
+	// These evaluate DSL functions themselves, which refers back to
+	// dslCtxFuncs, and would be an initialization loop otherwise.
+	dslCtxFuncs["reduceSeries"] = dslReduceSeries
+	dslCtxFuncs["applyByNode"] = dslApplyByNode
 }
 
 var preprocessArgFuncs = funcMap{
@@ -76,6 +90,9 @@ var preprocessArgFuncs = funcMap{
 		argDef{"seriesList", argSeries, nil}}},
 	"isNonNull": dslFuncType{dslIsNonNull, false, []argDef{
 		argDef{"seriesList", argSeries, nil}}},
+	"mapSeries": dslFuncType{dslMapSeries, true, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"mapNodes", argNumber, nil}}},
 	"maxSeries": dslFuncType{dslMaxSeries, true, []argDef{
 		argDef{"seriesList", argSeries, nil}}},
 	"max": dslFuncType{dslMaxSeries, true, []argDef{
@@ -229,11 +246,61 @@ var preprocessArgFuncs = funcMap{
 	"consolidateBy": dslFuncType{dslConsolidateBy, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"consolidationFunc", argString, nil}}},
-	"summarize": dslFuncType{dslSummarize, true, []argDef{
+	"summarize": dslFuncType{dslSummarize, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"intervalString", argString, nil},
+		argDef{"func", argString, "sum"},
+		argDef{"alignToFrom", argBool, "false"},
+		argDef{"tz", argString, "UTC"}}},
+	"smartSummarize": dslFuncType{dslSmartSummarize, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"intervalString", argString, nil},
 		argDef{"func", argString, "sum"},
-		argDef{"alignToFrom", argBool, "false"}}},
+		argDef{"alignTo", argString, ""},
+		argDef{"tz", argString, "UTC"}}},
+	"averageAbove": dslFuncType{dslAverageAbove, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"n", argNumber, nil}}},
+	"averageBelow": dslFuncType{dslAverageBelow, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"n", argNumber, nil}}},
+	"currentAbove": dslFuncType{dslCurrentAbove, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"n", argNumber, nil}}},
+	"currentBelow": dslFuncType{dslCurrentBelow, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"n", argNumber, nil}}},
+	"grep": dslFuncType{dslGrep, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"pattern", argString, nil}}},
+	"removeEmptySeries": dslFuncType{dslRemoveEmptySeries, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"xFilesFactor", argNumber, 0.0}}},
+	"unique": dslFuncType{dslUnique, true, []argDef{
+		argDef{"seriesLists", argSeries, nil}}},
+	"stddevSeries": dslFuncType{dslStddevSeries, true, []argDef{
+		argDef{"seriesLists", argSeries, nil}}},
+	"sortByMaxima": dslFuncType{dslSortByMaxima, false, []argDef{
+		argDef{"seriesList", argSeries, nil}}},
+	"sortByMinima": dslFuncType{dslSortByMinima, false, []argDef{
+		argDef{"seriesList", argSeries, nil}}},
+	"sortByTotal": dslFuncType{dslSortByTotal, false, []argDef{
+		argDef{"seriesList", argSeries, nil}}},
+	"sortByName": dslFuncType{dslSortByName, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"natural", argBool, "false"},
+		argDef{"reverse", argBool, "false"}}},
+	"cactiStyle": dslFuncType{dslCactiStyle, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"system", argString, ""},
+		argDef{"units", argString, ""}}},
+	"legendValue": dslFuncType{dslLegendValue, true, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"valueTypes", argString, nil}}},
+	"substr": dslFuncType{dslSubstr, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"start", argNumber, 0.0},
+		argDef{"stop", argNumber, 0.0}}},
 	"holtWintersForecast": dslFuncType{dslHoltWintersForecast, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"seasonLen", argString, "1d"},
@@ -249,6 +316,78 @@ var preprocessArgFuncs = funcMap{
 	"holtWintersAberration": dslFuncType{dslHoltWintersAberration, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"delta", argNumber, 3.0}}},
+	"linearRegression": dslFuncType{dslLinearRegression, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"startSourceAt", argString, ""},
+		argDef{"endSourceAt", argString, ""}}},
+	"forecast": dslFuncType{dslForecast, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"horizon", argString, ""},
+		argDef{"method", argString, "linear"},
+		argDef{"seasonLen", argString, "1d"}}},
+	"timeToThreshold": dslFuncType{dslTimeToThreshold, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"value", argNumber, nil},
+		argDef{"legend", argBool, "false"}}},
+	"zScore": dslFuncType{dslZScore, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"windowSize", argString, nil}}},
+	"madOutliers": dslFuncType{dslMadOutliers, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"windowSize", argString, nil},
+		argDef{"k", argNumber, 3.0}}},
+	"removeOutliers": dslFuncType{dslRemoveOutliers, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"windowSize", argString, nil},
+		argDef{"k", argNumber, 3.0}}},
+	"exponentialMovingAverage": dslFuncType{dslExponentialMovingAverage, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"windowSize", argString, nil}}},
+	"ewmaBands": dslFuncType{dslEwmaBands, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"alpha", argNumber, nil},
+		argDef{"k", argNumber, 3.0}}},
+	"pow": dslFuncType{dslPow, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"factor", argNumber, nil}}},
+	"powSeries": dslFuncType{dslPowSeries, true, []argDef{
+		argDef{"seriesList", argSeries, nil}}},
+	"squareRoot": dslFuncType{dslSquareRoot, false, []argDef{
+		argDef{"seriesList", argSeries, nil}}},
+	"invert": dslFuncType{dslInvert, false, []argDef{
+		argDef{"seriesList", argSeries, nil}}},
+	"minMax": dslFuncType{dslMinMax, false, []argDef{
+		argDef{"seriesList", argSeries, nil}}},
+	"sigmoid": dslFuncType{dslSigmoid, false, []argDef{
+		argDef{"seriesList", argSeries, nil}}},
+	"delay": dslFuncType{dslDelay, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"steps", argNumber, nil}}},
+	"interpolate": dslFuncType{dslInterpolate, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"limit", argNumber, math.Inf(1)}}},
+	"fallbackSeries": dslFuncType{dslFallbackSeries, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"fallback", argSeries, nil}}},
+	"timeSlice": dslFuncType{dslTimeSlice, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"startSliceAt", argString, nil},
+		argDef{"endSliceAt", argString, "now"}}},
+	"identity": dslFuncType{dslTimeFunction, false, []argDef{
+		argDef{"name", argString, nil},
+		argDef{"step", argNumber, 60.0}}},
+	"timeFunction": dslFuncType{dslTimeFunction, false, []argDef{
+		argDef{"name", argString, nil},
+		argDef{"step", argNumber, 60.0}}},
+	"randomWalk": dslFuncType{dslRandomWalk, false, []argDef{
+		argDef{"name", argString, nil},
+		argDef{"step", argNumber, 60.0}}},
+	"integralByInterval": dslFuncType{dslIntegralByInterval, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"intervalUnit", argString, nil}}},
+	"perSecond": dslFuncType{dslPerSecond, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"maxValue", argNumber, math.NaN()}}},
 
 	// COMBINE
 	// ++ averageSeries
@@ -256,32 +395,44 @@ var preprocessArgFuncs = funcMap{
 	// ++ averageSeriesWithWildcards
 	// ++ group
 	// ++ isNonNull
-	// -- mapSeries // returns a list of lists (non-standard)
+	// ++ mapSeries // returns a list of lists, see SeriesMap.Groups()
 	// ++ maxSeries
 	// ++ minSeries
 	// ++ percentileOfSeries
 	// ++ rangeOfSeries
-	// -- reduceSeries // relies on mapSeries
+	// ++ reduceSeries
+	// ++ applyByNode
+	// ++ aggregateWithWildcards
 	// ++ sumSeries
 	// ++ sumSeriesWithWildcards
 	// ++ averageSeriesWithWildcards
 	// ++ multiplySeries
+	// ++ powSeries
 
 	// TRANSFORM
 	// ++ absolute()
 	// ++ derivative()
+	// ++ delay
 	// ++ hitcount()
 	// ++ integral()
+	// ++ integralByInterval
+	// ++ interpolate
+	// ++ invert
 	// ++ log()
+	// ++ minMax // would require whole series min() and max()
 	// ++ nonNegativeDerivative
 	// ++ offset
 	// ++ offsetToZero // would require whole series min()
-	// -- perSecond // everything here is perSedond() already
+	// ++ perSecond // for counters, everything else here is per second already
+	// ++ pow
 	// ++ scale()
 	// ++ scaleToSeconds()
-	// -- smartSummarize
+	// ++ sigmoid
+	// ++ smartSummarize
+	// ++ squareRoot
 	// ++ summarize
 	// ++ timeShift
+	// ++ timeSlice
 	// ++ timeStack
 	// ++ transformNull
 
@@ -289,19 +440,29 @@ var preprocessArgFuncs = funcMap{
 	// ++ asPercent
 	// ++ diffSeries
 	// ++ divideSeries
+	// ++ ewmaBands // not in Graphite
+	// ++ exponentialMovingAverage
+	// ++ forecast // not in Graphite
+	// ++ histogramHeatmap // not in Graphite
+	// ++ histogramQuantile // not in Graphite
 	// ** holtWintersAberration
 	// ** holtWintersConfidenceBands
 	// ** holtWintersForecast
+	// ++ linearRegression
+	// ++ madOutliers // not in Graphite
 	// ++ nPercentile
-	// ?? stddevSeries
+	// ++ sketchQuantile // not in Graphite
+	// ++ stddevSeries
+	// ++ timeToThreshold // not in Graphite
+	// ++ zScore // not in Graphite
 
 	// FILTER
-	// ?? averageAbove
-	// ?? averageBelow
-	// ?? currentAbove
-	// ?? currentBelow
+	// ++ averageAbove
+	// ++ averageBelow
+	// ++ currentAbove
+	// ++ currentBelow
 	// ++ exclude
-	// ?? grep
+	// ++ grep
 	// ++ highestCurrent
 	// ++ highestMax
 	// ++ limit
@@ -318,7 +479,10 @@ var preprocessArgFuncs = funcMap{
 	// ++ removeAboveValue
 	// ++ removeBelowPercentile
 	// ++ removeBelowValue
+	// ++ removeEmptySeries
+	// ++ removeOutliers // not in Graphite
 	// ++ stdev
+	// ++ unique
 	// ++ useSeriesAbove
 	// ++ weightedAverage
 
@@ -327,21 +491,25 @@ var preprocessArgFuncs = funcMap{
 	// ++ aliasByMetric
 	// ++ aliasByNode
 	// ++ aliasSub
-	// ?? cactiStyle // TODO should be easy to do?
+	// ++ cactiStyle
 	// ++ changed
 	// ++ consolidateBy
 	// ++ constantLine
 	// ++ countSeries
 	// -- cumulative // == consolidateBy
+	// ++ fallbackSeries
 	// ++ groupByNode
+	// ++ identity
 	// ++ keepLastValue
-	// ?? randomWalk // later?
-	// ?? sortByMaxima
-	// ?? sortByMinima
-	// ?? sortByName
-	// ?? sortByTotal
+	// ++ legendValue
+	// ++ randomWalk
+	// ++ sortByMaxima
+	// ++ sortByMinima
+	// ++ sortByName
+	// ++ sortByTotal
 	// ?? stacked
-	// ?? substr
+	// ++ substr
+	// ++ timeFunction
 }
 
 func processArgs(dc *dslCtx, fn *dslFuncType, args []interface{}) (map[string]interface{}, []interface{}, error) {
@@ -448,6 +616,8 @@ func processArgs(dc *dslCtx, fn *dslFuncType, args []interface{}) (map[string]in
 			case argNumberOrSeries:
 				if number, ok := arg.(float64); ok {
 					value = append(value, number)
+				} else if series, ok := arg.(SeriesMap); ok {
+					value = append(value, series)
 				} else if str, ok := arg.(string); ok {
 					if number, err := strconv.ParseFloat(str, 64); err == nil { // is it a kw arg float?
 						value = append(value, number)
@@ -516,6 +686,10 @@ func callPreprocessArgFunc(dc *dslCtx, name string, argFunc *dslFuncType,
 
 func seriesFromFunction(dc *dslCtx, name string, args []interface{}) (SeriesMap, error) {
 
+	if err := dc.ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	argFunc, ok := preprocessArgFuncs[name]
 	if ok {
 		argMap, argSlice, err := processArgs(dc, &argFunc, args)
@@ -828,15 +1002,9 @@ func dslGroupByNode(dc *dslCtx, args []interface{}) (SeriesMap, error) {
 		return nil, fmt.Errorf("third arg %v is not a string", args[2])
 	}
 
-	// Check that the function is valid
-	fdef, ok := preprocessArgFuncs[funcName]
-	if !ok {
-		return nil, fmt.Errorf("%v is not a function we know", args[2])
-	}
-
-	// Check that the func is suitable
-	if len(fdef.args) != 1 || len(fdef.args) == 0 || fdef.args[0].tp != argSeries {
-		return nil, fmt.Errorf("%v is not suitable for callback", args[2])
+	fdef, err := seriesCallback(funcName)
+	if err != nil {
+		return nil, err
 	}
 
 	// First we need a complete list of series
@@ -862,10 +1030,33 @@ func dslGroupByNode(dc *dslCtx, args []interface{}) (SeriesMap, error) {
 		groups[group][name] = s
 	}
 
+	return aggregateGroups(dc, funcName, fdef, groups)
+}
+
+// seriesCallback looks up a function suitable for calling on a group
+// of series, i.e. one which takes a series list and nothing else.
+func seriesCallback(funcName string) (*dslFuncType, error) {
+	// Check that the function is valid
+	fdef, ok := preprocessArgFuncs[funcName]
+	if !ok {
+		return nil, fmt.Errorf("%v is not a function we know", funcName)
+	}
+
+	// Check that the func is suitable
+	if len(fdef.args) != 1 || fdef.args[0].tp != argSeries {
+		return nil, fmt.Errorf("%v is not suitable for callback", funcName)
+	}
+	return &fdef, nil
+}
+
+// aggregateGroups calls fdef on every group, the result is keyed by
+// the group key.
+func aggregateGroups(dc *dslCtx, funcName string, fdef *dslFuncType, groups map[string]SeriesMap) (SeriesMap, error) {
 	result := make(SeriesMap)
 	for alias, group := range groups {
+		group.toAliasSeriesSlice().Align()
 		argsMap := map[string]interface{}{fdef.args[0].name: group}
-		smap, err := callPreprocessArgFunc(dc, funcName, &fdef, nil, argsMap, nil)
+		smap, err := callPreprocessArgFunc(dc, funcName, fdef, nil, argsMap, []interface{}{group})
 		if err != nil {
 			return nil, fmt.Errorf("error in callPreprocessArgFunc: %v", err)
 		}
@@ -879,6 +1070,267 @@ func dslGroupByNode(dc *dslCtx, args []interface{}) (SeriesMap, error) {
 	return result, nil
 }
 
+// aggregateWithWildcards()
+//
+// Unlike sumSeriesWithWildcards() this groups the series it is given
+// rather than looking them up again, so it works on the output of
+// other functions. The func argument is either one of the names that
+// Graphite accepts (sum, average, etc.) or a function name.
+
+var aggregateFuncNames = map[string]string{
+	"average":  "averageSeries",
+	"avg":      "averageSeries",
+	"sum":      "sumSeries",
+	"total":    "sumSeries",
+	"min":      "minSeries",
+	"max":      "maxSeries",
+	"diff":     "diffSeries",
+	"range":    "rangeOfSeries",
+	"rangeOf":  "rangeOfSeries",
+	"multiply": "multiplySeries",
+	"count":    "countSeries",
+}
+
+func dslAggregateWithWildcards(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("Expecting at least 2 arguments, got %d", len(args))
+	}
+
+	smap, err := dc.seriesFromSeriesOrIdent(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	funcName, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("second arg %v is not a string", args[1])
+	}
+	if fn, ok := aggregateFuncNames[funcName]; ok {
+		funcName = fn
+	}
+	fdef, err := seriesCallback(funcName)
+	if err != nil {
+		return nil, err
+	}
+
+	poss := make(map[int]bool)
+	for _, arg := range args[2:] {
+		i, ok := arg.(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid position: %v", arg)
+		}
+		poss[int(i)] = true
+	}
+
+	groups := make(map[string]SeriesMap)
+	for name, s := range smap {
+		// a.b.c.d, 1, 2 => a.d
+		parts := strings.Split(name, ".")
+		keep := make([]string, 0, len(parts))
+		for i, part := range parts {
+			if !poss[i] {
+				keep = append(keep, part)
+			}
+		}
+		alias := strings.Join(keep, ".")
+		if groups[alias] == nil {
+			groups[alias] = make(SeriesMap)
+		}
+		groups[alias][name] = s
+	}
+
+	return aggregateGroups(dc, funcName, fdef, groups)
+}
+
+// mapSeries()
+//
+// Groups series by the nodes at the given positions, e.g. given
+// app.host1.hits and app.host1.misses, mapSeries(app.*.*, 1) results
+// in a single group "host1". The result is a list of lists, which
+// is only of use to reduceSeries(), to anything else it is the same
+// as the original list.
+
+func dslMapSeries(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	nodes := args["mapNodes"].([]interface{})
+	result := make(SeriesMap, len(series))
+	for name, s := range series {
+		parts := strings.Split(name, ".")
+		keys := make([]string, 0, len(nodes))
+		for _, num := range nodes {
+			n := int(num.(float64))
+			if n < 0 {
+				n = len(parts) + n
+			}
+			if n >= 0 && n < len(parts) {
+				keys = append(keys, parts[n])
+			}
+		}
+		result[name] = &groupedSeries{AliasSeries: s, group: strings.Join(keys, ".")}
+	}
+	return result, nil
+}
+
+// reduceSeries()
+//
+// reduceSeries(seriesLists, reduceFunction, reduceNode, *reduceMatchers)
+//
+// Within every group of seriesLists (see mapSeries()), picks the
+// series whose node at reduceNode is equal to each of the
+// reduceMatchers and calls reduceFunction with these series as
+// arguments, in the order of the matchers. As in Graphite, the
+// resulting series is named by the nodes preceding reduceNode
+// followed by "reduce" and reduceFunction, e.g.
+//
+//   reduceSeries(mapSeries(app.*.{hits,misses}, 1), "asPercent", 2, "hits", "misses")
+//
+// yields app.host1.reduce.asPercent, etc. Groups missing a match are
+// skipped.
+
+func dslReduceSeries(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+	if len(args) < 4 {
+		return nil, fmt.Errorf("Expecting at least 4 arguments, got %d", len(args))
+	}
+
+	smap, err := dc.seriesFromSeriesOrIdent(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	funcName, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("second arg %v is not a string", args[1])
+	}
+
+	fnode, ok := args[2].(float64)
+	if !ok {
+		return nil, fmt.Errorf("third arg %v is not a number", args[2])
+	}
+	pos := int(fnode)
+
+	matchers := make(map[string]int, len(args)-3)
+	for i, arg := range args[3:] {
+		m, ok := arg.(string)
+		if !ok {
+			m = fmt.Sprintf("%v", arg)
+		}
+		matchers[m] = i
+	}
+
+	result := make(SeriesMap)
+	keys, groups := smap.Groups()
+	for _, key := range keys {
+		group := groups[key]
+
+		// collect the matching series by their reduced name
+		reduced := make(map[string][]SeriesMap)
+		for _, name := range group.SortedKeys() {
+			parts := strings.Split(name, ".")
+			if pos < 0 || pos >= len(parts) {
+				continue
+			}
+			i, ok := matchers[parts[pos]]
+			if !ok {
+				continue
+			}
+			rname := strings.Join(append(parts[:pos:pos], "reduce", funcName), ".")
+			if reduced[rname] == nil {
+				reduced[rname] = make([]SeriesMap, len(matchers))
+			}
+			reduced[rname][i] = SeriesMap{name: group[name]}
+		}
+
+		for rname, sms := range reduced {
+			fargs := make([]interface{}, 0, len(sms))
+			for _, sm := range sms {
+				if sm == nil {
+					break // incomplete, skip it
+				}
+				fargs = append(fargs, sm)
+			}
+			if len(fargs) < len(sms) {
+				continue
+			}
+			res, err := seriesFromFunction(dc, funcName, fargs)
+			if err != nil {
+				return nil, err
+			}
+			for _, k := range res.SortedKeys() {
+				s := res[k]
+				s.Alias(rname)
+				result[rname] = s
+				break // only one series is expected
+			}
+		}
+	}
+	return result, nil
+}
+
+// applyByNode()
+//
+// applyByNode(seriesList, nodeNum, templateFunction, newName)
+//
+// For every distinct prefix of series names up to and including
+// nodeNum, evaluates templateFunction with every "%" replaced by the
+// prefix. If newName is given, the resulting series are named by it,
+// also with "%" replaced. E.g.:
+//
+//   applyByNode(servers.*.disk.bytes_free, 1, "divideSeries(%.disk.bytes_free, sumSeries(%.disk.bytes_*))")
+
+func dslApplyByNode(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+	if len(args) < 3 || len(args) > 4 {
+		return nil, fmt.Errorf("Expecting 3 or 4 arguments, got %d", len(args))
+	}
+
+	smap, err := dc.seriesFromSeriesOrIdent(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	fnode, ok := args[1].(float64)
+	if !ok {
+		return nil, fmt.Errorf("second arg %v is not a number", args[1])
+	}
+	pos := int(fnode)
+
+	template, ok := args[2].(string)
+	if !ok {
+		return nil, fmt.Errorf("third arg %v is not a string", args[2])
+	}
+
+	var newName string
+	if len(args) > 3 {
+		if newName, ok = args[3].(string); !ok {
+			return nil, fmt.Errorf("fourth arg %v is not a string", args[3])
+		}
+	}
+
+	prefixes := make(map[string]bool)
+	for name, _ := range smap {
+		parts := strings.Split(name, ".")
+		if pos < 0 || pos >= len(parts) {
+			continue
+		}
+		prefixes[strings.Join(parts[:pos+1], ".")] = true
+	}
+
+	result := make(SeriesMap)
+	for prefix, _ := range prefixes {
+		res, err := dc.evalSubExpr(strings.Replace(template, "%", prefix, -1))
+		if err != nil {
+			return nil, err
+		}
+		for name, s := range res {
+			if newName != "" {
+				name = strings.Replace(newName, "%", prefix, -1)
+				s.Alias(name)
+			}
+			result[name] = s
+		}
+	}
+	return result, nil
+}
+
 // percentileOfSeries()
 // TODO the interpolate argument is ignored for now
 
@@ -2269,85 +2721,288 @@ func dslConsolidateBy(args map[string]interface{}) (SeriesMap, error) {
 	fname := args["consolidationFunc"].(string)
 	maxPoints := args["_maxPoints_"].(int64)
 
-	var factor float64 = 1
-
+	var spp float64 // seconds per point
 	if fname == "sum" && maxPoints > 0 {
 		from := args["_from_"].(time.Time)
 		to := args["_to_"].(time.Time)
-		// factor is seconds per point
-		factor = to.Sub(from).Seconds() / float64(maxPoints)
+		spp = to.Sub(from).Seconds() / float64(maxPoints)
 	}
 
 	for name, s := range series {
+		factor := float64(1)
+		if spp > 0 {
+			factor = spp
+			if as, ok := s.(*aliasSeries); ok && as.cf == rrd.SUM {
+				// A SUM RRA already has the total of each
+				// slot, only the slots in a point are averaged.
+				factor = math.Max(1, spp/as.Step().Seconds())
+			}
+		}
 		s.Alias(fmt.Sprintf("consolidateBy(%v,%v)", name, fname))
 		series[name] = &seriesConsolidateBy{s, factor}
 	}
 	return series, nil
 }
 
-// summarize()
+// summarize(), smartSummarize()
 //
-type seriesSummarize struct {
-	AliasSeries
-	factor float64
-}
+// The points of the series are consolidated into intervals, which can
+// be calendar days, weeks, months or years (see
+// misc.CalendarInterval) in the time zone given by tz. Each point
+// covers its slot, which ends at the point time (this is how we mark
+// them internally), and contributes to every interval the slot
+// overlaps, in proportion to the overlap. As everything here is a
+// rate per second, the sum is the rate times the seconds, i.e. the
+// total for the interval. The resulting points are marked with the
+// end of the interval as well.
+//
+// summarize() intervals begin at the truncated (to interval) from,
+// or from itself if alignToFrom is true, and contain only the data
+// between from and to. smartSummarize() truncates from to alignTo
+// (or the unit of the interval, e.g. midnight for "7d") and fetches
+// the data from there, so that the first interval is complete.
 
-func (sl *seriesSummarize) CurrentValue() float64 {
-	return sl.AliasSeries.CurrentValue() * sl.factor
+var summarizeFuncs = map[string]bool{
+	"sum": true, "total": true, "avg": true, "average": true,
+	"min": true, "max": true, "first": true, "last": true,
 }
 
-func dslSummarize(args map[string]interface{}) (SeriesMap, error) {
-	series := args["seriesList"].(SeriesMap)
-	is := args["intervalString"].(string)
-	fname := args["func"].(string)
+type summarizeAcc struct {
+	n                     int
+	sum, secs             float64
+	min, max, first, last float64
+}
 
-	var factor float64
-	if fname == "sum" {
-		dur, err := misc.BetterParseDuration(is)
-		if err != nil {
-			return nil, err
-		}
-		factor = dur.Seconds()
-	} else {
-		// assume avg
-		// max and min cannot really be supported
-		// and do not make much sense here
-		factor = 1
+func (a *summarizeAcc) add(v, secs float64) {
+	if a.n == 0 {
+		a.min, a.max, a.first = v, v, v
 	}
+	a.n++
+	a.sum += v * secs
+	a.secs += secs
+	a.min = math.Min(a.min, v)
+	a.max = math.Max(a.max, v)
+	a.last = v
+}
 
-	for name, s := range series {
-		s.Alias(fmt.Sprintf("summarize(%v,%v,%v)", name, is, fname))
-		series[name] = &seriesSummarize{s, factor}
+func (a *summarizeAcc) value(fname string) float64 {
+	if a.n == 0 {
+		return math.NaN()
 	}
-
-	return series, nil
+	switch fname {
+	case "sum", "total":
+		return a.sum
+	case "avg", "average":
+		return a.sum / a.secs
+	case "min":
+		return a.min
+	case "max":
+		return a.max
+	case "first":
+		return a.first
+	}
+	return a.last
 }
 
-// timeStack
-func dslTimeStack(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+type seriesSummarize struct {
+	AliasSeries
+	bounds []time.Time // interval i is bounds[i] to bounds[i+1]
+	fname  string
+	values []float64
+	pos    int
+}
 
-	if len(args) != 4 {
-		return nil, fmt.Errorf("Expecting 4 arguments, got %d", len(args))
+func (s *seriesSummarize) load() {
+	n := len(s.bounds) - 1
+	accs := make([]summarizeAcc, n)
+	step := s.AliasSeries.GroupBy()
+	if step <= 0 {
+		step = s.AliasSeries.Step()
 	}
-	sspec, ok := args[0].(string)
-	if !ok {
-		return nil, fmt.Errorf("%v is not a string", args[0])
-		// TODO: timeStack of a SeriesMap would be nice, but the
-		// problem is that we cannot iterate over the same series in
-		// parallel from different places, and there is no "mechanism"
-		// for copying a series at this point.
+	if step <= 0 {
+		step = time.Second // should not happen
 	}
-	ispec, ok := args[1].(string)
-	if !ok {
-		return nil, fmt.Errorf("second arg %v is not a string", args[1])
+	for s.AliasSeries.Next() {
+		v := s.AliasSeries.CurrentValue()
+		if math.IsNaN(v) {
+			continue
+		}
+		end := s.AliasSeries.CurrentTime()
+		begin := end.Add(-step)
+		// first interval ending after the slot begins
+		i := sort.Search(n, func(i int) bool { return s.bounds[i+1].After(begin) })
+		for ; i < n && s.bounds[i].Before(end); i++ {
+			b, e := begin, end
+			if s.bounds[i].After(b) {
+				b = s.bounds[i]
+			}
+			if s.bounds[i+1].Before(e) {
+				e = s.bounds[i+1]
+			}
+			accs[i].add(v, e.Sub(b).Seconds())
+		}
 	}
-	period, err := misc.BetterParseDuration(ispec)
-	if err != nil {
-		return nil, err
+	s.AliasSeries.Close()
+	s.values = make([]float64, n)
+	for i := range accs {
+		s.values[i] = accs[i].value(s.fname)
 	}
+}
 
-	fbegin, ok := args[2].(float64)
-	if !ok {
+func (s *seriesSummarize) Next() bool {
+	if s.values == nil {
+		s.load()
+	}
+	if s.pos < len(s.values) {
+		s.pos++
+	}
+	return s.pos < len(s.values)
+}
+
+func (s *seriesSummarize) CurrentValue() float64 {
+	if s.pos >= 0 && s.pos < len(s.values) {
+		return s.values[s.pos]
+	}
+	return math.NaN()
+}
+
+func (s *seriesSummarize) CurrentTime() time.Time {
+	if s.pos >= 0 && s.pos < len(s.values) {
+		return s.bounds[s.pos+1]
+	}
+	return time.Time{}
+}
+
+// Step is the length of the current (or first) interval.
+func (s *seriesSummarize) Step() time.Duration {
+	i := s.pos
+	if i < 0 || i >= len(s.bounds)-1 {
+		i = 0
+	}
+	if len(s.bounds) < 2 {
+		return 0
+	}
+	return s.bounds[i+1].Sub(s.bounds[i])
+}
+
+func (s *seriesSummarize) GroupBy(...time.Duration) time.Duration {
+	return s.Step()
+}
+
+func (s *seriesSummarize) Close() error {
+	s.pos = -1
+	return nil
+}
+
+func summarizeParams(is, fname, tz string) (misc.CalendarInterval, *time.Location, error) {
+	if !summarizeFuncs[fname] {
+		return misc.CalendarInterval{}, nil, fmt.Errorf("unsupported func: %q (valid: sum, total, avg, average, min, max, first, last)", fname)
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return misc.CalendarInterval{}, nil, fmt.Errorf("invalid tz: %q: %v", tz, err)
+	}
+	iv, err := misc.ParseCalendarInterval(is)
+	return iv, loc, err
+}
+
+// summarizeBounds returns the interval boundaries from begin through
+// the first one which is not before to.
+func summarizeBounds(iv misc.CalendarInterval, begin, to time.Time) []time.Time {
+	bounds := []time.Time{begin}
+	for n := 1; bounds[len(bounds)-1].Before(to); n++ {
+		bounds = append(bounds, iv.AddTo(begin, n))
+	}
+	return bounds
+}
+
+func dslSummarize(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	is := args["intervalString"].(string)
+	fname := args["func"].(string)
+	alignToFrom := args["alignToFrom"].(bool)
+
+	iv, loc, err := summarizeParams(is, fname, args["tz"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("summarize(): %v", err)
+	}
+	from := args["_from_"].(time.Time).In(loc)
+	to := args["_to_"].(time.Time)
+
+	begin := from
+	if !alignToFrom {
+		begin = iv.Truncate(from)
+	}
+	bounds := summarizeBounds(iv, begin, to)
+
+	for name, s := range series {
+		s.Alias(fmt.Sprintf("summarize(%v,%v,%v)", name, is, fname))
+		series[name] = &seriesSummarize{AliasSeries: s, bounds: bounds, fname: fname, pos: -1}
+	}
+	return series, nil
+}
+
+func dslSmartSummarize(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	is := args["intervalString"].(string)
+	fname := args["func"].(string)
+	alignTo := args["alignTo"].(string)
+
+	iv, loc, err := summarizeParams(is, fname, args["tz"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("smartSummarize(): %v", err)
+	}
+	align := iv.Unit()
+	if alignTo != "" {
+		if align, err = misc.ParseCalendarInterval(alignTo); err != nil {
+			return nil, fmt.Errorf("smartSummarize(): alignTo: %v", err)
+		}
+	}
+	from := args["_from_"].(time.Time).In(loc)
+	to := args["_to_"].(time.Time)
+
+	begin := align.Truncate(from)
+	bounds := summarizeBounds(iv, begin, to)
+
+	for name, s := range series {
+		if begin.Before(from) {
+			// Fetch the beginning of the first interval as well
+			if mp := s.MaxPoints(); mp > 0 && to.After(from) {
+				s.MaxPoints(int64(float64(mp) * to.Sub(begin).Seconds() / to.Sub(from).Seconds()))
+			}
+			s.TimeRange(begin, to)
+		}
+		s.Alias(fmt.Sprintf("smartSummarize(%v,%v,%v)", name, is, fname))
+		series[name] = &seriesSummarize{AliasSeries: s, bounds: bounds, fname: fname, pos: -1}
+	}
+	return series, nil
+}
+
+// timeStack
+func dslTimeStack(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+
+	if len(args) != 4 {
+		return nil, fmt.Errorf("Expecting 4 arguments, got %d", len(args))
+	}
+	sspec, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a string", args[0])
+		// TODO: timeStack of a SeriesMap would be nice, but the
+		// problem is that we cannot iterate over the same series in
+		// parallel from different places, and there is no "mechanism"
+		// for copying a series at this point.
+	}
+	ispec, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("second arg %v is not a string", args[1])
+	}
+	period, err := misc.BetterParseDuration(ispec)
+	if err != nil {
+		return nil, err
+	}
+
+	fbegin, ok := args[2].(float64)
+	if !ok {
 		return nil, fmt.Errorf("third argument arg %v is not a number", args[2])
 	}
 	begin := int(fbegin)
@@ -2375,11 +3030,18 @@ func dslTimeStack(dc *dslCtx, args []interface{}) (SeriesMap, error) {
 		}
 
 		for i := begin; i <= num; i++ {
+			if err := dc.addSeries(1); err != nil {
+				return nil, err
+			}
 			// Give FS the "big" range, TimeRange later
-			dps, err := dc.FetchSeries(ds, from, to, dc.maxPoints)
+			start := time.Now()
+			dps, err := dc.FetchSeries(dc.fetchCtx(), ds, from, to, dc.maxPoints)
 			if err != nil {
 				return nil, fmt.Errorf("timeStack(): Error %v", err)
 			}
+			if dc.explain != nil {
+				dc.explain.fetch(sspec, name, ident, ds, 0, dps, from, to, dc.maxPoints, dc.cf, time.Now().Sub(start))
+			}
 			t := to.Add(-period * time.Duration(i))
 			f := t.Add(-period)
 			shift := to.Sub(t)
@@ -2620,3 +3282,1339 @@ func dslHoltWintersAberration(args map[string]interface{}) (SeriesMap, error) {
 	args["show"] = "aberr"
 	return dslHoltWintersForecast(args)
 }
+
+// movingWindow is the values of (at most) size points preceding the
+// current one. The size can also be given as a duration, in which
+// case it becomes known once the series step is known.
+type movingWindow struct {
+	size int
+	dur  time.Duration
+	vals []float64
+}
+
+func newMovingWindow(window string) (*movingWindow, error) {
+	if dur, err := misc.BetterParseDuration(window); err == nil && dur > 0 {
+		return &movingWindow{dur: dur}, nil
+	} else if points, err := strconv.ParseInt(window, 10, 64); err == nil && points > 0 {
+		return &movingWindow{size: int(points)}, nil
+	}
+	return nil, fmt.Errorf("invalid window size: %v", window)
+}
+
+// points returns the size of the window in points.
+func (w *movingWindow) points(step time.Duration) int {
+	if w.size == 0 {
+		if w.size = 1; step > 0 && w.dur > step {
+			w.size = int(w.dur / step)
+		}
+	}
+	return w.size
+}
+
+func (w *movingWindow) push(v float64, step time.Duration) {
+	if w.vals = append(w.vals, v); len(w.vals) > w.points(step) {
+		w.vals = w.vals[1:]
+	}
+}
+
+// values returns the values in the window which are not NaN.
+func (w *movingWindow) values() []float64 {
+	result := make([]float64, 0, len(w.vals))
+	for _, v := range w.vals {
+		if !math.IsNaN(v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// seriesMovingWindow computes every value from it and the window of
+// the values preceding it.
+type seriesMovingWindow struct {
+	AliasSeries
+	window  *movingWindow
+	started bool
+	current float64
+	fn      func(v float64, window []float64) float64
+}
+
+func (f *seriesMovingWindow) Next() bool {
+	if f.started {
+		f.window.push(f.current, f.GroupBy())
+	}
+	if !f.AliasSeries.Next() {
+		f.reset()
+		return false
+	}
+	f.started, f.current = true, f.AliasSeries.CurrentValue()
+	return true
+}
+
+func (f *seriesMovingWindow) CurrentValue() float64 {
+	if math.IsNaN(f.current) {
+		return f.current
+	}
+	return f.fn(f.current, f.window.values())
+}
+
+func (f *seriesMovingWindow) reset() {
+	f.started, f.window.vals = false, nil
+	if f.window.dur != 0 {
+		f.window.size = 0
+	}
+}
+
+func (f *seriesMovingWindow) Close() error {
+	f.reset()
+	return f.AliasSeries.Close()
+}
+
+func movingWindowFunc(args map[string]interface{}, alias string, fn func(v float64, window []float64) float64) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	window := args["windowSize"].(string)
+	for name, s := range series {
+		w, err := newMovingWindow(window)
+		if err != nil {
+			return nil, err
+		}
+		s.Alias(fmt.Sprintf(alias, name))
+		series[name] = &seriesMovingWindow{AliasSeries: s, window: w, fn: fn}
+	}
+	return series, nil
+}
+
+// zScore()
+//
+// The number of standard deviations a value is from the mean of the
+// window preceding it. If the window has no variation, the result is
+// 0 if the value is the mean, NaN otherwise.
+func dslZScore(args map[string]interface{}) (SeriesMap, error) {
+	alias := fmt.Sprintf("zScore(%%v,%v)", args["windowSize"])
+	return movingWindowFunc(args, alias, func(v float64, window []float64) float64 {
+		if len(window) < 2 {
+			return math.NaN()
+		}
+		ss := &series.SummarySeries{Series: series.NewSliceSeries(window, time.Time{}, time.Second)}
+		avg := ss.Avg()
+		sd := ss.StdDev(avg)
+		if sd == 0 {
+			if v == avg {
+				return 0
+			}
+			return math.NaN()
+		}
+		return (v - avg) / sd
+	})
+}
+
+// isMADOutlier tells whether v is more than k (scaled) median absolute
+// deviations from the median of the window. The 1.4826 scale makes
+// the MAD comparable to the standard deviation for normally
+// distributed values. Less than 3 values are not enough to tell, if
+// the MAD is 0, any value other than the median is an outlier.
+func isMADOutlier(v float64, window []float64, k float64) bool {
+	if len(window) < 3 {
+		return false
+	}
+	median := series.Quantile(window, 0.5)
+	devs := make([]float64, len(window))
+	for i, w := range window {
+		devs[i] = math.Abs(w - median)
+	}
+	return math.Abs(v-median) > k*1.4826*series.Quantile(devs, 0.5)
+}
+
+// madOutliers()
+//
+// Only the values which are outliers in relation to the window
+// preceding them, see isMADOutlier(), the rest is NaN.
+func dslMadOutliers(args map[string]interface{}) (SeriesMap, error) {
+	k := args["k"].(float64)
+	alias := fmt.Sprintf("madOutliers(%%v,%v,%v)", args["windowSize"], k)
+	return movingWindowFunc(args, alias, func(v float64, window []float64) float64 {
+		if isMADOutlier(v, window, k) {
+			return v
+		}
+		return math.NaN()
+	})
+}
+
+// removeOutliers()
+//
+// The opposite of madOutliers(), the outliers become NaN.
+func dslRemoveOutliers(args map[string]interface{}) (SeriesMap, error) {
+	k := args["k"].(float64)
+	alias := fmt.Sprintf("removeOutliers(%%v,%v,%v)", args["windowSize"], k)
+	return movingWindowFunc(args, alias, func(v float64, window []float64) float64 {
+		if isMADOutlier(v, window, k) {
+			return math.NaN()
+		}
+		return v
+	})
+}
+
+// exponentialMovingAverage()
+//
+// The smoothing factor is 2/(windowSize+1), with windowSize in points
+// or as a duration. The average begins with the first value, NaN
+// values leave it unchanged.
+
+type seriesExponentialMovingAverage struct {
+	AliasSeries
+	window *movingWindow
+	ema    float64
+}
+
+func (f *seriesExponentialMovingAverage) Next() bool {
+	if !f.AliasSeries.Next() {
+		f.ema = math.NaN()
+		return false
+	}
+	if v := f.AliasSeries.CurrentValue(); math.IsNaN(f.ema) {
+		f.ema = v
+	} else if !math.IsNaN(v) {
+		alpha := 2 / float64(f.window.points(f.GroupBy())+1)
+		f.ema = alpha*v + (1-alpha)*f.ema
+	}
+	return true
+}
+
+func (f *seriesExponentialMovingAverage) CurrentValue() float64 {
+	return f.ema
+}
+
+func (f *seriesExponentialMovingAverage) Close() error {
+	f.ema = math.NaN()
+	return f.AliasSeries.Close()
+}
+
+func dslExponentialMovingAverage(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	window := args["windowSize"].(string)
+	for name, s := range series {
+		w, err := newMovingWindow(window)
+		if err != nil {
+			return nil, err
+		}
+		s.Alias(fmt.Sprintf("exponentialMovingAverage(%v,%v)", name, window))
+		series[name] = &seriesExponentialMovingAverage{AliasSeries: s, window: w, ema: math.NaN()}
+	}
+	return series, nil
+}
+
+// ewmaBands()
+//
+// For every series an upper and a lower band k standard deviations
+// from the exponentially weighted moving average, the deviation being
+// exponentially weighted as well, with the smoothing factor alpha
+// (0 < alpha <= 1). The bands at a point are computed from the points
+// preceding it, so that a value outside of them is unexpected.
+func dslEwmaBands(args map[string]interface{}) (SeriesMap, error) {
+	sm := args["seriesList"].(SeriesMap)
+	alpha := args["alpha"].(float64)
+	k := args["k"].(float64)
+	if alpha <= 0 || alpha > 1 {
+		return nil, fmt.Errorf("alpha must be greater than 0 and at most 1, not %v", alpha)
+	}
+
+	result := make(SeriesMap, len(sm)*2)
+	for name, s := range sm {
+		data, m := materialize(s)
+		upper, lower := make([]float64, len(data)), make([]float64, len(data))
+		mean, variance := math.NaN(), 0.0
+		for i, v := range data {
+			sd := math.Sqrt(variance)
+			upper[i], lower[i] = mean+k*sd, mean-k*sd
+			if math.IsNaN(v) {
+				continue
+			}
+			if math.IsNaN(mean) {
+				mean = v
+				continue
+			}
+			diff := v - mean
+			mean += alpha * diff
+			variance = (1 - alpha) * (variance + alpha*diff*diff)
+		}
+		us := series.NewSliceSeries(upper, m.start, m.step)
+		us.Alias(fmt.Sprintf("ewmaUpper(%v,%v,%v)", seriesName(name, s), alpha, k))
+		ls := series.NewSliceSeries(lower, m.start, m.step)
+		ls.Alias(fmt.Sprintf("ewmaLower(%v,%v,%v)", seriesName(name, s), alpha, k))
+		result[name+".upper"] = us
+		result[name+".lower"] = ls
+	}
+	return result, nil
+}
+
+// linearFit returns the least squares fit v = a + b*t of the values
+// which are not NaN, where the value at i is at start + i*step and t
+// is in seconds since the epoch. ok is false if there are fewer than
+// 2 values or they are all at the same time.
+func linearFit(data []float64, start time.Time, step time.Duration) (a, b float64, ok bool) {
+	var n, sumT, sumV float64
+	for i, v := range data {
+		if !math.IsNaN(v) {
+			n++
+			sumT += float64(i)
+			sumV += v
+		}
+	}
+	if n < 2 {
+		return 0, 0, false
+	}
+	meanI, meanV := sumT/n, sumV/n
+	var sxy, sxx float64
+	for i, v := range data {
+		if !math.IsNaN(v) {
+			di := float64(i) - meanI
+			sxy += di * (v - meanV)
+			sxx += di * di
+		}
+	}
+	if sxx == 0 {
+		return 0, 0, false
+	}
+	// The fit is computed on the index to avoid losing precision
+	// with large epoch seconds, then converted.
+	bi := sxy / sxx
+	b = bi / step.Seconds()
+	t0 := float64(start.UnixNano())/1e9 + meanI*step.Seconds()
+	return meanV - b*t0, b, true
+}
+
+func fitAt(a, b float64, t time.Time) float64 {
+	return a + b*float64(t.UnixNano())/1e9
+}
+
+// parseSourceTime parses the time arguments of linearRegression(),
+// which are either seconds since the epoch, or relative to now,
+// e.g. "-7d", or empty, in which case dft is returned.
+func parseSourceTime(s string, dft time.Time) (time.Time, error) {
+	if s == "" {
+		return dft, nil
+	}
+	if rel := strings.TrimPrefix(s, "now"); rel == "" || rel[0] == '-' || rel[0] == '+' {
+		d, err := parseTimeShift(rel)
+		return time.Now().Add(d), err
+	}
+	if epoch, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(int64(epoch), 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %q", s)
+}
+
+// linearRegression()
+//
+// Graphite linearRegression(): the line fitted to the series between
+// startSourceAt and endSourceAt (the whole range by default), drawn
+// over the whole range. Series without enough values for a fit are
+// omitted.
+func dslLinearRegression(args map[string]interface{}) (SeriesMap, error) {
+	sm := args["seriesList"].(SeriesMap)
+	from := args["_from_"].(time.Time)
+	to := args["_to_"].(time.Time)
+
+	srcFrom, err := parseSourceTime(args["startSourceAt"].(string), from)
+	if err != nil {
+		return nil, err
+	}
+	srcTo, err := parseSourceTime(args["endSourceAt"].(string), to)
+	if err != nil {
+		return nil, err
+	}
+	if !srcFrom.Before(srcTo) {
+		return nil, fmt.Errorf("startSourceAt (%v) must be before endSourceAt (%v)", srcFrom, srcTo)
+	}
+
+	result := make(SeriesMap, len(sm))
+	for name, s := range sm {
+		if !srcFrom.Equal(from) || !srcTo.Equal(to) {
+			if mp := s.MaxPoints(); mp > 0 && to.After(from) {
+				s.MaxPoints(int64(float64(mp) * srcTo.Sub(srcFrom).Seconds() / to.Sub(from).Seconds()))
+			}
+			s.TimeRange(srcFrom, srcTo)
+		}
+		data, m := materialize(s)
+		a, b, ok := linearFit(data, m.start, m.step)
+		if !ok {
+			continue
+		}
+
+		// Same timestamps as the source, within from and to
+		k := from.Sub(m.start) / m.step
+		first := m.start.Add(k * m.step)
+		if first.Before(from) {
+			first = first.Add(m.step)
+		}
+		line := make([]float64, 0)
+		for t := first; !t.After(to); t = t.Add(m.step) {
+			line = append(line, fitAt(a, b, t))
+		}
+		ls := series.NewSliceSeries(line, first, m.step)
+		ls.Alias(fmt.Sprintf("linearRegression(%s, %d, %d)", seriesName(name, s), srcFrom.Unix(), srcTo.Unix()))
+		result[name] = ls
+	}
+	return result, nil
+}
+
+// forecast()
+//
+// The series with the values after the last one (which is not NaN)
+// forecast either by a linear fit of the series or with Holt-Winters
+// triple exponential smoothing (method "holtwinters", seasonLen is the
+// season length). With a horizon the series is extended that far past
+// the end of the range.
+func dslForecast(args map[string]interface{}) (SeriesMap, error) {
+	sm := args["seriesList"].(SeriesMap)
+	horizon, method := args["horizon"].(string), args["method"].(string)
+	seasonLen := args["seasonLen"].(string)
+
+	var extend, season time.Duration
+	var err error
+	if horizon != "" && horizon != "0" {
+		if extend, err = misc.BetterParseDuration(horizon); err != nil || extend < 0 {
+			return nil, fmt.Errorf("invalid horizon: %q", horizon)
+		}
+	}
+	switch method {
+	case "linear":
+	case "holtwinters":
+		if season, err = misc.BetterParseDuration(seasonLen); err != nil || season <= 0 {
+			return nil, fmt.Errorf("invalid seasonLen: %q", seasonLen)
+		}
+	default:
+		return nil, fmt.Errorf("invalid method: %q (valid methods: linear, holtwinters)", method)
+	}
+
+	for name, s := range sm {
+		data, m := materialize(s)
+		first, last := -1, -1
+		for i, v := range data {
+			if !math.IsNaN(v) {
+				if first == -1 {
+					first = i
+				}
+				last = i
+			}
+		}
+		for i := 0; m.step > 0 && i < int(extend/m.step); i++ {
+			data = append(data, math.NaN())
+		}
+		if last != -1 {
+			if method == "linear" {
+				if a, b, ok := linearFit(data[:last+1], m.start, m.step); ok {
+					for i := last + 1; i < len(data); i++ {
+						data[i] = fitAt(a, b, m.start.Add(time.Duration(i)*m.step))
+					}
+				}
+			} else if err := hwForecast(data, first, last, int(season/m.step)); err != nil {
+				return nil, fmt.Errorf("forecast(): %v: %v", name, err)
+			}
+		}
+		fs := series.NewSliceSeries(data, m.start, m.step)
+		if horizon == "" {
+			fs.Alias(fmt.Sprintf("forecast(%v,%v)", seriesName(name, s), method))
+		} else {
+			fs.Alias(fmt.Sprintf("forecast(%v,%v,%v)", seriesName(name, s), horizon, method))
+		}
+		sm[name] = fs
+	}
+	return sm, nil
+}
+
+// hwForecast replaces data after last with a Holt-Winters forecast
+// based on data from first to last, NaNs in which are replaced by the
+// preceding value.
+func hwForecast(data []float64, first, last, slen int) error {
+	if slen < 1 {
+		return fmt.Errorf("season shorter than the step")
+	}
+	known := make([]float64, last-first+1)
+	for i := range known {
+		if v := data[first+i]; math.IsNaN(v) {
+			known[i] = known[i-1]
+		} else {
+			known[i] = v
+		}
+	}
+	trend, err := series.HWInitialTrendFactor(known, slen)
+	if err != nil {
+		return err
+	}
+	seasonal, err := series.HWInitialSeasonalFactors(known, slen)
+	if err != nil {
+		return err
+	}
+	nPreds := len(data) - last - 1
+	smooth, _, _, _, _, _, _ := series.HWMinimizeSSE(known, slen, trend, seasonal, nPreds)
+	copy(data[last+1:], smooth[len(known):])
+	return nil
+}
+
+// timeToThreshold()
+//
+// When a series is projected (by a linear fit) to reach value: every
+// point is the number of seconds from it to that time, NaN if the
+// series does not reach the value after its last point. With legend
+// the series is unchanged and the projection is in its name.
+func dslTimeToThreshold(args map[string]interface{}) (SeriesMap, error) {
+	sm := args["seriesList"].(SeriesMap)
+	value := args["value"].(float64)
+	legend := args["legend"].(bool)
+
+	for name, s := range sm {
+		data, m := materialize(s)
+		crossing := time.Time{}
+		if a, b, ok := linearFit(data, m.start, m.step); ok && b != 0 {
+			t := (value - a) / b
+			crossing = time.Unix(0, int64(t*1e9))
+			last := -1
+			for i, v := range data {
+				if !math.IsNaN(v) {
+					last = i
+				}
+			}
+			if crossing.Before(m.start.Add(time.Duration(last) * m.step)) {
+				crossing = time.Time{}
+			}
+		}
+
+		if legend {
+			when := "never"
+			if !crossing.IsZero() {
+				when = crossing.UTC().Format(time.RFC3339)
+			}
+			s.Alias(fmt.Sprintf("%s (reaches %v at %s)", seriesName(name, s), value, when))
+			continue
+		}
+		for i := range data {
+			if crossing.IsZero() {
+				data[i] = math.NaN()
+			} else {
+				data[i] = crossing.Sub(m.start.Add(time.Duration(i) * m.step)).Seconds()
+			}
+		}
+		ts := series.NewSliceSeries(data, m.start, m.step)
+		ts.Alias(fmt.Sprintf("timeToThreshold(%v,%v)", seriesName(name, s), value))
+		sm[name] = ts
+	}
+	return sm, nil
+}
+
+// safeSummary is what the Graphite safe*() functions compute for a
+// whole series, None (NaN) values are ignored. If there are no values
+// at all, everything but count and total is NaN.
+type safeSummary struct {
+	count, total        int // values which are not NaN, all values
+	sum, min, max, last float64
+}
+
+func newSafeSummary(s AliasSeries) *safeSummary {
+	ss := &safeSummary{sum: math.NaN(), min: math.NaN(), max: math.NaN(), last: math.NaN()}
+	for s.Next() {
+		ss.total++
+		v := s.CurrentValue()
+		if math.IsNaN(v) {
+			continue
+		}
+		if ss.count == 0 {
+			ss.sum, ss.min, ss.max = 0, v, v
+		}
+		ss.count++
+		ss.sum += v
+		ss.min = math.Min(ss.min, v)
+		ss.max = math.Max(ss.max, v)
+		ss.last = v
+	}
+	s.Close()
+	return ss
+}
+
+func (ss *safeSummary) avg() float64 {
+	return ss.sum / float64(ss.count) // NaN if count is 0
+}
+
+// value returns the value by the name used in legendValue().
+func (ss *safeSummary) value(name string) (float64, bool) {
+	switch name {
+	case "avg":
+		return ss.avg(), true
+	case "total":
+		return ss.sum, true
+	case "min":
+		return ss.min, true
+	case "max":
+		return ss.max, true
+	case "last":
+		return ss.last, true
+	}
+	return math.NaN(), false
+}
+
+// The name under which the series is presented.
+func seriesName(name string, s AliasSeries) string {
+	if alias := s.Alias(); alias != "" {
+		return alias
+	}
+	return name
+}
+
+// averageAbove(), averageBelow(), currentAbove(), currentBelow()
+// As in Graphite, "above" is strictly above, "below" includes n, and
+// series without any values are dropped.
+
+func filterBySummary(args map[string]interface{}, value func(*safeSummary) float64, keep func(v, n float64) bool) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	n := args["n"].(float64)
+	for name, s := range series {
+		if v := value(newSafeSummary(s)); math.IsNaN(v) || !keep(v, n) {
+			delete(series, name)
+		}
+	}
+	return series, nil
+}
+
+func summaryAvg(ss *safeSummary) float64  { return ss.avg() }
+func summaryLast(ss *safeSummary) float64 { return ss.last }
+func summaryMax(ss *safeSummary) float64  { return ss.max }
+func summaryMin(ss *safeSummary) float64  { return ss.min }
+func summarySum(ss *safeSummary) float64  { return ss.sum }
+
+func above(v, n float64) bool { return v > n }
+func below(v, n float64) bool { return v <= n }
+
+func dslAverageAbove(args map[string]interface{}) (SeriesMap, error) {
+	return filterBySummary(args, summaryAvg, above)
+}
+
+func dslAverageBelow(args map[string]interface{}) (SeriesMap, error) {
+	return filterBySummary(args, summaryAvg, below)
+}
+
+func dslCurrentAbove(args map[string]interface{}) (SeriesMap, error) {
+	return filterBySummary(args, summaryLast, above)
+}
+
+func dslCurrentBelow(args map[string]interface{}) (SeriesMap, error) {
+	return filterBySummary(args, summaryLast, below)
+}
+
+// grep()
+
+func dslGrep(args map[string]interface{}) (SeriesMap, error) {
+	result := args["seriesList"].(SeriesMap)
+	reg, err := regexp.Compile(args["pattern"].(string))
+	if err != nil {
+		return nil, err
+	}
+	for name, _ := range result {
+		if !reg.MatchString(name) {
+			delete(result, name)
+		}
+	}
+	return result, nil
+}
+
+// removeEmptySeries()
+
+func dslRemoveEmptySeries(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	xff := args["xFilesFactor"].(float64)
+	for name, s := range series {
+		ss := newSafeSummary(s)
+		if ss.count == 0 || float64(ss.count)/float64(ss.total) < xff {
+			delete(series, name)
+		}
+	}
+	return series, nil
+}
+
+// unique()
+// A SeriesMap cannot have duplicates, combining the lists is enough.
+
+func dslUnique(args map[string]interface{}) (SeriesMap, error) {
+	return args["seriesLists"].(SeriesMap), nil
+}
+
+// stddevSeries()
+
+type seriesStddevSeries struct {
+	*aliasSeriesSlice
+}
+
+func (sl *seriesStddevSeries) CurrentValue() float64 {
+	return sl.StdDev()
+}
+
+func dslStddevSeries(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesLists"].(SeriesMap).toAliasSeriesSlice()
+	name := args["_legend_"].(string)
+	return SeriesMap{name: &seriesStddevSeries{series}}, nil
+}
+
+// sortByMaxima(), sortByMinima(), sortByTotal()
+// Series without any values sort as -Inf, like in Graphite.
+
+func sortBySummary(args map[string]interface{}, value func(*safeSummary) float64, reverse bool) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	keys := series.SortedKeys()
+	values := make(map[string]float64, len(keys))
+	for _, name := range keys {
+		v := value(newSafeSummary(series[name]))
+		if math.IsNaN(v) {
+			v = math.Inf(-1)
+		}
+		values[name] = v
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if reverse {
+			return values[keys[i]] > values[keys[j]]
+		}
+		return values[keys[i]] < values[keys[j]]
+	})
+	return series.positioned(keys), nil
+}
+
+func dslSortByMaxima(args map[string]interface{}) (SeriesMap, error) {
+	return sortBySummary(args, summaryMax, true)
+}
+
+func dslSortByMinima(args map[string]interface{}) (SeriesMap, error) {
+	return sortBySummary(args, summaryMin, false)
+}
+
+func dslSortByTotal(args map[string]interface{}) (SeriesMap, error) {
+	return sortBySummary(args, summarySum, true)
+}
+
+// sortByName()
+
+func dslSortByName(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	natural := args["natural"].(bool)
+	reverse := args["reverse"].(bool)
+	keys := series.SortedKeys()
+	names := make(map[string]string, len(keys))
+	for _, key := range keys {
+		names[key] = seriesName(key, series[key])
+	}
+	less := func(a, b string) bool {
+		if natural {
+			return naturalLess(names[a], names[b])
+		}
+		return names[a] < names[b]
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if reverse {
+			return less(keys[j], keys[i])
+		}
+		return less(keys[i], keys[j])
+	})
+	return series.positioned(keys), nil
+}
+
+var naturalDigits = regexp.MustCompile(`[0-9]+`)
+
+// naturalLess compares the way Graphite natSortKey() does: runs of
+// digits are compared as numbers, everything else case-insensitively.
+func naturalLess(a, b string) bool {
+	ca, cb := naturalChunks(a), naturalChunks(b)
+	for i := 0; i < len(ca) && i < len(cb); i++ {
+		x, y := ca[i], cb[i]
+		if i%2 == 1 { // digits
+			x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+			if len(x) != len(y) {
+				return len(x) < len(y)
+			}
+		} else {
+			x, y = strings.ToLower(x), strings.ToLower(y)
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return len(ca) < len(cb)
+}
+
+// Split s into alternating non-digit and digit chunks, always
+// beginning and ending with a (possibly empty) non-digit one.
+func naturalChunks(s string) []string {
+	locs := naturalDigits.FindAllStringIndex(s, -1)
+	result := make([]string, 0, 2*len(locs)+1)
+	prev := 0
+	for _, loc := range locs {
+		result = append(result, s[prev:loc[0]], s[loc[0]:loc[1]])
+		prev = loc[1]
+	}
+	return append(result, s[prev:])
+}
+
+// cactiStyle()
+
+var unitSystems = map[string][]struct {
+	prefix string
+	size   float64
+}{
+	"si": {{"Y", 1e24}, {"Z", 1e21}, {"E", 1e18}, {"P", 1e15}, {"T", 1e12}, {"G", 1e9}, {"M", 1e6}, {"K", 1e3}},
+	"binary": {{"Yi", 1 << 80}, {"Zi", 1 << 70}, {"Ei", 1 << 60}, {"Pi", 1 << 50}, {"Ti", 1 << 40},
+		{"Gi", 1 << 30}, {"Mi", 1 << 20}, {"Ki", 1 << 10}},
+}
+
+// formatUnits is Graphite format_units(), it scales v to the largest
+// prefix of the unit system which is not greater than v and returns
+// it along with the prefix (followed by units).
+func formatUnits(v float64, system, units string) (float64, string) {
+	for _, u := range unitSystems[system] {
+		if math.Abs(v) >= u.size {
+			v2 := v / u.size
+			if v2-math.Floor(v2) < 0.00000000001 && v > 1 {
+				v2 = math.Floor(v2)
+			}
+			return v2, u.prefix + units
+		}
+	}
+	if v-math.Floor(v) < 0.00000000001 && v > 1 {
+		v = math.Floor(v)
+	}
+	return v, units
+}
+
+func dslCactiStyle(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	system := args["system"].(string)
+	units := args["units"].(string)
+	if _, ok := unitSystems[system]; system != "" && !ok {
+		return nil, fmt.Errorf("cactiStyle(): invalid system: %q (valid: si, binary)", system)
+	}
+
+	format := func(v float64) string {
+		if math.IsNaN(v) {
+			return "nan"
+		}
+		prefix := units
+		if system != "" {
+			v, prefix = formatUnits(v, system, units)
+		}
+		if units != "" {
+			return fmt.Sprintf("%.2f %s", v, prefix)
+		}
+		return fmt.Sprintf("%.2f%s", v, prefix)
+	}
+	// Graphite computes the column widths from int(value or 3)
+	width := func(v float64) int {
+		if math.IsNaN(v) || v == 0 {
+			v = 3
+		}
+		return len(format(math.Trunc(v)))
+	}
+
+	widen := func(l *int, w int) {
+		if w > *l {
+			*l = w
+		}
+	}
+
+	summaries := make(map[string]*safeSummary, len(series))
+	var nameLen, lastLen, maxLen, minLen int
+	for name, s := range series {
+		ss := newSafeSummary(s)
+		summaries[name] = ss
+		widen(&nameLen, len(seriesName(name, s)))
+		widen(&lastLen, width(ss.last)+3)
+		widen(&maxLen, width(ss.max)+3)
+		widen(&minLen, width(ss.min)+3)
+	}
+	for name, s := range series {
+		ss := summaries[name]
+		s.Alias(fmt.Sprintf("%-*s Current:%-*s Max:%-*s Min:%-*s ",
+			nameLen, seriesName(name, s), lastLen, format(ss.last), maxLen, format(ss.max), minLen, format(ss.min)))
+	}
+	return series, nil
+}
+
+// legendValue()
+
+// pyFloat formats v the way Python str() formats a float, NaN is
+// None.
+func pyFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "None"
+	case math.IsInf(v, 1):
+		return "inf"
+	case math.IsInf(v, -1):
+		return "-inf"
+	}
+	if abs := math.Abs(v); abs != 0 && (abs < 1e-4 || abs >= 1e16) {
+		return strconv.FormatFloat(v, 'e', -1, 64)
+	}
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+func dslLegendValue(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	var valueTypes []string
+	for _, vt := range args["valueTypes"].([]interface{}) {
+		valueTypes = append(valueTypes, vt.(string))
+	}
+	var system string
+	if last := valueTypes[len(valueTypes)-1]; last == "si" || last == "binary" {
+		system, valueTypes = last, valueTypes[:len(valueTypes)-1]
+	}
+
+	for name, s := range series {
+		ss := newSafeSummary(s)
+		legend := seriesName(name, s)
+		for _, vt := range valueTypes {
+			v, ok := ss.value(vt)
+			if system == "" {
+				formatted := "(?)"
+				if ok {
+					formatted = pyFloat(v)
+				}
+				legend += fmt.Sprintf(" (%s: %s)", vt, formatted)
+			} else {
+				formatted := "None"
+				if ok && !math.IsNaN(v) {
+					v, prefix := formatUnits(v, system, "")
+					formatted = fmt.Sprintf("%.2f%s", v, prefix)
+				}
+				legend = fmt.Sprintf("%-20s%-5s%-10s", legend, vt, formatted)
+			}
+		}
+		s.Alias(legend)
+	}
+	return series, nil
+}
+
+// substr()
+
+// Python slice bounds: negative indexes count from the end, and
+// everything is clipped to [0, n].
+func pySliceBounds(n, start, stop int) (int, int) {
+	clip := func(i int) int {
+		if i < 0 {
+			i += n
+		}
+		if i < 0 {
+			return 0
+		} else if i > n {
+			return n
+		}
+		return i
+	}
+	start, stop = clip(start), clip(stop)
+	if stop < start {
+		stop = start
+	}
+	return start, stop
+}
+
+func dslSubstr(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	start := int(args["start"].(float64))
+	stop := int(args["stop"].(float64))
+
+	for name, s := range series {
+		legend := seriesName(name, s)
+		// the innermost function argument, e.g. a.b.c,2 in foo(bar(a.b.c,2))
+		left := strings.LastIndex(legend, "(") + 1
+		right := strings.Index(legend, ")")
+		if right < 0 {
+			right = len(legend)
+		}
+		left, right = pySliceBounds(len(legend), left, right)
+		parts := strings.Split(legend[left:right], ".")
+		from, to := pySliceBounds(len(parts), start, len(parts))
+		if stop != 0 {
+			from, to = pySliceBounds(len(parts), start, stop)
+		}
+		legend = strings.Join(parts[from:to], ".")
+		if i := strings.Index(legend, ","); i >= 0 {
+			legend = legend[:i] // drop any other function arguments
+		}
+		s.Alias(legend)
+	}
+	return series, nil
+}
+
+// pow(), squareRoot(), invert(), sigmoid()
+
+// seriesValueFunc is a series with fn applied to every value which is
+// not NaN.
+type seriesValueFunc struct {
+	AliasSeries
+	fn func(float64) float64
+}
+
+func (f *seriesValueFunc) CurrentValue() float64 {
+	value := f.AliasSeries.CurrentValue()
+	if math.IsNaN(value) { // e.g. math.Pow(NaN, 0) is 1
+		return value
+	}
+	return f.fn(value)
+}
+
+// valueFunc wraps every series of sm in a seriesValueFunc, legend is
+// a format with a %s verb for the name.
+func valueFunc(sm SeriesMap, legend string, fn func(float64) float64) SeriesMap {
+	for name, s := range sm {
+		s.Alias(fmt.Sprintf(legend, name))
+		sm[name] = &seriesValueFunc{s, fn}
+	}
+	return sm
+}
+
+func dslPow(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	factor := args["factor"].(float64)
+	return valueFunc(series, fmt.Sprintf("pow(%%s,%v)", factor), func(v float64) float64 {
+		return math.Pow(v, factor)
+	}), nil
+}
+
+func dslSquareRoot(args map[string]interface{}) (SeriesMap, error) {
+	return valueFunc(args["seriesList"].(SeriesMap), "squareRoot(%s)", math.Sqrt), nil
+}
+
+func dslInvert(args map[string]interface{}) (SeriesMap, error) {
+	return valueFunc(args["seriesList"].(SeriesMap), "invert(%s)", func(v float64) float64 {
+		if v == 0 {
+			return math.NaN()
+		}
+		return 1 / v
+	}), nil
+}
+
+func dslSigmoid(args map[string]interface{}) (SeriesMap, error) {
+	return valueFunc(args["seriesList"].(SeriesMap), "sigmoid(%s)", func(v float64) float64 {
+		return 1 / (1 + math.Exp(-v))
+	}), nil
+}
+
+// powSeries()
+
+type seriesPowSeries struct {
+	*aliasSeriesSlice
+}
+
+func (sl *seriesPowSeries) CurrentValue() float64 {
+	var result float64
+	for i, s := range sl.SeriesSlice {
+		value := s.CurrentValue()
+		if math.IsNaN(value) {
+			return value
+		}
+		if i == 0 {
+			result = value
+		} else {
+			result = math.Pow(result, value)
+		}
+	}
+	if math.IsInf(result, 0) { // Graphite gives None on overflow or 0 to a negative power
+		return math.NaN()
+	}
+	return result
+}
+
+func dslPowSeries(args map[string]interface{}) (SeriesMap, error) {
+	// We must use _args_ to preserve the order
+	argsAsSlice := args["_args_"].([]interface{})
+	sl := &aliasSeriesSlice{}
+	for _, arg := range argsAsSlice {
+		if ss, ok := arg.(SeriesMap); ok {
+			sl.SeriesSlice = append(sl.SeriesSlice, ss.toAliasSeriesSlice().SeriesSlice...)
+		} else {
+			return nil, fmt.Errorf("invalid series: %v", arg)
+		}
+	}
+	if len(sl.SeriesSlice) == 0 {
+		return SeriesMap{}, nil
+	}
+	name := args["_legend_"].(string)
+	return SeriesMap{name: &seriesPowSeries{sl}}, nil
+}
+
+// minMax()
+
+type seriesMinMax struct {
+	AliasSeries
+	min, max float64
+	ready    bool
+}
+
+func (f *seriesMinMax) Next() bool {
+	if !f.ready {
+		summary := newAliasSummarySeries(f.AliasSeries)
+		f.min, f.max, f.ready = summary.Min(), summary.Max(), true
+	}
+	return f.AliasSeries.Next()
+}
+
+func (f *seriesMinMax) CurrentValue() float64 {
+	value := f.AliasSeries.CurrentValue()
+	if math.IsNaN(value) || f.max == f.min {
+		return value - value // NaN or 0
+	}
+	return (value - f.min) / (f.max - f.min)
+}
+
+func dslMinMax(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	for name, s := range series {
+		s.Alias(fmt.Sprintf("minMax(%s)", name))
+		series[name] = &seriesMinMax{AliasSeries: s}
+	}
+	return series, nil
+}
+
+// delay()
+// A positive steps moves the values later, a negative one earlier.
+
+func dslDelay(args map[string]interface{}) (SeriesMap, error) {
+	sm := args["seriesList"].(SeriesMap)
+	steps := int(args["steps"].(float64))
+	for name, s := range sm {
+		data, m := materialize(s)
+		delayed := make([]float64, len(data))
+		for i := range delayed {
+			if j := i - steps; j >= 0 && j < len(data) {
+				delayed[i] = data[j]
+			} else {
+				delayed[i] = math.NaN()
+			}
+		}
+		ss := series.NewSliceSeries(delayed, m.start, m.step)
+		ss.Alias(fmt.Sprintf("delay(%s,%d)", seriesName(name, s), steps))
+		sm[name] = ss
+	}
+	return sm, nil
+}
+
+// interpolate()
+// Gaps of no more than limit NaNs between two values are filled in
+// linearly, NaNs at the beginning or the end stay.
+
+func dslInterpolate(args map[string]interface{}) (SeriesMap, error) {
+	sm := args["seriesList"].(SeriesMap)
+	limit := args["limit"].(float64)
+	for name, s := range sm {
+		data, m := materialize(s)
+		last := -1 // last value which is not NaN
+		for i, v := range data {
+			if math.IsNaN(v) {
+				continue
+			}
+			if gap := i - last - 1; last >= 0 && gap > 0 && float64(gap) <= limit {
+				for j := last + 1; j < i; j++ {
+					data[j] = data[last] + (v-data[last])*float64(j-last)/float64(i-last)
+				}
+			}
+			last = i
+		}
+		ss := series.NewSliceSeries(data, m.start, m.step)
+		ss.Alias(fmt.Sprintf("interpolate(%s)", seriesName(name, s)))
+		sm[name] = ss
+	}
+	return sm, nil
+}
+
+// fallbackSeries()
+
+func dslFallbackSeries(args map[string]interface{}) (SeriesMap, error) {
+	if series := args["seriesList"].(SeriesMap); len(series) > 0 {
+		return series, nil
+	}
+	return args["fallback"].(SeriesMap), nil
+}
+
+// timeSlice()
+
+type seriesTimeSlice struct {
+	AliasSeries
+	start, end time.Time
+}
+
+func (f *seriesTimeSlice) CurrentValue() float64 {
+	if t := f.AliasSeries.CurrentTime(); t.Before(f.start) || t.After(f.end) {
+		return math.NaN()
+	}
+	return f.AliasSeries.CurrentValue()
+}
+
+func dslTimeSlice(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	start, err := parseSourceTime(args["startSliceAt"].(string), time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseSourceTime(args["endSliceAt"].(string), time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	for name, s := range series {
+		s.Alias(fmt.Sprintf("timeSlice(%s,%d,%d)", name, start.Unix(), end.Unix()))
+		series[name] = &seriesTimeSlice{s, start, end}
+	}
+	return series, nil
+}
+
+// identity(), timeFunction(), randomWalk()
+
+// generatedSeries returns a series named name with fn of the time of
+// every point between from and to, step seconds apart, unless that
+// is more than maxPoints.
+func generatedSeries(args map[string]interface{}, fn func(t time.Time) float64) (SeriesMap, error) {
+	name := args["name"].(string)
+	secs := args["step"].(float64)
+	from := args["_from_"].(time.Time)
+	to := args["_to_"].(time.Time)
+	maxPoints := args["_maxPoints_"].(int64)
+
+	if secs <= 0 {
+		return nil, fmt.Errorf("step must be positive, not %v", secs)
+	}
+	step := time.Duration(secs * float64(time.Second))
+	if maxPoints > 0 {
+		if min := to.Sub(from) / time.Duration(maxPoints); step < min {
+			step = (min/time.Second + 1) * time.Second
+		}
+	}
+
+	// internally we mark ends of slots, not beginnings
+	start := from.Truncate(step).Add(step)
+	var dps []float64
+	for t := start; !t.After(to); t = t.Add(step) {
+		dps = append(dps, fn(t))
+	}
+
+	ss := series.NewSliceSeries(dps, start, step)
+	ss.Alias(name)
+	return SeriesMap{name: ss}, nil
+}
+
+// timeFunction(name, step) is the time of every point in seconds
+// since the epoch.
+func dslTimeFunction(args map[string]interface{}) (SeriesMap, error) {
+	return generatedSeries(args, func(t time.Time) float64 {
+		return float64(t.Unix())
+	})
+}
+
+// randomWalk(name, step) begins at 0 and changes by a random amount
+// between -0.5 and 0.5 every point.
+func dslRandomWalk(args map[string]interface{}) (SeriesMap, error) {
+	var value float64
+	return generatedSeries(args, func(time.Time) float64 {
+		result := value
+		value += rand.Float64() - 0.5
+		return result
+	})
+}
+
+// integralByInterval()
+// Like integral(), but starting over at every intervalUnit (from the
+// epoch, i.e. midnight UTC for "1d") that a slot begins in.
+
+type seriesIntegralByInterval struct {
+	AliasSeries
+	interval time.Duration
+	bucket   time.Time
+	total    float64
+}
+
+func (f *seriesIntegralByInterval) Next() bool {
+	if !f.AliasSeries.Next() {
+		f.bucket, f.total = time.Time{}, 0
+		return false
+	}
+	step := f.AliasSeries.GroupBy()
+	if step <= 0 {
+		step = f.AliasSeries.Step()
+	}
+	if bucket := f.AliasSeries.CurrentTime().Add(-step).Truncate(f.interval); !bucket.Equal(f.bucket) {
+		f.bucket, f.total = bucket, 0
+	}
+	if value := f.AliasSeries.CurrentValue(); !math.IsNaN(value) {
+		f.total += value
+	}
+	return true
+}
+
+func (f *seriesIntegralByInterval) CurrentValue() float64 {
+	if math.IsNaN(f.AliasSeries.CurrentValue()) {
+		return math.NaN()
+	}
+	return f.total
+}
+
+func dslIntegralByInterval(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	is := args["intervalUnit"].(string)
+	interval, err := misc.BetterParseDuration(is)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid interval: %v", is)
+	}
+	for name, s := range series {
+		s.Alias(fmt.Sprintf("integralByInterval(%s,'%s')", name, is))
+		series[name] = &seriesIntegralByInterval{AliasSeries: s, interval: interval}
+	}
+	return series, nil
+}
+
+// perSecond()
+// For counters: the per second rate of the increase between points.
+// A decrease is a counter wrap if maxValue is given and not below the
+// value, otherwise (e.g. a counter reset) it is NaN.
+
+type seriesPerSecond struct {
+	AliasSeries
+	started  bool
+	last     float64
+	lastTime time.Time
+	maxValue float64
+}
+
+func (f *seriesPerSecond) CurrentValue() float64 {
+	current := f.AliasSeries.CurrentValue()
+	secs := f.AliasSeries.CurrentTime().Sub(f.lastTime).Seconds()
+	if math.IsNaN(f.last) || secs <= 0 {
+		return math.NaN()
+	}
+	diff := current - f.last
+	if diff >= 0 {
+		return diff / secs
+	} else if !math.IsNaN(f.maxValue) && f.maxValue >= current {
+		return ((f.maxValue - f.last) + current + 1) / secs
+	}
+	return math.NaN()
+}
+
+func (f *seriesPerSecond) Next() bool {
+	if f.started {
+		f.last, f.lastTime = f.AliasSeries.CurrentValue(), f.AliasSeries.CurrentTime()
+	}
+	if !f.AliasSeries.Next() {
+		f.started, f.last = false, math.NaN()
+		return false
+	}
+	f.started = true
+	return true
+}
+
+func dslPerSecond(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	maxValue := args["maxValue"].(float64)
+	for name, s := range series {
+		s.Alias(fmt.Sprintf("perSecond(%s)", name))
+		series[name] = &seriesPerSecond{AliasSeries: s, last: math.NaN(), maxValue: maxValue}
+	}
+	return series, nil
+}
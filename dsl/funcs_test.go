@@ -1,14 +1,17 @@
 package dsl
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/jdcio/tgres/rrd"
 	"github.com/jdcio/tgres/serde"
+	"github.com/jdcio/tgres/series"
 )
 
 // TODO: These are happy path tests, need more edge-case testing
@@ -1011,6 +1014,45 @@ func Test_dsl_consolidateBy(t *testing.T) {
 	}
 }
 
+// cfFetcher records the CF FetchSeries is asked for
+type cfFetcher struct {
+	compatFetcher
+	cfs map[string]rrd.Consolidation
+}
+
+func (f *cfFetcher) FetchSeries(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	f.cfs[ds.(*compatDS).name] = serde.ConsolidationFromContext(ctx)
+	return f.compatFetcher.FetchSeries(ctx, ds, from, to, maxPoints)
+}
+
+// consolidateBy picks the RRA
+func Test_dsl_consolidateBy_cf(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	db := &cfFetcher{compatFetcher: compatFetcher{start: start, step: time.Minute, data: map[string][]float64{
+		"a": {1, 2}, "b": {3, 4},
+	}}}
+	for _, c := range []struct {
+		target string
+		expect map[string]rrd.Consolidation
+	}{
+		{"sumSeries(a, b)", map[string]rrd.Consolidation{"a": rrd.WMEAN, "b": rrd.WMEAN}},
+		{"consolidateBy(a, 'max')", map[string]rrd.Consolidation{"a": rrd.MAX}},
+		{"consolidateBy(scale(a, 2), sum)", map[string]rrd.Consolidation{"a": rrd.SUM}},
+		{"sumSeries(consolidateBy(a, 'min'), b)", map[string]rrd.Consolidation{"a": rrd.MIN, "b": rrd.WMEAN}},
+		{"consolidateBy(sumSeries(consolidateBy(a, 'first'), b), 'stddev')", map[string]rrd.Consolidation{"a": rrd.FIRST, "b": rrd.STDDEV}},
+		{"group(a).consolidateBy('count')", map[string]rrd.Consolidation{"a": rrd.COUNT}},
+	} {
+		db.cfs = make(map[string]rrd.Consolidation)
+		if _, err := ParseDsl(db, c.target, start, start.Add(2*time.Minute), 0); err != nil {
+			t.Errorf("%s: %v", c.target, err)
+			continue
+		}
+		if !reflect.DeepEqual(db.cfs, c.expect) {
+			t.Errorf("%s: expected %v, got %v", c.target, c.expect, db.cfs)
+		}
+	}
+}
+
 // summarize
 func Test_dsl_summarize(t *testing.T) {
 	td := setupTestData()
@@ -1022,3 +1064,828 @@ func Test_dsl_summarize(t *testing.T) {
 		t.Errorf("Unexpected value: %v", unexpected)
 	}
 }
+
+// summarize with calendar intervals, smartSummarize
+func Test_dsl_summarizeCalendar(t *testing.T) {
+	ones := func(n int) []float64 {
+		result := make([]float64, n)
+		for i := range result {
+			result[i] = 1
+		}
+		return result
+	}
+	day := float64(86400)
+
+	for _, c := range []struct {
+		expr     string
+		step     time.Duration
+		points   int
+		start    string // the first slot
+		from, to string
+		times    []string
+		values   []float64
+	}{
+		// months of different lengths
+		{"summarize(x, '1mon', 'sum')", 24 * time.Hour, 90, "2017-01-01T00:00:00Z", "2017-01-01T00:00:00Z", "2017-04-01T00:00:00Z",
+			[]string{"2017-02-01T00:00:00Z", "2017-03-01T00:00:00Z", "2017-04-01T00:00:00Z"},
+			[]float64{31 * day, 28 * day, 31 * day}},
+		{"summarize(x, '1mon', 'avg')", 24 * time.Hour, 90, "2017-01-01T00:00:00Z", "2017-01-01T00:00:00Z", "2017-04-01T00:00:00Z",
+			[]string{"2017-02-01T00:00:00Z", "2017-03-01T00:00:00Z", "2017-04-01T00:00:00Z"},
+			[]float64{1, 1, 1}},
+		// weeks begin on Monday, 2017-01-01 is a Sunday
+		{"summarize(x, '1w')", 24 * time.Hour, 15, "2017-01-01T00:00:00Z", "2017-01-01T00:00:00Z", "2017-01-16T00:00:00Z",
+			[]string{"2017-01-02T00:00:00Z", "2017-01-09T00:00:00Z", "2017-01-16T00:00:00Z"},
+			[]float64{day, 7 * day, 7 * day}},
+		// local days, the second one is 23 hours long (DST)
+		{"summarize(x, '1d', 'sum', false, 'America/New_York')", time.Hour, 47, "2017-03-11T05:00:00Z", "2017-03-11T05:00:00Z", "2017-03-13T04:00:00Z",
+			[]string{"2017-03-12T05:00:00Z", "2017-03-13T04:00:00Z"},
+			[]float64{24 * 3600, 23 * 3600}},
+		{"summarize(x, '1d', tz='America/New_York')", time.Hour, 47, "2017-03-11T05:00:00Z", "2017-03-11T05:00:00Z", "2017-03-13T04:00:00Z",
+			[]string{"2017-03-12T05:00:00Z", "2017-03-13T04:00:00Z"},
+			[]float64{24 * 3600, 23 * 3600}},
+		// intervals begin at from, the last one only has half a day of data
+		{"summarize(x, '1d', 'sum', true)", time.Hour, 48, "2017-01-01T00:00:00Z", "2017-01-01T12:00:00Z", "2017-01-03T00:00:00Z",
+			[]string{"2017-01-02T12:00:00Z", "2017-01-03T12:00:00Z"},
+			[]float64{day, day / 2}},
+		// a slot longer than the interval is spread across intervals
+		{"summarize(x, '6h', 'sum')", 24 * time.Hour, 1, "2017-01-01T00:00:00Z", "2017-01-01T00:00:00Z", "2017-01-02T00:00:00Z",
+			[]string{"2017-01-01T06:00:00Z", "2017-01-01T12:00:00Z", "2017-01-01T18:00:00Z", "2017-01-02T00:00:00Z"},
+			[]float64{day / 4, day / 4, day / 4, day / 4}},
+		// the first interval begins at midnight, not at from
+		{"smartSummarize(x, '1d')", time.Hour, 48, "2017-01-01T00:00:00Z", "2017-01-01T12:00:00Z", "2017-01-03T00:00:00Z",
+			[]string{"2017-01-02T00:00:00Z", "2017-01-03T00:00:00Z"},
+			[]float64{day, day}},
+		{"smartSummarize(x, '1d', 'max', '1mon')", time.Hour, 72, "2017-01-01T00:00:00Z", "2017-01-02T12:00:00Z", "2017-01-04T00:00:00Z",
+			[]string{"2017-01-02T00:00:00Z", "2017-01-03T00:00:00Z", "2017-01-04T00:00:00Z"},
+			[]float64{1, 1, 1}},
+	} {
+		parse := func(s string) time.Time {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				panic(err)
+			}
+			return t
+		}
+		// points are marked with the end of their slot
+		db := &compatFetcher{
+			start: parse(c.start).Add(c.step),
+			step:  c.step,
+			data:  map[string][]float64{"x": ones(c.points)},
+		}
+		sm, err := ParseDsl(db, c.expr, parse(c.from), parse(c.to), 0)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		for _, s := range sm {
+			var n int
+			for s.Next() {
+				if n < len(c.times) {
+					if tm := s.CurrentTime(); !tm.Equal(parse(c.times[n])) {
+						t.Errorf("%s: point %d: expected time %s, got %v", c.expr, n, c.times[n], tm.UTC())
+					}
+					if v := s.CurrentValue(); math.Abs(v-c.values[n]) > 1e-6 {
+						t.Errorf("%s: point %d: expected %v, got %v", c.expr, n, c.values[n], v)
+					}
+				}
+				n++
+			}
+			if n != len(c.times) {
+				t.Errorf("%s: expected %d points, got %d", c.expr, len(c.times), n)
+			}
+		}
+	}
+
+	for _, expr := range []string{
+		"summarize(x, '1d', 'median')",
+		"summarize(x, '1d', 'sum', false, 'Nowhere/Special')",
+		"summarize(x, '0d')",
+		"smartSummarize(x, '1d', 'sum', 'bogus')",
+	} {
+		if _, err := ParseDsl(&compatFetcher{data: map[string][]float64{"x": nil}}, expr, time.Now().Add(-time.Hour), time.Now(), 0); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
+
+// createTestDS creates a DS with a single 1 minute RRA spanning an
+// hour up to td.when, every data point set to v.
+func createTestDS(td *testData, name string, v float64) error {
+	rspec := rrd.RRASpec{
+		Function: rrd.WMEAN,
+		Step:     time.Minute,
+		Span:     time.Hour,
+		Latest:   td.when,
+		DPs:      make(map[int64]float64),
+	}
+	for i := int64(0); i < rspec.Span.Nanoseconds()/rspec.Step.Nanoseconds(); i++ {
+		rspec.DPs[i] = v
+	}
+	spec := &rrd.DSSpec{
+		Step: time.Second,
+		RRAs: []rrd.RRASpec{rspec},
+	}
+	if _, err := td.db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec); err != nil {
+		return err
+	}
+	// the name cache only loads by itself when empty
+	td.rcache.(*namedDsFetcher).Preload()
+	return nil
+}
+
+// ParseDslContext limits and cancellation
+func Test_dsl_ParseDslContext(t *testing.T) {
+	td := setupTestData()
+	for _, name := range []string{"limits.a", "limits.b", "limits.c"} {
+		if err := createTestDS(td, name, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sm, err := ParseDslContext(context.Background(), td.rcache, `sumSeries("limits.*")`, td.from, td.to, 100, 3)
+	if err != nil {
+		t.Error(err)
+	}
+	if ok, unexpected := checkEveryValueIs(sm, 3); !ok {
+		t.Errorf("Unexpected value: %v", unexpected)
+	}
+
+	_, err = ParseDslContext(context.Background(), td.rcache, `sumSeries("limits.*")`, td.from, td.to, 100, 2)
+	if le, ok := err.(*LimitError); !ok || le.What != "series" || le.Limit != 2 {
+		t.Errorf("Expected a series *LimitError, got: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ParseDslContext(ctx, td.rcache, `sumSeries("limits.*")`, td.from, td.to, 100, 0)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+
+	// What was fetched before the limit was hit is closed
+	cf := &closeCountingFetcher{ctxDSFetcher: td.rcache}
+	_, err = ParseDslContext(context.Background(), cf, `sumSeries("limits.a", "limits.*")`, td.from, td.to, 100, 3)
+	if _, ok := err.(*LimitError); !ok {
+		t.Errorf("Expected a *LimitError, got: %v", err)
+	}
+	if cf.fetched != 1 || cf.closed != 1 {
+		t.Errorf("Expected 1 series fetched and closed, got %d fetched, %d closed", cf.fetched, cf.closed)
+	}
+	cf.fetched, cf.closed = 0, 0
+	if _, err = ParseDslContext(context.Background(), cf, `sumSeries("limits.*")`, td.from, td.to, 100, 3); err != nil {
+		t.Error(err)
+	}
+	if cf.fetched != 3 || cf.closed != 0 {
+		t.Errorf("Expected 3 series fetched and none closed, got %d fetched, %d closed", cf.fetched, cf.closed)
+	}
+}
+
+type closeCountingFetcher struct {
+	ctxDSFetcher
+	fetched, closed int
+}
+
+func (f *closeCountingFetcher) FetchSeries(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	s, err := f.ctxDSFetcher.FetchSeries(ctx, ds, from, to, maxPoints)
+	f.fetched++
+	return &closeCountingSeries{s, f}, err
+}
+
+type closeCountingSeries struct {
+	series.Series
+	f *closeCountingFetcher
+}
+
+func (s *closeCountingSeries) Close() error {
+	s.f.closed++
+	return s.Series.Close()
+}
+
+// ExplainDsl
+func Test_dsl_ExplainDsl(t *testing.T) {
+	td := setupTestData()
+	for _, name := range []string{"explain.a", "explain.b"} {
+		if err := createTestDS(td, name, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sm, ex, err := ExplainDsl(context.Background(), td.rcache, `scale(sumSeries("explain.*"), 2)`, td.from, td.to, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, unexpected := checkEveryValueIs(sm, 4); !ok {
+		t.Errorf("Unexpected value: %v", unexpected)
+	}
+
+	root := ex.Root
+	if root == nil || root.Func != "scale" || len(root.Children) != 1 {
+		t.Fatalf("Unexpected root: %#v", root)
+	}
+	child := root.Children[0]
+	if child.Func != "sumSeries" || len(child.Fetches) != 2 {
+		t.Fatalf("Unexpected child: %#v", child)
+	}
+	for _, f := range child.Fetches {
+		if f.RRA == nil || f.RRA.CF != "WMEAN" || f.RRA.Step != "1m0s" {
+			t.Errorf("Unexpected RRA: %#v", f.RRA)
+		}
+	}
+	if root.Points() == 0 || root.Points() != child.Points() {
+		t.Errorf("Unexpected point counts: root %d, child %d", root.Points(), child.Points())
+	}
+
+	// calls in an applyByNode() template are children of applyByNode()
+	_, ex, err = ExplainDsl(context.Background(), td.rcache, `applyByNode("explain.*", 1, "scale(%, 2)")`, td.from, td.to, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root = ex.Root
+	if root == nil || root.Func != "applyByNode" || len(root.Children) != 2 {
+		t.Fatalf("Unexpected applyByNode root: %#v", root)
+	}
+	for _, child := range root.Children {
+		if child.Func != "scale" || len(child.Fetches) != 1 {
+			t.Errorf("Unexpected applyByNode child: %#v", child)
+		}
+	}
+}
+
+// mapSeries
+// reduceSeries
+// applyByNode
+// aggregateWithWildcards
+func Test_dsl_mapReduce(t *testing.T) {
+	td := setupTestData()
+	for name, v := range map[string]float64{
+		"app.h1.hits": 30, "app.h1.misses": 10,
+		"app.h2.hits": 10, "app.h2.misses": 10} {
+		if err := createTestDS(td, name, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sm, err := ParseDsl(td.rcache, `mapSeries("app.*.*", 1)`, td.from, td.to, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, groups := sm.Groups()
+	if len(keys) != 2 || keys[0] != "h1" || len(groups["h1"]) != 2 || len(groups["h2"]) != 2 {
+		t.Errorf("Unexpected groups: %v %v", keys, groups)
+	}
+
+	expected := map[string]float64{"app.h1.reduce.divideSeries": 3, "app.h2.reduce.divideSeries": 1}
+	sm, err = ParseDsl(td.rcache, `reduceSeries(mapSeries("app.*.*", 1), "divideSeries", 2, "hits", "misses")`, td.from, td.to, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sm) != len(expected) {
+		t.Errorf("Unexpected series: %v", sm.SortedKeys())
+	}
+	for name, v := range expected {
+		if ok, unexpected := checkEveryValueIs(SeriesMap{name: sm[name]}, v); sm[name] == nil || !ok {
+			t.Errorf("%s: Unexpected value: %v", name, unexpected)
+		}
+	}
+
+	expected = map[string]float64{"app.h1.ratio": 3, "app.h2.ratio": 1}
+	sm, err = ParseDsl(td.rcache, `applyByNode("app.*.hits", 1, "divideSeries(%.hits, %.misses)", "%.ratio")`, td.from, td.to, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sm) != len(expected) {
+		t.Errorf("Unexpected series: %v", sm.SortedKeys())
+	}
+	for name, v := range expected {
+		if ok, unexpected := checkEveryValueIs(SeriesMap{name: sm[name]}, v); sm[name] == nil || !ok {
+			t.Errorf("%s: Unexpected value: %v", name, unexpected)
+		}
+	}
+
+	sm, err = ParseDsl(td.rcache, `aggregateWithWildcards(scale("app.*.hits", 2), "sum", 1)`, td.from, td.to, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, unexpected := checkEveryValueIs(SeriesMap{"app.hits": sm["app.hits"]}, 80); sm["app.hits"] == nil || !ok {
+		t.Errorf("Unexpected value: %v (%v)", unexpected, sm.SortedKeys())
+	}
+}
+
+// infix operators
+func Test_dsl_infix(t *testing.T) {
+	td := setupTestData()
+	for name, v := range map[string]float64{
+		"infix.a.rx": 10, "infix.b.rx": 20, "infix.a.tx": 2, "infix.b.tx": 4, "infix.zero.none": 0,
+	} {
+		if err := createTestDS(td, name, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		target string
+		expect map[string]float64 // series name -> every value
+	}{
+		{"infix.a.rx * 2 + 1", map[string]float64{"infix.a.rx * 2 + 1": 21}},
+		{"1 + infix.a.rx * 2", map[string]float64{"1 + infix.a.rx * 2": 21}},
+		{"(1 + infix.a.rx) * 2", map[string]float64{"(1 + infix.a.rx) * 2": 22}},
+		{"((infix.a.rx - 1)) / (1 + 2)", map[string]float64{"(infix.a.rx - 1) / 3": 3}},
+		{"infix.a.rx - -2", map[string]float64{"infix.a.rx - -2": 12}},
+		{"-2 * 3 + infix.a.rx", map[string]float64{"-6 + infix.a.rx": 4}},
+		{"scale(infix.a.rx, 60 * 60)", map[string]float64{"scale(infix.a.rx,3600)": 36000}},
+		{"infix.*.rx > 15", map[string]float64{"infix.a.rx > 15": 0, "infix.b.rx > 15": 1}},
+		{"'infix.*.rx' > 15", map[string]float64{"infix.a.rx > 15": 0, "infix.b.rx > 15": 1}},
+		{"infix.*.rx / infix.*.tx", map[string]float64{
+			"infix.a.rx / infix.a.tx": 5, "infix.b.rx / infix.b.tx": 5}},
+		{"infix.*.rx - infix.a.tx", map[string]float64{
+			"infix.a.rx - infix.a.tx": 8, "infix.b.rx - infix.a.tx": 18}},
+		{"infix.a.tx * group(infix.*.rx)", map[string]float64{
+			"infix.a.tx * infix.a.rx": 20, "infix.a.tx * infix.b.rx": 40}},
+		{"group(infix.*.rx) == group(infix.b.rx, infix.a.rx)", map[string]float64{
+			"infix.a.rx == infix.a.rx": 1, "infix.b.rx == infix.b.rx": 1}},
+		{"sumSeries('infix.*.rx') / infix.zero.none", map[string]float64{"sumSeries(infix.*.rx) / infix.zero.none": math.NaN()}},
+		{"removeBelowValue(infix.a.rx, 100) + infix.a.tx", map[string]float64{
+			"removeBelowValue(infix.a.rx,100) + infix.a.tx": math.NaN()}},
+		{"removeBelowValue(infix.a.rx, 100) >= 0", map[string]float64{
+			"removeBelowValue(infix.a.rx,100) >= 0": math.NaN()}},
+	} {
+		sm, err := ParseDsl(td.rcache, c.target, td.from, td.to, 100)
+		if err != nil {
+			t.Errorf("%s: %v", c.target, err)
+			continue
+		}
+		if len(sm) != len(c.expect) {
+			t.Errorf("%s: expected %d series, got %v", c.target, len(c.expect), sm.SortedKeys())
+			continue
+		}
+		for key, s := range sm {
+			expect, ok := c.expect[seriesName(key, s)]
+			if !ok {
+				t.Errorf("%s: unexpected series %q", c.target, seriesName(key, s))
+				continue
+			}
+			n := 0
+			for s.Next() {
+				v := s.CurrentValue()
+				if v != expect && !(math.IsNaN(v) && math.IsNaN(expect)) {
+					t.Errorf("%s: %s: expected %v, got %v", c.target, seriesName(key, s), expect, v)
+					break
+				}
+				n++
+			}
+			if n == 0 {
+				t.Errorf("%s: %s: no data points", c.target, seriesName(key, s))
+			}
+		}
+	}
+
+	for _, target := range []string{
+		"infix.a.rx % 2",         // unsupported operator
+		"1 + infix(\"+\", 1, 2)", // no series
+		"infix.a.rx && infix.a.tx",
+		"infix.a.rx * '2'", // a string is not a number
+		"infix.a.rx * (\"2\")",
+	} {
+		if _, err := ParseDsl(td.rcache, target, td.from, td.to, 100); err == nil {
+			t.Errorf("%s: expected an error", target)
+		}
+	}
+
+	// Series without a pair are closed
+	for _, name := range []string{"pair.a.rx", "pair.b.rx", "pair.c.rx", "pair.a.tx", "pair.b.tx"} {
+		if err := createTestDS(td, name, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cf := &closeCountingFetcher{ctxDSFetcher: td.rcache}
+	sm, err := ParseDsl(cf, "pair.*.rx / pair.*.tx", td.from, td.to, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sm) != 2 || cf.fetched != 5 || cf.closed != 1 {
+		t.Errorf("Expected 2 series, 5 fetched and 1 closed, got %v, %d fetched, %d closed", sm.SortedKeys(), cf.fetched, cf.closed)
+	}
+}
+
+// zScore, madOutliers, removeOutliers, exponentialMovingAverage, ewmaBands
+func Test_dsl_anomaly(t *testing.T) {
+	nan := math.NaN()
+	start := time.Unix(1500000000, 0)
+	db := &compatFetcher{start: start, step: time.Minute, data: map[string][]float64{
+		"spike": {1, 2, 3, 4, 100},
+		"mad":   {1, 2, 1, 2, 1, 50, 1},
+		"ema":   {2, 4, nan, 8},
+		"ewma":  {2, 4, 4},
+	}}
+	for _, c := range []struct {
+		target string
+		expect map[string][]float64
+	}{
+		{"zScore(spike, 3)", map[string][]float64{"spike": {nan, nan, 1.5 / math.Sqrt(0.5), 2, 97}}},
+		{"zScore(spike, '3min')", map[string][]float64{"spike": {nan, nan, 1.5 / math.Sqrt(0.5), 2, 97}}},
+		{"madOutliers(mad, 4)", map[string][]float64{"mad": {nan, nan, nan, 2, nan, 50, nan}}},
+		{"removeOutliers(mad, 4)", map[string][]float64{"mad": {1, 2, 1, nan, 1, nan, 1}}},
+		{"removeOutliers(mad, 4, 100)", map[string][]float64{"mad": {1, 2, 1, nan, 1, 50, 1}}},
+		{"exponentialMovingAverage(ema, 3)", map[string][]float64{"ema": {2, 3, 3, 5.5}}},
+		{"ewmaBands(ewma, 0.5, 2)", map[string][]float64{
+			"ewma.upper": {nan, 2, 5},
+			"ewma.lower": {nan, 2, 1},
+		}},
+	} {
+		n := len(db.data[strings.SplitN(strings.SplitN(c.target, "(", 2)[1], ",", 2)[0]])
+		sm, err := ParseDsl(db, c.target, start, start.Add(time.Duration(n)*time.Minute), 100)
+		if err != nil {
+			t.Errorf("%s: %v", c.target, err)
+			continue
+		}
+		if len(sm) != len(c.expect) {
+			t.Errorf("%s: expected %d series, got %v", c.target, len(c.expect), sm.SortedKeys())
+			continue
+		}
+		for name, expect := range c.expect {
+			s := sm[name]
+			if s == nil {
+				t.Errorf("%s: missing %s in %v", c.target, name, sm.SortedKeys())
+				continue
+			}
+			var got []float64
+			for s.Next() {
+				got = append(got, s.CurrentValue())
+			}
+			same := len(got) == len(expect)
+			for i := 0; same && i < len(got); i++ {
+				same = got[i] == expect[i] || math.IsNaN(got[i]) && math.IsNaN(expect[i])
+			}
+			if !same {
+				t.Errorf("%s: %s: expected %v, got %v", c.target, name, expect, got)
+			}
+		}
+	}
+
+	for _, target := range []string{"zScore(spike, 'x')", "zScore(spike, 0)", "ewmaBands(ewma, 0)", "ewmaBands(ewma, 1.5)"} {
+		if _, err := ParseDsl(db, target, start, start.Add(time.Hour), 100); err == nil {
+			t.Errorf("%s: expected an error", target)
+		}
+	}
+}
+
+// linearRegression, forecast, timeToThreshold
+func Test_dsl_regression(t *testing.T) {
+	nan := math.NaN()
+	start := time.Unix(1500000000, 0)
+	db := &compatFetcher{start: start, step: time.Minute, data: map[string][]float64{
+		"disk":   {10, 20, 30, nan, 50},
+		"grow":   {1, 2, nan, nan},
+		"season": {1, 2, 3, 2, 1, 2, 3, 2, 1, 2, 3, 2, 1, 2, 3, 2},
+	}}
+	to := start.Add(4 * time.Minute)
+	values := func(s AliasSeries) []float64 {
+		var result []float64
+		for s.Next() {
+			result = append(result, s.CurrentValue())
+		}
+		return result
+	}
+	same := func(a, b []float64) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if math.Abs(a[i]-b[i]) > 1e-6 && !(math.IsNaN(a[i]) && math.IsNaN(b[i])) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, c := range []struct {
+		target, name string
+		expect       []float64
+	}{
+		{"linearRegression(disk)", "linearRegression(disk, 1500000000, 1500000240)", []float64{10, 20, 30, 40, 50}},
+		{"linearRegression(disk, 1500000000, 1500000120)", "linearRegression(disk, 1500000000, 1500000120)", []float64{10, 20, 30, 40, 50}},
+		{"forecast(disk)", "forecast(disk,linear)", []float64{10, 20, 30, nan, 50}},
+		{"forecast(disk, '3min')", "forecast(disk,3min,linear)", []float64{10, 20, 30, nan, 50, 60, 70, 80}},
+		{"forecast(grow)", "forecast(grow,linear)", []float64{1, 2, 3, 4}},
+		{"timeToThreshold(disk, 100)", "timeToThreshold(disk,100)", []float64{540, 480, 420, 360, 300}},
+		{"timeToThreshold(disk, 5)", "timeToThreshold(disk,5)", []float64{nan, nan, nan, nan, nan}},
+		{"timeToThreshold(disk, 100, true)", "disk (reaches 100 at 2017-07-14T02:49:00Z)", []float64{10, 20, 30, nan, 50}},
+		{"timeToThreshold(disk, 5, true)", "disk (reaches 5 at never)", []float64{10, 20, 30, nan, 50}},
+	} {
+		sm, err := ParseDsl(db, c.target, start, to, 100)
+		if err != nil {
+			t.Errorf("%s: %v", c.target, err)
+			continue
+		}
+		if len(sm) != 1 {
+			t.Errorf("%s: expected 1 series, got %v", c.target, sm.SortedKeys())
+			continue
+		}
+		for name, s := range sm {
+			if got := seriesName(name, s); got != c.name {
+				t.Errorf("%s: expected name %q, got %q", c.target, c.name, got)
+			}
+			if got := values(s); !same(got, c.expect) {
+				t.Errorf("%s: expected %v, got %v", c.target, c.expect, got)
+			}
+		}
+	}
+
+	sm, err := ParseDsl(db, "forecast(season, '8min', 'holtwinters', '4min')", start, start.Add(15*time.Minute), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := values(sm["season"])
+	if len(got) != 24 {
+		t.Fatalf("holtwinters: expected 24 points, got %v", got)
+	}
+	for i, v := range got[16:] {
+		if expect := db.data["season"][i%4]; math.Abs(v-expect) > expect*0.2 {
+			t.Errorf("holtwinters: expected about %v at %d, got %v", expect, i+16, v)
+		}
+	}
+
+	for _, target := range []string{
+		"linearRegression(disk, 'x')",
+		"linearRegression(disk, 1500000240, 1500000000)",
+		"forecast(disk, 'x')",
+		"forecast(disk, '1h', 'magic')",
+		"forecast(disk, '1h', 'holtwinters')", // not two seasons of data
+	} {
+		if _, err := ParseDsl(db, target, start, to, 100); err == nil {
+			t.Errorf("%s: expected an error", target)
+		}
+	}
+}
+
+// histogramQuantile, histogramHeatmap
+func Test_dsl_histogram(t *testing.T) {
+	nan := math.NaN()
+	start := time.Unix(1500000000, 0)
+	db := &compatFetcher{start: start, step: time.Minute, data: map[string][]float64{
+		"a.lat.le_100":  {0, 10, 10, nan},
+		"a.lat.le_0_5":  {0, 0, 5, nan},
+		"a.lat.le_200":  {0, 20, 10, nan},
+		"a.lat.le_inf":  {0, 20, 30, nan},
+		"b.lat.le_100":  {5, 5, 5, 5},
+		"b.lat.le_inf":  {10, 10, 10, 10},
+		"c.lat.bucket1": {1, 2, 3, 4},
+		"c.lat.bucket2": {2, 4, 6, 8},
+	}, tags: map[string]serde.Ident{
+		"c.lat.bucket1": {"le": "10"},
+		"c.lat.bucket2": {"le": "+Inf"},
+	}}
+	for _, c := range []struct {
+		target string
+		expect map[string][]float64
+	}{
+		{"histogramQuantile(0.5, a.lat.*, 2)", map[string][]float64{"a.lat": {nan, 100, 200, nan}}},
+		{"histogramQuantile(0.9, *.lat.le_*, 2)", map[string][]float64{
+			"a.lat": {nan, 100 + 100*0.8, 200, nan},
+			"b.lat": {100, 100, 100, 100},
+		}},
+		{"histogramQuantile(0.25, b.lat.*, 2)", map[string][]float64{"b.lat": {50, 50, 50, 50}}},
+		{"histogramQuantile(0.5, c.lat.*, 'le')", map[string][]float64{"c.lat.*": {10, 10, 10, 10}}},
+		{"histogramHeatmap(b.lat.*, 2)", map[string][]float64{
+			"100":  {5, 5, 5, 5},
+			"+Inf": {5, 5, 5, 5},
+		}},
+		{"histogramHeatmap(*.lat.le_*, 2)", map[string][]float64{
+			"0.5":  {0, 0, 5, nan},
+			"100":  {5, 15, 10, nan},
+			"200":  {0, 10, 0, nan},
+			"+Inf": {5, 5, 25, nan},
+		}},
+	} {
+		sm, err := ParseDsl(db, c.target, start, start.Add(4*time.Minute), 100)
+		if err != nil {
+			t.Errorf("%s: %v", c.target, err)
+			continue
+		}
+		if len(sm) != len(c.expect) {
+			t.Errorf("%s: expected %d series, got %v", c.target, len(c.expect), sm.SortedKeys())
+			continue
+		}
+		for name, expect := range c.expect {
+			s := sm[name]
+			if s == nil {
+				t.Errorf("%s: missing %s in %v", c.target, name, sm.SortedKeys())
+				continue
+			}
+			var got []float64
+			for s.Next() {
+				got = append(got, s.CurrentValue())
+			}
+			same := len(got) == len(expect)
+			for i := 0; same && i < len(got); i++ {
+				same = math.Abs(got[i]-expect[i]) < 1e-9 || math.IsNaN(got[i]) && math.IsNaN(expect[i])
+			}
+			if !same {
+				t.Errorf("%s: %s: expected %v, got %v", c.target, name, expect, got)
+			}
+		}
+	}
+
+	sm, err := ParseDsl(db, "histogramHeatmap(a.lat.*, 2)", start, start.Add(4*time.Minute), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := strings.Join(sm.SortedKeys(), " "); keys != "0.5 100 200 +Inf" {
+		t.Errorf("histogramHeatmap: expected buckets sorted by bound, got %s", keys)
+	}
+
+	for _, target := range []string{
+		"histogramQuantile(1.5, a.lat.*, 2)",
+		"histogramQuantile(0.5, a.lat.*, 'le')",
+		"histogramQuantile(0.5, a.lat.*, 1)",
+		"histogramQuantile(0.5, a.lat.*, 5)",
+	} {
+		if _, err := ParseDsl(db, target, start, start.Add(time.Hour), 100); err == nil {
+			t.Errorf("%s: expected an error", target)
+		}
+	}
+}
+
+// sketchFetcher serves SKETCH RRAs built from lists of values per slot
+type sketchFetcher struct {
+	compatFetcher
+	rras map[string]rrd.RoundRobinArchiver
+}
+
+func (f *sketchFetcher) FetchSketches(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (rrd.RoundRobinArchiver, error) {
+	return f.rras[ds.(*compatDS).name], nil
+}
+
+func sketchRRA(latest time.Time, slots map[time.Time][2]int) rrd.RoundRobinArchiver {
+	sks := make(map[int64]*rrd.Sketch)
+	for end, r := range slots {
+		sk := rrd.NewSketch(rrd.SketchAccuracy)
+		for v := r[0]; v <= r[1]; v++ {
+			sk.Add(float64(v))
+		}
+		sks[rrd.SlotIndex(end, time.Minute, 10)] = sk
+	}
+	return rrd.NewRoundRobinArchive(rrd.RRASpec{Function: rrd.SKETCH, Step: time.Minute, Span: 10 * time.Minute, Latest: latest, Sketches: sks})
+}
+
+// sketchQuantile
+func Test_dsl_sketchQuantile(t *testing.T) {
+	nan := math.NaN()
+	start := time.Unix(1500000000, 0)
+	db := &sketchFetcher{
+		compatFetcher: compatFetcher{start: start, step: time.Minute, data: map[string][]float64{"a": nil, "b": nil}},
+		rras: map[string]rrd.RoundRobinArchiver{
+			"a": sketchRRA(start.Add(3*time.Minute), map[time.Time][2]int{
+				start.Add(time.Minute):     {1, 100},
+				start.Add(2 * time.Minute): {101, 200},
+			}),
+			"b": sketchRRA(start.Add(3*time.Minute), map[time.Time][2]int{
+				start.Add(time.Minute): {1001, 1100},
+			}),
+		},
+	}
+	for _, c := range []struct {
+		target    string
+		maxPoints int64
+		expect    []float64
+	}{
+		{"sketchQuantile(0.5, '*')", 0, []float64{nan, 100, 150}},
+		{"sketchQuantile(0.5, '*')", 1, []float64{nan, 150}},
+		{"sketchQuantile(1, 'a')", 0, []float64{nan, 100, 200}},
+	} {
+		sm, err := ParseDsl(db, c.target, start, start.Add(2*time.Minute), c.maxPoints)
+		if err != nil {
+			t.Errorf("%s: %v", c.target, err)
+			continue
+		}
+		if len(sm) != 1 {
+			t.Errorf("%s: expected 1 series, got %v", c.target, sm.SortedKeys())
+			continue
+		}
+		var got []float64
+		for _, s := range sm {
+			for s.Next() {
+				got = append(got, s.CurrentValue())
+			}
+		}
+		same := len(got) == len(c.expect)
+		for i := 0; same && i < len(got); i++ {
+			same = math.Abs(got[i]-c.expect[i]) <= c.expect[i]*rrd.SketchAccuracy || math.IsNaN(got[i]) && math.IsNaN(c.expect[i])
+		}
+		if !same {
+			t.Errorf("%s: expected %v, got %v", c.target, c.expect, got)
+		}
+	}
+
+	if _, err := ParseDsl(db, "sketchQuantile(1.5, 'a')", start, start.Add(time.Hour), 0); err == nil {
+		t.Errorf("sketchQuantile: expected an error for q > 1")
+	}
+	if _, err := ParseDsl(&db.compatFetcher, "sketchQuantile(0.5, 'a')", start, start.Add(time.Hour), 0); err == nil {
+		t.Errorf("sketchQuantile: expected an error without sketch support")
+	}
+}
+
+// Graphite math and normalization functions
+func Test_dsl_math(t *testing.T) {
+	nan := math.NaN()
+	start := time.Unix(1500000000, 0)
+	to := start.Add(5 * time.Minute)
+	db := &compatFetcher{start: start, step: time.Minute, data: map[string][]float64{
+		"a":       {1, 4, nan, 9, 0},
+		"b":       {2, 0.5, 2, nan, -1},
+		"gap":     {1, nan, nan, 4, nan},
+		"counter": {10, 70, 130, 10, nan},
+	}}
+	for _, c := range []struct {
+		target string
+		expect map[string][]float64
+	}{
+		{"pow(a, 2)", map[string][]float64{"a": {1, 16, nan, 81, 0}}},
+		{"pow(a, 0)", map[string][]float64{"a": {1, 1, nan, 1, 1}}},
+		{"powSeries(a, b)", map[string][]float64{"powSeries(a,b)": {1, 2, nan, nan, nan}}},
+		{"squareRoot(a)", map[string][]float64{"a": {1, 2, nan, 3, 0}}},
+		{"squareRoot(b)", map[string][]float64{"b": {math.Sqrt2, math.Sqrt(0.5), math.Sqrt2, nan, nan}}},
+		{"invert(a)", map[string][]float64{"a": {1, 0.25, nan, 1.0 / 9, nan}}},
+		{"minMax(a)", map[string][]float64{"a": {1.0 / 9, 4.0 / 9, nan, 1, 0}}},
+		{"sigmoid(b)", map[string][]float64{"b": {
+			1 / (1 + math.Exp(-2)), 1 / (1 + math.Exp(-0.5)), 1 / (1 + math.Exp(-2)), nan, 1 / (1 + math.E)}}},
+		{"delay(a, 2)", map[string][]float64{"a": {nan, nan, 1, 4, nan}}},
+		{"delay(a, -1)", map[string][]float64{"a": {4, nan, 9, 0, nan}}},
+		{"interpolate(gap)", map[string][]float64{"gap": {1, 2, 3, 4, nan}}},
+		{"interpolate(gap, 1)", map[string][]float64{"gap": {1, nan, nan, 4, nan}}},
+		{"fallbackSeries(nosuch, a)", map[string][]float64{"a": {1, 4, nan, 9, 0}}},
+		{"fallbackSeries(b, a)", map[string][]float64{"b": {2, 0.5, 2, nan, -1}}},
+		{"timeSlice(a, 1500000060, 1500000120)", map[string][]float64{"a": {nan, 4, nan, nan, nan}}},
+		{"integralByInterval(a, '2min')", map[string][]float64{"a": {1, 4, nan, 9, 9}}},
+		{"perSecond(counter)", map[string][]float64{"counter": {nan, 1, 1, nan, nan}}},
+		{"perSecond(counter, 179)", map[string][]float64{"counter": {nan, 1, 1, 1, nan}}},
+	} {
+		sm, err := ParseDsl(db, c.target, start, to, 100)
+		if err != nil {
+			t.Errorf("%s: %v", c.target, err)
+			continue
+		}
+		if len(sm) != len(c.expect) {
+			t.Errorf("%s: expected %d series, got %v", c.target, len(c.expect), sm.SortedKeys())
+			continue
+		}
+		for name, expect := range c.expect {
+			s := sm[name]
+			if s == nil {
+				t.Errorf("%s: missing %s in %v", c.target, name, sm.SortedKeys())
+				continue
+			}
+			var got []float64
+			for s.Next() {
+				got = append(got, s.CurrentValue())
+			}
+			same := len(got) == len(expect)
+			for i := 0; same && i < len(got); i++ {
+				same = math.Abs(got[i]-expect[i]) < 1e-9 || math.IsNaN(got[i]) && math.IsNaN(expect[i])
+			}
+			if !same {
+				t.Errorf("%s: %s: expected %v, got %v", c.target, name, expect, got)
+			}
+		}
+	}
+
+	// generated series
+	sm, err := ParseDsl(db, "identity('t')", start, start.Add(time.Hour), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for s := sm["t"]; s.Next(); n++ {
+		if v := s.CurrentValue(); v != float64(s.CurrentTime().Unix()) || v <= float64(start.Unix()) || int64(v)%60 != 0 {
+			t.Errorf("identity: unexpected value %v at %v", v, s.CurrentTime())
+		}
+	}
+	if n != 60 {
+		t.Errorf("identity: expected 60 points, got %d", n)
+	}
+	sm, err = ParseDsl(db, "timeFunction('t', 1)", start, start.Add(time.Hour), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step := sm["t"].Step(); step != 37*time.Second {
+		t.Errorf("timeFunction: expected the step to be increased to 37s for maxPoints, got %v", step)
+	}
+	sm, err = ParseDsl(db, "randomWalk('walk')", start, start.Add(time.Hour), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := nan
+	for s := sm["walk"]; s.Next(); {
+		v := s.CurrentValue()
+		if math.IsNaN(last) && v != 0 || !math.IsNaN(last) && math.Abs(v-last) > 0.5 {
+			t.Errorf("randomWalk: unexpected %v after %v", v, last)
+		}
+		last = v
+	}
+
+	for _, target := range []string{"pow(a)", "delay(a)", "timeSlice(a, 'x')", "identity('t', 0)", "integralByInterval(a, 'x')"} {
+		if _, err := ParseDsl(db, target, start, to, 100); err == nil {
+			t.Errorf("%s: expected an error", target)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package dsl
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/serde"
+	"github.com/jdcio/tgres/series"
+)
+
+// Graphite compatibility tests. testdata/graphite_compat.json
+// contains a set of series, and for each target the graphite-web
+// (1.1) /render?format=json response for it with these series
+// loaded. New cases should come from a graphite-web instance loaded
+// with the same series. The same target evaluated by us must produce
+// the same series (names and data points) in the same order.
+
+type compatFixture struct {
+	Start  int64
+	Step   int64
+	Series map[string][]*float64
+	Cases  []struct {
+		Target   string
+		Response []compatSeries
+	}
+}
+
+type compatSeries struct {
+	Target     string
+	Datapoints [][2]*float64
+}
+
+// compatFetcher serves the fixture series, without any RRAs or
+// consolidation involved.
+type compatFetcher struct {
+	start time.Time
+	step  time.Duration
+	data  map[string][]float64
+	tags  map[string]serde.Ident // optional extra ident tags
+}
+
+type compatDS struct {
+	*rrd.DataSource
+	name string
+}
+
+func (f *compatFetcher) identsFromPattern(pattern string) map[string]serde.Ident {
+	result := make(map[string]serde.Ident)
+	pparts := strings.Split(pattern, ".")
+	for name, _ := range f.data {
+		nparts := strings.Split(name, ".")
+		if len(nparts) != len(pparts) {
+			continue
+		}
+		match := true
+		for i, p := range pparts {
+			if ok, _ := path.Match(p, nparts[i]); !ok {
+				match = false
+				break
+			}
+		}
+		if match {
+			ident := serde.Ident{"name": name}
+			for k, v := range f.tags[name] {
+				ident[k] = v
+			}
+			result[name] = ident
+		}
+	}
+	return result
+}
+
+func (f *compatFetcher) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	if _, ok := f.data[ident["name"]]; !ok {
+		return nil, nil
+	}
+	return &compatDS{rrd.NewDataSource(rrd.DSSpec{Step: f.step}), ident["name"]}, nil
+}
+
+func (f *compatFetcher) FetchSeries(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	return series.NewSliceSeries(f.data[ds.(*compatDS).name], f.start, f.step), nil
+}
+
+func compatRender(sm SeriesMap) []compatSeries {
+	result := make([]compatSeries, 0, len(sm))
+	for _, name := range sm.SortedKeys() {
+		s := sm[name]
+		cs := compatSeries{Target: seriesName(name, s)}
+		for s.Next() {
+			t := float64(s.CurrentTime().Unix())
+			var pv *float64
+			if v := s.CurrentValue(); !math.IsNaN(v) {
+				pv = &v
+			}
+			cs.Datapoints = append(cs.Datapoints, [2]*float64{pv, &t})
+		}
+		s.Close()
+		result = append(result, cs)
+	}
+	return result
+}
+
+func compatSameValue(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return math.Abs(*a-*b) < 1e-9
+}
+
+func compatPoints(dps [][2]*float64) string {
+	b, _ := json.Marshal(dps)
+	return string(b)
+}
+
+func Test_dsl_graphiteCompat(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/graphite_compat.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixture compatFixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		t.Fatal(err)
+	}
+
+	db := &compatFetcher{
+		start: time.Unix(fixture.Start, 0),
+		step:  time.Duration(fixture.Step) * time.Second,
+		data:  make(map[string][]float64),
+	}
+	var points int
+	for name, vals := range fixture.Series {
+		if len(vals) > points {
+			points = len(vals)
+		}
+		for _, v := range vals {
+			if v == nil {
+				db.data[name] = append(db.data[name], math.NaN())
+			} else {
+				db.data[name] = append(db.data[name], *v)
+			}
+		}
+	}
+	from := db.start
+	to := from.Add(db.step * time.Duration(points))
+
+	for _, c := range fixture.Cases {
+		sm, err := ParseDsl(db, "group("+c.Target+")", from, to, 100)
+		if err != nil {
+			t.Errorf("%s: %v", c.Target, err)
+			continue
+		}
+		got := compatRender(sm)
+		if len(got) != len(c.Response) {
+			names := make([]string, 0, len(got))
+			for _, s := range got {
+				names = append(names, s.Target)
+			}
+			t.Errorf("%s: expected %d series, got %d: %q", c.Target, len(c.Response), len(got), names)
+			continue
+		}
+		for i, exp := range c.Response {
+			if got[i].Target != exp.Target {
+				t.Errorf("%s: series %d: expected name %q, got %q", c.Target, i, exp.Target, got[i].Target)
+			}
+			same := len(got[i].Datapoints) == len(exp.Datapoints)
+			for n := 0; same && n < len(exp.Datapoints); n++ {
+				same = compatSameValue(got[i].Datapoints[n][0], exp.Datapoints[n][0]) &&
+					compatSameValue(got[i].Datapoints[n][1], exp.Datapoints[n][1])
+			}
+			if !same {
+				t.Errorf("%s: series %d (%s): expected %s, got %s", c.Target, i, exp.Target,
+					compatPoints(exp.Datapoints), compatPoints(got[i].Datapoints))
+			}
+		}
+	}
+}
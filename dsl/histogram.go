@@ -0,0 +1,258 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jdcio/tgres/series"
+)
+
+// Histograms exported as a series per bucket, e.g. foo.bucket.le_100,
+// foo.bucket.le_250, foo.bucket.le_inf. The buckets are cumulative,
+// i.e. a bucket counts everything less than or equal to its upper
+// bound (as in Prometheus). The bound is read from the name node
+// given as a number, or from the ident tag given as a string, the
+// value of which is a number possibly preceded by non-digits, with
+// "_" for the decimal point (le_0_5 is 0.5), or "inf".
+
+type histogramBucket struct {
+	key   string
+	bound float64
+}
+
+// parseBucketBound returns the upper bound of a bucket, e.g. 100 for
+// "le_100" or +Inf for "le_inf".
+func parseBucketBound(s string) (float64, error) {
+	ls := strings.ToLower(s)
+	i := strings.IndexAny(ls, "0123456789")
+	if n := strings.Index(ls, "inf"); n != -1 && (i == -1 || n < i) {
+		return math.Inf(1), nil
+	}
+	if i == -1 {
+		return 0, fmt.Errorf("no bucket bound in %q", s)
+	}
+	bound, err := strconv.ParseFloat(strings.Replace(ls[i:], "_", ".", -1), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bucket bound in %q", s)
+	}
+	return bound, nil
+}
+
+// histograms returns the series of sm as histograms, each sorted by
+// bucket bound. With a node, the series are grouped by name with the
+// bucket node removed, with a tag all the series are one histogram.
+func histograms(dc *dslCtx, sm SeriesMap, bucket interface{}) (map[string][]histogramBucket, error) {
+	result := make(map[string][]histogramBucket)
+	for _, key := range sm.SortedKeys() {
+		var group, value string
+		switch b := bucket.(type) {
+		case float64:
+			parts := strings.Split(key, ".")
+			node := int(b)
+			if node < 0 {
+				node += len(parts)
+			}
+			if node < 0 || node >= len(parts) {
+				return nil, fmt.Errorf("%s has no node %v", key, b)
+			}
+			value = parts[node]
+			group = strings.Join(append(parts[:node:node], parts[node+1:]...), ".")
+		case string:
+			ident, ok := dc.identsFromPattern(key)[key]
+			if !ok || ident[b] == "" {
+				return nil, fmt.Errorf("%s has no %q tag", key, b)
+			}
+			value = ident[b]
+		default:
+			return nil, fmt.Errorf("bucketNode must be a number or a tag name, not %v", bucket)
+		}
+		bound, err := parseBucketBound(value)
+		if err != nil {
+			return nil, err
+		}
+		for _, hb := range result[group] {
+			if hb.bound == bound {
+				return nil, fmt.Errorf("%s and %s are the same bucket", hb.key, key)
+			}
+		}
+		result[group] = append(result[group], histogramBucket{key, bound})
+	}
+	for _, buckets := range result {
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].bound < buckets[j].bound })
+	}
+	return result, nil
+}
+
+// bucketQuantile computes the q quantile from cumulative bucket counts
+// by linear interpolation within the bucket it falls in, assuming the
+// lowest bucket begins at 0. A quantile in the +Inf bucket is the
+// highest finite bound.
+func bucketQuantile(q float64, bounds, counts []float64) float64 {
+	var max float64
+	for i, c := range counts {
+		if math.IsNaN(c) {
+			return math.NaN()
+		}
+		if c < max { // counts cannot decrease, Prometheus does the same
+			counts[i] = max
+		} else {
+			max = c
+		}
+	}
+	total := counts[len(counts)-1]
+	if len(counts) == 0 || total <= 0 {
+		return math.NaN()
+	}
+	rank := q * total
+	i := sort.Search(len(counts), func(i int) bool { return counts[i] >= rank })
+	if math.IsInf(bounds[i], 1) {
+		if i == 0 {
+			return math.NaN()
+		}
+		return bounds[i-1]
+	}
+	var lower, prev float64
+	if i > 0 {
+		lower, prev = bounds[i-1], counts[i-1]
+	} else if bounds[0] < 0 {
+		return bounds[0]
+	}
+	if counts[i] == prev {
+		return lower
+	}
+	return lower + (bounds[i]-lower)*(rank-prev)/(counts[i]-prev)
+}
+
+// histogramQuantile()
+
+type seriesHistogramQuantile struct {
+	*aliasSeriesSlice
+	q      float64
+	bounds []float64
+}
+
+func (f *seriesHistogramQuantile) CurrentValue() float64 {
+	counts := make([]float64, len(f.SeriesSlice))
+	for i, s := range f.SeriesSlice {
+		counts[i] = s.CurrentValue()
+	}
+	return bucketQuantile(f.q, f.bounds, counts)
+}
+
+// histogramQuantile(q, seriesList, bucketNode) computes the q (0 to 1)
+// quantile of every histogram in seriesList for every point in time.
+func dslHistogramQuantile(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("Expecting 3 arguments, got %d", len(args))
+	}
+	q, ok := args[0].(float64)
+	if !ok || q < 0 || q > 1 {
+		return nil, fmt.Errorf("q must be a number between 0 and 1, not %v", args[0])
+	}
+	sm, err := dc.seriesFromSeriesOrIdent(args[1])
+	if err != nil {
+		return nil, err
+	}
+	hists, err := histograms(dc, sm, args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(SeriesMap, len(hists))
+	for group, buckets := range hists {
+		hq := &seriesHistogramQuantile{aliasSeriesSlice: &aliasSeriesSlice{}, q: q}
+		for _, hb := range buckets {
+			hq.SeriesSlice = append(hq.SeriesSlice, sm[hb.key])
+			hq.bounds = append(hq.bounds, hb.bound)
+		}
+		hq.Align()
+		name := group
+		if name == "" {
+			name = fmt.Sprintf("%v", args[1])
+		}
+		hq.Alias(fmt.Sprintf("histogramQuantile(%v,%s)", q, name))
+		result[name] = hq
+	}
+	return result, nil
+}
+
+// histogramHeatmap(seriesList, bucketNode) returns a series per bucket
+// which counts only what is in that bucket (not cumulative) named by
+// its upper bound and sorted by it, which is what the Grafana heatmap
+// panel expects ("Time series buckets" data format). All the
+// histograms in the list are added up.
+func dslHistogramHeatmap(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("Expecting 2 arguments, got %d", len(args))
+	}
+	sm, err := dc.seriesFromSeriesOrIdent(args[0])
+	if err != nil {
+		return nil, err
+	}
+	hists, err := histograms(dc, sm, args[1])
+	if err != nil {
+		return nil, err
+	}
+	sm.toAliasSeriesSlice().Align()
+
+	// Bucket series are needed for their own and the next bucket, so
+	// they are read into memory.
+	var (
+		sums  = make(map[float64][]float64)
+		m     materialized
+		bound []float64
+	)
+	for _, buckets := range hists {
+		var prev []float64
+		for _, hb := range buckets {
+			var data []float64
+			data, m = materialize(sm[hb.key])
+			sum, ok := sums[hb.bound]
+			if !ok {
+				sum = make([]float64, len(data))
+				bound = append(bound, hb.bound)
+			}
+			for i := 0; i < len(data) && i < len(sum); i++ {
+				v := data[i]
+				if i < len(prev) {
+					v -= prev[i]
+				}
+				if v < 0 {
+					v = 0
+				}
+				sum[i] += v
+			}
+			sums[hb.bound], prev = sum, data
+		}
+	}
+
+	sort.Float64s(bound)
+	result := make(SeriesMap, len(sums))
+	keys := make([]string, 0, len(sums))
+	for _, b := range bound {
+		name := strconv.FormatFloat(b, 'f', -1, 64)
+		ss := series.NewSliceSeries(sums[b], m.start, m.step)
+		ss.Alias(name)
+		result[name] = ss
+		keys = append(keys, name)
+	}
+	return result.positioned(keys), nil
+}
@@ -0,0 +1,432 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jdcio/tgres/series"
+)
+
+// Infix operators. The parser gives us binary expressions such as
+// a.b * 2 for free, infixCalls() rewrites them as calls to infix(),
+// i.e. infix("*", a.b, 2), which is then evaluated like any other
+// function. The rules are:
+//
+// A series and a number: the operation is applied to every data
+// point of every series in the list.
+//
+// Two series lists: all the series of both sides are aligned together
+// (see SeriesSlice.Align()), then paired up. If one side is a single
+// series, it is paired with every series of the other side. Otherwise
+// series are paired by name: if the two lists have names in common,
+// by the whole name, else by what remains of the names once the nodes
+// common to all series of a list are removed from the beginning and
+// the end, e.g. a.*.rx / a.*.tx pairs a.foo.rx with a.foo.tx. Series
+// without a pair are dropped.
+//
+// A series name can be given as is or quoted, as elsewhere in the
+// DSL, but a number must not be quoted: "2" is a string, not a number.
+//
+// NaN in either operand results in NaN, so does division by
+// zero. Comparisons result in 1 (true) or 0 (false).
+
+var infixFuncs = map[string]func(a, b float64) float64{
+	"+": func(a, b float64) float64 { return a + b },
+	"-": func(a, b float64) float64 { return a - b },
+	"*": func(a, b float64) float64 { return a * b },
+	"/": func(a, b float64) float64 {
+		if b == 0 {
+			return math.NaN()
+		}
+		return a / b
+	},
+	"==": infixCompare(func(a, b float64) bool { return a == b }),
+	"!=": infixCompare(func(a, b float64) bool { return a != b }),
+	"<":  infixCompare(func(a, b float64) bool { return a < b }),
+	"<=": infixCompare(func(a, b float64) bool { return a <= b }),
+	">":  infixCompare(func(a, b float64) bool { return a > b }),
+	">=": infixCompare(func(a, b float64) bool { return a >= b }),
+}
+
+func infixCompare(cmp func(a, b float64) bool) func(a, b float64) float64 {
+	return func(a, b float64) float64 {
+		if math.IsNaN(a) || math.IsNaN(b) {
+			return math.NaN()
+		}
+		if cmp(a, b) {
+			return 1
+		}
+		return 0
+	}
+}
+
+// infixCalls rewrites the binary expressions in e as calls to
+// infix() and removes parentheses. An infix() call in parentheses
+// gets the operator in parentheses too, e.g. infix("(+)", a, 1), so
+// that the series name keeps them. An expression consisting of
+// numbers only is computed right here, so that e.g. scale(x, 60 * 60)
+// works as expected.
+func infixCalls(e ast.Expr) (ast.Expr, error) {
+	var err error
+	switch t := e.(type) {
+	case *ast.ParenExpr:
+		x, err := infixCalls(t.X)
+		if err != nil {
+			return nil, err
+		}
+		if call, ok := x.(*ast.CallExpr); ok && !isParenInfixCall(call) && isInfixCall(call) {
+			op := call.Args[0].(*ast.BasicLit)
+			op.Value = strconv.Quote("(" + infixOp(op) + ")")
+		}
+		return x, nil
+	case *ast.CallExpr:
+		if sel, ok := t.Fun.(*ast.SelectorExpr); ok { // chaining
+			if sel.X, err = infixCalls(sel.X); err != nil {
+				return nil, err
+			}
+		}
+		for i, arg := range t.Args {
+			if t.Args[i], err = infixCalls(arg); err != nil {
+				return nil, err
+			}
+		}
+		return t, nil
+	case *ast.BinaryExpr:
+		op := t.Op.String()
+		fn, ok := infixFuncs[op]
+		if !ok {
+			return nil, fmt.Errorf("unsupported operator: %v", op)
+		}
+		x, err := infixCalls(t.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := infixCalls(t.Y)
+		if err != nil {
+			return nil, err
+		}
+		x, y = escapedNumber(x), escapedNumber(y)
+		for _, operand := range []ast.Expr{x, y} {
+			if lit, ok := quotedNumber(operand); ok {
+				return nil, fmt.Errorf("a quoted number cannot be an operand of %s: %s", op, lit.Value)
+			}
+		}
+		if a, ok := astNumber(x); ok {
+			if b, ok := astNumber(y); ok {
+				v := strconv.FormatFloat(fn(a, b), 'g', -1, 64)
+				return &ast.BasicLit{ValuePos: t.Pos(), Kind: token.FLOAT, Value: v}, nil
+			}
+		}
+		return &ast.CallExpr{
+			Fun:  &ast.Ident{NamePos: t.Pos(), Name: "infix"},
+			Args: []ast.Expr{&ast.BasicLit{ValuePos: t.OpPos, Kind: token.STRING, Value: strconv.Quote(op)}, x, y},
+		}, nil
+	}
+	return e, nil
+}
+
+// isInfixCall tells whether call is a call to infix() created by
+// infixCalls(), isParenInfixCall whether it was in parentheses.
+func isInfixCall(call *ast.CallExpr) bool {
+	id, ok := call.Fun.(*ast.Ident)
+	if !ok || id.Name != "infix" || len(call.Args) != 3 {
+		return false
+	}
+	lit, ok := call.Args[0].(*ast.BasicLit)
+	return ok && lit.Kind == token.STRING
+}
+
+func isParenInfixCall(call *ast.CallExpr) bool {
+	return isInfixCall(call) && strings.HasPrefix(infixOp(call.Args[0].(*ast.BasicLit)), "(")
+}
+
+func infixOp(lit *ast.BasicLit) string {
+	op, _ := strconv.Unquote(lit.Value)
+	return op
+}
+
+// escapedNumber returns e as a number literal if it is an identifier
+// which is a number, i.e. a negative number whose minus was escaped
+// (see escapeBadChars()), e.g. the -2 of a.b - -2.
+func escapedNumber(e ast.Expr) ast.Expr {
+	if id, ok := e.(*ast.Ident); ok {
+		v := unEscapeBadChars(id.Name)
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			return &ast.BasicLit{ValuePos: id.Pos(), Kind: token.FLOAT, Value: v}
+		}
+	}
+	return e
+}
+
+// quotedNumber returns e if it is a string literal of a number,
+// possibly in parentheses.
+func quotedNumber(e ast.Expr) (*ast.BasicLit, bool) {
+	for {
+		paren, ok := e.(*ast.ParenExpr)
+		if !ok {
+			break
+		}
+		e = paren.X
+	}
+	if lit, ok := e.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+		s, err := strconv.Unquote(lit.Value)
+		if err == nil {
+			_, err = strconv.ParseFloat(s, 64)
+		}
+		return lit, err == nil
+	}
+	return nil, false
+}
+
+// astNumber returns the value of e if it is a number literal.
+func astNumber(e ast.Expr) (float64, bool) {
+	switch t := e.(type) {
+	case *ast.BasicLit:
+		if t.Kind == token.INT || t.Kind == token.FLOAT {
+			v, err := strconv.ParseFloat(t.Value, 64)
+			return v, err == nil
+		}
+	case *ast.UnaryExpr:
+		if v, ok := astNumber(t.X); ok {
+			switch t.Op {
+			case token.ADD:
+				return v, true
+			case token.SUB:
+				return -v, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// infix()
+
+type seriesInfixScalar struct {
+	AliasSeries
+	fn          func(a, b float64) float64
+	scalar      float64
+	scalarFirst bool
+}
+
+func (f *seriesInfixScalar) CurrentValue() float64 {
+	if f.scalarFirst {
+		return f.fn(f.scalar, f.AliasSeries.CurrentValue())
+	}
+	return f.fn(f.AliasSeries.CurrentValue(), f.scalar)
+}
+
+type seriesInfix struct {
+	*aliasSeriesSlice
+	fn func(a, b float64) float64
+}
+
+func (f *seriesInfix) CurrentValue() float64 {
+	return f.fn(f.SeriesSlice[0].CurrentValue(), f.SeriesSlice[1].CurrentValue())
+}
+
+// infixOperand returns the operand as a series list or, if it is a
+// number, as a number. A string is a series name, never a number.
+func infixOperand(dc *dslCtx, arg interface{}) (SeriesMap, float64, error) {
+	if a, ok := arg.(float64); ok {
+		return nil, a, nil
+	}
+	sm, err := dc.seriesFromSeriesOrIdent(arg)
+	return sm, 0, err
+}
+
+func dslInfix(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("Expecting 3 arguments, got %d", len(args))
+	}
+	op, _ := args[0].(string)
+	paren := len(op) > 2 && op[0] == '(' && op[len(op)-1] == ')'
+	if paren {
+		op = op[1 : len(op)-1]
+	}
+	named := func(name string) string {
+		if paren {
+			return "(" + name + ")"
+		}
+		return name
+	}
+	fn, ok := infixFuncs[op]
+	if !ok {
+		return nil, fmt.Errorf("unsupported operator: %v", args[0])
+	}
+	left, a, err := infixOperand(dc, args[1])
+	if err != nil {
+		return nil, err
+	}
+	right, b, err := infixOperand(dc, args[2])
+	if err != nil {
+		left.close()
+		return nil, err
+	}
+
+	switch {
+	case left == nil && right == nil:
+		return nil, fmt.Errorf("%v %s %v: at least one operand must be a series", a, op, b)
+	case right == nil:
+		for name, s := range left {
+			s.Alias(named(fmt.Sprintf("%s %s %v", seriesName(name, s), op, b)))
+			left[name] = &seriesInfixScalar{s, fn, b, false}
+		}
+		return left, nil
+	case left == nil:
+		for name, s := range right {
+			s.Alias(named(fmt.Sprintf("%v %s %s", a, op, seriesName(name, s))))
+			right[name] = &seriesInfixScalar{s, fn, a, true}
+		}
+		return right, nil
+	}
+
+	all := left.toAliasSeriesSlice()
+	all.SeriesSlice = append(all.SeriesSlice, right.toAliasSeriesSlice().SeriesSlice...)
+	all.Align()
+
+	pairs, err := infixPairs(left, right)
+	if err != nil {
+		left.close()
+		right.close()
+		return nil, err
+	}
+	paired := [2]map[string]bool{make(map[string]bool), make(map[string]bool)}
+	for _, p := range pairs {
+		paired[0][p[0]], paired[1][p[1]] = true, true
+	}
+	for n, sm := range []SeriesMap{left, right} {
+		for name, s := range sm {
+			if !paired[n][name] {
+				s.Close() // dropped
+			}
+		}
+	}
+
+	result := make(SeriesMap, len(pairs))
+	for _, p := range pairs {
+		l, r := left[p[0]], right[p[1]]
+		name := named(seriesName(p[0], l) + " " + op + " " + seriesName(p[1], r))
+		key := p[0]
+		if len(left) == 1 && len(right) > 1 {
+			key = p[1]
+		}
+		result[key] = &seriesInfix{&aliasSeriesSlice{series.SeriesSlice{l, r}, name}, fn}
+	}
+
+	// A single series paired with many must be shared by all the
+	// pairs, and a series can only be iterated over by one of them,
+	// so each pair gets its own copy.
+	if len(pairs) > 1 {
+		for _, side := range []struct {
+			sm SeriesMap
+			n  int
+		}{{left, 0}, {right, 1}} {
+			if len(side.sm) != 1 {
+				continue
+			}
+			data, s := materialize(side.sm[pairs[0][side.n]])
+			for _, rs := range result {
+				ss := rs.(*seriesInfix).SeriesSlice
+				cp := series.NewSliceSeries(data, s.start, s.step)
+				ss[side.n] = &aliasSeries{Series: cp, alias: s.alias}
+			}
+		}
+	}
+	return result, nil
+}
+
+// infixPairs pairs up the series of two lists, see the rules at the
+// top of this file. The result is a list of [left key, right key].
+func infixPairs(left, right SeriesMap) ([][2]string, error) {
+	var pairs [][2]string
+	if len(left) == 1 || len(right) == 1 {
+		for _, l := range left.SortedKeys() {
+			for _, r := range right.SortedKeys() {
+				pairs = append(pairs, [2]string{l, r})
+			}
+		}
+		return pairs, nil
+	}
+
+	for _, l := range left.SortedKeys() {
+		if _, ok := right[l]; ok {
+			pairs = append(pairs, [2]string{l, l})
+		}
+	}
+	if len(pairs) > 0 {
+		return pairs, nil
+	}
+
+	lnames, err := varyingNames(left)
+	if err != nil {
+		return nil, err
+	}
+	rnames, err := varyingNames(right)
+	if err != nil {
+		return nil, err
+	}
+	for vn, l := range lnames {
+		if r, ok := rnames[vn]; ok {
+			pairs = append(pairs, [2]string{l, r})
+		}
+	}
+	return pairs, nil
+}
+
+// varyingNames maps the names of the series in sm with the nodes
+// common to all of them removed from the beginning and the end to the
+// series key.
+func varyingNames(sm SeriesMap) (map[string]string, error) {
+	keys := sm.SortedKeys()
+	nodes := make([][]string, len(keys))
+	minLen := -1
+	for i, key := range keys {
+		nodes[i] = strings.Split(key, ".")
+		if minLen == -1 || len(nodes[i]) < minLen {
+			minLen = len(nodes[i])
+		}
+	}
+	same := func(node func(parts []string) string) bool {
+		for _, parts := range nodes[1:] {
+			if node(parts) != node(nodes[0]) {
+				return false
+			}
+		}
+		return true
+	}
+	var head, tail int
+	for head < minLen && same(func(parts []string) string { return parts[head] }) {
+		head++
+	}
+	for head+tail < minLen && same(func(parts []string) string { return parts[len(parts)-1-tail] }) {
+		tail++
+	}
+	result := make(map[string]string, len(keys))
+	for i, key := range keys {
+		vn := strings.Join(nodes[i][head:len(nodes[i])-tail], ".")
+		if other, ok := result[vn]; ok {
+			return nil, fmt.Errorf("cannot tell %q and %q apart by name", other, key)
+		}
+		result[vn] = key
+	}
+	return result, nil
+}
@@ -0,0 +1,347 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Macro is a user defined function with parameters, e.g.
+//
+//	errRate(svc) = asPercent(sumSeries(svc.*.err), sumSeries(svc.*.req))
+//
+// A macro is called like any built-in function, including chained,
+// e.g. errRate(myapp) or myapp.errRate(), and is expanded in the
+// source before it is evaluated. A parameter is replaced with the
+// argument as is, or, when it begins a series name (svc.*.err above),
+// with the argument as part of the name, in which case the argument
+// must be a name. Parameters are not substituted inside strings.
+type Macro struct {
+	Name    string
+	Params  []string
+	Body    string
+	escBody string
+}
+
+func (m *Macro) String() string {
+	return fmt.Sprintf("%s(%s) = %s", m.Name, strings.Join(m.Params, ", "), m.Body)
+}
+
+func (m *Macro) param(name string) int {
+	for i, p := range m.Params {
+		if p == name {
+			return i
+		}
+	}
+	return -1
+}
+
+var (
+	macroDef   = regexp.MustCompile(`^\s*(\w+)\s*\(([^()]*)\)\s*=\s*(.*?)\s*$`)
+	macroIdent = regexp.MustCompile(`^[A-Za-z_]\w*$`)
+)
+
+// ParseMacro parses a macro definition, "name(param, ...) = body".
+func ParseMacro(def string) (*Macro, error) {
+	parts := macroDef.FindStringSubmatch(def)
+	if parts == nil || parts[3] == "" {
+		return nil, fmt.Errorf("invalid macro definition (expecting name(param, ...) = body): %q", def)
+	}
+	m := &Macro{Name: parts[1], Body: parts[3], escBody: escapeSrc(parts[3])}
+	if !macroIdent.MatchString(m.Name) {
+		return nil, fmt.Errorf("invalid macro name: %q", m.Name)
+	}
+	if strings.TrimSpace(parts[2]) != "" {
+		for _, p := range strings.Split(parts[2], ",") {
+			p = strings.TrimSpace(p)
+			if !macroIdent.MatchString(p) {
+				return nil, fmt.Errorf("invalid parameter name: %q", p)
+			}
+			if m.param(p) != -1 {
+				return nil, fmt.Errorf("duplicate parameter: %q", p)
+			}
+			m.Params = append(m.Params, p)
+		}
+	}
+	if _, err := parser.ParseExpr(m.escBody); err != nil {
+		return nil, fmt.Errorf("error parsing %q: %v", m.Body, err)
+	}
+	return m, nil
+}
+
+type macroMap map[string]*Macro
+
+// The macros currently defined. The map is never modified, defining a
+// macro replaces it with a new one.
+var macros struct {
+	sync.RWMutex
+	m macroMap
+}
+
+func currentMacros() macroMap {
+	macros.RLock()
+	defer macros.RUnlock()
+	return macros.m
+}
+
+// DefineMacro parses def (see ParseMacro()) and defines the macro,
+// replacing any previous definition of the same name. It is an error
+// for a macro to have the name of a built-in function or to be
+// recursive.
+func DefineMacro(def string) (*Macro, error) {
+	m, err := ParseMacro(def)
+	if err != nil {
+		return nil, err
+	}
+	_, builtin := preprocessArgFuncs[m.Name]
+	if _, ok := dslCtxFuncs[m.Name]; builtin || ok {
+		return nil, fmt.Errorf("%s is a built-in function", m.Name)
+	}
+
+	macros.Lock()
+	defer macros.Unlock()
+
+	mm := make(macroMap, len(macros.m)+1)
+	for name, other := range macros.m {
+		mm[name] = other
+	}
+	mm[m.Name] = m
+
+	// Expanding a call reveals recursion, including via other macros
+	call := fmt.Sprintf("%s(%s)", m.Name, strings.Join(m.Params, ", "))
+	if _, err := expandMacros(mm, call, nil); err != nil {
+		return nil, err
+	}
+	macros.m = mm
+	return m, nil
+}
+
+// UndefineMacro removes the macro, it returns false if there was no
+// such macro.
+func UndefineMacro(name string) bool {
+	macros.Lock()
+	defer macros.Unlock()
+	if _, ok := macros.m[name]; !ok {
+		return false
+	}
+	mm := make(macroMap, len(macros.m))
+	for n, m := range macros.m {
+		if n != name {
+			mm[n] = m
+		}
+	}
+	macros.m = mm
+	return true
+}
+
+// Macros returns all the macros defined, sorted by name.
+func Macros() []*Macro {
+	mm := currentMacros()
+	result := make([]*Macro, 0, len(mm))
+	for _, m := range mm {
+		result = append(result, m)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func callName(call *ast.CallExpr) string {
+	switch fn := call.Fun.(type) {
+	case *ast.Ident:
+		return fn.Name
+	case *ast.SelectorExpr:
+		return fn.Sel.Name
+	}
+	return ""
+}
+
+// srcOf returns the part of src that n was parsed from.
+func srcOf(src string, n ast.Node) string {
+	return src[n.Pos()-1 : n.End()-1]
+}
+
+// expandMacros returns src (escaped, see escapeSrc()) with the macro
+// calls in it replaced by the (expanded) macro bodies. expanding is
+// the list of macros being expanded, which is how recursion is
+// detected.
+func expandMacros(mm macroMap, src string, expanding []string) (string, error) {
+	if len(mm) == 0 {
+		return src, nil
+	}
+	tr, err := parser.ParseExpr(src)
+	if err != nil {
+		return "", err
+	}
+
+	// The outermost macro calls, their arguments are expanded by
+	// expandCall(). These are in the order of the source.
+	var calls []*ast.CallExpr
+	ast.Inspect(tr, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok {
+			if _, ok := mm[callName(call)]; ok {
+				calls = append(calls, call)
+				return false
+			}
+		}
+		return true
+	})
+
+	var (
+		buf  bytes.Buffer
+		last int
+	)
+	for _, call := range calls {
+		text, err := expandCall(mm, src, call, expanding)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(src[last : call.Pos()-1])
+		buf.WriteString(text)
+		last = int(call.End()) - 1
+	}
+	buf.WriteString(src[last:])
+	return buf.String(), nil
+}
+
+func expandCall(mm macroMap, src string, call *ast.CallExpr, expanding []string) (string, error) {
+	m := mm[callName(call)]
+	for _, name := range expanding {
+		if name == m.Name {
+			return "", fmt.Errorf("macro recursion: %s -> %s", strings.Join(expanding, " -> "), m.Name)
+		}
+	}
+
+	var args []string
+	if sel, ok := call.Fun.(*ast.SelectorExpr); ok { // chained
+		args = append(args, srcOf(src, sel.X))
+	}
+	for _, arg := range call.Args {
+		args = append(args, srcOf(src, arg))
+	}
+	if len(args) != len(m.Params) {
+		return "", fmt.Errorf("%s() takes %d argument(s), got %d", m.Name, len(m.Params), len(args))
+	}
+	for i, arg := range args {
+		var err error
+		if args[i], err = expandMacros(mm, arg, expanding); err != nil {
+			return "", err
+		}
+	}
+
+	body, err := m.substitute(args)
+	if err != nil {
+		return "", err
+	}
+	body, err = expandMacros(mm, body, append(expanding[:len(expanding):len(expanding)], m.Name))
+	if err != nil {
+		return "", err
+	}
+	return "(" + body + ")", nil
+}
+
+// substitute returns the macro body with the parameters replaced by
+// args.
+func (m *Macro) substitute(args []string) (string, error) {
+	tr, err := parser.ParseExpr(m.escBody)
+	if err != nil {
+		return "", err
+	}
+
+	type replacement struct {
+		node ast.Node
+		text string
+	}
+	var (
+		repls []replacement
+		skip  = make(map[*ast.Ident]bool) // function names
+	)
+	ast.Inspect(tr, func(n ast.Node) bool {
+		if err != nil {
+			return false
+		}
+		switch t := n.(type) {
+		case *ast.CallExpr:
+			if id, ok := t.Fun.(*ast.Ident); ok {
+				skip[id] = true
+			}
+		case *ast.SelectorExpr:
+			skip[t.Sel] = true
+			root := t.X
+			for sel, ok := root.(*ast.SelectorExpr); ok; sel, ok = root.(*ast.SelectorExpr) {
+				root = sel.X
+			}
+			if id, ok := root.(*ast.Ident); ok {
+				if i := m.param(id.Name); i != -1 {
+					var name string
+					if name, err = macroName(m, i, args[i]); err == nil {
+						rest := m.escBody[id.End()-1 : t.End()-1]
+						repls = append(repls, replacement{t, `"` + name + rest + `"`})
+					}
+					return false
+				}
+			}
+		case *ast.Ident:
+			if i := m.param(t.Name); i != -1 && !skip[t] {
+				repls = append(repls, replacement{t, "(" + args[i] + ")"})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		buf  bytes.Buffer
+		last int
+	)
+	for _, r := range repls {
+		buf.WriteString(m.escBody[last : r.node.Pos()-1])
+		buf.WriteString(r.text)
+		last = int(r.node.End()) - 1
+	}
+	buf.WriteString(m.escBody[last:])
+	return buf.String(), nil
+}
+
+// macroName returns arg as a (part of a) series name, arg must be a
+// name or a string.
+func macroName(m *Macro, i int, arg string) (string, error) {
+	e, err := parser.ParseExpr(arg)
+	if err != nil {
+		return "", err
+	}
+	for p, ok := e.(*ast.ParenExpr); ok; p, ok = e.(*ast.ParenExpr) {
+		e = p.X
+	}
+	switch t := e.(type) {
+	case *ast.Ident, *ast.SelectorExpr:
+		return srcOf(arg, t), nil
+	case *ast.BasicLit:
+		if s := t.Value; len(s) > 1 && s[0] == '"' {
+			return s[1 : len(s)-1], nil
+		}
+		return t.Value, nil
+	}
+	return "", fmt.Errorf("%s(): %s must be a name, not %s", m.Name, m.Params[i], unEscapeBadChars(arg))
+}
@@ -0,0 +1,90 @@
+package dsl
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_dsl_macros(t *testing.T) {
+	td := setupTestData()
+	for name, v := range map[string]float64{
+		"macro.web.a.err": 1, "macro.web.a.req": 4, "macro.web.b.err": 3, "macro.web.b.req": 12,
+	} {
+		if err := createTestDS(td, name, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, def := range []string{
+		"errRate(svc) = asPercent(sumSeries(svc.*.err), sumSeries(svc.*.req))",
+		"pct(a, b) = a / b * 100",
+		"errRate2(svc) = pct(sumSeries(svc.*.err), sumSeries(svc.*.req))",
+		"twice(x) = scale(x, 2)",
+	} {
+		m, err := DefineMacro(def)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer UndefineMacro(m.Name)
+	}
+
+	for _, c := range []struct {
+		target string
+		expect float64
+	}{
+		{"errRate(macro.web)", 25},
+		{"errRate('macro.web')", 25},
+		{"macro.web.errRate()", 25},
+		{"errRate(macro.web).scale(2)", 50},
+		{"errRate2(macro.web)", 25},
+		{"pct(macro.web.b.err, macro.web.b.req)", 25},
+		{"twice(errRate(macro.web)) + 1", 51},
+		{"sumSeries(macro.web.*.err).twice()", 8},
+	} {
+		sm, err := ParseDsl(td.rcache, c.target, td.from, td.to, 100)
+		if err != nil {
+			t.Errorf("%s: %v", c.target, err)
+			continue
+		}
+		if ok, unexpected := checkEveryValueIs(sm, c.expect); len(sm) != 1 || !ok {
+			t.Errorf("%s: unexpected value: %v (%v)", c.target, unexpected, sm.SortedKeys())
+		}
+	}
+
+	for _, target := range []string{
+		"errRate(macro.web, 2)",
+		"errRate(sumSeries(macro.web))",
+	} {
+		if _, err := ParseDsl(td.rcache, target, td.from, td.to, 100); err == nil {
+			t.Errorf("%s: expected an error", target)
+		}
+	}
+
+	for _, def := range []string{
+		"scale(x) = x",
+		"noBody(x) = ",
+		"bad(x, x) = x",
+		"self(x) = scale(self(x), 2)",
+	} {
+		if _, err := DefineMacro(def); err == nil {
+			t.Errorf("%s: expected an error", def)
+		}
+	}
+
+	// Mutual recursion can only be detected once the second macro is defined
+	if _, err := DefineMacro("ping(x) = pong(x)"); err != nil {
+		t.Fatal(err)
+	}
+	defer UndefineMacro("ping")
+	_, err := DefineMacro("pong(x) = ping(x)")
+	if err == nil || !strings.Contains(err.Error(), "recursion") {
+		t.Errorf("expected a recursion error, got %v", err)
+	}
+
+	if !UndefineMacro("twice") || UndefineMacro("twice") {
+		t.Errorf("UndefineMacro() should only succeed once")
+	}
+	if _, err := ParseDsl(td.rcache, "twice(macro.web.a.err)", td.from, td.to, 100); err == nil {
+		t.Errorf("expected an error calling an undefined macro")
+	}
+}
@@ -16,6 +16,7 @@
 package dsl
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -35,11 +36,12 @@ type NamedDSFetcher interface {
 type fsFinder interface {
 	identsFromPattern(ident string) map[string]serde.Ident
 	FsFind(pattern string) []*FsFindNode
+	Idents() []serde.Ident
 }
 
 type dsFetcher interface {
 	FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error)
-	FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error)
+	FetchSeries(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error)
 }
 
 type rraDataLoader interface {
@@ -114,6 +116,24 @@ func (r *namedDsFetcher) StartStateSaver() {
 	}
 }
 
+// Forget drops a DS which was deleted or changed from the LRU, and,
+// if the DS no longer exists, from the name cache. It is meant to be
+// registered as a serde delete listener.
+func (r *namedDsFetcher) Forget(ident serde.Ident) {
+	r.dsLRU.forget(ident)
+	if ds, err := r.dsLRU.db.FetchOrCreateDataSource(ident, nil); err == nil && ds == nil {
+		r.dsns.remove(ident)
+	}
+}
+
+// Idents returns the idents of all known series, sorted by name.
+func (r *namedDsFetcher) Idents() []serde.Ident {
+	if r.dsns.empty() {
+		r.dsns.reload()
+	}
+	return r.dsns.allIdents()
+}
+
 // FsFind provides a way of searching dot-separated names using same
 // rules as filepath.Match, as well as comma-separated values in curly
 // braces such as "foo.{bar,baz}".
@@ -16,6 +16,7 @@
 package dsl
 
 import (
+	"context"
 	"time"
 
 	"github.com/jdcio/tgres/rrd"
@@ -66,8 +67,8 @@ func (m mapCache) Search(_ serde.SearchQuery) (serde.SearchResult, error) {
 	return sr, nil
 }
 
-func (mapCache) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
-	return series.NewRRASeries(ds.RRAs()[0]), nil
+func (mapCache) FetchSeries(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	return series.NewContextSeries(ctx, series.NewRRASeries(ds.RRAs()[0])), nil
 }
 
 func (mapCache) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
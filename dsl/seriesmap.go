@@ -41,14 +41,117 @@ import "sort"
 //  - does NOT implement Series, it's a container of series, but not a series
 //  - is how we give Series names - the key is the name
 //  - does not support duplicates - same series would need different names
+//  - can carry grouped series lists (Graphite "list of lists", see
+//    mapSeries()), a series belongs to a group if it is a grouper,
+//    to anything not group-aware it is still a flat list
+//  - is ordered by key, unless series have a position (see sortByName())
 type SeriesMap map[string]AliasSeries
 
+// A series which belongs to a group within a SeriesMap
+type grouper interface {
+	Group() string
+}
+
+type groupedSeries struct {
+	AliasSeries
+	group string
+}
+
+func (gs *groupedSeries) Group() string { return gs.group }
+
+// Groups splits the SeriesMap by group and returns the sorted group
+// keys along with the groups. Series not belonging to any group end
+// up in the "" group.
+func (sm SeriesMap) Groups() ([]string, map[string]SeriesMap) {
+	groups := make(map[string]SeriesMap)
+	for name, s := range sm {
+		var group string
+		if g, ok := s.(grouper); ok {
+			group = g.Group()
+		}
+		if groups[group] == nil {
+			groups[group] = make(SeriesMap)
+		}
+		groups[group][name] = s
+	}
+	keys := make([]string, 0, len(groups))
+	for k, _ := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, groups
+}
+
+// A series which has a position within a SeriesMap. A negative
+// position means that it has none.
+type positioner interface {
+	Position() int
+}
+
+type positionedSeries struct {
+	AliasSeries
+	pos int
+}
+
+func (ps *positionedSeries) Position() int { return ps.pos }
+
+// Group preserves the grouping (if any) of the underlying series.
+func (ps *positionedSeries) Group() string {
+	if g, ok := ps.AliasSeries.(grouper); ok {
+		return g.Group()
+	}
+	return ""
+}
+
+// positioned returns a SeriesMap in which the series are in the
+// order of keys. Series not in keys are omitted.
+func (sm SeriesMap) positioned(keys []string) SeriesMap {
+	result := make(SeriesMap, len(keys))
+	for n, key := range keys {
+		s := sm[key]
+		if ps, ok := s.(*positionedSeries); ok {
+			s = ps.AliasSeries
+		}
+		result[key] = &positionedSeries{AliasSeries: s, pos: n}
+	}
+	return result
+}
+
+// close closes all the series, which is necessary for those which
+// are dropped rather than returned.
+func (sm SeriesMap) close() {
+	for _, s := range sm {
+		s.Close()
+	}
+}
+
+func (sm SeriesMap) position(key string) int {
+	if p, ok := sm[key].(positioner); ok {
+		return p.Position()
+	}
+	return -1
+}
+
+// SortedKeys returns the keys in the order in which the series should
+// be presented. Series with a position come first in that order, the
+// rest follow sorted by key.
 func (sm SeriesMap) SortedKeys() []string {
 	keys := make([]string, 0, len(sm))
+	anyPos := false
 	for k, _ := range sm {
 		keys = append(keys, k)
+		anyPos = anyPos || sm.position(k) >= 0
 	}
 	sort.Strings(keys)
+	if anyPos {
+		sort.SliceStable(keys, func(i, j int) bool {
+			pi, pj := sm.position(keys[i]), sm.position(keys[j])
+			if pi < 0 {
+				return false
+			}
+			return pj < 0 || pi < pj
+		})
+	}
 	return keys
 }
 
@@ -0,0 +1,127 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/serde"
+	"github.com/jdcio/tgres/series"
+)
+
+// sketchQuantile()
+
+// mergeSketches merges into sk the sketches of rra slots which end
+// after after and no later than upTo.
+func mergeSketches(sk *rrd.Sketch, rra rrd.RoundRobinArchiver, after, upTo time.Time) error {
+	slots, latest := rra.Slots(), rra.Latest()
+	if latest.IsZero() {
+		return nil
+	}
+	earliest := slots.Add(latest, -rra.Size())
+	for t := slots.Add(slots.Truncate(after), 1); !t.After(upTo); t = slots.Add(t, 1) {
+		if !t.After(earliest) || t.After(latest) {
+			continue
+		}
+		if s := rra.Sketches()[slots.Index(t)]; s != nil {
+			if err := sk.Merge(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sketchQuantile(q, seriesList) computes the q (0 to 1) quantile of
+// all the data source values of all the series for every point in
+// time from the sketches kept by their SKETCH RRAs. Unlike a
+// percentile of averages, this is the true quantile (within the
+// sketch accuracy), since sketches are merged across series and
+// time. The seriesList must be a name, as it is data sources rather
+// than series that are needed.
+func dslSketchQuantile(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("Expecting 2 arguments, got %d", len(args))
+	}
+	q, ok := args[0].(float64)
+	if !ok || q < 0 || q > 1 {
+		return nil, fmt.Errorf("q must be a number between 0 and 1, not %v", args[0])
+	}
+	pattern, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("seriesList must be a name, not %v", args[1])
+	}
+	sf, ok := dc.ctxDSFetcher.(serde.SketchFetcher)
+	if !ok {
+		return nil, fmt.Errorf("sketchQuantile(): sketches are not supported")
+	}
+
+	idents := dc.identsFromPattern(pattern)
+	if err := dc.addSeries(len(idents)); err != nil {
+		return nil, err
+	}
+	var (
+		rras []rrd.RoundRobinArchiver
+		step time.Duration
+	)
+	for _, ident := range idents {
+		if err := dc.ctx.Err(); err != nil {
+			return nil, err
+		}
+		ds, err := dc.FetchOrCreateDataSource(ident, nil)
+		if err != nil {
+			return nil, fmt.Errorf("sketchQuantile(): Error %v", err)
+		}
+		if ds == nil {
+			continue
+		}
+		rra, err := sf.FetchSketches(dc.ctx, ds, dc.from, dc.to, dc.maxPoints)
+		if err != nil {
+			return nil, fmt.Errorf("sketchQuantile(): %s: %v", ident, err)
+		}
+		rras = append(rras, rra)
+		if rra.Step() > step {
+			step = rra.Step()
+		}
+	}
+	if len(rras) == 0 {
+		return SeriesMap{}, nil
+	}
+
+	// The coarsest step, or coarser if maxPoints requires it
+	if n := int64(dc.to.Sub(dc.from) / step); dc.maxPoints > 0 && n > dc.maxPoints {
+		step *= time.Duration((n + dc.maxPoints - 1) / dc.maxPoints)
+	}
+
+	start := dc.from.Truncate(step)
+	var data []float64
+	for t := start; !t.After(dc.to); t = t.Add(step) {
+		sk := rrd.NewSketch(rrd.SketchAccuracy)
+		for _, rra := range rras {
+			if err := mergeSketches(sk, rra, t.Add(-step), t); err != nil {
+				return nil, fmt.Errorf("sketchQuantile(): %v", err)
+			}
+		}
+		data = append(data, sk.Quantile(q))
+	}
+
+	name := fmt.Sprintf("sketchQuantile(%v,%s)", q, pattern)
+	ss := series.NewSliceSeries(data, start, step)
+	ss.Alias(name)
+	return SeriesMap{name: ss}, nil
+}
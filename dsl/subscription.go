@@ -0,0 +1,127 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jdcio/tgres/serde"
+)
+
+// A Subscription keeps track of the data sources referenced by a DSL
+// expression and sends to its C channel whenever any of them
+// receives a new data point. This is only possible for data sources
+// that are watched by the LRU cache (i.e. query-cache-size is not 0
+// and the DS is handled by this node), for anything else the caller
+// should poll by calling Eval() periodically.
+type Subscription struct {
+	C         chan struct{}
+	db        NamedDSFetcher
+	src       string
+	maxSeries int
+	mu        *sync.Mutex
+	idents    map[string]serde.Ident
+	closed    bool
+}
+
+type subscriber interface {
+	subscribe(ident serde.Ident, ch chan struct{})
+	unsubscribe(ident serde.Ident, ch chan struct{})
+}
+
+// NewSubscription returns a Subscription for the DSL expression
+// src. maxSeries limits the number of data sources the expression
+// may reference, 0 means no limit. No data sources are subscribed
+// until Eval() is called.
+func NewSubscription(db NamedDSFetcher, src string, maxSeries int) *Subscription {
+	return &Subscription{
+		C:         make(chan struct{}, 1),
+		db:        db,
+		src:       src,
+		maxSeries: maxSeries,
+		mu:        &sync.Mutex{},
+		idents:    make(map[string]serde.Ident),
+	}
+}
+
+// Eval evaluates the expression, same as ParseDslContext, and
+// (re)subscribes to all the data sources it references, which may
+// change as series are added or removed.
+func (s *Subscription) Eval(ctx context.Context, from, to time.Time, maxPoints int64) (SeriesMap, error) {
+	rf := &recordingFetcher{ctxDSFetcher: s.db, idents: make(map[string]serde.Ident)}
+	sm, err := ParseDslContext(ctx, rf, s.src, from, to, maxPoints, s.maxSeries)
+	if err != nil {
+		return nil, err
+	}
+	s.update(rf.idents)
+	return sm, nil
+}
+
+func (s *Subscription) update(idents map[string]serde.Ident) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	sub, ok := s.db.(subscriber)
+	if !ok {
+		return
+	}
+	for k, ident := range s.idents {
+		if _, ok := idents[k]; !ok {
+			sub.unsubscribe(ident, s.C)
+		}
+	}
+	for k, ident := range idents {
+		if _, ok := s.idents[k]; !ok {
+			sub.subscribe(ident, s.C)
+		}
+	}
+	s.idents = idents
+}
+
+// Close unsubscribes from all data sources. It is safe to call Close
+// more than once.
+func (s *Subscription) Close() {
+	s.update(map[string]serde.Ident{})
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+}
+
+// Series returns the number of data sources currently subscribed.
+func (s *Subscription) Series() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.idents)
+}
+
+// recordingFetcher records the idents of every pattern looked up
+// while evaluating an expression.
+type recordingFetcher struct {
+	ctxDSFetcher
+	idents map[string]serde.Ident
+}
+
+func (r *recordingFetcher) identsFromPattern(pattern string) map[string]serde.Ident {
+	result := r.ctxDSFetcher.identsFromPattern(pattern)
+	for _, ident := range result {
+		r.idents[ident.String()] = ident
+	}
+	return result
+}
@@ -0,0 +1,124 @@
+package dsl
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jdcio/tgres/serde"
+)
+
+// subscribedNames returns the names of the DSs ch is subscribed to.
+func subscribedNames(d *dsLRU, ch chan struct{}) []string {
+	d.Lock()
+	defer d.Unlock()
+	var result []string
+	for key, subs := range d.subs {
+		if subs[ch] {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_Subscription(t *testing.T) {
+	when := time.Now().Truncate(time.Minute)
+	db := serde.NewMemSerDe()
+	rcache := NewNamedDSFetcher(db.Fetcher(), nil, 0)
+	td := &testData{when: when, from: when.Add(-time.Hour), to: when, db: db, rcache: rcache}
+	for _, name := range []string{"sub.a", "sub.b"} {
+		if err := createTestDS(td, name, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b, c := serde.Ident{"name": "sub.a"}, serde.Ident{"name": "sub.b"}, serde.Ident{"name": "sub.c"}
+
+	sub := NewSubscription(rcache, `group("sub.*")`, 0)
+	if names := subscribedNames(rcache.dsLRU, sub.C); len(names) != 0 {
+		t.Errorf("expected no subscriptions before Eval(), got %v", names)
+	}
+	eval := func() {
+		if _, err := sub.Eval(context.Background(), td.from, td.to, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	eval()
+	if names, expect := subscribedNames(rcache.dsLRU, sub.C), []string{a.String(), b.String()}; !sameStrings(names, expect) || sub.Series() != 2 {
+		t.Errorf("expected subscriptions %v, got %v (%d)", expect, names, sub.Series())
+	}
+	rcache.dsLRU.notify(a)
+	select {
+	case <-sub.C:
+	default:
+		t.Errorf("expected a notification for %v", a)
+	}
+
+	// a new series matching the pattern is subscribed to...
+	if err := createTestDS(td, "sub.c", 1); err != nil {
+		t.Fatal(err)
+	}
+	eval()
+	if names, expect := subscribedNames(rcache.dsLRU, sub.C), []string{a.String(), b.String(), c.String()}; !sameStrings(names, expect) {
+		t.Errorf("after adding sub.c: expected subscriptions %v, got %v", expect, names)
+	}
+
+	// ...and one that no longer exists is unsubscribed
+	db.DeleteDataSource(a)
+	rcache.Forget(a)
+	eval()
+	if names, expect := subscribedNames(rcache.dsLRU, sub.C), []string{b.String(), c.String()}; !sameStrings(names, expect) || sub.Series() != 2 {
+		t.Errorf("after deleting sub.a: expected subscriptions %v, got %v (%d)", expect, names, sub.Series())
+	}
+	rcache.dsLRU.notify(a)
+	select {
+	case <-sub.C:
+		t.Errorf("unexpected notification for %v after unsubscribing", a)
+	default:
+	}
+
+	// an error leaves the subscriptions as they are
+	sub.src = `group("sub.*", nosuchfunc())`
+	if _, err := sub.Eval(context.Background(), td.from, td.to, 100); err == nil {
+		t.Errorf("expected an error")
+	}
+	if sub.Series() != 2 {
+		t.Errorf("expected 2 subscriptions after an error, got %d", sub.Series())
+	}
+
+	sub.Close()
+	sub.Close()
+	if names := subscribedNames(rcache.dsLRU, sub.C); len(names) != 0 || sub.Series() != 0 {
+		t.Errorf("expected no subscriptions after Close(), got %v", names)
+	}
+	sub.update(map[string]serde.Ident{b.String(): b})
+	if names := subscribedNames(rcache.dsLRU, sub.C); len(names) != 0 {
+		t.Errorf("expected update() after Close() to do nothing, got %v", names)
+	}
+
+	// maxSeries
+	lim := NewSubscription(rcache, `group("sub.*")`, 1)
+	defer lim.Close()
+	if _, err := lim.Eval(context.Background(), td.from, td.to, 100); err == nil {
+		t.Errorf("maxSeries: expected an error")
+	} else if le, ok := err.(*LimitError); !ok || le.What != "series" {
+		t.Errorf("maxSeries: expected a series *LimitError, got %v", err)
+	}
+	if names := subscribedNames(rcache.dsLRU, lim.C); len(names) != 0 {
+		t.Errorf("maxSeries: expected no subscriptions, got %v", names)
+	}
+}
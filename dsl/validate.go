@@ -0,0 +1,424 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Before anything is evaluated, the expression is checked against the
+// function table: the function names, the number of arguments and
+// their types, as far as they can be known without evaluating
+// anything. Errors are reported with the offset in the expression as
+// it was given, i.e. before escaping (see escapeSrc()) and macro
+// expansion.
+
+// A ValidationError is an invalid DSL expression.
+type ValidationError struct {
+	Src    string // the expression
+	Offset int    // where the problem is, in bytes from the beginning of Src
+	Func   string // the function, if any
+	Msg    string
+}
+
+func (e *ValidationError) Error() string {
+	where := fmt.Sprintf("at offset %d", e.Offset)
+	if e.Func != "" {
+		where += fmt.Sprintf(" in %s()", e.Func)
+	}
+	return fmt.Sprintf("Error parsing %q %s: %s", e.Src, where, e.Msg)
+}
+
+// The arguments of the dslCtxFuncs, which process their arguments
+// themselves. They are only used for validation and the function
+// list, functions not here (e.g. infix()) are not validated.
+var dslCtxFuncArgs = map[string]dslFuncType{
+	"sumSeriesWithWildcards": dslFuncType{nil, true, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"position", argNumber, nil}}},
+	"averageSeriesWithWildcards": dslFuncType{nil, true, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"position", argNumber, nil}}},
+	"groupByNode": dslFuncType{nil, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"nodeNum", argNumber, nil},
+		argDef{"callback", argString, nil}}},
+	"timeStack": dslFuncType{nil, false, []argDef{
+		argDef{"seriesList", argString, nil}, // a name only, not a series
+		argDef{"timeShiftUnit", argString, nil},
+		argDef{"timeShiftStart", argNumber, nil},
+		argDef{"timeShiftEnd", argNumber, nil}}},
+	"aggregateWithWildcards": dslFuncType{nil, true, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"func", argString, nil},
+		argDef{"positions", argNumber, ""}}}, // may be none
+	"reduceSeries": dslFuncType{nil, true, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"reduceFunction", argString, nil},
+		argDef{"reduceNode", argNumber, nil},
+		argDef{"reduceMatchers", argString, nil}}},
+	"applyByNode": dslFuncType{nil, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"nodeNum", argNumber, nil},
+		argDef{"templateFunction", argString, nil},
+		argDef{"newName", argString, ""}}},
+	"histogramQuantile": dslFuncType{nil, false, []argDef{
+		argDef{"q", argNumber, nil},
+		argDef{"seriesList", argSeries, nil},
+		argDef{"bucketNode", argString, nil}}}, // a node number or a tag name
+	"histogramHeatmap": dslFuncType{nil, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"bucketNode", argString, nil}}},
+	"sketchQuantile": dslFuncType{nil, false, []argDef{
+		argDef{"q", argNumber, nil},
+		argDef{"seriesList", argString, nil}}}, // a name only, not a series
+}
+
+// What an argument is, as far as can be told from the AST.
+type exprKind int
+
+const (
+	exprNumber exprKind = iota
+	exprString          // quoted
+	exprName            // e.g. foo.bar, a series name (or true/false)
+	exprSeries          // the result of a function or an operator
+)
+
+var exprKindNames = map[exprKind]string{
+	exprNumber: "a number",
+	exprString: "a string",
+	exprName:   "a name",
+	exprSeries: "a series",
+}
+
+type validator struct {
+	src    string // as given
+	escSrc string // escaped, which the AST positions refer to
+	mm     macroMap
+	escOff []int // escaped offset of every src offset, see error()
+}
+
+// validate checks the expression src (escSrc escaped, see
+// escapeSrc()), macros mm are valid functions.
+func validate(src, escSrc string, mm macroMap) error {
+	v := &validator{src: src, escSrc: escSrc, mm: mm}
+	tr, err := parser.ParseExpr(escSrc)
+	if err != nil {
+		if el, ok := err.(scanner.ErrorList); ok && len(el) > 0 {
+			return v.error(el[0].Pos.Offset, "", "%s", el[0].Msg)
+		}
+		return v.error(0, "", "%s", err.Error())
+	}
+	_, err = v.expr(tr)
+	return err
+}
+
+// error returns a *ValidationError at the offset off in escSrc.
+func (v *validator) error(off int, fn string, format string, args ...interface{}) error {
+	if v.escOff == nil {
+		v.escOff = escOffsets(v.src)
+	}
+	return &ValidationError{Src: v.src, Offset: srcOffset(v.escOff, off), Func: fn, Msg: fmt.Sprintf(format, args...)}
+}
+
+// escOffsets returns the offset in escapeSrc(src) of every offset in
+// src (and of its end). Outside of infix operators every character is
+// escaped on its own, with the keyword strings fix moving a quote
+// rather than adding one, which is what makes this possible.
+func escOffsets(src string) []int {
+	ops := infixOperator.FindAllStringIndex(src, -1)
+	result := make([]int, len(src)+1)
+	for i := 0; i < len(src); i++ {
+		for len(ops) > 0 && ops[0][1] <= i {
+			ops = ops[1:]
+		}
+		w := 1
+		if len(ops) == 0 || i < ops[0][0] {
+			w = len(fixBackSlashes(escapeBadPart(src[i : i+1])))
+		}
+		result[i+1] = result[i] + w
+	}
+	return result
+}
+
+// srcOffset returns the offset in src which corresponds to the offset
+// off in the escaped src, given escOffsets(src).
+func srcOffset(escOff []int, off int) int {
+	if i := sort.SearchInts(escOff, off); i < len(escOff) {
+		return i
+	}
+	return len(escOff) - 1
+}
+
+// text returns the unescaped source of e.
+func (v *validator) text(e ast.Node) string {
+	return unEscapeBadChars(v.escSrc[e.Pos()-1 : e.End()-1])
+}
+
+func (v *validator) expr(e ast.Expr) (exprKind, error) {
+	switch t := e.(type) {
+	case *ast.ParenExpr:
+		return v.expr(t.X)
+	case *ast.BasicLit:
+		switch t.Kind {
+		case token.INT, token.FLOAT:
+			return exprNumber, nil
+		case token.STRING:
+			return exprString, nil
+		}
+	case *ast.Ident, *ast.SelectorExpr:
+		return exprName, nil
+	case *ast.UnaryExpr:
+		if _, ok := astNumber(t); ok {
+			return exprNumber, nil
+		}
+		return 0, v.error(int(t.Pos())-1, "", "expecting a number after %s", t.Op)
+	case *ast.BinaryExpr:
+		x, err := v.expr(t.X)
+		if err != nil {
+			return 0, err
+		}
+		y, err := v.expr(t.Y)
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := infixFuncs[t.Op.String()]; !ok {
+			return 0, v.error(int(t.OpPos)-1, "", "unsupported operator: %v", t.Op)
+		}
+		for _, operand := range []struct {
+			e    ast.Expr
+			kind exprKind
+		}{{t.X, x}, {t.Y, y}} {
+			if _, ok := quotedNumber(operand.e); ok {
+				return 0, v.error(int(operand.e.Pos())-1, "", "a quoted number cannot be an operand of %v: %s", t.Op, v.text(operand.e))
+			}
+		}
+		if x == exprNumber && y == exprNumber {
+			return exprNumber, nil
+		}
+		return exprSeries, nil
+	case *ast.CallExpr:
+		return exprSeries, v.call(t)
+	}
+	return 0, v.error(int(e.Pos())-1, "", "unsupported expression: %s", v.text(e))
+}
+
+func (v *validator) call(call *ast.CallExpr) error {
+	name := callName(call)
+	if name == "" {
+		return v.error(int(call.Pos())-1, "", "not a function: %s", v.text(call.Fun))
+	}
+
+	args := call.Args
+	if sel, ok := call.Fun.(*ast.SelectorExpr); ok { // chained
+		args = append([]ast.Expr{sel.X}, args...)
+	}
+	kinds := make([]exprKind, len(args))
+	for i, arg := range args {
+		var err error
+		if kinds[i], err = v.expr(arg); err != nil {
+			return err
+		}
+	}
+
+	fn, ok := preprocessArgFuncs[name]
+	if !ok {
+		fn, ok = dslCtxFuncArgs[name]
+	}
+	if !ok {
+		if m, ok := v.mm[name]; ok {
+			if len(args) != len(m.Params) {
+				return v.error(int(call.Pos())-1, name, "takes %d argument(s), got %d", len(m.Params), len(args))
+			}
+			return nil
+		}
+		if _, ok := dslCtxFuncs[name]; ok {
+			return nil // not validated
+		}
+		pos := call.Fun.Pos()
+		if sel, ok := call.Fun.(*ast.SelectorExpr); ok {
+			pos = sel.Sel.Pos()
+		}
+		return v.error(int(pos)-1, "", "no such function: %s", name)
+	}
+	return v.args(call, name, &fn, args, kinds)
+}
+
+// args checks args against the function definition the same way
+// processArgs() processes them.
+func (v *validator) args(call *ast.CallExpr, name string, fn *dslFuncType, args []ast.Expr, kinds []exprKind) error {
+	var (
+		positional []int // indexes in args
+		kwargs     = make(map[string]ast.Expr)
+	)
+	for i, arg := range args {
+		text := v.text(arg)
+		if kinds[i] == exprString {
+			text = text[1 : len(text)-1]
+		}
+		if (kinds[i] == exprString || kinds[i] == exprName) && strings.Contains(text, "=") {
+			kwargs[strings.SplitN(text, "=", 2)[0]] = arg
+			continue
+		}
+		if len(kwargs) > 0 {
+			return v.error(int(arg.Pos())-1, name, "positional argument %d follows keyword arguments", i+1)
+		}
+		positional = append(positional, i)
+	}
+
+	for kw, arg := range kwargs {
+		found := false
+		for _, ad := range fn.args {
+			found = found || ad.name == kw
+		}
+		if !found {
+			return v.error(int(arg.Pos())-1, name, "unknown keyword argument: %s", kw)
+		}
+	}
+
+	for n, ad := range fn.args {
+		last := fn.varArg && n == len(fn.args)-1
+		if n >= len(positional) {
+			if _, ok := kwargs[ad.name]; !ok && ad.dft == nil {
+				return v.error(int(call.Rparen)-1, name, "missing argument %d (%s)", n+1, ad.name)
+			}
+			continue
+		}
+		limit := n + 1
+		if last {
+			limit = len(positional)
+		}
+		for _, i := range positional[n:limit] {
+			if err := v.arg(name, i, ad, args[i], kinds[i]); err != nil {
+				return err
+			}
+		}
+	}
+	if !fn.varArg && len(positional) > len(fn.args) {
+		i := positional[len(fn.args)]
+		return v.error(int(args[i].Pos())-1, name, "takes at most %d argument(s), got %d", len(fn.args), len(positional))
+	}
+	return nil
+}
+
+func (v *validator) arg(name string, i int, ad argDef, arg ast.Expr, kind exprKind) error {
+	var ok bool
+	text := v.text(arg)
+	switch ad.tp {
+	case argSeries:
+		ok = kind != exprNumber
+	case argNumber:
+		if ok = kind == exprNumber; !ok && kind != exprSeries {
+			if kind == exprString {
+				text = text[1 : len(text)-1]
+			}
+			_, err := strconv.ParseFloat(text, 64)
+			ok = err == nil
+		}
+	case argString:
+		ok = kind != exprSeries
+	case argBool:
+		if kind == exprString {
+			text = text[1 : len(text)-1]
+		}
+		text = strings.ToLower(text)
+		ok = kind != exprSeries && (text == "true" || text == "false")
+	case argNumberOrSeries:
+		ok = true
+	}
+	if !ok {
+		return v.error(int(arg.Pos())-1, name, "argument %d (%s) expecting %s, got %s",
+			i+1, ad.name, argTypeNames[ad.tp], exprKindNames[kind])
+	}
+	return nil
+}
+
+var argTypeNames = map[argType]string{
+	argSeries:         "a series",
+	argNumber:         "a number",
+	argString:         "a string",
+	argBool:           "true or false",
+	argNumberOrSeries: "a number or a series",
+}
+
+// A FuncParam is a parameter of a function (see FuncSignature).
+type FuncParam struct {
+	Name     string
+	Type     string // series, number, string, bool or numberOrSeries
+	Default  string // "" if required, otherwise Optional is true
+	Optional bool
+	Multiple bool // the rest of the arguments, e.g. sumSeries(*seriesList)
+}
+
+// A FuncSignature describes a function which can be used in a DSL
+// expression, e.g. for editor autocompletion.
+type FuncSignature struct {
+	Name   string
+	Params []FuncParam
+	Macro  bool // user defined, see Macro
+}
+
+var argTypeParamTypes = map[argType]string{
+	argSeries:         "series",
+	argNumber:         "number",
+	argString:         "string",
+	argBool:           "bool",
+	argNumberOrSeries: "numberOrSeries",
+}
+
+func newFuncSignature(name string, fn *dslFuncType) *FuncSignature {
+	sig := &FuncSignature{Name: name}
+	for n, ad := range fn.args {
+		p := FuncParam{Name: ad.name, Type: argTypeParamTypes[ad.tp], Optional: ad.dft != nil}
+		p.Multiple = fn.varArg && n == len(fn.args)-1
+		if f, ok := ad.dft.(float64); ok && math.IsNaN(f) {
+			p.Default = "None"
+		} else if ad.dft != nil && !p.Multiple {
+			p.Default = fmt.Sprintf("%v", ad.dft)
+		}
+		sig.Params = append(sig.Params, p)
+	}
+	return sig
+}
+
+// Functions returns the signatures of all the functions, including
+// macros, sorted by name.
+func Functions() []*FuncSignature {
+	var result []*FuncSignature
+	for name, fn := range preprocessArgFuncs {
+		result = append(result, newFuncSignature(name, &fn))
+	}
+	for name, fn := range dslCtxFuncArgs {
+		result = append(result, newFuncSignature(name, &fn))
+	}
+	for _, m := range Macros() {
+		sig := &FuncSignature{Name: m.Name, Macro: true}
+		for _, p := range m.Params {
+			sig.Params = append(sig.Params, FuncParam{Name: p})
+		}
+		result = append(result, sig)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
@@ -0,0 +1,91 @@
+package dsl
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_dsl_validate(t *testing.T) {
+	m, err := DefineMacro("twice(x) = scale(x, 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer UndefineMacro(m.Name)
+
+	for _, target := range []string{
+		"scale(a.b, 2)",
+		"group('a.*').scale(2)",
+		"sortByName(a.b.*, natural=true, reverse=true)",
+		"cactiStyle(a.b.d*, units='req')",
+		"asPercent(a, None)",
+		"sumSeries(a, b, c) / 2 + 1",
+		"sumSeriesWithWildcards(a.*.b, 1, 2)",
+		"histogramQuantile(0.9, a.*, 'le')",
+		"twice(a.b).twice()",
+		"percentileOfSeries(a.*, '95', true)",
+		"nonNegativeDerivative(a, maxValue=inf)",
+	} {
+		if err := validate(target, escapeSrc(target), currentMacros()); err != nil {
+			t.Errorf("%s: unexpected %v", target, err)
+		}
+	}
+
+	for _, c := range []struct {
+		target string
+		offset int
+		fn     string
+		msg    string
+	}{
+		{"scale(a.b, 2", 12, "", "missing ','"},
+		{"nosuch(a.b)", 0, "", "no such function: nosuch"},
+		{"group(a.b).nosuch(1)", 11, "", "no such function: nosuch"},
+		{"scale(a.b, x.y)", 11, "scale", "argument 2 (factor) expecting a number, got a name"},
+		{"scale(2, 'a-b')", 6, "scale", "argument 1 (seriesList) expecting a series, got a number"},
+		{"alias(a.*, group(b))", 11, "alias", "expecting a string, got a series"},
+		{"scale(a.b)", 9, "scale", "missing argument 2 (factor)"},
+		{"scale(a.b, 1, 2)", 14, "scale", "takes at most 2 argument(s), got 3"},
+		{"sortByName(a.*, bogus=true)", 16, "sortByName", "unknown keyword argument: bogus"},
+		{"sortByName(a.*, natural=true, false)", 30, "sortByName", "follows keyword arguments"},
+		{"percentileOfSeries(a.*, 95, maybe)", 28, "percentileOfSeries", "expecting true or false"},
+		{"sumSeries(a.*) && b", 15, "", "unsupported operator: &&"},
+		{"twice(a, b)", 0, "twice", "takes 1 argument(s), got 2"},
+		{"sumSeries(a, scale('x*y-z', '*'))", 28, "scale", "argument 2 (factor) expecting a number"},
+		{"a-b.c * scale(a.b, x.y)", 19, "scale", "argument 2 (factor) expecting a number"},
+		{"scale(%, 2)", 6, "", "found '%'"},
+		{"a.b * '2'", 6, "", "a quoted number cannot be an operand of *"},
+	} {
+		err := validate(c.target, escapeSrc(c.target), currentMacros())
+		verr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("%s: expected a *ValidationError, got %v", c.target, err)
+			continue
+		}
+		if verr.Offset != c.offset || verr.Func != c.fn || !strings.Contains(verr.Msg, c.msg) {
+			t.Errorf("%s: expected %q in %s() at %d, got %q in %s() at %d",
+				c.target, c.msg, c.fn, c.offset, verr.Msg, verr.Func, verr.Offset)
+		}
+	}
+
+	// ParseDsl reports it as is, before fetching anything
+	_, err = ParseDsl(&compatFetcher{}, "scale(a.b, x)", time.Now().Add(-time.Hour), time.Now(), 10)
+	if _, ok := err.(*ValidationError); !ok {
+		t.Errorf("expected a *ValidationError, got %v", err)
+	}
+
+	found := false
+	for _, fn := range Functions() {
+		if fn.Name == "scale" {
+			found = len(fn.Params) == 2 && fn.Params[1].Name == "factor" && fn.Params[1].Type == "number" && !fn.Params[1].Optional
+		}
+		if fn.Name == "twice" && !fn.Macro {
+			t.Errorf("twice() should be a macro")
+		}
+		if fn.Name == "infix" {
+			t.Errorf("infix() should not be listed")
+		}
+	}
+	if !found {
+		t.Errorf("scale(seriesList, factor) not found in Functions()")
+	}
+}
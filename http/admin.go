@@ -0,0 +1,419 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jdcio/tgres/dsl"
+	"github.com/jdcio/tgres/misc"
+	"github.com/jdcio/tgres/receiver"
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/serde"
+)
+
+// This file implements the data source administration API. A DS is
+// identified either by the "name" parameter (a dotted name, same as
+// in the DSL), or by "ident", which is the full ident as JSON. All
+// changes go through the serde, which notifies every node so that
+// cached copies of the DS are dropped and reloaded. Note that a
+// deleted DS will be created again if data points matching a [[ds]]
+// config section keep arriving for it.
+
+type adminDS struct {
+	Ident      serde.Ident `json:"ident"`
+	Id         int64       `json:"id,omitempty"`
+	Step       string      `json:"step"`
+	Heartbeat  string      `json:"heartbeat"`
+	Type       string      `json:"type"`
+	Fill       string      `json:"fill"`
+	Min        *float64    `json:"min,omitempty"`
+	Max        *float64    `json:"max,omitempty"`
+	Fields     []string    `json:"fields,omitempty"`
+	LastUpdate time.Time   `json:"lastUpdate"`
+	RRAs       []*adminRRA `json:"rras"`
+}
+
+type adminRRA struct {
+	CF       string    `json:"cf"`
+	Step     string    `json:"step"`
+	Span     string    `json:"span"`
+	Size     int64     `json:"size"`
+	Xff      float32   `json:"xff"`
+	Season   string    `json:"season,omitempty"`
+	TZ       string    `json:"tz,omitempty"`
+	Field    string    `json:"field,omitempty"`
+	Latest   time.Time `json:"latest"`
+	BundleId int64     `json:"bundleId,omitempty"`
+	Seg      int64     `json:"seg,omitempty"`
+	Idx      int64     `json:"idx,omitempty"`
+}
+
+type adminDeleteResult struct {
+	DryRun  bool     `json:"dryRun"`
+	Deleted []string `json:"deleted"`
+}
+
+// AdminDSHandler shows the spec, state and RRAs of a DS.
+func AdminDSHandler(db serde.Fetcher) http.HandlerFunc {
+	return adminHandler("GET", func(w http.ResponseWriter, r *http.Request) {
+		ident, err := adminIdent(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ds, err := db.FetchOrCreateDataSource(ident, nil)
+		writeAdminDS(w, "AdminDSHandler", ident, ds, err)
+	})
+}
+
+// AdminDSDeleteHandler deletes all DSs whose names match the "target"
+// pattern. If "dryrun" is set, the names are only listed.
+func AdminDSDeleteHandler(db serde.Fetcher, rcache dsl.NamedDSFetcher) http.HandlerFunc {
+	return adminHandler("POST", func(w http.ResponseWriter, r *http.Request) {
+		adm, ok := db.(serde.DataSourceAdmin)
+		if !ok {
+			http.Error(w, "not supported by this serde", http.StatusNotImplemented)
+			return
+		}
+		target := r.FormValue("target")
+		if target == "" {
+			http.Error(w, "target required", http.StatusBadRequest)
+			return
+		}
+		dryRun, _ := strconv.ParseBool(r.FormValue("dryrun"))
+
+		result := &adminDeleteResult{DryRun: dryRun, Deleted: []string{}}
+		for _, node := range rcache.FsFind(target) {
+			if !node.Leaf {
+				continue
+			}
+			if !dryRun {
+				ds, err := adm.DeleteDataSource(node.Ident())
+				if err != nil {
+					log.Printf("AdminDSDeleteHandler(): %v", err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if ds == nil {
+					continue // deleted in the meantime
+				}
+			}
+			result.Deleted = append(result.Deleted, node.Name)
+		}
+		sort.Strings(result.Deleted)
+		writeJSON(w, "AdminDSDeleteHandler", result)
+	})
+}
+
+// AdminDSHeartbeatHandler sets the DS heartbeat to "heartbeat".
+func AdminDSHeartbeatHandler(db serde.Fetcher) http.HandlerFunc {
+	return adminHandler("POST", func(w http.ResponseWriter, r *http.Request) {
+		adm, ok := db.(serde.DataSourceAdmin)
+		if !ok {
+			http.Error(w, "not supported by this serde", http.StatusNotImplemented)
+			return
+		}
+		ident, err := adminIdent(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hb, err := misc.BetterParseDuration(r.FormValue("heartbeat"))
+		if err != nil || hb < 0 {
+			http.Error(w, fmt.Sprintf("invalid heartbeat: %q", r.FormValue("heartbeat")), http.StatusBadRequest)
+			return
+		}
+		ds, err := adm.SetHeartbeat(ident, hb)
+		writeAdminDS(w, "AdminDSHeartbeatHandler", ident, ds, err)
+	})
+}
+
+// AdminRRAAddHandler adds an RRA described by the "cf", "step",
+// "span", "xff" and (Holt-Winters CFs only) "season" parameters to the
+// DS. With a "tz" parameter the step is in days, weeks or months
+// ("1d", "1w", "1mon") and slots follow the calendar of that time
+// zone. Adding an RRA which already exists does nothing.
+func AdminRRAAddHandler(db serde.Fetcher) http.HandlerFunc {
+	return adminHandler("POST", func(w http.ResponseWriter, r *http.Request) {
+		adm, ok := db.(serde.DataSourceAdmin)
+		if !ok {
+			http.Error(w, "not supported by this serde", http.StatusNotImplemented)
+			return
+		}
+		ident, err := adminIdent(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		spec, err := adminRRASpec(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ds, err := db.FetchOrCreateDataSource(ident, nil)
+		if err != nil || ds == nil {
+			writeAdminDS(w, "AdminRRAAddHandler", ident, ds, err)
+			return
+		}
+		if spec.Step%ds.Step() != 0 {
+			http.Error(w, fmt.Sprintf("RRA step (%v) must be a multiple of DS step (%v)", spec.Step, ds.Step()), http.StatusBadRequest)
+			return
+		}
+		ds, err = adm.AddRRA(ident, spec)
+		writeAdminDS(w, "AdminRRAAddHandler", ident, ds, err)
+	})
+}
+
+// AdminRRARemoveHandler removes the RRA matching the "cf", "step" and
+// "span" parameters from the DS along with all its data.
+func AdminRRARemoveHandler(db serde.Fetcher) http.HandlerFunc {
+	return adminHandler("POST", func(w http.ResponseWriter, r *http.Request) {
+		adm, ok := db.(serde.DataSourceAdmin)
+		if !ok {
+			http.Error(w, "not supported by this serde", http.StatusNotImplemented)
+			return
+		}
+		ident, err := adminIdent(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		spec, err := adminRRASpec(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ds, err := adm.RemoveRRA(ident, spec)
+		writeAdminDS(w, "AdminRRARemoveHandler", ident, ds, err)
+	})
+}
+
+// AdminDSMigrateHandler migrates the DS to a new spec given by the
+// "step", "heartbeat", "fill" and repeated "rra" parameters, the
+// latter in config syntax (e.g. "max:1m:400d" or
+// "1d@Europe/Paris:2y"). Omitted parameters default to what the DS has
+// now. Data of the new RRAs is resampled from the existing ones, RRAs
+// not listed are removed. Unless rcvr is nil, the migration is done
+// by the receiver, which first writes the data it has in memory.
+func AdminDSMigrateHandler(db serde.Fetcher, rcvr *receiver.Receiver) http.HandlerFunc {
+	return adminHandler("POST", func(w http.ResponseWriter, r *http.Request) {
+		adm, ok := db.(serde.DataSourceAdmin)
+		if !ok {
+			http.Error(w, "not supported by this serde", http.StatusNotImplemented)
+			return
+		}
+		ident, err := adminIdent(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ds, err := db.FetchOrCreateDataSource(ident, nil)
+		if err != nil || ds == nil {
+			writeAdminDS(w, "AdminDSMigrateHandler", ident, ds, err)
+			return
+		}
+
+		spec := ds.Spec()
+		if s := r.FormValue("step"); s != "" {
+			if spec.Step, err = misc.BetterParseDuration(s); err != nil || spec.Step <= 0 {
+				http.Error(w, fmt.Sprintf("invalid step: %q", s), http.StatusBadRequest)
+				return
+			}
+		}
+		if s := r.FormValue("heartbeat"); s != "" {
+			if spec.Heartbeat, err = misc.BetterParseDuration(s); err != nil || spec.Heartbeat < 0 {
+				http.Error(w, fmt.Sprintf("invalid heartbeat: %q", s), http.StatusBadRequest)
+				return
+			}
+		}
+		if s := r.FormValue("fill"); s != "" {
+			if spec.Fill, err = rrd.ParseFillPolicy(s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if rras := r.Form["rra"]; len(rras) > 0 { // r.Form is parsed by FormValue
+			spec.RRAs = nil
+			for _, s := range rras {
+				rraSpec, err := rrd.ParseRRASpec(s)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				spec.RRAs = append(spec.RRAs, rraSpec)
+			}
+		}
+		for i := range spec.RRAs {
+			rraSpec := &spec.RRAs[i]
+			if rraSpec.Location != nil {
+				rraSpec.Span = rraSpec.Span / rraSpec.Step * rraSpec.Step // calendar steps are approximate
+			}
+			if rraSpec.Span < rraSpec.Step || rraSpec.Span%rraSpec.Step != 0 {
+				http.Error(w, fmt.Sprintf("span (%v) must be a multiple of step (%v)", rraSpec.Span, rraSpec.Step), http.StatusBadRequest)
+				return
+			}
+			if rraSpec.Step%spec.Step != 0 {
+				http.Error(w, fmt.Sprintf("RRA step (%v) must be a multiple of DS step (%v)", rraSpec.Step, spec.Step), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if rcvr != nil {
+			ds, err = rcvr.MigrateDataSource(ident, &spec)
+		} else {
+			ds, err = adm.MigrateDataSource(ident, &spec)
+		}
+		writeAdminDS(w, "AdminDSMigrateHandler", ident, ds, err)
+	})
+}
+
+func adminHandler(method string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fn(w, r)
+	}
+}
+
+func adminIdent(r *http.Request) (serde.Ident, error) {
+	if s := r.FormValue("ident"); s != "" {
+		var ident serde.Ident
+		if err := json.Unmarshal([]byte(s), &ident); err != nil {
+			return nil, fmt.Errorf("invalid ident: %v", err)
+		}
+		return ident, nil
+	}
+	if name := r.FormValue("name"); name != "" {
+		return serde.Ident{"name": name}, nil
+	}
+	return nil, fmt.Errorf("name or ident required")
+}
+
+func adminRRASpec(r *http.Request) (rrd.RRASpec, error) {
+	var (
+		spec rrd.RRASpec
+		err  error
+	)
+	if cf := r.FormValue("cf"); cf != "" {
+		if spec.Function, err = rrd.ParseConsolidation(cf); err != nil {
+			return spec, err
+		}
+	}
+	if tz := r.FormValue("tz"); tz != "" {
+		if spec.Calendar, err = misc.ParseCalendarInterval(r.FormValue("step")); err != nil || spec.Calendar.Dur != 0 {
+			return spec, fmt.Errorf("invalid step: %q (must be days, weeks or months with tz)", r.FormValue("step"))
+		}
+		if spec.Location, err = time.LoadLocation(tz); err != nil {
+			return spec, fmt.Errorf("invalid tz: %q", tz)
+		}
+		spec.Step = spec.Calendar.Approx()
+	} else if spec.Step, err = misc.BetterParseDuration(r.FormValue("step")); err != nil || spec.Step <= 0 {
+		return spec, fmt.Errorf("invalid step: %q", r.FormValue("step"))
+	}
+	if spec.Span, err = misc.BetterParseDuration(r.FormValue("span")); err != nil || spec.Span < spec.Step {
+		return spec, fmt.Errorf("invalid span: %q", r.FormValue("span"))
+	}
+	if spec.Location != nil {
+		spec.Span = spec.Span / spec.Step * spec.Step // calendar steps are approximate
+	}
+	if spec.Span%spec.Step != 0 {
+		return spec, fmt.Errorf("span (%v) must be a multiple of step (%v)", spec.Span, spec.Step)
+	}
+	if s := r.FormValue("xff"); s != "" {
+		xff, err := strconv.ParseFloat(s, 32)
+		if err != nil || xff < 0 || xff > 1 {
+			return spec, fmt.Errorf("invalid xff: %q", s)
+		}
+		spec.Xff = float32(xff)
+	}
+	if s := r.FormValue("season"); s != "" {
+		if spec.Season, err = misc.BetterParseDuration(s); err != nil || spec.Season < spec.Step || !spec.Function.IsHoltWinters() {
+			return spec, fmt.Errorf("invalid season: %q", s)
+		}
+	}
+	return spec, nil
+}
+
+func writeAdminDS(w http.ResponseWriter, name string, ident serde.Ident, ds rrd.DataSourcer, err error) {
+	if err != nil {
+		log.Printf("%s(): %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ds == nil {
+		http.Error(w, fmt.Sprintf("not found: %s", ident), http.StatusNotFound)
+		return
+	}
+
+	result := &adminDS{
+		Ident:      ident,
+		Step:       ds.Step().String(),
+		Heartbeat:  ds.Heartbeat().String(),
+		Type:       ds.Type().String(),
+		Fill:       ds.Fill().String(),
+		Fields:     ds.Fields(),
+		LastUpdate: ds.LastUpdate(),
+		RRAs:       make([]*adminRRA, 0, len(ds.RRAs())),
+	}
+	if spec := ds.Spec(); spec.Min < spec.Max { // JSON has no Inf
+		if !math.IsInf(spec.Min, 0) {
+			result.Min = &spec.Min
+		}
+		if !math.IsInf(spec.Max, 0) {
+			result.Max = &spec.Max
+		}
+	}
+	if dbds, ok := ds.(serde.DbDataSourcer); ok {
+		result.Ident, result.Id = dbds.Ident(), dbds.Id()
+	}
+	for _, rra := range ds.RRAs() {
+		spec := rra.Spec()
+		ar := &adminRRA{
+			CF:     spec.Function.String(),
+			Step:   spec.Step.String(),
+			Span:   spec.Span.String(),
+			Size:   rra.Size(),
+			Xff:    spec.Xff,
+			Latest: rra.Latest(),
+		}
+		if spec.Season != 0 {
+			ar.Season = spec.Season.String()
+		}
+		if rra.Slots().IsCalendar() {
+			ar.Step, ar.TZ = spec.Calendar.String(), spec.Location.String()
+		}
+		if fields := ds.Fields(); spec.Field < len(fields) {
+			ar.Field = fields[spec.Field]
+		}
+		if dbrra, ok := rra.(serde.DbRoundRobinArchiver); ok {
+			ar.BundleId, ar.Seg, ar.Idx = dbrra.BundleId(), dbrra.Seg(), dbrra.Idx()
+		}
+		result.RRAs = append(result.RRAs, ar)
+	}
+	writeJSON(w, name, result)
+}
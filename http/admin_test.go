@@ -0,0 +1,197 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdcio/tgres/serde"
+)
+
+func adminRequest(h http.HandlerFunc, method string, params url.Values) *httptest.ResponseRecorder {
+	var r *http.Request
+	if method == "GET" {
+		r = httptest.NewRequest(method, "/admin?"+params.Encode(), nil)
+	} else {
+		r = httptest.NewRequest(method, "/admin", strings.NewReader(params.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func Test_adminHandler(t *testing.T) {
+	rcache, db := testFetcher(t, time.Now(), map[string]float64{"adm.a": 1})
+	for _, c := range []struct {
+		name   string
+		h      http.HandlerFunc
+		method string
+	}{
+		{"ds", AdminDSHandler(db), "POST"},
+		{"delete", AdminDSDeleteHandler(db, rcache), "GET"},
+		{"heartbeat", AdminDSHeartbeatHandler(db), "GET"},
+		{"rra/add", AdminRRAAddHandler(db), "GET"},
+		{"rra/remove", AdminRRARemoveHandler(db), "GET"},
+		{"migrate", AdminDSMigrateHandler(db, nil), "GET"},
+	} {
+		w := adminRequest(c.h, c.method, url.Values{"name": {"adm.a"}, "target": {"adm.*"}})
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") == c.method {
+			t.Errorf("%s: %s: expected 405, got %d (Allow: %q)", c.name, c.method, w.Code, w.Header().Get("Allow"))
+		}
+	}
+	if _, err := db.FetchOrCreateDataSource(serde.Ident{"name": "adm.a"}, nil); err != nil {
+		t.Errorf("DS should not have been affected: %v", err)
+	}
+}
+
+func Test_AdminDSHandler(t *testing.T) {
+	_, db := testFetcher(t, time.Now(), map[string]float64{"adm.a": 1})
+	h := AdminDSHandler(db)
+
+	w := adminRequest(h, "GET", url.Values{"name": {"adm.a"}})
+	var ds adminDS
+	if err := json.Unmarshal(w.Body.Bytes(), &ds); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ds.Ident["name"] != "adm.a" || ds.Step != "1s" || len(ds.RRAs) != 1 || ds.RRAs[0].CF != "WMEAN" || ds.RRAs[0].Size != 60 {
+		t.Errorf("unexpected DS: %s", w.Body.String())
+	}
+	if w := adminRequest(h, "GET", url.Values{"ident": {`{"name":"adm.a"}`}}); w.Code != http.StatusOK {
+		t.Errorf("by ident: expected 200, got %d", w.Code)
+	}
+
+	for _, c := range []struct {
+		params url.Values
+		status int
+	}{
+		{url.Values{}, http.StatusBadRequest},
+		{url.Values{"ident": {"{"}}, http.StatusBadRequest},
+		{url.Values{"name": {"adm.nosuch"}}, http.StatusNotFound},
+	} {
+		if w := adminRequest(h, "GET", c.params); w.Code != c.status {
+			t.Errorf("%v: expected %d, got %d", c.params, c.status, w.Code)
+		}
+	}
+}
+
+func Test_AdminDSDeleteHandler(t *testing.T) {
+	rcache, db := testFetcher(t, time.Now(), map[string]float64{"del.a": 1, "del.b": 2, "keep.c": 3})
+	h := AdminDSDeleteHandler(db, rcache)
+
+	if w := adminRequest(h, "POST", url.Values{}); w.Code != http.StatusBadRequest {
+		t.Errorf("no target: expected 400, got %d", w.Code)
+	}
+
+	del := func(params url.Values) *adminDeleteResult {
+		w := adminRequest(h, "POST", params)
+		var result adminDeleteResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("%v: expected 200, got %d: %s", params, w.Code, w.Body.String())
+		}
+		return &result
+	}
+	exists := func(name string) bool {
+		ds, _ := db.FetchOrCreateDataSource(serde.Ident{"name": name}, nil)
+		return ds != nil
+	}
+
+	if result := del(url.Values{"target": {"del.*"}, "dryrun": {"true"}}); !result.DryRun || len(result.Deleted) != 2 || !exists("del.a") {
+		t.Errorf("dry run: expected del.a and del.b listed but not deleted, got %+v", result)
+	}
+	if result := del(url.Values{"target": {"del.*"}}); result.DryRun || len(result.Deleted) != 2 || result.Deleted[0] != "del.a" || exists("del.a") || exists("del.b") {
+		t.Errorf("delete: expected del.a and del.b deleted, got %+v", result)
+	}
+	if !exists("keep.c") {
+		t.Errorf("keep.c should not have been deleted")
+	}
+	if result := del(url.Values{"target": {"nosuch.*"}}); len(result.Deleted) != 0 {
+		t.Errorf("no match: expected nothing deleted, got %+v", result)
+	}
+}
+
+func Test_AdminDSHeartbeatHandler(t *testing.T) {
+	_, db := testFetcher(t, time.Now(), map[string]float64{"adm.a": 1})
+	h := AdminDSHeartbeatHandler(db)
+
+	for _, c := range []struct {
+		params url.Values
+		status int
+	}{
+		{url.Values{"name": {"adm.a"}, "heartbeat": {"x"}}, http.StatusBadRequest},
+		{url.Values{"heartbeat": {"5m"}}, http.StatusBadRequest},
+		{url.Values{"name": {"adm.nosuch"}, "heartbeat": {"5m"}}, http.StatusNotFound},
+		{url.Values{"name": {"adm.a"}, "heartbeat": {"5m"}}, http.StatusOK},
+	} {
+		if w := adminRequest(h, "POST", c.params); w.Code != c.status {
+			t.Errorf("%v: expected %d, got %d: %s", c.params, c.status, w.Code, w.Body.String())
+		}
+	}
+	if ds, _ := db.FetchOrCreateDataSource(serde.Ident{"name": "adm.a"}, nil); ds == nil || ds.Heartbeat() != 5*time.Minute {
+		t.Errorf("expected heartbeat 5m")
+	}
+}
+
+func Test_AdminRRAHandlers(t *testing.T) {
+	_, db := testFetcher(t, time.Now(), map[string]float64{"adm.a": 1})
+	add, remove := AdminRRAAddHandler(db), AdminRRARemoveHandler(db)
+	rras := func() int {
+		ds, _ := db.FetchOrCreateDataSource(serde.Ident{"name": "adm.a"}, nil)
+		return len(ds.RRAs())
+	}
+
+	for _, c := range []struct {
+		h      http.HandlerFunc
+		params url.Values
+		status int
+		rras   int
+	}{
+		{add, url.Values{"name": {"adm.a"}, "cf": {"max"}, "step": {"1m"}, "span": {"90s"}}, http.StatusBadRequest, 1},
+		{add, url.Values{"name": {"adm.a"}, "cf": {"nosuch"}, "step": {"1m"}, "span": {"1h"}}, http.StatusBadRequest, 1},
+		{add, url.Values{"name": {"adm.nosuch"}, "cf": {"max"}, "step": {"1m"}, "span": {"1h"}}, http.StatusNotFound, 1},
+		{add, url.Values{"name": {"adm.a"}, "cf": {"max"}, "step": {"1m"}, "span": {"1h"}}, http.StatusOK, 2},
+		{add, url.Values{"name": {"adm.a"}, "cf": {"max"}, "step": {"1m"}, "span": {"1h"}}, http.StatusOK, 2}, // exists
+		{remove, url.Values{"name": {"adm.nosuch"}, "cf": {"max"}, "step": {"1m"}, "span": {"1h"}}, http.StatusNotFound, 2},
+		{remove, url.Values{"name": {"adm.a"}, "cf": {"max"}, "step": {"1m"}, "span": {"1h"}}, http.StatusOK, 1},
+	} {
+		if w := adminRequest(c.h, "POST", c.params); w.Code != c.status {
+			t.Errorf("%v: expected %d, got %d: %s", c.params, c.status, w.Code, w.Body.String())
+		}
+		if n := rras(); n != c.rras {
+			t.Errorf("%v: expected %d RRAs, got %d", c.params, c.rras, n)
+		}
+	}
+}
+
+func Test_AdminDSMigrateHandler(t *testing.T) {
+	_, db := testFetcher(t, time.Now(), map[string]float64{"adm.a": 1})
+	h := AdminDSMigrateHandler(db, nil)
+
+	for _, c := range []struct {
+		params url.Values
+		status int
+	}{
+		{url.Values{"name": {"adm.nosuch"}, "step": {"1m"}}, http.StatusNotFound},
+		{url.Values{"name": {"adm.a"}, "step": {"0"}}, http.StatusBadRequest},
+		{url.Values{"name": {"adm.a"}, "fill": {"nosuch"}}, http.StatusBadRequest},
+		{url.Values{"name": {"adm.a"}, "step": {"1m"}, "rra": {"30s:1h"}}, http.StatusBadRequest}, // RRA step < DS step
+		{url.Values{"name": {"adm.a"}, "rra": {"nosuch"}}, http.StatusBadRequest},
+	} {
+		if w := adminRequest(h, "POST", c.params); w.Code != c.status {
+			t.Errorf("%v: expected %d, got %d: %s", c.params, c.status, w.Code, w.Body.String())
+		}
+	}
+
+	w := adminRequest(h, "POST", url.Values{"name": {"adm.a"}, "step": {"1m"}, "fill": {"previous"}, "rra": {"5m:1h", "max:1m:1h"}})
+	var ds adminDS
+	if err := json.Unmarshal(w.Body.Bytes(), &ds); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("migrate: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ds.Step != "1m0s" || ds.Fill != "previous" || len(ds.RRAs) != 2 || ds.RRAs[0].Step != "5m0s" || ds.RRAs[1].CF != "MAX" {
+		t.Errorf("migrate: unexpected DS: %s", w.Body.String())
+	}
+}
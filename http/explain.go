@@ -0,0 +1,81 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jdcio/tgres/dsl"
+)
+
+type targetExplain struct {
+	Target  string       `json:"target"`
+	Explain *dsl.Explain `json:"explain"`
+	Series  int          `json:"series"`
+	Points  int          `json:"points"`
+	Time    string       `json:"time"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// renderExplain is the explain=true variant of /render. The targets
+// are evaluated and iterated over exactly like render would do it,
+// but instead of the data points the response describes how each
+// target was evaluated. Targets are processed one at a time so that
+// the timings are not skewed by one another.
+func renderExplain(w http.ResponseWriter, ctx context.Context, rcache dsl.NamedDSFetcher, targets []string, from, to time.Time, points int64, limits *QueryLimits) {
+	budget := limits.pointBudget()
+	result := make([]*targetExplain, 0, len(targets))
+	for _, target := range targets {
+		start := time.Now()
+		te := &targetExplain{Target: target}
+		sm, ex, err := explainTarget(ctx, rcache, target, from.Unix(), to.Unix(), points, limits.maxSeries())
+		te.Explain = ex
+		if err == nil {
+			var gss []*graphiteSeries
+			gss, err = readDataPoints(ctx, sm, budget)
+			te.Series = len(gss)
+			for _, gs := range gss {
+				if gs != nil {
+					te.Points += len(gs.dps)
+				}
+			}
+		}
+		if err != nil {
+			if msg, _, ok := limits.limitError(err); ok {
+				te.Error = msg
+			} else {
+				te.Error = err.Error()
+			}
+			log.Printf("renderExplain() %q: %v", target, err)
+		}
+		te.Time = time.Now().Sub(start).String()
+		result = append(result, te)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		log.Printf("renderExplain(): %v", err)
+	}
+}
+
+func explainTarget(ctx context.Context, rcache dsl.NamedDSFetcher, target string, from, to, maxPoints int64, maxSeries int) (dsl.SeriesMap, *dsl.Explain, error) {
+	return dsl.ExplainDsl(ctx, rcache, targetQuery(target), time.Unix(from, 0), time.Unix(to, 0), maxPoints, maxSeries)
+}
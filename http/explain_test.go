@@ -0,0 +1,108 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type testExplainNode struct {
+	Func     string
+	Args     []string
+	Series   int
+	Points   int64
+	CallTime string `json:"call_time"`
+	IterTime string `json:"iter_time"`
+	Error    string
+	Fetches  []struct {
+		Name      string
+		RRA       *struct{ CF, Step string }
+		FetchTime string `json:"fetch_time"`
+	}
+	Children []*testExplainNode
+}
+
+func Test_GraphiteRenderHandler_explain(t *testing.T) {
+	now := time.Now()
+	rcache, _ := testFetcher(t, now, map[string]float64{"exp.a": 1, "exp.b": 2, "lim.a": 1, "lim.b": 1, "lim.c": 1})
+
+	q := url.Values{
+		"target":  {"scale(sumSeries(exp.*), 2)", "nosuchfunc(exp.a)", "lim.*"},
+		"from":    {strconv.FormatInt(now.Add(-30*time.Minute).Unix(), 10)},
+		"until":   {strconv.FormatInt(now.Unix(), 10)},
+		"explain": {"true"},
+	}
+	w := httptest.NewRecorder()
+	GraphiteRenderHandler(rcache, &QueryLimits{MaxSeries: 2})(w, httptest.NewRequest("GET", "/render?"+q.Encode(), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("explain: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var result []struct {
+		Target  string
+		Explain *struct {
+			Expr string
+			Root *testExplainNode
+		}
+		Series int
+		Points int
+		Time   string
+		Error  string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 3 {
+		t.Fatalf("explain: expected 3 targets, got %d: %s", len(result), w.Body.String())
+	}
+
+	duration := func(what, s string) {
+		if _, err := time.ParseDuration(s); err != nil {
+			t.Errorf("%s: expected a duration, got %q", what, s)
+		}
+	}
+
+	// the one which works
+	te := result[0]
+	if te.Target != "scale(sumSeries(exp.*), 2)" || te.Error != "" || te.Series != 1 || te.Points == 0 {
+		t.Errorf("explain: unexpected target result: %+v", te)
+	}
+	duration("target time", te.Time)
+	if te.Explain == nil || te.Explain.Root == nil {
+		t.Fatalf("explain: no trace: %s", w.Body.String())
+	}
+	// targets are evaluated as group(target)
+	root := te.Explain.Root
+	if root.Func != "group" || len(root.Children) != 1 {
+		t.Fatalf("explain: unexpected group call: %+v", root)
+	}
+	root = root.Children[0]
+	if root.Func != "scale" || root.Series != 1 || root.Points == 0 || len(root.Children) != 1 {
+		t.Fatalf("explain: unexpected root call: %+v", root)
+	}
+	duration("root call_time", root.CallTime)
+	duration("root iter_time", root.IterTime)
+	child := root.Children[0]
+	if child.Func != "sumSeries" || len(child.Fetches) != 2 {
+		t.Fatalf("explain: unexpected child call: %+v", child)
+	}
+	duration("child call_time", child.CallTime)
+	for _, f := range child.Fetches {
+		if (f.Name != "exp.a" && f.Name != "exp.b") || f.RRA == nil || f.RRA.CF != "WMEAN" || f.RRA.Step != "1m0s" {
+			t.Errorf("explain: unexpected fetch: %+v", f)
+		}
+		duration("fetch_time", f.FetchTime)
+	}
+
+	// an invalid target, and the series limit
+	if te := result[1]; te.Error == "" {
+		t.Errorf("explain: expected an error for nosuchfunc: %+v", te)
+	}
+	if te := result[2]; te.Error != "query limit exceeded: more than 2 series" {
+		t.Errorf("explain: expected the series limit error, got %q", te.Error)
+	}
+}
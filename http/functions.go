@@ -0,0 +1,52 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"net/http"
+
+	"github.com/jdcio/tgres/dsl"
+)
+
+type funcParam struct {
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"`
+	Default  string `json:"default,omitempty"`
+	Optional bool   `json:"optional,omitempty"`
+	Multiple bool   `json:"multiple,omitempty"`
+}
+
+type funcSignature struct {
+	Name   string       `json:"name"`
+	Params []*funcParam `json:"params"`
+	Macro  bool         `json:"macro,omitempty"`
+}
+
+// FunctionsHandler lists the DSL functions and their parameters (see
+// dsl.Functions()), e.g. for editor autocompletion.
+func FunctionsHandler() http.HandlerFunc {
+	return adminHandler("GET", func(w http.ResponseWriter, r *http.Request) {
+		result := []*funcSignature{}
+		for _, fn := range dsl.Functions() {
+			sig := &funcSignature{Name: fn.Name, Params: []*funcParam{}, Macro: fn.Macro}
+			for _, p := range fn.Params {
+				sig.Params = append(sig.Params, &funcParam{p.Name, p.Type, p.Default, p.Optional, p.Multiple})
+			}
+			result = append(result, sig)
+		}
+		writeJSON(w, "FunctionsHandler", result)
+	})
+}
@@ -0,0 +1,55 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jdcio/tgres/dsl"
+)
+
+func Test_FunctionsHandler(t *testing.T) {
+	if _, err := dsl.DefineMacro("httpTestFn(a, b) = sumSeries(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+	defer dsl.UndefineMacro("httpTestFn")
+
+	w := adminRequest(FunctionsHandler(), "GET", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected 200 JSON, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var result []map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]string)
+	var prev string
+	for _, fn := range result {
+		var name string
+		json.Unmarshal(fn["name"], &name)
+		if name <= prev {
+			t.Errorf("expected functions sorted by name, got %q after %q", name, prev)
+		}
+		prev = name
+		b, _ := json.Marshal(fn)
+		byName[name] = string(b)
+	}
+
+	for name, expect := range map[string]string{
+		"scale":         `{"name":"scale","params":[{"name":"seriesList","type":"series"},{"name":"factor","type":"number"}]}`,
+		"averageSeries": `{"name":"averageSeries","params":[{"name":"seriesList","type":"series","multiple":true}]}`,
+		"summarize": `{"name":"summarize","params":[{"name":"seriesList","type":"series"},{"name":"intervalString","type":"string"},` +
+			`{"name":"func","type":"string","default":"sum","optional":true},{"name":"alignToFrom","type":"bool","default":"false","optional":true},` +
+			`{"name":"tz","type":"string","default":"UTC","optional":true}]}`,
+		"sinusoid":   `{"name":"sinusoid","params":[]}`,
+		"httpTestFn": `{"macro":true,"name":"httpTestFn","params":[{"name":"a"},{"name":"b"}]}`,
+	} {
+		if got := byName[name]; got != expect {
+			t.Errorf("%s:\nexpected %s\n     got %s", name, expect, got)
+		}
+	}
+
+	if w := adminRequest(FunctionsHandler(), "POST", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: expected 405, got %d", w.Code)
+	}
+}
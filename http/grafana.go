@@ -0,0 +1,415 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jdcio/tgres/dsl"
+)
+
+// This file implements the Grafana JSON datasource (aka SimpleJSON)
+// protocol, which consists of a handful of endpoints all accepting
+// a JSON POST: /search, /query, /annotations, /tag-keys and
+// /tag-values. A GET of the root should return 200 OK, which Grafana
+// uses to test the datasource.
+
+// Used when the request does not specify maxDataPoints.
+const grafanaMaxDataPoints = 512
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// check defaults To to now and verifies that From precedes it.
+func (gr *grafanaRange) check() error {
+	if gr.To.IsZero() {
+		gr.To = time.Now()
+	}
+	if gr.From.IsZero() || !gr.From.Before(gr.To) {
+		return fmt.Errorf("invalid range: %v - %v", gr.From, gr.To)
+	}
+	return nil
+}
+
+type grafanaTarget struct {
+	Target string `json:"target"`
+	RefId  string `json:"refId"`
+	Type   string `json:"type"` // "timeserie" (default) or "table"
+	Hide   bool   `json:"hide"`
+}
+
+type grafanaQueryRequest struct {
+	Range         grafanaRange    `json:"range"`
+	Targets       []grafanaTarget `json:"targets"`
+	MaxDataPoints int64           `json:"maxDataPoints"`
+}
+
+type grafanaTimeserie struct {
+	Target     string          `json:"target"`
+	Datapoints [][]interface{} `json:"datapoints"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type grafanaTable struct {
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+	Type    string          `json:"type"`
+}
+
+type grafanaAnnotationRequest struct {
+	Range      grafanaRange    `json:"range"`
+	Annotation json.RawMessage `json:"annotation"` // returned as is
+}
+
+type grafanaAnnotation struct {
+	Annotation json.RawMessage `json:"annotation"`
+	Time       int64           `json:"time"`
+	Title      string          `json:"title"`
+	Text       string          `json:"text"`
+}
+
+type grafanaTag struct {
+	Type string `json:"type,omitempty"`
+	Text string `json:"text"`
+}
+
+// Returns 200 OK, this is how Grafana tests a datasource. Since it is
+// registered on a subtree, any path other than root is 404.
+func GrafanaTestHandler(root string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != root {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "OK\n")
+	}
+}
+
+func GrafanaSearchHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
+	return grafanaJSONHandler(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Target string `json:"target"`
+		}
+		if err := decodeGrafanaRequest(r, &req); err != nil {
+			log.Printf("GrafanaSearchHandler(): %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pattern := req.Target
+		if pattern == "" {
+			pattern = "*"
+		}
+		nodes := rcache.FsFind(pattern)
+		result := make([]string, 0, len(nodes))
+		for _, node := range nodes {
+			result = append(result, node.Name)
+		}
+		writeJSON(w, "GrafanaSearchHandler", result)
+	})
+}
+
+func GrafanaQueryHandler(rcache dsl.NamedDSFetcher, limits *QueryLimits) http.HandlerFunc {
+	return makeGzipHandler(grafanaJSONHandler(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		var req grafanaQueryRequest
+		if err := decodeGrafanaRequest(r, &req); err != nil {
+			log.Printf("GrafanaQueryHandler(): %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := req.Range.check(); err != nil {
+			log.Printf("GrafanaQueryHandler(): %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.MaxDataPoints <= 0 {
+			req.MaxDataPoints = grafanaMaxDataPoints
+		}
+
+		ctx, cancel := limits.context(r.Context())
+		defer cancel()
+		budget := limits.pointBudget()
+
+		var (
+			wg        sync.WaitGroup
+			mu        sync.Mutex
+			errs      []string
+			limitErr  error
+			batchSize int
+		)
+		targets := make([][]*graphiteSeries, len(req.Targets))
+		for n, target := range req.Targets {
+			if target.Hide || target.Target == "" {
+				continue
+			}
+			wg.Add(1)
+			batchSize++
+			go func(wg *sync.WaitGroup, target string, n int) {
+				sm, err := processTarget(ctx, rcache, target, req.Range.From.Unix(), req.Range.To.Unix(), req.MaxDataPoints, limits.maxSeries())
+				if err == nil {
+					// readDataPoints must run, see GraphiteRenderHandler
+					targets[n], err = readDataPoints(ctx, sm, budget)
+				}
+				if err != nil {
+					mu.Lock()
+					if _, _, ok := limits.limitError(err); ok {
+						limitErr = err
+					} else {
+						errs = append(errs, fmt.Sprintf("%s: %v", target, err))
+					}
+					mu.Unlock()
+					log.Printf("GrafanaQueryHandler() %q: %v", target, err)
+				}
+				wg.Done()
+			}(&wg, target.Target, n)
+			if batchSize > BATCH_LIMIT { // limit concurrent processing
+				wg.Wait()
+				batchSize = 0
+			}
+		}
+		wg.Wait()
+
+		if limitErr != nil {
+			msg, status, _ := limits.limitError(limitErr)
+			http.Error(w, msg, status)
+			return
+		}
+		if len(errs) > 0 {
+			// Grafana displays the body of the error response
+			http.Error(w, fmt.Sprintf("%v", errs), http.StatusBadRequest)
+			return
+		}
+
+		result := make([]interface{}, 0, len(targets))
+		for n, target := range req.Targets {
+			if target.Type == "table" {
+				result = append(result, grafanaLatestTable(targets[n]))
+				continue
+			}
+			for _, series := range targets[n] {
+				result = append(result, grafanaSeries(series))
+			}
+		}
+		writeJSON(w, "GrafanaQueryHandler", result)
+
+		log.Printf("GrafanaQueryHandler: finished in %v", time.Now().Sub(start))
+	}))
+}
+
+// The annotation query is a target expression, every known non-zero
+// point of the resulting series becomes an annotation. Comparisons
+// are handy here, e.g. "foo.errors > 10" annotates the points where
+// there were more than 10 errors.
+func GrafanaAnnotationsHandler(rcache dsl.NamedDSFetcher, limits *QueryLimits) http.HandlerFunc {
+	return grafanaJSONHandler(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			req grafanaAnnotationRequest
+			ann struct {
+				Query string `json:"query"`
+			}
+		)
+		err := decodeGrafanaRequest(r, &req)
+		if err == nil && len(req.Annotation) > 0 {
+			err = json.Unmarshal(req.Annotation, &ann)
+		}
+		if err == nil {
+			err = req.Range.check()
+		}
+		if err != nil {
+			log.Printf("GrafanaAnnotationsHandler(): %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result := make([]*grafanaAnnotation, 0)
+		if ann.Query == "" {
+			writeJSON(w, "GrafanaAnnotationsHandler", result)
+			return
+		}
+
+		ctx, cancel := limits.context(r.Context())
+		defer cancel()
+
+		sm, err := processTarget(ctx, rcache, ann.Query, req.Range.From.Unix(), req.Range.To.Unix(), grafanaMaxDataPoints, limits.maxSeries())
+		var target []*graphiteSeries
+		if err == nil {
+			target, err = readDataPoints(ctx, sm, limits.pointBudget())
+		}
+		if err != nil {
+			log.Printf("GrafanaAnnotationsHandler() %q: %v", ann.Query, err)
+			if msg, status, ok := limits.limitError(err); ok {
+				http.Error(w, msg, status)
+			} else {
+				http.Error(w, fmt.Sprintf("%s: %v", ann.Query, err), http.StatusBadRequest)
+			}
+			return
+		}
+
+		for _, series := range target {
+			for _, dp := range series.dps {
+				if dp.t > 0 && dp.v != 0 && grafanaValue(dp.v) != nil {
+					result = append(result, &grafanaAnnotation{
+						Annotation: req.Annotation,
+						Time:       dp.t * 1000,
+						Title:      series.name,
+						Text:       strconv.FormatFloat(dp.v, 'f', -1, 64),
+					})
+				}
+			}
+		}
+		writeJSON(w, "GrafanaAnnotationsHandler", result)
+	})
+}
+
+func GrafanaTagKeysHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
+	return grafanaJSONHandler(func(w http.ResponseWriter, r *http.Request) {
+		keys := make(map[string]bool)
+		for _, ident := range rcache.Idents() {
+			for k, _ := range ident {
+				keys[k] = true
+			}
+		}
+		result := make([]grafanaTag, 0, len(keys))
+		for _, k := range sortedStringSet(keys) {
+			result = append(result, grafanaTag{Type: "string", Text: k})
+		}
+		writeJSON(w, "GrafanaTagKeysHandler", result)
+	})
+}
+
+func GrafanaTagValuesHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
+	return grafanaJSONHandler(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Key string `json:"key"`
+		}
+		if err := decodeGrafanaRequest(r, &req); err != nil {
+			log.Printf("GrafanaTagValuesHandler(): %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		vals := make(map[string]bool)
+		for _, ident := range rcache.Idents() {
+			if v, ok := ident[req.Key]; ok {
+				vals[v] = true
+			}
+		}
+		result := make([]grafanaTag, 0, len(vals))
+		for _, v := range sortedStringSet(vals) {
+			result = append(result, grafanaTag{Text: v})
+		}
+		writeJSON(w, "GrafanaTagValuesHandler", result)
+	})
+}
+
+// grafanaJSONHandler sets the content type and deals with CORS
+// preflight requests which Grafana sends in "direct" access mode.
+func grafanaJSONHandler(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Access-Control-Allow-Headers", "accept, content-type")
+			w.Header().Set("Access-Control-Allow-Methods", "POST")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fn(w, r)
+	}
+}
+
+// An empty body is not an error, v is left as is.
+func decodeGrafanaRequest(r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && err != io.EOF {
+		return fmt.Errorf("decoding request: %v", err)
+	}
+	return nil
+}
+
+// JSON cannot represent NaN or Inf, they become null.
+func grafanaValue(v float64) interface{} {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return v
+}
+
+func grafanaSeries(gs *graphiteSeries) *grafanaTimeserie {
+	result := &grafanaTimeserie{Target: gs.name, Datapoints: make([][]interface{}, 0, len(gs.dps))}
+	for _, dp := range gs.dps {
+		if dp.t > 0 {
+			result.Datapoints = append(result.Datapoints, []interface{}{grafanaValue(dp.v), dp.t * 1000})
+		}
+	}
+	return result
+}
+
+// grafanaLatestTable builds a table of the most recent known value
+// of every series, something the Graphite format cannot express.
+func grafanaLatestTable(target []*graphiteSeries) *grafanaTable {
+	result := &grafanaTable{
+		Columns: []grafanaColumn{
+			{Text: "Time", Type: "time"},
+			{Text: "Series", Type: "string"},
+			{Text: "Value", Type: "number"},
+		},
+		Rows: make([][]interface{}, 0, len(target)),
+		Type: "table",
+	}
+	for _, series := range target {
+		var t int64
+		v := math.NaN()
+		for i := len(series.dps) - 1; i >= 0; i-- {
+			dp := series.dps[i]
+			if dp.t > 0 && !math.IsNaN(dp.v) {
+				t, v = dp.t, dp.v
+				break
+			}
+		}
+		if t == 0 {
+			// no data at all, still list the series
+			result.Rows = append(result.Rows, []interface{}{nil, series.name, nil})
+			continue
+		}
+		result.Rows = append(result.Rows, []interface{}{t * 1000, series.name, grafanaValue(v)})
+	}
+	return result
+}
+
+func sortedStringSet(set map[string]bool) []string {
+	result := make([]string, 0, len(set))
+	for s, _ := range set {
+		result = append(result, s)
+	}
+	sort.Strings(result)
+	return result
+}
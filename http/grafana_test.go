@@ -0,0 +1,186 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdcio/tgres/dsl"
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/serde"
+)
+
+func grafanaPost(h http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/grafana/x", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func grafanaRangeJSON(now time.Time) string {
+	from, _ := now.Add(-30 * time.Minute).MarshalJSON()
+	to, _ := now.MarshalJSON()
+	return `{"from":` + string(from) + `,"to":` + string(to) + `}`
+}
+
+func Test_GrafanaTestHandler(t *testing.T) {
+	for _, c := range []struct {
+		path   string
+		status int
+	}{
+		{"/grafana/", http.StatusOK},
+		{"/grafana/foo", http.StatusNotFound},
+		{"/grafana/search/bar", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		GrafanaTestHandler("/grafana/")(w, httptest.NewRequest("GET", c.path, nil))
+		if w.Code != c.status {
+			t.Errorf("GET %s: expected %d, got %d", c.path, c.status, w.Code)
+		}
+	}
+}
+
+func Test_GrafanaQueryHandler(t *testing.T) {
+	now := time.Now()
+	rcache, _ := testFetcher(t, now, map[string]float64{"gf.a": 1, "gf.b": 2})
+	h := GrafanaQueryHandler(rcache, nil)
+
+	w := grafanaPost(h, `{"range":`+grafanaRangeJSON(now)+`,"maxDataPoints":100,"targets":[
+		{"target":"gf.*","refId":"A"},
+		{"target":"gf.*","refId":"B","type":"table"},
+		{"target":"gf.a","refId":"C","hide":true}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("query: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var result []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	// two timeseries for A, one table for B, nothing for hidden C
+	if len(result) != 3 {
+		t.Fatalf("query: expected 3 results, got %d: %s", len(result), w.Body.String())
+	}
+	if result[0]["target"] != "gf.a" || result[1]["target"] != "gf.b" {
+		t.Errorf("timeserie: expected gf.a and gf.b, got %v and %v", result[0]["target"], result[1]["target"])
+	}
+	if dps, _ := result[1]["datapoints"].([]interface{}); len(dps) == 0 {
+		t.Errorf("timeserie: expected datapoints")
+	} else if dp := dps[0].([]interface{}); dp[0] != 2.0 {
+		t.Errorf("timeserie: expected value 2, got %v", dp[0])
+	}
+	if result[2]["type"] != "table" {
+		t.Fatalf("table: expected type table, got %v", result[2]["type"])
+	}
+	rows, _ := result[2]["rows"].([]interface{})
+	if len(rows) != 2 {
+		t.Fatalf("table: expected 2 rows, got %v", rows)
+	}
+	if row := rows[1].([]interface{}); row[1] != "gf.b" || row[2] != 2.0 {
+		t.Errorf("table: expected gf.b with 2, got %v", row)
+	}
+
+	for _, body := range []string{
+		`{"range":`,
+		`{"targets":[{"target":"gf.a"}]}`,
+		`{"range":` + grafanaRangeJSON(now) + `,"targets":[{"target":"nosuchfunc(gf.a)"}]}`,
+	} {
+		if w := grafanaPost(h, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+}
+
+func Test_GrafanaSearchHandler(t *testing.T) {
+	rcache, _ := testFetcher(t, time.Now(), map[string]float64{"gs.a": 1, "gs.b": 2})
+	w := grafanaPost(GrafanaSearchHandler(rcache), `{"target":"gs.*"}`)
+	if body := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || body != `["gs.a","gs.b"]` {
+		t.Errorf("search: expected 200 with gs.a and gs.b, got %d: %s", w.Code, body)
+	}
+	if w := grafanaPost(GrafanaSearchHandler(rcache), `{`); w.Code != http.StatusBadRequest {
+		t.Errorf("bad JSON: expected 400, got %d", w.Code)
+	}
+}
+
+func Test_GrafanaTagHandlers(t *testing.T) {
+	db := serde.NewMemSerDe()
+	spec := &rrd.DSSpec{Step: time.Minute, RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour}}}
+	for _, ident := range []serde.Ident{
+		{"name": "tag.a", "host": "h1", "dc": "east"},
+		{"name": "tag.b", "host": "h2"},
+		{"name": "tag.c", "host": "h1"},
+	} {
+		if _, err := db.FetchOrCreateDataSource(ident, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rcache := dsl.NewNamedDSFetcher(db.Fetcher(), nil, 0)
+	rcache.Preload()
+
+	for _, c := range []struct {
+		h      http.HandlerFunc
+		body   string
+		expect string
+	}{
+		{GrafanaTagKeysHandler(rcache), ``, `[{"type":"string","text":"dc"},{"type":"string","text":"host"},{"type":"string","text":"name"}]`},
+		{GrafanaTagValuesHandler(rcache), `{"key":"host"}`, `[{"text":"h1"},{"text":"h2"}]`},
+		{GrafanaTagValuesHandler(rcache), `{"key":"nosuchkey"}`, `[]`},
+	} {
+		w := grafanaPost(c.h, c.body)
+		if body := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || body != c.expect {
+			t.Errorf("%q: expected 200 %s, got %d %s", c.body, c.expect, w.Code, body)
+		}
+	}
+	if w := grafanaPost(GrafanaTagValuesHandler(rcache), `{"key":`); w.Code != http.StatusBadRequest {
+		t.Errorf("bad JSON: expected 400, got %d", w.Code)
+	}
+}
+
+func Test_GrafanaAnnotationsHandler(t *testing.T) {
+	now := time.Now()
+	rcache, _ := testFetcher(t, now, map[string]float64{"ann.a": 2, "ann.b": 1})
+	h := GrafanaAnnotationsHandler(rcache, nil)
+
+	annotate := func(query string) []*grafanaAnnotation {
+		w := grafanaPost(h, `{"range":`+grafanaRangeJSON(now)+`,"annotation":{"name":"x","query":"`+query+`"}}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: expected 200, got %d: %s", query, w.Code, w.Body.String())
+		}
+		var result []*grafanaAnnotation
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	if result := annotate(""); len(result) != 0 {
+		t.Errorf("empty query: expected no annotations, got %d", len(result))
+	}
+	if result := annotate("ann.b > 1.5"); len(result) != 0 {
+		t.Errorf("false comparison: expected no annotations, got %d", len(result))
+	}
+	result := annotate("ann.a > 1.5")
+	if len(result) == 0 {
+		t.Fatalf("true comparison: expected annotations")
+	}
+	for _, a := range result {
+		var ann struct{ Name, Query string }
+		json.Unmarshal(a.Annotation, &ann)
+		if a.Text != "1" || a.Time <= 0 || ann.Name != "x" || ann.Query != "ann.a > 1.5" {
+			t.Errorf("unexpected annotation: %+v", a)
+			break
+		}
+	}
+
+	for _, body := range []string{
+		`{"range":`,
+		`{"annotation":{"query":"ann.a"}}`,
+		`{"range":` + grafanaRangeJSON(now) + `,"annotation":{"query":"nosuchfunc(ann.a)"}}`,
+	} {
+		if w := grafanaPost(h, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+}
@@ -19,6 +19,8 @@ package http
 
 import (
 	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -28,6 +30,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jdcio/tgres/dsl"
@@ -36,6 +39,67 @@ import (
 
 const BATCH_LIMIT = 64
 
+// QueryLimits restrict the resources used by a single request. Zero
+// values mean no limit.
+type QueryLimits struct {
+	Timeout   time.Duration // wall time of the whole request
+	MaxSeries int           // series matched by a single target
+	MaxPoints int           // data points returned in total
+}
+
+// context returns a context derived from parent with Timeout applied.
+func (l *QueryLimits) context(parent context.Context) (context.Context, context.CancelFunc) {
+	if l != nil && l.Timeout > 0 {
+		return context.WithTimeout(parent, l.Timeout)
+	}
+	return context.WithCancel(parent)
+}
+
+func (l *QueryLimits) maxSeries() int {
+	if l == nil {
+		return 0
+	}
+	return l.MaxSeries
+}
+
+func (l *QueryLimits) pointBudget() *pointBudget {
+	if l == nil {
+		return &pointBudget{}
+	}
+	return &pointBudget{limit: int64(l.MaxPoints)}
+}
+
+// limitError returns a message and an HTTP status if err is the
+// result of a limit being hit or the request being canceled.
+func (l *QueryLimits) limitError(err error) (string, int, bool) {
+	switch err {
+	case context.DeadlineExceeded:
+		if l == nil {
+			return "query timed out", http.StatusServiceUnavailable, true
+		}
+		return fmt.Sprintf("query timed out (limit %v)", l.Timeout), http.StatusServiceUnavailable, true
+	case context.Canceled:
+		return "query canceled", http.StatusServiceUnavailable, true
+	}
+	if _, ok := err.(*dsl.LimitError); ok {
+		return err.Error(), http.StatusBadRequest, true
+	}
+	return "", 0, false
+}
+
+// pointBudget keeps count of data points returned across concurrent
+// readDataPoints calls.
+type pointBudget struct {
+	n, limit int64
+}
+
+func (b *pointBudget) take() error {
+	if n := atomic.AddInt64(&b.n, 1); b.limit > 0 && n > b.limit {
+		return &dsl.LimitError{What: "points", Limit: b.limit}
+	}
+	return nil
+}
+
 func GraphiteMetricsFindHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -74,7 +138,7 @@ func GraphiteMetricsFindHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 	}
 }
 
-func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
+func GraphiteRenderHandler(rcache dsl.NamedDSFetcher, limits *QueryLimits) http.HandlerFunc {
 
 	return makeGzipHandler(
 		func(w http.ResponseWriter, r *http.Request) {
@@ -111,7 +175,23 @@ func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 				}
 			}
 
-			var wg sync.WaitGroup
+			// ctx is canceled when the client goes away or the timeout expires
+			ctx, cancel := limits.context(r.Context())
+			defer cancel()
+
+			if explain := r.FormValue("explain"); explain != "" && explain != "false" && explain != "0" {
+				renderExplain(w, ctx, rcache, r.Form["target"], *from, *to, int64(points), limits)
+				log.Printf("GraphiteRenderHandler: explain finished in %v", time.Now().Sub(start))
+				return
+			}
+
+			budget := limits.pointBudget()
+
+			var (
+				wg       sync.WaitGroup
+				mu       sync.Mutex
+				limitErr error
+			)
 
 			targets := make([][]*graphiteSeries, len(r.Form["target"]))
 			batchSize := 0
@@ -119,15 +199,26 @@ func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 				wg.Add(1)
 				batchSize++
 				go func(wg *sync.WaitGroup, target string, targets [][]*graphiteSeries, n int) {
-					if sm, err := processTarget(rcache, target, from.Unix(), to.Unix(), int64(points)); err == nil {
+					sm, err := processTarget(ctx, rcache, target, from.Unix(), to.Unix(), int64(points), limits.maxSeries())
+					if err == nil {
 						// sm may contain locked watched RRAs,
 						// readDataPoints unlocks them in
 						// series.Close() It's important to not do
 						// anything that could interrupt this, we MUST
 						// run readDataPoints.
-						targets[n] = readDataPoints(sm)
-					} else {
-						w.Header().Set("X-Tgres-DSL-Error", fmt.Sprintf("%v", err))
+						targets[n], err = readDataPoints(ctx, sm, budget)
+					}
+					if err != nil {
+						if _, _, ok := limits.limitError(err); ok {
+							mu.Lock()
+							limitErr = err
+							mu.Unlock()
+						} else {
+							w.Header().Set("X-Tgres-DSL-Error", fmt.Sprintf("%v", err))
+							if verr, ok := err.(*dsl.ValidationError); ok {
+								w.Header().Set("X-Tgres-DSL-Error-Offset", strconv.Itoa(verr.Offset))
+							}
+						}
 						log.Printf("RenderHandler() %q: %v", target, err)
 					}
 					wg.Done()
@@ -139,6 +230,14 @@ func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 			}
 			wg.Wait()
 
+			if limitErr != nil {
+				msg, status, _ := limits.limitError(limitErr)
+				w.Header().Set("X-Tgres-DSL-Error", msg)
+				http.Error(w, msg, status)
+				log.Printf("GraphiteRenderHandler: %s after %v", msg, time.Now().Sub(start))
+				return
+			}
+
 			fmt.Fprintf(w, "[")
 
 			for tn, target := range targets {
@@ -200,9 +299,19 @@ func parseTime(s string) (*time.Time, error) {
 		return nil, nil
 	}
 
-	if s[0] == '-' { // relative
+	// relative, e.g. -1d, now-1d, or in the future (for forecasts) +7d
+	if strings.HasPrefix(s, "now") && len(s) > 3 {
+		s = s[3:]
+	}
+	if s[0] == ' ' { // an unescaped + in a URL query
+		s = "+" + strings.TrimSpace(s)
+	}
+	if s[0] == '-' || s[0] == '+' {
 		if dur, err := misc.BetterParseDuration(s[1:len(s)]); err == nil {
-			t := time.Now().Add(-dur)
+			if s[0] == '-' {
+				dur = -dur
+			}
+			t := time.Now().Add(dur)
 			return &t, nil
 		} else {
 			return nil, fmt.Errorf("parseTime(): Error parsing relative time %q: %v", s, err)
@@ -235,6 +344,10 @@ func quoteIdentifiers(target string) string {
 			part = "\"" + part[1:len(part)-1] + "\""
 		}
 
+		if _, err := strconv.ParseFloat(part, 64); err == nil {
+			continue // a number, e.g. the 1.5 of a.b * 1.5
+		}
+
 		if strings.Contains(part, ".") && !strings.HasPrefix(part, "\"") {
 			// our part followed by a non-string character or eol
 			// this is to avoid replacing unintentionally a smaller substring in a larger one
@@ -256,11 +369,35 @@ func quoteIdentifiers(target string) string {
 	return result
 }
 
-func processTarget(rcache dsl.NamedDSFetcher, target string, from, to, maxPoints int64) (dsl.SeriesMap, error) {
+func processTarget(ctx context.Context, rcache dsl.NamedDSFetcher, target string, from, to, maxPoints int64, maxSeries int) (dsl.SeriesMap, error) {
+	sm, err := dsl.ParseDslContext(ctx, rcache, targetQuery(target), time.Unix(from, 0), time.Unix(to, 0), maxPoints, maxSeries)
+	if verr, ok := err.(*dsl.ValidationError); ok {
+		// the user knows nothing of the query, only the target
+		verr.Src, verr.Offset = target, targetOffset(target, verr.Offset)
+	}
+	return sm, err
+}
+
+// targetOffset returns the offset in target corresponding to the
+// offset off in targetQuery(target), which differs from the target
+// by the group() around it and the quotes quoteIdentifiers() adds or
+// replaces.
+func targetOffset(target string, off int) int {
+	query := targetQuery(target)
+	i, j := len("group("), 0
+	for ; i < off && j < len(target); i++ {
+		if query[i] == target[j] || query[i] == '"' && target[j] == '\'' {
+			j++
+		}
+	}
+	return j
+}
+
+// targetQuery converts a Graphite target into a DSL expression.
+func targetQuery(target string) string {
 	target = quoteIdentifiers(target)
 	// In our DSL everything must be a function call, so we wrap everything in group()
-	query := fmt.Sprintf("group(%s)", target)
-	return dsl.ParseDsl(rcache, query, time.Unix(from, 0), time.Unix(to, 0), maxPoints)
+	return fmt.Sprintf("group(%s)", target)
 }
 
 // Graphite data points
@@ -273,12 +410,18 @@ type graphiteSeries struct {
 	name string
 }
 
-func readDataPoints(sm dsl.SeriesMap) []*graphiteSeries {
+// readDataPoints reads all the series in sm, it returns an error if
+// ctx is done or the budget is exceeded before it finishes, in
+// which case the result is incomplete. Either way, all series are
+// closed.
+func readDataPoints(ctx context.Context, sm dsl.SeriesMap, budget *pointBudget) ([]*graphiteSeries, error) {
 	names := sm.SortedKeys()
 	result := make([]*graphiteSeries, len(names))
 	var (
 		wg        sync.WaitGroup
 		batchSize int
+		mu        sync.Mutex
+		readErr   error
 	)
 	for n, name := range sm.SortedKeys() {
 		series := sm[name]
@@ -291,6 +434,12 @@ func readDataPoints(sm dsl.SeriesMap) []*graphiteSeries {
 		go func(wg *sync.WaitGroup, result []*graphiteSeries, n int, name string) {
 			gs := &graphiteSeries{make([]*dataPoint, 0), name}
 			for series.Next() {
+				if err := budget.take(); err != nil {
+					mu.Lock()
+					readErr = err
+					mu.Unlock()
+					break
+				}
 				gs.dps = append(gs.dps, &dataPoint{series.CurrentTime().Unix(), series.CurrentValue()})
 			}
 			result[n] = gs
@@ -303,7 +452,10 @@ func readDataPoints(sm dsl.SeriesMap) []*graphiteSeries {
 		}
 	}
 	wg.Wait()
-	return result
+	if readErr != nil {
+		return result, readErr
+	}
+	return result, ctx.Err()
 }
 
 // Gzip Compression
@@ -329,3 +481,11 @@ func makeGzipHandler(fn http.HandlerFunc) http.HandlerFunc {
 		fn(gzr, r)
 	}
 }
+
+// writeJSON writes v as the JSON response of the handler name, an
+// error can only be logged since the response has begun by then.
+func writeJSON(w http.ResponseWriter, name string, v interface{}) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("%s(): %v", name, err)
+	}
+}
@@ -0,0 +1,129 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdcio/tgres/dsl"
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/serde"
+)
+
+// testFetcher returns a name fetcher of a memory serde with a DS of
+// constant value v per name, with an hour of data up to now at a
+// minute resolution.
+func testFetcher(t *testing.T, now time.Time, dss map[string]float64) (dsl.NamedDSFetcher, serde.Fetcher) {
+	db := serde.NewMemSerDe()
+	for name, v := range dss {
+		rspec := rrd.RRASpec{
+			Function: rrd.WMEAN,
+			Step:     time.Minute,
+			Span:     time.Hour,
+			Latest:   now.Truncate(time.Minute),
+			DPs:      make(map[int64]float64),
+		}
+		for i := int64(0); i < 60; i++ {
+			rspec.DPs[i] = v
+		}
+		spec := &rrd.DSSpec{Step: time.Second, RRAs: []rrd.RRASpec{rspec}}
+		if _, err := db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rcache := dsl.NewNamedDSFetcher(db.Fetcher(), nil, 0)
+	rcache.Preload()
+	return rcache, db.Fetcher()
+}
+
+func Test_QueryLimits_limitError(t *testing.T) {
+	limits := &QueryLimits{Timeout: time.Second}
+	for _, c := range []struct {
+		limits *QueryLimits
+		err    error
+		msg    string
+		status int
+		ok     bool
+	}{
+		{limits, context.DeadlineExceeded, "query timed out (limit 1s)", http.StatusServiceUnavailable, true},
+		{nil, context.DeadlineExceeded, "query timed out", http.StatusServiceUnavailable, true},
+		{limits, context.Canceled, "query canceled", http.StatusServiceUnavailable, true},
+		{limits, &dsl.LimitError{What: "series", Limit: 2}, "query limit exceeded: more than 2 series", http.StatusBadRequest, true},
+		{limits, errors.New("foo"), "", 0, false},
+	} {
+		msg, status, ok := c.limits.limitError(c.err)
+		if msg != c.msg || status != c.status || ok != c.ok {
+			t.Errorf("limitError(%v): expected %q %d %v, got %q %d %v", c.err, c.msg, c.status, c.ok, msg, status, ok)
+		}
+	}
+}
+
+func Test_pointBudget(t *testing.T) {
+	b := (&QueryLimits{MaxPoints: 2}).pointBudget()
+	if b.take() != nil || b.take() != nil {
+		t.Errorf("take() within the limit should not be an error")
+	}
+	if le, ok := b.take().(*dsl.LimitError); !ok || le.What != "points" || le.Limit != 2 {
+		t.Errorf("take() beyond the limit should be a points *LimitError")
+	}
+	b = (*QueryLimits)(nil).pointBudget()
+	for i := 0; i < 1000; i++ {
+		if err := b.take(); err != nil {
+			t.Fatalf("take() without a limit should not be an error: %v", err)
+		}
+	}
+}
+
+func Test_GraphiteRenderHandler_limits(t *testing.T) {
+	now := time.Now()
+	rcache, _ := testFetcher(t, now, map[string]float64{"lim.a": 1, "lim.b": 2, "lim.c": 3})
+
+	render := func(limits *QueryLimits, ctx context.Context, target string) *httptest.ResponseRecorder {
+		q := url.Values{
+			"target": {target},
+			"from":   {strconv.FormatInt(now.Add(-30*time.Minute).Unix(), 10)},
+			"until":  {strconv.FormatInt(now.Unix(), 10)},
+		}
+		r := httptest.NewRequest("GET", "/render?"+q.Encode(), nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		GraphiteRenderHandler(rcache, limits)(w, r)
+		return w
+	}
+
+	bg := context.Background()
+	if w := render(&QueryLimits{MaxSeries: 3, MaxPoints: 1000}, bg, "lim.*"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"lim.c"`) {
+		t.Errorf("within limits: expected 200 with lim.c, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := render(&QueryLimits{MaxSeries: 2}, bg, "lim.*"); w.Code != http.StatusBadRequest ||
+		w.Header().Get("X-Tgres-DSL-Error") != "query limit exceeded: more than 2 series" {
+		t.Errorf("series limit: expected 400, got %d %q", w.Code, w.Header().Get("X-Tgres-DSL-Error"))
+	}
+	if w := render(&QueryLimits{MaxPoints: 10}, bg, "lim.*"); w.Code != http.StatusBadRequest ||
+		w.Header().Get("X-Tgres-DSL-Error") != "query limit exceeded: more than 10 points" {
+		t.Errorf("points limit: expected 400, got %d %q", w.Code, w.Header().Get("X-Tgres-DSL-Error"))
+	}
+	ctx, cancel := context.WithCancel(bg)
+	cancel()
+	if w := render(nil, ctx, "lim.*"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("canceled: expected 503, got %d", w.Code)
+	}
+}
+
+func Test_quoteIdentifiers(t *testing.T) {
+	for _, c := range []struct{ target, expect string }{
+		{"a.b", `"a.b"`},
+		{"scale(a.*.c, 1.5)", `scale("a.*.c", 1.5)`},
+		{"a.b > 1.5", `"a.b" > 1.5`},
+		{"a.b * -2.5", `"a.b" * -2.5`},
+	} {
+		if got := quoteIdentifiers(c.target); got != c.expect {
+			t.Errorf("quoteIdentifiers(%q): expected %s, got %s", c.target, c.expect, got)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"net/http"
+
+	"github.com/jdcio/tgres/dsl"
+)
+
+// Macros (see dsl.Macro) defined via these handlers only exist on the
+// node that received the request and until it is restarted, the ones
+// that should persist belong in the config.
+
+type macro struct {
+	Name       string   `json:"name"`
+	Params     []string `json:"params"`
+	Body       string   `json:"body"`
+	Definition string   `json:"definition"`
+}
+
+func newMacro(m *dsl.Macro) *macro {
+	return &macro{Name: m.Name, Params: m.Params, Body: m.Body, Definition: m.String()}
+}
+
+// MacrosHandler lists the macros.
+func MacrosHandler() http.HandlerFunc {
+	return adminHandler("GET", func(w http.ResponseWriter, r *http.Request) {
+		result := []*macro{}
+		for _, m := range dsl.Macros() {
+			result = append(result, newMacro(m))
+		}
+		writeJSON(w, "MacrosHandler", result)
+	})
+}
+
+// MacroDefineHandler defines the macro given by the "macro" parameter,
+// e.g. "errRate(svc) = asPercent(svc.err, svc.req)", replacing any
+// macro of the same name.
+func MacroDefineHandler() http.HandlerFunc {
+	return adminHandler("POST", func(w http.ResponseWriter, r *http.Request) {
+		m, err := dsl.DefineMacro(r.FormValue("macro"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, "MacroDefineHandler", newMacro(m))
+	})
+}
+
+// MacroDeleteHandler removes the macro named by "name".
+func MacroDeleteHandler() http.HandlerFunc {
+	return adminHandler("POST", func(w http.ResponseWriter, r *http.Request) {
+		name := r.FormValue("name")
+		if !dsl.UndefineMacro(name) {
+			http.Error(w, "no such macro: "+name, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, "MacroDeleteHandler", map[string]string{"deleted": name})
+	})
+}
@@ -0,0 +1,77 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/jdcio/tgres/dsl"
+)
+
+func Test_MacroHandlers(t *testing.T) {
+	define, list, del := MacroDefineHandler(), MacrosHandler(), MacroDeleteHandler()
+	defer dsl.UndefineMacro("httpTestRate")
+
+	listed := func() map[string]*macro {
+		w := adminRequest(list, "GET", nil)
+		var result []*macro
+		if err := json.Unmarshal(w.Body.Bytes(), &result); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("list: expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		m := make(map[string]*macro)
+		for _, r := range result {
+			m[r.Name] = r
+		}
+		return m
+	}
+
+	w := adminRequest(define, "POST", url.Values{"macro": {"httpTestRate(svc) = asPercent(svc.err, svc.req)"}})
+	var m macro
+	if err := json.Unmarshal(w.Body.Bytes(), &m); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("define: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if m.Name != "httpTestRate" || len(m.Params) != 1 || m.Params[0] != "svc" || m.Body != "asPercent(svc.err, svc.req)" {
+		t.Errorf("define: unexpected macro: %s", w.Body.String())
+	}
+	if lm := listed()["httpTestRate"]; lm == nil || lm.Definition != m.Definition {
+		t.Errorf("list: expected httpTestRate, got %+v", lm)
+	}
+
+	// redefining replaces
+	if w := adminRequest(define, "POST", url.Values{"macro": {"httpTestRate(svc, n) = scale(svc.err, n)"}}); w.Code != http.StatusOK {
+		t.Errorf("redefine: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if lm := listed()["httpTestRate"]; lm == nil || len(lm.Params) != 2 {
+		t.Errorf("redefine: expected 2 params, got %+v", lm)
+	}
+
+	for _, c := range []struct {
+		h      http.HandlerFunc
+		method string
+		params url.Values
+		status int
+	}{
+		{define, "POST", url.Values{}, http.StatusBadRequest},
+		{define, "POST", url.Values{"macro": {"httpTestBad(x) ="}}, http.StatusBadRequest},
+		{define, "POST", url.Values{"macro": {"scale(x) = x"}}, http.StatusBadRequest}, // a function
+		{define, "GET", url.Values{"macro": {"httpTestRate(x) = x"}}, http.StatusMethodNotAllowed},
+		{list, "POST", nil, http.StatusMethodNotAllowed},
+		{del, "GET", url.Values{"name": {"httpTestRate"}}, http.StatusMethodNotAllowed},
+		{del, "POST", url.Values{"name": {"httpTestNoSuch"}}, http.StatusNotFound},
+	} {
+		if w := adminRequest(c.h, c.method, c.params); w.Code != c.status {
+			t.Errorf("%s %v: expected %d, got %d: %s", c.method, c.params, c.status, w.Code, w.Body.String())
+		}
+	}
+
+	if w := adminRequest(del, "POST", url.Values{"name": {"httpTestRate"}}); w.Code != http.StatusOK {
+		t.Errorf("delete: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if lm := listed()["httpTestRate"]; lm != nil {
+		t.Errorf("delete: httpTestRate still listed")
+	}
+	if w := adminRequest(del, "POST", url.Values{"name": {"httpTestRate"}}); w.Code != http.StatusNotFound {
+		t.Errorf("delete again: expected 404, got %d", w.Code)
+	}
+}
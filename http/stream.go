@@ -0,0 +1,261 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/jdcio/tgres/dsl"
+)
+
+const (
+	streamMinInterval  = time.Second      // do not evaluate more often than this
+	streamPollInterval = 10 * time.Second // evaluate at least this often
+	streamKeepAlive    = 15 * time.Second
+)
+
+// StreamHandler streams new data points for a Graphite target as
+// Server-Sent Events. Parameters are the same as for /render, except
+// that there is only one target and "from" is a relative window
+// (default -1h) used on every evaluation, "until" is always now.
+//
+// The target is evaluated whenever any of the series it references
+// receive a new data point (as signaled by the DSL LRU cache), or
+// every streamPollInterval for series that cannot be watched. Every
+// evaluation produces a "data" event for each series that has known
+// (non-NaN) data points newer than the last one sent, the first
+// evaluation only establishes where the client starts.
+//
+// maxClients limits the number of concurrent streams, maxSeries the
+// number of series a target may reference, 0 means no limit. The
+// timeout and points limits apply to every evaluation.
+func StreamHandler(rcache dsl.NamedDSFetcher, limits *QueryLimits, maxClients, maxSeries int) http.HandlerFunc {
+	var clients int32
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		target := r.FormValue("target")
+		if target == "" {
+			http.Error(w, "target parameter required", http.StatusBadRequest)
+			return
+		}
+
+		window := time.Hour
+		if f := r.FormValue("from"); f != "" {
+			from, err := parseTime(f)
+			if err != nil || f[0] != '-' {
+				log.Printf("StreamHandler(): (from) invalid relative time: %q", f)
+				http.Error(w, fmt.Sprintf("from: invalid relative time: %q", f), http.StatusBadRequest)
+				return
+			}
+			window = time.Now().Sub(*from)
+		}
+
+		points := int64(512)
+		if mdp := r.FormValue("maxDataPoints"); mdp != "" {
+			var err error
+			if points, err = strconv.ParseInt(mdp, 10, 64); err != nil {
+				log.Printf("StreamHandler(): (maxDataPoints) %v", err)
+				http.Error(w, fmt.Sprintf("maxDataPoints: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if n := atomic.AddInt32(&clients, 1); maxClients > 0 && int(n) > maxClients {
+			atomic.AddInt32(&clients, -1)
+			log.Printf("StreamHandler(): too many clients (%d)", maxClients)
+			http.Error(w, fmt.Sprintf("too many streaming clients (limit %d)", maxClients), http.StatusServiceUnavailable)
+			return
+		}
+		defer atomic.AddInt32(&clients, -1)
+
+		sub := dsl.NewSubscription(rcache, targetQuery(target), maxSeries)
+		defer sub.Close()
+
+		// canceled once the client is gone, see done below
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		ss := &seriesStream{ctx: ctx, sub: sub, limits: limits, window: window, maxPoints: points, sent: make(map[string]int64)}
+
+		// Evaluate once before committing to the stream so that
+		// errors can be reported with a proper status code.
+		if _, err := ss.eval(); err != nil {
+			log.Printf("StreamHandler() %q: %v", target, err)
+			msg, status, ok := limits.limitError(err)
+			if !ok {
+				msg, status = err.Error(), http.StatusBadRequest
+			}
+			w.Header().Set("X-Tgres-DSL-Error", msg)
+			http.Error(w, msg, status)
+			return
+		}
+
+		// The stream lives well beyond the server write timeout,
+		// which can only be lifted by taking over the connection.
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, bufrw, err := hj.Hijack()
+		if err != nil {
+			log.Printf("StreamHandler(): %v", err)
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Time{})
+
+		hdr := w.Header()
+		hdr.Set("Content-Type", "text/event-stream")
+		hdr.Set("Cache-Control", "no-cache")
+		hdr.Set("Connection", "close")
+		fmt.Fprintf(bufrw, "HTTP/1.1 200 OK\r\n")
+		hdr.Write(bufrw)
+		fmt.Fprintf(bufrw, "\r\n")
+		if err := bufrw.Flush(); err != nil {
+			return
+		}
+
+		// Anything read from the client (or an error) means it is gone.
+		done := make(chan struct{})
+		go func() {
+			io.Copy(ioutil.Discard, bufrw)
+			close(done)
+			cancel()
+		}()
+
+		log.Printf("StreamHandler(): started streaming %q to %v", target, conn.RemoteAddr())
+
+		tick := time.NewTicker(streamMinInterval)
+		defer tick.Stop()
+
+		var (
+			dirty     bool
+			lastEval  = time.Now()
+			lastWrite = time.Now()
+		)
+		for {
+			select {
+			case <-done:
+				log.Printf("StreamHandler(): client %v disconnected", conn.RemoteAddr())
+				return
+			case <-sub.C:
+				dirty = true
+			case now := <-tick.C:
+				if dirty || now.Sub(lastEval) >= streamPollInterval {
+					dirty, lastEval = false, now
+					events, err := ss.eval()
+					if err != nil {
+						msg := err.Error()
+						if m, _, ok := limits.limitError(err); ok {
+							msg = m
+						}
+						writeStreamEvent(bufrw, "error", msg)
+						bufrw.Flush()
+						log.Printf("StreamHandler() %q: %v", target, err)
+						return
+					}
+					for _, ev := range events {
+						if err := writeStreamEvent(bufrw, "data", ev); err != nil {
+							return
+						}
+					}
+					if len(events) > 0 {
+						if bufrw.Flush() != nil {
+							return
+						}
+						lastWrite = now
+					}
+				}
+				if now.Sub(lastWrite) >= streamKeepAlive {
+					// a comment, ignored by the client
+					fmt.Fprintf(bufrw, ": keepalive\n\n")
+					if bufrw.Flush() != nil {
+						return
+					}
+					lastWrite = now
+				}
+			}
+		}
+	}
+}
+
+// seriesStream keeps track of what has been sent so far.
+type seriesStream struct {
+	ctx       context.Context
+	sub       *dsl.Subscription
+	limits    *QueryLimits
+	window    time.Duration
+	maxPoints int64
+	sent      map[string]int64 // time of last point sent by series name
+	started   bool
+}
+
+type streamEvent struct {
+	Target     string          `json:"target"`
+	Datapoints [][]interface{} `json:"datapoints"`
+}
+
+func (ss *seriesStream) eval() ([]*streamEvent, error) {
+	ctx, cancel := ss.limits.context(ss.ctx)
+	defer cancel()
+
+	to := time.Now()
+	sm, err := ss.sub.Eval(ctx, to.Add(-ss.window), to, ss.maxPoints)
+	if err != nil {
+		return nil, err
+	}
+	gss, err := readDataPoints(ctx, sm, ss.limits.pointBudget())
+	if err != nil {
+		return nil, err
+	}
+	var result []*streamEvent
+	for _, gs := range gss {
+		ev := &streamEvent{Target: gs.name}
+		last := ss.sent[gs.name]
+		for _, dp := range gs.dps {
+			if dp.t > last && !math.IsNaN(dp.v) && !math.IsInf(dp.v, 0) {
+				ev.Datapoints = append(ev.Datapoints, []interface{}{dp.v, dp.t})
+				ss.sent[gs.name] = dp.t
+			}
+		}
+		if ss.started && len(ev.Datapoints) > 0 {
+			result = append(result, ev)
+		}
+	}
+	ss.started = true
+	return result, nil
+}
+
+func writeStreamEvent(w *bufio.ReadWriter, event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
@@ -0,0 +1,150 @@
+package http
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jdcio/tgres/dsl"
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/series"
+)
+
+// streamFetcher is a NamedDSFetcher whose every series is the data
+// points in dps, which tests change between evaluations.
+type streamFetcher struct {
+	dsl.NamedDSFetcher
+	latest time.Time
+	dps    map[int64]float64
+}
+
+func (f *streamFetcher) set(t time.Time, v float64) {
+	f.dps[rrd.SlotIndex(t, time.Minute, 60)] = v
+}
+
+func (f *streamFetcher) FetchSeries(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	dps := make(map[int64]float64, len(f.dps))
+	for i, v := range f.dps {
+		dps[i] = v
+	}
+	rra := rrd.NewRoundRobinArchive(rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour, Latest: f.latest, DPs: dps})
+	return series.NewRRASeries(rra), nil
+}
+
+func Test_seriesStream_eval(t *testing.T) {
+	now := time.Now()
+	latest := now.Truncate(time.Minute)
+	rcache, _ := testFetcher(t, now, map[string]float64{"st.a": 1})
+	f := &streamFetcher{NamedDSFetcher: rcache, latest: latest.Add(-time.Minute), dps: make(map[int64]float64)}
+	for i := 1; i <= 3; i++ {
+		f.set(latest.Add(-time.Duration(i)*time.Minute), float64(i))
+	}
+
+	sub := dsl.NewSubscription(f, targetQuery("st.a"), 0)
+	defer sub.Close()
+	ss := &seriesStream{ctx: context.Background(), sub: sub, window: time.Hour, maxPoints: 100, sent: make(map[string]int64)}
+	eval := func() []*streamEvent {
+		events, err := ss.eval()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return events
+	}
+
+	// the first evaluation only establishes the starting point
+	if events := eval(); len(events) != 0 {
+		t.Errorf("first eval: expected no events, got %d", len(events))
+	}
+	if last := ss.sent["st.a"]; last != latest.Add(-time.Minute).Unix() {
+		t.Errorf("first eval: expected the last point sent at %v, got %v", latest.Add(-time.Minute).Unix(), last)
+	}
+	if events := eval(); len(events) != 0 {
+		t.Errorf("no new data: expected no events, got %d", len(events))
+	}
+
+	// an unknown point is not sent
+	f.latest = latest
+	f.set(latest, math.NaN())
+	if events := eval(); len(events) != 0 {
+		t.Errorf("NaN: expected no events, got %d", len(events))
+	}
+
+	// only points newer than what was sent are, even if older ones changed
+	f.set(latest.Add(-2*time.Minute), 99)
+	f.set(latest, 4)
+	events := eval()
+	if len(events) != 1 || events[0].Target != "st.a" || len(events[0].Datapoints) != 1 {
+		t.Fatalf("new point: expected one event with one point, got %+v", events)
+	}
+	if dp := events[0].Datapoints[0]; dp[0] != 4.0 || dp[1] != latest.Unix() {
+		t.Errorf("new point: expected [4 %d], got %v", latest.Unix(), dp)
+	}
+	if events := eval(); len(events) != 0 {
+		t.Errorf("after new point: expected no events, got %d", len(events))
+	}
+}
+
+func Test_StreamHandler(t *testing.T) {
+	now := time.Now()
+	rcache, _ := testFetcher(t, now, map[string]float64{"sh.a": 1, "sh.b": 2})
+	srv := httptest.NewServer(StreamHandler(rcache, nil, 1, 1))
+	defer srv.Close()
+
+	for _, c := range []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusBadRequest},
+		{"?target=sh.a&from=1h", http.StatusBadRequest},
+		{"?target=sh.a&maxDataPoints=x", http.StatusBadRequest},
+		{"?target=sh.*", http.StatusBadRequest}, // more than maxSeries
+	} {
+		resp, err := http.Get(srv.URL + c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%q: expected %d, got %d", c.query, c.status, resp.StatusCode)
+		}
+	}
+
+	first, err := http.Get(srv.URL + "?target=sh.a&from=-10min")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.StatusCode != http.StatusOK || first.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected a 200 event stream, got %d %q", first.StatusCode, first.Header.Get("Content-Type"))
+	}
+
+	// maxClients is 1
+	resp, err := http.Get(srv.URL + "?target=sh.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("second client: expected 503, got %d", resp.StatusCode)
+	}
+
+	// once the first client is gone there is room again
+	first.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(srv.URL + "?target=sh.a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after the first client left: expected 200, got %d", resp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -69,6 +69,17 @@ func main() {
 		return
 	}
 
+	// "migrate name ..." applies the config [[ds]] spec to existing DSs
+	if flag.Arg(0) == "migrate" {
+		if flag.NArg() < 2 {
+			log.Fatalf("Usage: %s [-c config] migrate name [name ...]", os.Args[0])
+		}
+		if err := daemon.Migrate(textCfgPath, flag.Args()[1:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
 	if bg {
 		if !filepath.IsAbs(textCfgPath) {
 			log.Fatalf("ERROR: Background only possible when config path is absolute (cfg path: %q).", textCfgPath)
@@ -0,0 +1,155 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misc
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CalendarInterval is an interval which may be in calendar units
+// (days, weeks, months, years). Unlike a time.Duration, its length
+// varies: a day is not always 24 hours (DST) and months have
+// different numbers of days, so it only makes sense relative to a
+// time in some location. Only one of the fields is ever set.
+type CalendarInterval struct {
+	Months int           // years are 12 months
+	Days   int           // weeks are 7 days
+	Dur    time.Duration // anything else
+}
+
+var calendarUnits = regexp.MustCompile(`^([0-9]+)(d|days?|w|weeks?|mon|months?|y|years?)$`)
+
+// ParseCalendarInterval parses intervals such as "1d", "2w", "1mon"
+// or "1y" as calendar intervals, anything else is parsed by
+// BetterParseDuration() and is a fixed duration.
+func ParseCalendarInterval(s string) (CalendarInterval, error) {
+	var ci CalendarInterval
+	if m := calendarUnits.FindStringSubmatch(strings.TrimSpace(s)); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return ci, err
+		}
+		switch m[2][0] {
+		case 'd':
+			ci.Days = n
+		case 'w':
+			ci.Days = n * 7
+		case 'm':
+			ci.Months = n
+		case 'y':
+			ci.Months = n * 12
+		}
+	} else {
+		d, err := BetterParseDuration(s)
+		if err != nil {
+			return ci, err
+		}
+		ci.Dur = d
+	}
+	if ci.Months <= 0 && ci.Days <= 0 && ci.Dur <= 0 {
+		return ci, fmt.Errorf("invalid interval: %q", s)
+	}
+	return ci, nil
+}
+
+// AddTo returns t plus n intervals. Calendar units are added in t's
+// location, i.e. a day later is the same wall clock time on the next
+// day.
+func (ci CalendarInterval) AddTo(t time.Time, n int) time.Time {
+	if ci.Months != 0 || ci.Days != 0 {
+		return t.AddDate(0, ci.Months*n, ci.Days*n)
+	}
+	return t.Add(ci.Dur * time.Duration(n))
+}
+
+// Unit returns the unit the interval is expressed in, e.g. a day for
+// "3d", a week for "2w", a year for "24mon" and an hour for "6h".
+func (ci CalendarInterval) Unit() CalendarInterval {
+	switch {
+	case ci.Months%12 == 0 && ci.Months > 0:
+		return CalendarInterval{Months: 12}
+	case ci.Months > 0:
+		return CalendarInterval{Months: 1}
+	case ci.Days%7 == 0 && ci.Days > 0:
+		return CalendarInterval{Days: 7}
+	case ci.Days > 0:
+		return CalendarInterval{Days: 1}
+	}
+	for _, u := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		if ci.Dur%u == 0 {
+			return CalendarInterval{Dur: u}
+		}
+	}
+	return ci
+}
+
+// Truncate returns the beginning of the interval containing t, in
+// t's location. Months are counted from January of year 0 (thus
+// "3mon" are quarters and "1y" begins on January 1st), days from
+// January 1st 1970, weeks begin on Monday. A duration which evenly
+// divides a day is counted from midnight, any other duration from
+// the zero time, see time.Truncate().
+func (ci CalendarInterval) Truncate(t time.Time) time.Time {
+	loc := t.Location()
+	y, m, d := t.Date()
+	switch {
+	case ci.Months > 0:
+		months := y*12 + int(m) - 1
+		months -= mod(months, ci.Months)
+		return time.Date(months/12, time.Month(months%12+1), 1, 0, 0, 0, 0, loc)
+	case ci.Days > 0:
+		days := int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400)
+		if ci.Days%7 == 0 {
+			days -= mod(days-4, ci.Days) // 1970-01-05 is a Monday
+		} else {
+			days -= mod(days, ci.Days)
+		}
+		return time.Date(1970, 1, 1+days, 0, 0, 0, 0, loc)
+	case (24*time.Hour)%ci.Dur == 0:
+		midnight := time.Date(y, m, d, 0, 0, 0, 0, loc)
+		return midnight.Add(t.Sub(midnight) / ci.Dur * ci.Dur)
+	}
+	return t.Truncate(ci.Dur)
+}
+
+// Approx returns the approximate duration of the interval, assuming
+// 24 hour days and 30 day months.
+func (ci CalendarInterval) Approx() time.Duration {
+	return time.Duration(ci.Months)*30*24*time.Hour + time.Duration(ci.Days)*24*time.Hour + ci.Dur
+}
+
+func (ci CalendarInterval) String() string {
+	switch {
+	case ci.Months%12 == 0 && ci.Months > 0:
+		return fmt.Sprintf("%dy", ci.Months/12)
+	case ci.Months > 0:
+		return fmt.Sprintf("%dmon", ci.Months)
+	case ci.Days%7 == 0 && ci.Days > 0:
+		return fmt.Sprintf("%dw", ci.Days/7)
+	case ci.Days > 0:
+		return fmt.Sprintf("%dd", ci.Days)
+	}
+	return ci.Dur.String()
+}
+
+// mod is % which is never negative (for positive b).
+func mod(a, b int) int {
+	return ((a % b) + b) % b
+}
@@ -65,9 +65,9 @@ var directorForwardDPToNode = func(dp *incomingDP, node *cluster.Node, snd chan
 	return nil
 }
 
-var directorProcessDataPoint = func(cds *cachedDs, dsf dsFlusherBlocking) (int, int) {
+var directorProcessDataPoint = func(cds *cachedDs, dsf dsFlusherBlocking) (int, int, int) {
 
-	cnt, blk, err := cds.processIncoming()
+	cnt, blk, oor, err := cds.processIncoming()
 	if err != nil {
 		if !strings.Contains(err.Error(), "not greater than data source") {
 			log.Printf("directorProcessDataPoint [%v] error: %v", cds.Ident(), err)
@@ -83,7 +83,7 @@ var directorProcessDataPoint = func(cds *cachedDs, dsf dsFlusherBlocking) (int,
 		cds.lastFlush = time.Now()
 	}
 	cds.mu.Unlock()
-	return cnt, blk
+	return cnt, blk, oor
 }
 
 var directorProcessOrForward = func(dsc *dsCache, cds *cachedDs, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats) {
@@ -126,6 +126,12 @@ var directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan
 		return
 	}
 
+	if dp.field == "" { // forwarded data points are already split
+		if ident, field := dsc.splitField(dp.cachedIdent); ident != nil {
+			dp.cachedIdent, dp.field = ident, field
+		}
+	}
+
 	cds := dsc.getByIdentOrCreateEmpty(dp.cachedIdent)
 	if cds == nil {
 		stats.unknown++
@@ -347,22 +353,24 @@ var worker = func(wg *sync.WaitGroup, workerCh chan *cachedDs, dsf dsFlusherBloc
 	log.Printf("worker %d: starting.", n)
 	defer wg.Done()
 	lastStat := time.Now()
-	accepted, watchBlk := 0, 0
+	accepted, watchBlk, outOfRange := 0, 0, 0
 	for {
 		cds, ok := <-workerCh
 		if !ok {
 			log.Printf("worker %d: exiting.", n)
 			return
 		}
-		cnt, blk := directorProcessDataPoint(cds, dsf)
+		cnt, blk, oor := directorProcessDataPoint(cds, dsf)
 		accepted += cnt
 		watchBlk += blk
+		outOfRange += oor
 
 		if lastStat.Before(time.Now().Add(-time.Second)) {
 			sr.reportStatCount("receiver.datapoints.accepted", float64(accepted))
 			sr.reportStatCount("receiver.cache.watch_blocked", float64(watchBlk))
+			sr.reportStatCount("receiver.datapoints.out_of_range", float64(outOfRange))
 			lastStat = time.Now()
-			accepted, watchBlk = 0, 0
+			accepted, watchBlk, outOfRange = 0, 0, 0
 		}
 	}
 }
@@ -17,7 +17,9 @@ package receiver
 
 import (
 	"fmt"
+	"log"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -73,11 +75,97 @@ func (d *dsCache) delete(ident serde.Ident) {
 	defer d.Unlock()
 	s := ident.String()
 	if cds := d.byIdent[s]; cds != nil {
-		d.rraCount -= len(cds.RRAs())
+		if cds.spec != nil {
+			d.rraCount -= len(cds.spec.RRAs)
+		} else if ds, ok := cds.DbDataSourcer.(rrd.DataSourcer); ok && ds != nil {
+			d.rraCount -= len(ds.RRAs())
+		}
 		delete(d.byIdent, s)
 	}
 }
 
+// forget removes a DS which was deleted or changed in the database
+// from the cache, so that it is reloaded next time a data point for
+// it arrives. Whatever is in the vcache for RRAs (or the DS) that no
+// longer exist is purged from it, the rest of the in-memory state is
+// moved to the vcache so that it isn't lost. If the step has changed
+// (a migration), the DS state is of the old step, it is purged rather
+// than written over the state the migration reset.
+func (d *dsCache) forget(ident serde.Ident) {
+	cds := d.getByIdent(newCachedIdent(ident))
+	if cds == nil {
+		return
+	}
+	d.delete(ident)
+
+	cds.mu.Lock()
+	defer cds.mu.Unlock()
+
+	if cds.spec != nil { // never loaded, nothing to flush
+		return
+	}
+
+	ds, err := d.db.FetchOrCreateDataSource(ident, nil)
+	if err != nil {
+		log.Printf("dsCache.forget(): %v", err)
+		return
+	}
+	if ds == nil { // gone entirely
+		d.dsf.purgeVCache(cds.DbDataSourcer, cds.RRAs())
+		return
+	}
+
+	if ds.Step() == cds.Step() {
+		d.dsf.flushToVCache(cds.DbDataSourcer)
+	} else {
+		d.dsf.purgeVCache(cds.DbDataSourcer, nil)
+		d.dsf.flushRRAsToVCache(cds.DbDataSourcer)
+	}
+
+	current := make(map[bundleKey]map[int64]bool)
+	for _, rra := range ds.RRAs() {
+		if dbrra, ok := rra.(serde.DbRoundRobinArchiver); ok {
+			key := bundleKey{dbrra.BundleId(), dbrra.Seg()}
+			if current[key] == nil {
+				current[key] = make(map[int64]bool)
+			}
+			current[key][dbrra.Idx()] = true
+		}
+	}
+	var gone []rrd.RoundRobinArchiver
+	for _, rra := range cds.RRAs() {
+		if dbrra, ok := rra.(serde.DbRoundRobinArchiver); ok {
+			if !current[bundleKey{dbrra.BundleId(), dbrra.Seg()}][dbrra.Idx()] {
+				gone = append(gone, rra)
+			}
+		}
+	}
+	if len(gone) > 0 {
+		d.dsf.purgeVCache(nil, gone)
+	}
+}
+
+// migrate migrates the DS (see
+// serde.DataSourceAdmin.MigrateDataSource) once whatever is in memory
+// for it has been written to the database, so that the new RRAs are
+// resampled from all of its data. Data points which arrive in the
+// meantime are dealt with by forget().
+func (d *dsCache) migrate(ident serde.Ident, spec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	adm, ok := d.db.(serde.DataSourceAdmin)
+	if !ok {
+		return nil, fmt.Errorf("DS migration is not supported by this serde")
+	}
+	if cds := d.getByIdent(newCachedIdent(ident)); cds != nil {
+		cds.mu.Lock()
+		if cds.spec == nil {
+			d.dsf.flushToVCache(cds.DbDataSourcer)
+		}
+		cds.mu.Unlock()
+	}
+	d.dsf.flushVCache()
+	return adm.MigrateDataSource(ident, spec)
+}
+
 func (d *dsCache) preLoad() error {
 	dss, err := d.db.FetchDataSources()
 	if err != nil {
@@ -110,6 +198,43 @@ func (d *dsCache) getByIdentOrCreateEmpty(ident *cachedIdent) *cachedDs {
 	return result
 }
 
+// splitField splits the ident of a data point for a field of a
+// multi-value DS, which is "name:field", into the ident of the DS and
+// the field. The ident returned is nil if the data point is not for
+// a field: the name has no ":", a DS by the name as is exists, or
+// there is no DS (cached or to be created) by the name before the
+// ":" with the field.
+func (d *dsCache) splitField(ident *cachedIdent) (*cachedIdent, string) {
+	name := ident.Ident["name"]
+	i := strings.LastIndex(name, ":")
+	if i < 1 || i == len(name)-1 || d.getByIdent(ident) != nil {
+		return nil, ""
+	}
+
+	base := make(serde.Ident, len(ident.Ident))
+	for k, v := range ident.Ident {
+		base[k] = v
+	}
+	base["name"] = name[:i]
+	field := name[i+1:]
+	result := newCachedIdent(base)
+
+	var fields []string
+	if cds := d.getByIdent(result); cds != nil {
+		if spec := cds.spec; spec != nil {
+			fields = spec.Fields
+		} else {
+			fields = cds.Fields()
+		}
+	} else if spec := d.finder.FindMatchingDSSpec(base); spec != nil {
+		fields = spec.Fields
+	}
+	if rrd.FieldIndex(fields, field) < 0 {
+		return nil, ""
+	}
+	return result, field
+}
+
 // load (or create) via the SerDe given an empty cachedDs with ident and spec
 func (d *dsCache) fetchOrCreateByIdent(cds *cachedDs) error {
 	ds, err := d.db.FetchOrCreateDataSource(cds.Ident(), cds.spec)
@@ -213,7 +338,7 @@ func (cds *cachedDs) appendIncoming(dp *incomingDP) {
 	cds.incoming = append(cds.incoming, dp)
 }
 
-func (cds *cachedDs) processIncoming() (int, int, error) {
+func (cds *cachedDs) processIncoming() (int, int, int, error) {
 
 	const BIG = 32 // this number was chosen rather arbitrarily
 
@@ -223,7 +348,7 @@ func (cds *cachedDs) processIncoming() (int, int, error) {
 
 	count := len(cds.incoming)
 	if count == 0 {
-		return 0, 0, nil
+		return 0, 0, 0, nil
 	}
 
 	// delay processing by 1/10 of a step, in a clustered situation it
@@ -231,19 +356,29 @@ func (cds *cachedDs) processIncoming() (int, int, error) {
 	// this (along with the Sort() just below) addresses it.  Unless
 	// there are already a bunch of points queued up
 	if !(cds.lastProcess.Before(time.Now().Add(-cds.Step()/10)) || count > BIG) {
-		return 0, 0, nil
+		return 0, 0, 0, nil
 	}
 
 	sort.Sort(cds.incoming)
 
-	blocked := 0 // watched ch blocked
+	blocked, outOfRange := 0, 0 // watched ch blocked, outside of min/max
 	for _, dp := range cds.incoming {
 		// continue on errors
-		err = cds.ProcessDataPoint(dp.value, dp.timeStamp)
+		field := 0
+		if dp.field != "" {
+			field = rrd.FieldIndex(cds.Fields(), dp.field)
+			err = cds.ProcessFieldDataPoint(field, dp.value, dp.timeStamp)
+		} else {
+			err = cds.ProcessDataPoint(dp.value, dp.timeStamp)
+		}
+		if err == rrd.ErrOutOfRange {
+			outOfRange++
+			err = nil
+		}
 
 		if cds.watchCh != nil {
 			select {
-			case cds.watchCh <- dsl.DataPoint{Ident: cds.Ident(), T: dp.timeStamp, V: dp.value}:
+			case cds.watchCh <- dsl.DataPoint{Ident: cds.Ident(), Field: field, T: dp.timeStamp, V: dp.value}:
 			default:
 				// TODO: This means the in-memory series never gets
 				// this data point. There should be a better solution
@@ -262,7 +397,7 @@ func (cds *cachedDs) processIncoming() (int, int, error) {
 		cds.incoming = nil
 	}
 
-	return count, blocked, err
+	return count, blocked, outOfRange, err
 }
 
 // This is exported so as to be Gob-Encodable
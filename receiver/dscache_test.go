@@ -15,7 +15,9 @@
 package receiver
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -73,6 +75,42 @@ func Test_dscache_delete(t *testing.T) {
 	}
 }
 
+func Test_dscache_forget(t *testing.T) {
+	db := &fakeSerde{}
+	dsf := &fakeDsFlusher{}
+	d := newDsCache(db, nil, dsf)
+
+	foo := serde.Ident{"name": "foo"}
+	ds := serde.NewDbDataSource(0, foo, 0, 0, rrd.NewDataSource(*DftDSSPec))
+	d.insert(&cachedDs{DbDataSourcer: ds, mu: &sync.Mutex{}})
+
+	// changed DS is removed from the cache, but not purged from vcache
+	d.forget(foo)
+	if cds := d.getByIdent(newCachedIdent(foo)); cds != nil {
+		t.Errorf("forget: did not delete")
+	}
+	if db.createCalled != 1 || dsf.purged != 0 {
+		t.Errorf("forget: createCalled: %d (expected 1), purged: %d (expected 0)", db.createCalled, dsf.purged)
+	}
+	if st := d.stats(); st.rraCount != 0 {
+		t.Errorf("forget: rraCount: %d (expected 0)", st.rraCount)
+	}
+
+	// deleted DS is purged
+	d.insert(&cachedDs{DbDataSourcer: ds, mu: &sync.Mutex{}})
+	db.notFound = true
+	d.forget(foo)
+	if dsf.purged != 1 {
+		t.Errorf("forget: purged: %d (expected 1)", dsf.purged)
+	}
+
+	// not cached, nothing to do
+	d.forget(foo)
+	if db.createCalled != 2 {
+		t.Errorf("forget: createCalled: %d (expected 2)", db.createCalled)
+	}
+}
+
 func Test_dscache_preLoad(t *testing.T) {
 	db := &fakeSerde{}
 	d := newDsCache(db, nil, nil)
@@ -107,7 +145,7 @@ type fakeSerde struct {
 	flushCalled, createCalled, fetchCalled int
 	fakeErr                                bool
 	returnDss                              []rrd.DataSourcer
-	nondb                                  bool
+	nondb, notFound                        bool
 }
 
 func (m *fakeSerde) Fetcher() serde.Fetcher                                { return m }
@@ -115,7 +153,7 @@ func (m *fakeSerde) Flusher() serde.Flusher                                { ret
 func (m *fakeSerde) EventListener() serde.EventListener                    { return nil } // not supported
 func (f *fakeSerde) FetchDataSourceById(id int64) (rrd.DataSourcer, error) { return nil, nil }
 func (m *fakeSerde) Search(serde.SearchQuery) (serde.SearchResult, error)  { return nil, nil }
-func (f *fakeSerde) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+func (f *fakeSerde) FetchSeries(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
 	return nil, nil
 }
 
@@ -140,6 +178,9 @@ func (f *fakeSerde) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpe
 	if f.fakeErr {
 		return nil, fmt.Errorf("some error")
 	}
+	if f.notFound {
+		return nil, nil
+	}
 	if f.nondb {
 		return rrd.NewDataSource(*DftDSSPec), nil
 	} else {
@@ -185,6 +226,41 @@ func Test_dscache_fetchOrCreateByIdent(t *testing.T) {
 	}
 }
 
+func Test_dscache_splitField(t *testing.T) {
+	spec := *DftDSSPec
+	spec.Fields = []string{"rx", "tx"}
+	d := newDsCache(nil, &SimpleDSFinder{&spec}, nil)
+
+	ident, field := d.splitField(newCachedIdent(serde.Ident{"name": "foo:rx", "host": "a"}))
+	if ident == nil || ident.Ident["name"] != "foo" || ident.Ident["host"] != "a" || field != "rx" {
+		t.Errorf("splitField: expected foo and rx, got %v and %q", ident, field)
+	}
+	for _, name := range []string{"foo", "foo:", ":rx", "foo:zz"} {
+		if ident, _ := d.splitField(newCachedIdent(serde.Ident{"name": name})); ident != nil {
+			t.Errorf("splitField(%q): expected nil, got %v", name, ident)
+		}
+	}
+
+	// A DS by the name as is
+	bar := newCachedIdent(serde.Ident{"name": "bar:rx"})
+	d.insert(&cachedDs{DbDataSourcer: serde.NewDbDataSource(1, bar.Ident, 0, 0, rrd.NewDataSource(*DftDSSPec)), mu: &sync.Mutex{}})
+	if ident, _ := d.splitField(bar); ident != nil {
+		t.Errorf("splitField: expected nil for an existing DS, got %v", ident)
+	}
+
+	// The fields of a cached DS are those of the DS, not of the spec
+	baz := newCachedIdent(serde.Ident{"name": "baz"})
+	bspec := *DftDSSPec
+	bspec.Fields = []string{"load1", "load5"}
+	d.insert(&cachedDs{DbDataSourcer: serde.NewDbDataSource(2, baz.Ident, 0, 0, rrd.NewDataSource(bspec)), mu: &sync.Mutex{}})
+	if ident, field := d.splitField(newCachedIdent(serde.Ident{"name": "baz:load5"})); ident == nil || ident.String() != baz.String() || field != "load5" {
+		t.Errorf("splitField: expected baz and load5, got %v and %q", ident, field)
+	}
+	if ident, _ := d.splitField(newCachedIdent(serde.Ident{"name": "baz:rx"})); ident != nil {
+		t.Errorf("splitField: expected nil for a field the cached DS does not have, got %v", ident)
+	}
+}
+
 func Test_dscache_register(t *testing.T) {
 	d := newDsCache(nil, nil, nil)
 	d.clstr = &fakeCluster{}
@@ -21,6 +21,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/jdcio/tgres/rrd"
 	"github.com/jdcio/tgres/serde"
 )
 
@@ -29,18 +30,28 @@ type dsFlusher struct {
 	vcache *verticalCache
 	sr     statReporter
 	dbCh   chan *vDpFlushRequest
+	n      int        // number of db flushers
+	syncMu sync.Mutex // serializes flushVCache
 }
 
 // There are 3 types of flush requests:
-// 1. Data Points (DPS), requires bundle_id, seg, dps and vers
-// 2. RRA State, requires bundle_id, seg, latests, duration, value
-// 3. DS State (DSS), requires seg, lastupdate, duration, value
+// 1. Data Points (DPS), requires bundle_id, seg, dps and vers, sketches
+// 2. RRA State, requires bundle_id, seg, latests, duration, value, m2, sketch, hw
+// 3. DS State (DSS), requires seg, lastupdate, lastvalue, duration, value, fields
+// A request with only a barrier is not a flush, see flushVCache().
 type vDpFlushRequest struct {
 	bundleId, seg, i            int64
 	dps                         crossRRAPoints        // DPS
 	ivers                       map[int64]*iVer       // DPS (versions)
+	sketches                    map[int64]interface{} // DPS (SKETCH)
 	latests                     map[int64]interface{} // Latests
+	m2                          map[int64]interface{} // RRA State (STDDEV)
+	sketch                      map[int64]interface{} // RRA State (SKETCH)
+	hw                          map[int64]interface{} // RRA State (Holt-Winters)
 	lastupdate, duration, value map[int64]interface{} // DSS
+	lastvalue                   map[int64]interface{} // DSS
+	fields                      map[int64]interface{} // DSS (multi-value)
+	barrier                     *sync.WaitGroup
 }
 
 func (f *dsFlusher) start(flusherWg, startWg *sync.WaitGroup, minStep time.Duration, n int) {
@@ -50,6 +61,7 @@ func (f *dsFlusher) start(flusherWg, startWg *sync.WaitGroup, minStep time.Durat
 	// it means the db most definitely cannot keep up, and it's
 	// okay for whatever upstream to be blocked by it.
 	f.dbCh = make(chan *vDpFlushRequest, 10240)
+	f.n = n
 	f.vcache = &verticalCache{
 		Mutex:   &sync.Mutex{},
 		dps:     make(map[bundleKey]*verticalCacheSegment),
@@ -108,12 +120,66 @@ func (f *dsFlusher) flushToVCache(ds serde.DbDataSourcer) {
 	return
 }
 
+// flushRRAsToVCache is flushToVCache without the DS state, which is
+// for when the state in memory is no longer valid.
+func (f *dsFlusher) flushRRAsToVCache(ds serde.DbDataSourcer) {
+	if f.db != nil {
+		for _, rra := range ds.RRAs() {
+			if _rra, ok := rra.(*serde.DbRoundRobinArchive); ok {
+				f.vcache.updateDps(_rra)
+			}
+		}
+		ds.ClearRRAs()
+	}
+}
+
+// flushVCache writes everything in the vcache to the db and returns
+// once it is written, including what was queued for the db flushers
+// before. This is done by sending each db flusher a barrier, the
+// flushers wait for one another at it, thus each takes exactly one
+// and by then all the requests before the barriers are done.
+func (f *dsFlusher) flushVCache() {
+	if f.db == nil || f.dbCh == nil {
+		return
+	}
+	f.syncMu.Lock()
+	defer f.syncMu.Unlock()
+
+	f.vcache.flush(f.dbCh, true)
+	var barrier sync.WaitGroup
+	barrier.Add(f.n + 1)
+	for i := 0; i < f.n; i++ {
+		f.dbCh <- &vDpFlushRequest{barrier: &barrier}
+	}
+	barrier.Done()
+	barrier.Wait()
+}
+
+// purgeVCache removes the state of ds (unless it is nil) and the data
+// points and state of rras from the vcache.
+func (f *dsFlusher) purgeVCache(ds serde.DbDataSourcer, rras []rrd.RoundRobinArchiver) {
+	if f.vcache == nil {
+		return
+	}
+	if ds != nil {
+		f.vcache.removeDss(ds)
+	}
+	for _, rra := range rras {
+		if _rra, ok := rra.(serde.DbRoundRobinArchiver); ok {
+			f.vcache.removeDps(_rra)
+		}
+	}
+}
+
 func (f *dsFlusher) statReporter() statReporter {
 	return f.sr
 }
 
 type dsFlusherBlocking interface {
 	flushToVCache(serde.DbDataSourcer)
+	flushRRAsToVCache(serde.DbDataSourcer)
+	flushVCache()
+	purgeVCache(serde.DbDataSourcer, []rrd.RoundRobinArchiver)
 	statReporter() statReporter
 	start(flusherWg, startWg *sync.WaitGroup, minStep time.Duration, n int)
 	stop()
@@ -149,10 +215,13 @@ var dbFlusher = func(wc wController, db serde.Flusher, ch chan *vDpFlushRequest,
 			st.chMaxLen = l
 		}
 
-		if len(dpr.lastupdate) > 0 {
+		if dpr.barrier != nil {
+			dpr.barrier.Done()
+			dpr.barrier.Wait()
+		} else if len(dpr.lastupdate) > 0 {
 			// DS state Flush
 			start := time.Now()
-			sqlOps, err := db.FlushDSStates(dpr.seg, dpr.lastupdate, dpr.value, dpr.duration)
+			sqlOps, err := db.FlushDSStates(dpr.seg, dpr.lastupdate, dpr.lastvalue, dpr.value, dpr.duration, dpr.fields)
 			if err != nil {
 				log.Printf("vdbflusher: ERROR in VerticalFlushDSs: %v", err)
 			}
@@ -165,7 +234,7 @@ var dbFlusher = func(wc wController, db serde.Flusher, ch chan *vDpFlushRequest,
 			// Datapoints flush
 			idps, vers := dataPointsWithVersions(dpr.dps, dpr.i, dpr.ivers)
 			start := time.Now()
-			sqlOps, err := db.FlushDataPoints(dpr.bundleId, dpr.seg, dpr.i, idps, vers)
+			sqlOps, err := db.FlushDataPoints(dpr.bundleId, dpr.seg, dpr.i, idps, vers, dpr.sketches)
 			if err != nil {
 				log.Printf("vdbflusher: ERROR in VerticalFlushDps: %v", err)
 			}
@@ -177,7 +246,7 @@ var dbFlusher = func(wc wController, db serde.Flusher, ch chan *vDpFlushRequest,
 		} else if (len(dpr.latests) + len(dpr.value) + len(dpr.duration)) > 0 {
 			// RRA State flush
 			start := time.Now()
-			sqlOps, err := db.FlushRRAStates(dpr.bundleId, dpr.seg, dpr.latests, dpr.value, dpr.duration)
+			sqlOps, err := db.FlushRRAStates(dpr.bundleId, dpr.seg, dpr.latests, dpr.value, dpr.duration, dpr.m2, dpr.sketch, dpr.hw)
 			if err != nil {
 				log.Printf("verticalCache: ERROR in VerticalFlushRRAs: %v", err)
 			}
@@ -26,23 +26,26 @@ import (
 )
 
 type fakeDsFlusher struct {
-	called int
-	sr     statReporter
+	called, purged int
+	sr             statReporter
 }
 
-func (f *fakeDsFlusher) flushDS(ds serde.DbDataSourcer, block bool)         { f.called++ }
-func (f *fakeDsFlusher) flushToVCache(serde.DbDataSourcer)                  {}
-func (f *fakeDsFlusher) flusher() serde.Flusher                             { return f }
-func (f *fakeDsFlusher) statReporter() statReporter                         { return f.sr }
-func (f *fakeDsFlusher) start(_, _ *sync.WaitGroup, _ time.Duration, n int) {}
-func (f *fakeDsFlusher) stop()                                              {}
-func (f *fakeDsFlusher) FlushDataPoints(bunlde_id, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+func (f *fakeDsFlusher) flushDS(ds serde.DbDataSourcer, block bool)                { f.called++ }
+func (f *fakeDsFlusher) flushToVCache(serde.DbDataSourcer)                         {}
+func (f *fakeDsFlusher) flushRRAsToVCache(serde.DbDataSourcer)                     {}
+func (f *fakeDsFlusher) flushVCache()                                              {}
+func (f *fakeDsFlusher) purgeVCache(serde.DbDataSourcer, []rrd.RoundRobinArchiver) { f.purged++ }
+func (f *fakeDsFlusher) flusher() serde.Flusher                                    { return f }
+func (f *fakeDsFlusher) statReporter() statReporter                                { return f.sr }
+func (f *fakeDsFlusher) start(_, _ *sync.WaitGroup, _ time.Duration, n int)        {}
+func (f *fakeDsFlusher) stop()                                                     {}
+func (f *fakeDsFlusher) FlushDataPoints(bunlde_id, seg, i int64, dps, vers, sketches map[int64]interface{}) (int, error) {
 	return 0, nil
 }
-func (f *fakeDsFlusher) FlushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (int, error) {
+func (f *fakeDsFlusher) FlushDSStates(seg int64, lastupdate, lastvalue, value, duration, fields map[int64]interface{}) (int, error) {
 	return 0, nil
 }
-func (f *fakeDsFlusher) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+func (f *fakeDsFlusher) FlushRRAStates(bundle_id, seg int64, latests, value, duration, m2, sketch, hw map[int64]interface{}) (int, error) {
 	return 0, nil
 }
 
@@ -0,0 +1,194 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jdcio/tgres/rrd"
+	"github.com/jdcio/tgres/serde"
+	"github.com/jdcio/tgres/series"
+)
+
+// migrateSerde is a DB of a single DS which records what is flushed
+// to it and when it is migrated.
+type migrateSerde struct {
+	sync.Mutex
+	spec       *rrd.DSSpec
+	lastupdate interface{} // DS state
+	dps        int         // data points written
+	listener   func(serde.Ident)
+
+	// what was written at the time of migration
+	migratedDps        int
+	migratedLastupdate interface{}
+}
+
+func (m *migrateSerde) Fetcher() serde.Fetcher             { return m }
+func (m *migrateSerde) Flusher() serde.Flusher             { return m }
+func (m *migrateSerde) EventListener() serde.EventListener { return m }
+
+func (m *migrateSerde) RegisterDeleteListener(f func(serde.Ident)) error {
+	m.listener = f
+	return nil
+}
+
+func (m *migrateSerde) Search(serde.SearchQuery) (serde.SearchResult, error) { return nil, nil }
+func (m *migrateSerde) FetchDataSources() ([]rrd.DataSourcer, error)         { return nil, nil }
+func (m *migrateSerde) FetchDataSourceById(id int64) (rrd.DataSourcer, error) {
+	return nil, nil
+}
+func (m *migrateSerde) FetchSeries(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	return nil, nil
+}
+
+func (m *migrateSerde) FetchOrCreateDataSource(ident serde.Ident, _ *rrd.DSSpec) (rrd.DataSourcer, error) {
+	m.Lock()
+	defer m.Unlock()
+	ds := rrd.NewDataSource(*m.spec)
+	rras := ds.RRAs()
+	for i, rra := range rras {
+		rras[i] = &serde.DbRoundRobinArchive{RoundRobinArchiver: rra}
+	}
+	ds.SetRRAs(rras)
+	return serde.NewDbDataSource(1, ident, 0, 0, ds), nil
+}
+
+func (m *migrateSerde) FlushDataPoints(bundle_id, seg, i int64, dps, vers, sketches map[int64]interface{}) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.dps += len(dps)
+	return 1, nil
+}
+
+func (m *migrateSerde) FlushDSStates(seg int64, lastupdate, lastvalue, value, duration, fields map[int64]interface{}) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.lastupdate = lastupdate[0]
+	return 1, nil
+}
+
+func (m *migrateSerde) FlushRRAStates(bundle_id, seg int64, latests, value, duration, m2, sketch, hw map[int64]interface{}) (int, error) {
+	return 1, nil
+}
+
+func (m *migrateSerde) DeleteDataSource(serde.Ident) (rrd.DataSourcer, error) {
+	return nil, fmt.Errorf("not supported")
+}
+func (m *migrateSerde) SetHeartbeat(serde.Ident, time.Duration) (rrd.DataSourcer, error) {
+	return nil, fmt.Errorf("not supported")
+}
+func (m *migrateSerde) AddRRA(serde.Ident, rrd.RRASpec) (rrd.DataSourcer, error) {
+	return nil, fmt.Errorf("not supported")
+}
+func (m *migrateSerde) RemoveRRA(serde.Ident, rrd.RRASpec) (rrd.DataSourcer, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+// MigrateDataSource resets the DS state, as a step change does, and
+// notifies the listener the way the Postgres serde does.
+func (m *migrateSerde) MigrateDataSource(ident serde.Ident, spec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	m.Lock()
+	m.migratedDps, m.migratedLastupdate = m.dps, m.lastupdate
+	m.spec, m.lastupdate = spec, nil
+	m.Unlock()
+	m.listener(ident)
+	return m.FetchOrCreateDataSource(ident, spec)
+}
+
+func Test_Receiver_MigrateDataSource(t *testing.T) {
+	dsSpec := func(step time.Duration) *rrd.DSSpec {
+		return &rrd.DSSpec{
+			Step:      step,
+			Heartbeat: time.Hour,
+			RRAs:      []rrd.RRASpec{{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour}},
+		}
+	}
+	newSpec := dsSpec(2 * time.Second)
+
+	ident := serde.Ident{"name": "foo"}
+	start := time.Unix(1500000000, 0)
+
+	// ingest returns a receiver with points for ident which have
+	// not been flushed.
+	ingest := func(db *migrateSerde) (*Receiver, *sync.WaitGroup) {
+		r := New(db, nil)
+		var flusherWg, startWg sync.WaitGroup
+		r.flusher.start(&flusherWg, &startWg, time.Second, 2)
+		startWg.Wait()
+
+		ds, _ := db.FetchOrCreateDataSource(ident, nil)
+		cds := &cachedDs{DbDataSourcer: ds.(serde.DbDataSourcer), mu: &sync.Mutex{}}
+		r.dsc.insert(cds)
+		for i := 1; i <= 10; i++ {
+			if err := cds.ProcessDataPoint(float64(i), start.Add(time.Duration(i)*time.Second)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return r, &flusherWg
+	}
+	stop := func(r *Receiver, wg *sync.WaitGroup) {
+		r.flusher.stop()
+		wg.Wait()
+	}
+
+	// everything in memory is in the DB by the time it is migrated
+	db := &migrateSerde{spec: dsSpec(time.Second)}
+	r, wg := ingest(db)
+	if _, err := r.MigrateDataSource(ident, newSpec); err != nil {
+		t.Fatal(err)
+	}
+	if db.migratedDps == 0 {
+		t.Errorf("MigrateDataSource: no data points written before the migration")
+	}
+	if lu, _ := db.migratedLastupdate.(time.Time); !lu.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("MigrateDataSource: DS state not written before the migration: %v", db.migratedLastupdate)
+	}
+	if cds := r.dsc.getByIdent(newCachedIdent(ident)); cds != nil {
+		t.Errorf("MigrateDataSource: DS still in the cache")
+	}
+	r.flusher.flushVCache()
+	if db.lastupdate != nil {
+		t.Errorf("MigrateDataSource: old step DS state written over the migrated one: %v", db.lastupdate)
+	}
+	stop(r, wg)
+
+	// migrated elsewhere (e.g. tgres migrate), the data points are
+	// kept, but not the old step DS state
+	db = &migrateSerde{spec: dsSpec(time.Second)}
+	r, wg = ingest(db)
+	if _, err := db.MigrateDataSource(ident, newSpec); err != nil {
+		t.Fatal(err)
+	}
+	r.flusher.flushVCache()
+	if db.dps == 0 {
+		t.Errorf("forget: data points not written")
+	}
+	if db.lastupdate != nil {
+		t.Errorf("forget: old step DS state written over the migrated one: %v", db.lastupdate)
+	}
+	stop(r, wg)
+
+	// stopped
+	r.stopped = true
+	if _, err := r.MigrateDataSource(ident, newSpec); err == nil {
+		t.Errorf("MigrateDataSource: expected an error when stopped")
+	}
+}
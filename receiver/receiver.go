@@ -21,6 +21,7 @@ package receiver
 import (
 	"bytes"
 	"encoding/gob"
+	"fmt"
 	"os"
 	"sync"
 	"time"
@@ -28,6 +29,7 @@ import (
 	"github.com/jdcio/tgres/aggregator"
 	"github.com/jdcio/tgres/blaster"
 	"github.com/jdcio/tgres/cluster"
+	"github.com/jdcio/tgres/rrd"
 	"github.com/jdcio/tgres/serde"
 )
 
@@ -153,10 +155,10 @@ func NewWithMaxQueue(db serde.SerDe, finder MatchingDSSpecFinder, maxQueue int)
 	r.flusher = &dsFlusher{db: db.Flusher(), sr: r}
 	r.dsc = newDsCache(db.Fetcher(), finder, r.flusher)
 
-	// Register DS delete listener
+	// Register DS delete (or change) listener
 	if el := db.EventListener(); el != nil {
 		el.RegisterDeleteListener(func(ident serde.Ident) {
-			r.dsc.delete(ident)
+			r.dsc.forget(ident)
 		})
 	}
 
@@ -212,6 +214,16 @@ func (r *Receiver) DsCache() *dsCache {
 	return r.dsc
 }
 
+// MigrateDataSource is serde.DataSourceAdmin.MigrateDataSource for a
+// DS which may have data not yet written to the database. The data is
+// written first so that it is migrated too.
+func (r *Receiver) MigrateDataSource(ident serde.Ident, spec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	if r.stopped {
+		return nil, fmt.Errorf("MigrateDataSource: receiver is stopped")
+	}
+	return r.dsc.migrate(ident, spec)
+}
+
 // Sends a data point to the receiver channel. A Data Source PDP
 // always treats incoming data as a rate, it is the responsibility of
 // the caller to present non-rate values such as counters as a
@@ -294,8 +306,12 @@ type clusterer interface {
 // to create from most any data point representation out there. This
 // data point representation has no notion of duration and therefore
 // must rely on some kind of a separately stored "last update" time.
+// A data point for a field of a multi-value DS arrives with the ident
+// name "name:field", which the director splits into the ident of the
+// DS and the field.
 type incomingDP struct {
 	cachedIdent *cachedIdent
+	field       string
 	timeStamp   time.Time
 	value       float64
 	Hops        int
@@ -314,6 +330,7 @@ func (dp *incomingDP) GobEncode() ([]byte, error) {
 	check(enc.Encode(dp.timeStamp))
 	check(enc.Encode(dp.value))
 	check(enc.Encode(dp.Hops))
+	check(enc.Encode(dp.field))
 	if err != nil {
 		return nil, err
 	}
@@ -334,5 +351,6 @@ func (dp *incomingDP) GobDecode(b []byte) error {
 	check(dec.Decode(&dp.timeStamp))
 	check(dec.Decode(&dp.value))
 	check(dec.Decode(&dp.Hops))
+	check(dec.Decode(&dp.field))
 	return err
 }
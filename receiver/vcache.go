@@ -42,19 +42,24 @@ type verticalCacheSegment struct {
 	latests     map[int64]time.Time // rra.latest
 	value       map[int64]float64
 	duration    map[int64]int64
+	m2          map[int64]float64               // STDDEV RRAs only
+	sketchRows  map[int64]map[int64]interface{} // SKETCH RRAs only, marshaled, keyed like rows
+	sketch      map[int64]interface{}           // SKETCH RRAs only, current slot
+	hw          map[int64]interface{}           // Holt-Winters RRAs only, marshaled model
 	maxLatest   time.Time
 	latestIndex int64
 	lastFlushRT time.Time
-	step        time.Duration
-	size        int64
+	slots       map[int64]rrd.Slots // per RRA, calendar slots can differ within a bundle
 }
 
 type dsStateSegment struct {
 	*sync.Mutex
 	lastFlushRT time.Time
 	lastupdate  map[int64]time.Time
+	lastvalue   map[int64]float64
 	value       map[int64]float64
 	duration    map[int64]int64
+	fields      map[int64]interface{} // multi-value DSs only, marshaled rrd.FieldStates
 }
 
 // The top level key for this cache is the combination of bundleId,
@@ -89,8 +94,11 @@ func (vc *verticalCache) updateDps(rra serde.DbRoundRobinArchiver) {
 			latests:     make(map[int64]time.Time),
 			value:       make(map[int64]float64),
 			duration:    make(map[int64]int64),
-			step:        rra.Step(),
-			size:        rra.Size(),
+			m2:          make(map[int64]float64),
+			sketchRows:  make(map[int64]map[int64]interface{}),
+			sketch:      make(map[int64]interface{}),
+			hw:          make(map[int64]interface{}),
+			slots:       make(map[int64]rrd.Slots),
 			lastFlushRT: time.Now(), // Or else it will get sent to the flusher right away!
 		}
 		vc.dps[key] = segment
@@ -112,11 +120,39 @@ func (vc *verticalCache) updateDps(rra serde.DbRoundRobinArchiver) {
 	latest := rra.Latest()
 	if segment.maxLatest.Before(latest) {
 		segment.maxLatest = latest
-		segment.latestIndex = rrd.SlotIndex(latest, rra.Step(), rra.Size())
+		segment.latestIndex = rra.Slots().Index(latest)
 	}
+	segment.slots[idx] = rra.Slots()
 	segment.latests[idx] = latest
 	segment.value[idx] = rra.Value()
 	segment.duration[idx] = rra.Duration().Nanoseconds() / 1e6
+	if rra.Spec().Function == rrd.STDDEV {
+		segment.m2[idx] = rra.M2()
+	}
+	if rra.Spec().Function == rrd.SKETCH {
+		for i, sk := range rra.Sketches() {
+			if _, ok := segment.rows[i][idx]; !ok {
+				continue // sketches go along with a data point
+			}
+			if data, err := sk.MarshalBinary(); err == nil {
+				if segment.sketchRows[i] == nil {
+					segment.sketchRows[i] = make(map[int64]interface{})
+				}
+				segment.sketchRows[i][idx] = data
+			}
+		}
+		segment.sketch[idx] = nil
+		if sk := rra.Sketch(); sk != nil {
+			if data, err := sk.MarshalBinary(); err == nil {
+				segment.sketch[idx] = data
+			}
+		}
+	}
+	if hw := rra.HoltWinters(); hw != nil {
+		if data, err := hw.MarshalBinary(); err == nil {
+			segment.hw[idx] = data
+		}
+	}
 
 	segment.Unlock()
 }
@@ -133,8 +169,10 @@ func (vc *verticalCache) updateDss(ds serde.DbDataSourcer) {
 			Mutex:       &sync.Mutex{},
 			lastFlushRT: time.Now(),
 			lastupdate:  make(map[int64]time.Time),
+			lastvalue:   make(map[int64]float64),
 			duration:    make(map[int64]int64), // milliseconds
 			value:       make(map[int64]float64),
+			fields:      make(map[int64]interface{}),
 		}
 		vc.dss[seg] = segment
 	}
@@ -142,8 +180,64 @@ func (vc *verticalCache) updateDss(ds serde.DbDataSourcer) {
 
 	segment.Lock()
 	segment.lastupdate[idx] = ds.LastUpdate()
+	segment.lastvalue[idx] = ds.LastValue()
 	segment.duration[idx] = ds.Duration().Nanoseconds() / 1e6
 	segment.value[idx] = ds.Value()
+	if states := ds.FieldStates(); len(states) > 0 {
+		if data, err := states.MarshalBinary(); err == nil {
+			segment.fields[idx] = data
+		}
+	}
+	segment.Unlock()
+}
+
+// Remove data points and state of an RRA which no longer exists
+func (vc *verticalCache) removeDps(rra serde.DbRoundRobinArchiver) {
+
+	seg, idx := rra.Seg(), rra.Idx()
+
+	vc.Lock()
+	segment := vc.dps[bundleKey{rra.BundleId(), seg}]
+	vc.Unlock()
+	if segment == nil {
+		return
+	}
+
+	segment.Lock()
+	for _, row := range segment.rows {
+		delete(row, idx)
+	}
+	for _, row := range segment.sketchRows {
+		delete(row, idx)
+	}
+	delete(segment.sketch, idx)
+	delete(segment.hw, idx)
+	delete(segment.latests, idx)
+	delete(segment.value, idx)
+	delete(segment.duration, idx)
+	delete(segment.m2, idx)
+	delete(segment.slots, idx)
+	segment.Unlock()
+}
+
+// Remove state of a DS which no longer exists
+func (vc *verticalCache) removeDss(ds serde.DbDataSourcer) {
+
+	seg, idx := ds.Seg(), ds.Idx()
+
+	vc.Lock()
+	segment := vc.dss[seg]
+	vc.Unlock()
+	if segment == nil {
+		return
+	}
+
+	segment.Lock()
+	delete(segment.lastupdate, idx)
+	delete(segment.lastvalue, idx)
+	delete(segment.duration, idx)
+	delete(segment.value, idx)
+	delete(segment.fields, idx)
 	segment.Unlock()
 }
 
@@ -235,7 +329,7 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 
 			// latests - keep the highest value we come across
 			for idx, _ := range dps {
-				l := rrd.SlotTime(i, segment.latests[idx], segment.step, segment.size)
+				l := segment.slots[idx].Time(i, segment.latests[idx])
 				if flushLatests[idx].Before(l) { // no value is zero time
 					flushLatests[idx] = l
 				}
@@ -243,7 +337,7 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 		}
 
 		// Build a map of latest i and version according to flushLatests
-		flushIVers := latestIVers(flushLatests, segment.step, segment.size)
+		flushIVers := latestIVers(flushLatests, segment.slots)
 
 		// Second iteration: datapoints and versions
 		for i, dps := range segment.rows {
@@ -252,7 +346,7 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 				continue
 			}
 
-			dfr := &vDpFlushRequest{key.bundleId, key.seg, i, dps, flushIVers, nil, nil, nil, nil}
+			dfr := &vDpFlushRequest{key.bundleId, key.seg, i, dps, flushIVers, segment.sketchRows[i], nil, nil, nil, nil, nil, nil, nil, nil, nil, nil}
 
 			if full { // insist, even if we block
 				ch <- dfr
@@ -270,10 +364,11 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 
 			// delete the flushed segment row
 			delete(segment.rows, i)
+			delete(segment.sketchRows, i)
 		}
 
 		// RRA State
-		var lat, dur, val map[int64]interface{}
+		var lat, dur, val, m2, sk, hw map[int64]interface{}
 		if len(flushLatests) > 0 {
 			lat = make(map[int64]interface{}, len(flushLatests))
 			for k, v := range flushLatests {
@@ -292,9 +387,27 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 				val[k] = interface{}(v)
 			}
 		}
+		if len(segment.m2) > 0 {
+			m2 = make(map[int64]interface{}, len(segment.m2))
+			for k, v := range segment.m2 {
+				m2[k] = interface{}(v)
+			}
+		}
+		if len(segment.sketch) > 0 {
+			sk = make(map[int64]interface{}, len(segment.sketch))
+			for k, v := range segment.sketch {
+				sk[k] = v
+			}
+		}
+		if len(segment.hw) > 0 {
+			hw = make(map[int64]interface{}, len(segment.hw))
+			for k, v := range segment.hw {
+				hw[k] = v
+			}
+		}
 		if (len(flushLatests) + len(segment.duration) + len(segment.value)) > 0 {
 			// unlike dps, insist on a blocking operation
-			ch <- &vDpFlushRequest{key.bundleId, key.seg, 0, nil, nil, lat, nil, dur, val}
+			ch <- &vDpFlushRequest{key.bundleId, key.seg, 0, nil, nil, nil, lat, m2, sk, hw, nil, dur, val, nil, nil, nil}
 			rsFlushes += 1
 		}
 
@@ -327,6 +440,11 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 				lu[k] = interface{}(v)
 			}
 
+			lv := make(map[int64]interface{}, len(segment.lastvalue))
+			for k, v := range segment.lastvalue {
+				lv[k] = interface{}(v)
+			}
+
 			dur := make(map[int64]interface{}, len(segment.duration))
 			for k, v := range segment.duration {
 				dur[k] = interface{}(v)
@@ -336,13 +454,16 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 			for k, v := range segment.value {
 				val[k] = interface{}(v)
 			}
-			ch <- &vDpFlushRequest{0, seg, 0, nil, nil, nil, lu, dur, val}
+			// fields is replaced below, no need to copy it
+			ch <- &vDpFlushRequest{0, seg, 0, nil, nil, nil, nil, nil, nil, nil, lu, dur, val, lv, segment.fields, nil}
 			dsFlushes += 1
 
 			// Clear out the segment
 			segment.lastupdate = make(map[int64]time.Time)
+			segment.lastvalue = make(map[int64]float64)
 			segment.duration = make(map[int64]int64)
 			segment.value = make(map[int64]float64)
+			segment.fields = make(map[int64]interface{})
 		}
 
 		// even if there was nothing to flush consider it a flush
@@ -380,14 +501,10 @@ func (iv *iVer) version(i int64) int {
 	return version
 }
 
-func latestIVers(latests map[int64]time.Time, step time.Duration, size int64) map[int64]*iVer {
+func latestIVers(latests map[int64]time.Time, slots map[int64]rrd.Slots) map[int64]*iVer {
 	result := make(map[int64]*iVer, len(latests))
 	for idx, latest := range latests {
-		i := rrd.SlotIndex(latest, step, size)
-		span_ms := (step.Nanoseconds() / 1e6) * size
-		latest_ms := latest.UnixNano() / 1e6
-		ver := int((latest_ms / span_ms) % 32767)
-		result[idx] = &iVer{i: i, ver: ver}
+		result[idx] = &iVer{i: slots[idx].Index(latest), ver: slots[idx].Version(latest)}
 	}
 	return result
 }
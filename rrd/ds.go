@@ -16,6 +16,7 @@
 package rrd
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"time"
@@ -33,8 +34,14 @@ type DataSource struct {
 	Pdp
 	step       time.Duration        // Step (PDP) size
 	heartbeat  time.Duration        // Heartbeat is inactivity period longer than this causes NaN values. 0 -> no heartbeat.
+	fill       FillPolicy           // What a gap longer than heartbeat becomes, NaN by default
+	dsType     DSType               // How incoming values are converted (GAUGE, COUNTER, etc)
+	min, max   float64              // Valid range of (converted) values, not enforced unless min < max
 	lastUpdate time.Time            // Last time we received an update (series time - can be in the past or future)
+	lastValue  float64              // Last value received as is, needed by non-GAUGE types
 	rras       []RoundRobinArchiver // Array of Round Robin Archives
+	fields     []string             // Field names of a multi-value DS, see fields.go
+	fieldDSs   []*DataSource        // One per field, sharing the RRAs above
 }
 
 // DataSourcer is a DataSource as an interface.
@@ -42,15 +49,23 @@ type DataSourcer interface {
 	Pdper
 	Step() time.Duration
 	Heartbeat() time.Duration
+	Fill() FillPolicy
+	Type() DSType
 	LastUpdate() time.Time
+	LastValue() float64
 	RRAs() []RoundRobinArchiver
 	SetRRAs(rras []RoundRobinArchiver)
 	Copy() DataSourcer
 	BestRRA(start, end time.Time, points int64) RoundRobinArchiver
+	BestRRAByCF(start, end time.Time, points int64, cf Consolidation) RoundRobinArchiver
 	PointCount() int
 	ClearRRAs()
 	ProcessDataPoint(value float64, ts time.Time) error
 	Spec() DSSpec
+	Fields() []string
+	Field(n int) DataSourcer
+	FieldStates() FieldStates
+	ProcessFieldDataPoint(n int, value float64, ts time.Time) error
 }
 
 // NewDataSource returns a new DataSource in accordance with the passed
@@ -59,17 +74,27 @@ func NewDataSource(spec DSSpec) *DataSource {
 	result := &DataSource{
 		step:       spec.Step,
 		heartbeat:  spec.Heartbeat,
+		fill:       spec.Fill,
+		dsType:     spec.Type,
+		min:        spec.Min,
+		max:        spec.Max,
 		lastUpdate: spec.LastUpdate,
+		lastValue:  spec.LastValue,
 		Pdp: Pdp{
 			value:    spec.Value,
 			duration: spec.Duration,
 		},
 	}
+	if len(spec.Fields) > 0 {
+		result.fields = spec.Fields
+		result.newFieldDSs(spec.FieldStates)
+	}
 
-	for _, rspec := range spec.RRAs {
+	for _, rspec := range spec.FieldRRAs() {
 		rra := NewRoundRobinArchive(rspec)
 		result.rras = append(result.rras, rra)
 	}
+	result.setFieldRRAs()
 
 	return result
 }
@@ -104,15 +129,28 @@ func (ds *DataSource) Step() time.Duration { return ds.step }
 // success".
 func (ds *DataSource) Heartbeat() time.Duration { return ds.heartbeat }
 
+// Fill is the policy which determines what a gap in the data (see
+// Heartbeat) becomes, NaN by default.
+func (ds *DataSource) Fill() FillPolicy { return ds.fill }
+
+// Type returns the DS type, which determines how incoming values are
+// converted before they are added to the PDP.
+func (ds *DataSource) Type() DSType { return ds.dsType }
+
 // LastUpdate returns the timestamp of the last Data Point processed
 func (ds *DataSource) LastUpdate() time.Time { return ds.lastUpdate }
 
+// LastValue returns the value of the last Data Point processed as it
+// was received, i.e. before any conversion.
+func (ds *DataSource) LastValue() float64 { return ds.lastValue }
+
 // List of Round Robin Archives this Data Source has
 func (ds *DataSource) RRAs() []RoundRobinArchiver { return ds.rras }
 
 // SetRRAs provides a way to set the RRAs (which may contain data)
 func (ds *DataSource) SetRRAs(rras []RoundRobinArchiver) {
 	ds.rras = rras
+	ds.setFieldRRAs()
 	ds.checkLastUpdate()
 }
 
@@ -122,22 +160,62 @@ func (ds *DataSource) Copy() DataSourcer {
 		Pdp:        Pdp{value: ds.value, duration: ds.duration},
 		step:       ds.step,
 		heartbeat:  ds.heartbeat,
+		fill:       ds.fill,
+		dsType:     ds.dsType,
+		min:        ds.min,
+		max:        ds.max,
 		lastUpdate: ds.lastUpdate,
+		lastValue:  ds.lastValue,
 		rras:       make([]RoundRobinArchiver, len(ds.rras)),
 	}
 	for n, rra := range ds.rras {
 		newDs.rras[n] = rra.Copy()
 	}
+	if len(ds.fields) > 0 {
+		newDs.fields = ds.fields
+		newDs.newFieldDSs(ds.FieldStates())
+		newDs.setFieldRRAs()
+	}
 	return newDs
 }
 
 // BestRRA examines the RRAs and returns the one that best matches the
-// given start, end and resolution (as number of points).
+// given start, end and resolution (as number of points). WMEAN RRAs
+// are preferred, see BestRRAByCF().
 func (ds *DataSource) BestRRA(start, end time.Time, points int64) RoundRobinArchiver {
-	var result []RoundRobinArchiver
+	return ds.BestRRAByCF(start, end, points, WMEAN)
+}
+
+// BestRRAByCF is BestRRA considering only the RRAs with the given
+// consolidation function, unless there are none, in which case all
+// RRAs except the Holt-Winters ones (which store the model rather than
+// the data) are considered. For a multi-value DS only the RRAs of the
+// first field are considered, use Field() for the others.
+func (ds *DataSource) BestRRAByCF(start, end time.Time, points int64, cf Consolidation) RoundRobinArchiver {
+	if len(ds.fieldDSs) > 0 {
+		return ds.fieldDSs[0].BestRRAByCF(start, end, points, cf)
+	}
+
+	var rras, result []RoundRobinArchiver
 
-	// Any RRA include start?
 	for _, rra := range ds.rras {
+		if rra.Spec().Function == cf {
+			rras = append(rras, rra)
+		}
+	}
+	if len(rras) == 0 {
+		for _, rra := range ds.rras {
+			if !rra.Spec().Function.IsHoltWinters() {
+				rras = append(rras, rra)
+			}
+		}
+	}
+	if len(rras) == 0 {
+		rras = ds.rras
+	}
+
+	// Any RRA include start?
+	for _, rra := range rras {
 		// We need to include RRAs that were last updated before start too
 		// or we end up with nothing, then the lowest resolution RRA
 		if rra.includes(start) || rra.Latest().Before(start) {
@@ -147,7 +225,7 @@ func (ds *DataSource) BestRRA(start, end time.Time, points int64) RoundRobinArch
 
 	if len(result) == 0 { // if we found nothing above, simply select the longest RRA
 		var longest RoundRobinArchiver
-		for _, rra := range ds.rras {
+		for _, rra := range rras {
 			if longest == nil || longest.Size()*int64(longest.Step()) < rra.Size()*int64(rra.Step()) {
 				longest = rra
 			}
@@ -220,9 +298,9 @@ func surroundingStep(mark time.Time, step time.Duration) (time.Time, time.Time)
 // updateRange takes a range given to it (which can be less than a PDP
 // or span multiple PDPs) and performs at most 3 updates to the RRAs:
 //
-//        [1]                 [2] [3]
-//      ‖--|------- ... -------|---‖    the update range
-//   |-----|-----|- ... -|-----|-----|  ---> time
+//	     [1]                 [2] [3]
+//	   ‖--|------- ... -------|---‖    the update range
+//	|-----|-----|- ... -|-----|-----|  ---> time
 //
 // 1 - for the remaining piece of the first PDP in the range
 // 2 - for all the full PDPs in between
@@ -292,11 +370,25 @@ func (ds *DataSource) updateRange(begin, end time.Time, value float64) {
 	}
 }
 
+// ErrOutOfRange is returned by ProcessDataPoint when the value was
+// outside of the DS Min/Max range. The data point is still processed,
+// but its value is recorded as NaN.
+var ErrOutOfRange = errors.New("Data point value is outside of the data source min/max range")
+
 // ProcessDataPoint checks the values and updates the DS
 // PDP. If this the very first call for this DS (lastUpdate is 0),
-// then it only sets lastUpdate and returns.
+// then it only sets lastUpdate and returns. Unless the DS is a GAUGE,
+// the value is first converted to a rate using the previous value.
+// A (converted) value outside of Min/Max becomes NaN, in which case
+// ErrOutOfRange is returned. A gap longer than Heartbeat before the
+// data point is filled according to the Fill policy. Data points of a
+// multi-value DS must be processed with ProcessFieldDataPoint().
 func (ds *DataSource) ProcessDataPoint(value float64, ts time.Time) error {
 
+	if len(ds.fields) > 0 {
+		return fmt.Errorf("Data source has fields %v, a data point must be for one of them", ds.fields)
+	}
+
 	if math.IsInf(value, 0) {
 		return fmt.Errorf("±Inf is not a valid data point value: %v", value)
 	}
@@ -305,6 +397,24 @@ func (ds *DataSource) ProcessDataPoint(value float64, ts time.Time) error {
 		return fmt.Errorf("Data point time stamp %v is not greater than data source last update time %v", ts, ds.lastUpdate)
 	}
 
+	raw := value
+	if ds.dsType != GAUGE {
+		if ds.lastUpdate.IsZero() {
+			value = math.NaN()
+		} else {
+			max := math.Inf(1)
+			if ds.min < ds.max {
+				max = ds.max
+			}
+			value = ds.dsType.rate(value, ds.lastValue, max, ts.Sub(ds.lastUpdate))
+		}
+	}
+
+	var err error
+	if ds.min < ds.max && (value < ds.min || value > ds.max) {
+		value, err = math.NaN(), ErrOutOfRange
+	}
+
 	if ds.heartbeat == 0 {
 		// With 0 HB, just set the step to the value. Do not attempt
 		// to back-fill anything. Subsequent data point in the same
@@ -312,40 +422,57 @@ func (ds *DataSource) ProcessDataPoint(value float64, ts time.Time) error {
 		if !ds.lastUpdate.IsZero() {
 			lastEnd := ds.lastUpdate.Truncate(ds.step).Add(ds.step)
 			if lastEnd.Before(ts.Truncate(ds.step)) {
-				ds.updateRange(lastEnd, ts.Truncate(ds.step), math.NaN())
+				ds.fillGap(lastEnd, ts.Truncate(ds.step), ds.lastValue, value)
 			}
 		}
 
 		ds.updateRange(ts.Truncate(ds.step), ts.Add(ds.step).Truncate(ds.step), value)
+		ds.updateSketches(ts, value)
 	} else {
 
-		// ds value is NaN if HB is exceeded
-		if ts.Sub(ds.lastUpdate) > ds.heartbeat {
-			value = math.NaN()
-		}
-
 		if !ds.lastUpdate.IsZero() { // Do not update a never-before-updated DS
-			ds.updateRange(ds.lastUpdate, ts, value)
+			if ts.Sub(ds.lastUpdate) > ds.heartbeat {
+				// HB is exceeded, what the gap becomes depends on
+				// the fill policy, by default it is NaN
+				ds.fillGap(ds.lastUpdate, ts, ds.lastValue, value)
+				if ds.fill == FillNaN {
+					value = math.NaN()
+				}
+			} else {
+				ds.updateRange(ds.lastUpdate, ts, value)
+			}
+			ds.updateSketches(ts, value)
 		}
 	}
 
 	ds.lastUpdate = ts
+	ds.lastValue = raw
 
-	return nil
+	return err
 }
 
 func (ds *DataSource) updateRRAs(periodBegin, periodEnd time.Time) {
 	for _, rra := range ds.rras {
-		// If this is a multi ds.step update and the step of the RRA
+		// If this is a multi ds.step update and the RRA slot it
+		// begins in (whose length varies for calendar slots)
 		// exceeds the interval, we cheat and send a larger duration
 		// once instead of iterating and updating in ds.step
 		// increments.
 		duration := ds.duration
 		span := periodEnd.Sub(periodBegin)
-		if span > ds.step && rra.Step() >= span {
+		if slots := rra.Slots(); span > ds.step && slots.Length(slots.Truncate(periodBegin)) >= span {
 			duration = span
 		}
-		rra.update(periodBegin, periodEnd, ds.value, duration)
+		rra.update(periodBegin, periodEnd, ds.value, duration, ds.step)
+	}
+}
+
+// updateSketches adds the value to the sketches of SKETCH RRAs. It
+// is called after updateRange() so that slots ending before ts are
+// complete by then.
+func (ds *DataSource) updateSketches(ts time.Time, value float64) {
+	for _, rra := range ds.rras {
+		rra.addSketchValue(ts, value)
 	}
 }
 
@@ -369,15 +496,24 @@ func (ds *DataSource) checkLastUpdate() {
 	}
 }
 
-// Return a DSSpec corresponding to this DS
+// Return a DSSpec corresponding to this DS. The RRAs of a
+// multi-value DS are those of its first field, i.e. the layout shared
+// by all fields.
 func (ds *DataSource) Spec() DSSpec {
 	spec := DSSpec{
 		Step:      ds.step,
 		Heartbeat: ds.heartbeat,
-		RRAs:      make([]RRASpec, len(ds.rras)),
+		Fill:      ds.fill,
+		Type:      ds.dsType,
+		Min:       ds.min,
+		Max:       ds.max,
+		Fields:    ds.fields,
+		RRAs:      make([]RRASpec, 0, len(ds.rras)),
 	}
-	for i, rra := range ds.rras {
-		spec.RRAs[i] = rra.Spec()
+	for _, rra := range ds.rras {
+		if rspec := rra.Spec(); rspec.Field == 0 {
+			spec.RRAs = append(spec.RRAs, rspec)
+		}
 	}
 	return spec
 }
@@ -389,10 +525,26 @@ func (ds *DataSource) Spec() DSSpec {
 type DSSpec struct {
 	Step      time.Duration
 	Heartbeat time.Duration
+	Type      DSType
 	RRAs      []RRASpec
 
+	// What a gap longer than Heartbeat becomes, NaN by default.
+	Fill FillPolicy
+
+	// Values (after Type conversion) outside of Min/Max are recorded
+	// as NaN. The range is only enforced if Min < Max, use ±Inf for
+	// an open end.
+	Min, Max float64
+
+	// Field names of a multi-value DS, see fields.go. Every RRA
+	// above exists once for every field.
+	Fields []string
+
 	// These can be used to fill the initial value
 	LastUpdate time.Time
+	LastValue  float64
 	Value      float64
 	Duration   time.Duration
+	// The initial state of the fields of a multi-value DS
+	FieldStates FieldStates
 }
@@ -283,6 +283,90 @@ func Test_DataSource_ProcessDataPoint(t *testing.T) {
 	}
 }
 
+func Test_DataSource_ProcessDataPoint_Types(t *testing.T) {
+
+	ds := NewDataSource(DSSpec{Step: 10 * time.Second, Heartbeat: time.Hour, Type: COUNTER})
+	ds.ProcessDataPoint(1000, time.Unix(100, 0))
+	if ds.LastValue() != 1000 {
+		t.Errorf("ProcessDataPoint: COUNTER: LastValue() != 1000: %v", ds.LastValue())
+	}
+	ds.ProcessDataPoint(1500, time.Unix(110, 0))
+	if ds.value != 0 || ds.duration != 0 || len(ds.rras) != 0 {
+		t.Errorf("ProcessDataPoint: COUNTER: unexpected PDP state: %v %v", ds.value, ds.duration)
+	}
+	ds.ProcessDataPoint(2000, time.Unix(115, 0))
+	if ds.value != 100 || ds.duration != 5*time.Second {
+		t.Errorf("ProcessDataPoint: COUNTER: ds.value != 100 || ds.duration != 5s: %v %v", ds.value, ds.duration)
+	}
+
+	for _, c := range []struct {
+		t                DSType
+		value, last, exp float64
+	}{
+		{GAUGE, 50, 10, 50},
+		{COUNTER, 50, 10, 4},
+		{COUNTER, 6, math.Exp2(32) - 4, 1},
+		{COUNTER, 6, math.Exp2(40), (math.Exp2(64) - math.Exp2(40) + 6) / 10},
+		{DERIVE, 10, 50, -4},
+		{ABSOLUTE, 50, 10, 5},
+	} {
+		if got := c.t.rate(c.value, c.last, math.Inf(1), 10*time.Second); got != c.exp {
+			t.Errorf("rate: %v(%v, %v) expected %v, got %v", c.t, c.value, c.last, c.exp, got)
+		}
+	}
+	if got := COUNTER.rate(50, math.NaN(), math.Inf(1), 10*time.Second); !math.IsNaN(got) {
+		t.Errorf("rate: COUNTER with NaN last value expected NaN, got %v", got)
+	}
+	if got := DERIVE.rate(50, 10, math.Inf(1), 0); !math.IsNaN(got) {
+		t.Errorf("rate: DERIVE with 0 elapsed expected NaN, got %v", got)
+	}
+	if got := COUNTER.rate(6, math.Exp2(32)-4, 1e6, 10*time.Second); got != 1 {
+		t.Errorf("rate: COUNTER wrap within max expected 1, got %v", got)
+	}
+	if got := COUNTER.rate(6, 1000, 1e6, 10*time.Second); !math.IsNaN(got) {
+		t.Errorf("rate: COUNTER reset exceeding max expected NaN, got %v", got)
+	}
+
+	// a reset is NaN, but not ErrOutOfRange
+	ds = NewDataSource(DSSpec{Step: 10 * time.Second, Heartbeat: time.Hour, Type: COUNTER, Min: 0, Max: 1e6})
+	ds.ProcessDataPoint(1000, time.Unix(100, 0))
+	if err := ds.ProcessDataPoint(6, time.Unix(110, 0)); err != nil || ds.value != 0 || ds.duration != 0 {
+		t.Errorf("ProcessDataPoint: COUNTER reset should be NaN without error: %v %v %v", err, ds.value, ds.duration)
+	}
+
+	if typ, err := ParseDSType("derive"); err != nil || typ != DERIVE {
+		t.Errorf("ParseDSType: expected DERIVE, got %v %v", typ, err)
+	}
+	if _, err := ParseDSType("bogus"); err == nil {
+		t.Errorf("ParseDSType: no error on invalid type")
+	}
+}
+
+func Test_DataSource_ProcessDataPoint_MinMax(t *testing.T) {
+
+	ds := NewDataSource(DSSpec{Step: 10 * time.Second, Heartbeat: time.Hour, Min: 0, Max: math.Inf(1)})
+	ds.ProcessDataPoint(10, time.Unix(100, 0))
+	if err := ds.ProcessDataPoint(-1, time.Unix(105, 0)); err != ErrOutOfRange {
+		t.Errorf("ProcessDataPoint: expected ErrOutOfRange, got %v", err)
+	}
+	if ds.value != 0 || ds.duration != 0 { // NaN is not added to the PDP
+		t.Errorf("ProcessDataPoint: out of range value should be NaN: %v %v", ds.value, ds.duration)
+	}
+	if err := ds.ProcessDataPoint(1e12, time.Unix(108, 0)); err != nil {
+		t.Errorf("ProcessDataPoint: unexpected error: %v", err)
+	}
+	if spec := ds.Spec(); spec.Min != 0 || !math.IsInf(spec.Max, 1) {
+		t.Errorf("Spec: Min/Max not preserved: %v %v", spec.Min, spec.Max)
+	}
+
+	// Min >= Max is not enforced (e.g. the zero value)
+	ds = NewDataSource(DSSpec{Step: 10 * time.Second, Heartbeat: time.Hour})
+	ds.ProcessDataPoint(10, time.Unix(100, 0))
+	if err := ds.ProcessDataPoint(-1, time.Unix(105, 0)); err != nil || ds.value != -1 {
+		t.Errorf("ProcessDataPoint: range should not be enforced: %v %v", err, ds.value)
+	}
+}
+
 func Test_DataSource_ProcessDataPoint_HB0(t *testing.T) {
 	// 0 heartbeat
 
@@ -429,3 +513,69 @@ func Test_DataSource_Copy(t *testing.T) {
 		t.Errorf("Copy: !reflect.DeepEqual(ds, cpy)")
 	}
 }
+
+func Test_DataSource_BestRRAByCF(t *testing.T) {
+	ds := NewDataSource(DSSpec{Step: 10 * time.Second, RRAs: []RRASpec{
+		RRASpec{Function: MAX, Step: 10 * time.Second, Span: time.Hour},
+		RRASpec{Function: WMEAN, Step: time.Minute, Span: time.Hour},
+	}})
+	end := time.Unix(10000, 0)
+	start := end.Add(-time.Hour)
+	if rra := ds.BestRRA(start, end, 0); rra.Spec().Function != WMEAN {
+		t.Errorf("BestRRA: expected the WMEAN RRA, got %v", rra.Spec().Function)
+	}
+	if rra := ds.BestRRAByCF(start, end, 0, MAX); rra.Spec().Function != MAX {
+		t.Errorf("BestRRAByCF: expected the MAX RRA, got %v", rra.Spec().Function)
+	}
+	if rra := ds.BestRRAByCF(start, end, 0, SUM); rra.Step() != 10*time.Second {
+		t.Errorf("BestRRAByCF: without a SUM RRA, expected the highest resolution RRA, got %v", rra.Step())
+	}
+}
+
+func Test_DataSource_ProcessDataPoint_Sketch(t *testing.T) {
+	ds := NewDataSource(DSSpec{
+		Step:      10 * time.Second,
+		Heartbeat: time.Hour,
+		RRAs: []RRASpec{
+			RRASpec{Function: SKETCH, Step: time.Minute, Span: time.Hour},
+			RRASpec{Function: WMEAN, Step: time.Minute, Span: time.Hour},
+		},
+	})
+	t0 := time.Unix(1500000000, 0).Truncate(time.Minute)
+	for k := 0; k <= 125; k++ {
+		ds.ProcessDataPoint(float64(k), t0.Add(time.Duration(k)*time.Second))
+	}
+
+	rra := ds.RRAs()[0]
+	for _, c := range []struct {
+		end    time.Time
+		median float64
+	}{
+		{t0.Add(time.Minute), 30},     // 1 to 60
+		{t0.Add(2 * time.Minute), 90}, // 61 to 120
+	} {
+		sk := rra.Sketches()[SlotIndex(c.end, time.Minute, 60)]
+		if sk == nil || sk.Count() != 60 {
+			t.Errorf("Sketches: slot %v: expected 60 values, got %v", c.end, sk)
+			continue
+		}
+		if got := sk.Quantile(0.5); math.Abs(got-c.median) > c.median*SketchAccuracy {
+			t.Errorf("Sketches: slot %v: expected median %v, got %v", c.end, c.median, got)
+		}
+	}
+	if sk := rra.Sketch(); sk == nil || sk.Count() != 5 { // 121 to 125
+		t.Errorf("Sketch: expected 5 values in the current slot, got %v", sk)
+	}
+	if len(ds.RRAs()[1].Sketches()) != 0 || ds.RRAs()[1].Sketch() != nil {
+		t.Errorf("Sketches: only SKETCH RRAs should have sketches")
+	}
+
+	cp := ds.Copy()
+	ds.ClearRRAs()
+	if len(rra.Sketches()) != 0 {
+		t.Errorf("ClearRRAs: sketches not cleared")
+	}
+	if len(cp.RRAs()[0].Sketches()) != 2 {
+		t.Errorf("Copy: expected 2 sketches, got %d", len(cp.RRAs()[0].Sketches()))
+	}
+}
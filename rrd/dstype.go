@@ -0,0 +1,100 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// DSType determines how an incoming value is converted before it is
+// added to the DS PDP. Only GAUGE values are taken as is, all other
+// types are converted to a per-second rate.
+type DSType int
+
+const (
+	GAUGE    DSType = iota // Value as is
+	COUNTER                // Monotonically increasing counter, 32/64-bit wrap aware
+	DERIVE                 // Like COUNTER, but can decrease, no wrap detection
+	ABSOLUTE               // Counter that resets on every read
+)
+
+func (t DSType) String() string {
+	switch t {
+	case GAUGE:
+		return "GAUGE"
+	case COUNTER:
+		return "COUNTER"
+	case DERIVE:
+		return "DERIVE"
+	case ABSOLUTE:
+		return "ABSOLUTE"
+	}
+	return fmt.Sprintf("DSType(%d)", int(t))
+}
+
+// ParseDSType converts a (case-insensitive) string such as "COUNTER"
+// to a DSType. An empty string is GAUGE.
+func ParseDSType(s string) (DSType, error) {
+	switch strings.ToUpper(s) {
+	case "GAUGE", "":
+		return GAUGE, nil
+	case "COUNTER":
+		return COUNTER, nil
+	case "DERIVE":
+		return DERIVE, nil
+	case "ABSOLUTE":
+		return ABSOLUTE, nil
+	}
+	return GAUGE, fmt.Errorf("Invalid DS type: %q (must be GAUGE, COUNTER, DERIVE or ABSOLUTE)", s)
+}
+
+// rate converts value to a per-second rate given the previous value
+// and the time elapsed since it was received. The result is NaN when
+// there is no previous value to compare to. A COUNTER decrease is
+// taken to be a wrap, unless the wrapped rate would exceed max, in
+// which case it is a reset (e.g. a process restart) and also NaN.
+func (t DSType) rate(value, last, max float64, elapsed time.Duration) float64 {
+	if t == GAUGE {
+		return value
+	}
+	secs := elapsed.Seconds()
+	if secs <= 0 {
+		return math.NaN()
+	}
+	switch t {
+	case COUNTER:
+		diff := value - last
+		if diff < 0 { // wrapped (or reset)
+			if last < math.Exp2(32) {
+				diff += math.Exp2(32)
+			} else {
+				diff += math.Exp2(64)
+			}
+			if diff/secs > max {
+				return math.NaN()
+			}
+		}
+		return diff / secs
+	case DERIVE:
+		return (value - last) / secs
+	case ABSOLUTE:
+		return value / secs
+	}
+	return math.NaN()
+}
@@ -0,0 +1,218 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// A multi-value DS has several named fields (e.g. "rx" and "tx", or
+// "load1", "load5" and "load15") which arrive at the same time
+// stamps. The fields share the step, heartbeat, type, min/max and the
+// RRA layout of the DS, but each field has its own PDP, last update
+// and last value, and its own set of RRAs. The RRAs of all fields are
+// in RRAs() (see DSSpec.FieldRRAs() for the order), RRASpec.Field
+// tells which field an RRA belongs to.
+//
+// Data points for a field are processed with ProcessFieldDataPoint(),
+// Field() returns the field as a DataSourcer of its own (which shares
+// the RRAs with the DS) and is what should be used for reading the
+// data of a field. The last update of the DS is the latest last
+// update of its fields.
+
+// FieldState is the state of a single field of a multi-value DS, it
+// corresponds to the DSSpec LastUpdate, LastValue, Value and Duration
+// of a single value DS.
+type FieldState struct {
+	LastUpdate time.Time
+	LastValue  float64
+	Value      float64
+	Duration   time.Duration
+}
+
+// FieldStates is the state of all the fields of a DS.
+type FieldStates []FieldState
+
+const fieldStatesVersion = 1
+
+// MarshalBinary encodes the states as the version byte followed by
+// the last update (as Unix nanoseconds), last value, value and
+// duration of every field, 32 bytes each.
+func (fs FieldStates) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 1+32*len(fs))
+	buf[0] = fieldStatesVersion
+	for i, f := range fs {
+		var lu int64
+		if !f.LastUpdate.IsZero() {
+			lu = f.LastUpdate.UnixNano()
+		}
+		b := buf[1+32*i:]
+		binary.LittleEndian.PutUint64(b, uint64(lu))
+		binary.LittleEndian.PutUint64(b[8:], math.Float64bits(f.LastValue))
+		binary.LittleEndian.PutUint64(b[16:], math.Float64bits(f.Value))
+		binary.LittleEndian.PutUint64(b[24:], uint64(f.Duration))
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes what MarshalBinary encoded.
+func (fs *FieldStates) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 || data[0] != fieldStatesVersion || (len(data)-1)%32 != 0 {
+		return fmt.Errorf("invalid field state data")
+	}
+	result := make(FieldStates, (len(data)-1)/32)
+	for i := range result {
+		b := data[1+32*i:]
+		if lu := int64(binary.LittleEndian.Uint64(b)); lu != 0 {
+			result[i].LastUpdate = time.Unix(0, lu)
+		}
+		result[i].LastValue = math.Float64frombits(binary.LittleEndian.Uint64(b[8:]))
+		result[i].Value = math.Float64frombits(binary.LittleEndian.Uint64(b[16:]))
+		result[i].Duration = time.Duration(binary.LittleEndian.Uint64(b[24:]))
+	}
+	*fs = result
+	return nil
+}
+
+// FieldIndex returns the index of the field name in fields, or -1 if
+// it is not there.
+func FieldIndex(fields []string, name string) int {
+	for i, f := range fields {
+		if f == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// FieldRRAs returns the RRAs of a DS created from this spec: for a
+// multi-value DS every RRA of the spec once for every field (with
+// Field set accordingly), such that the RRAs of all the fields with
+// the same spec are next to each other, otherwise just the RRAs.
+func (spec DSSpec) FieldRRAs() []RRASpec {
+	if len(spec.Fields) == 0 {
+		return spec.RRAs
+	}
+	result := make([]RRASpec, 0, len(spec.RRAs)*len(spec.Fields))
+	for _, rspec := range spec.RRAs {
+		for i := range spec.Fields {
+			rspec.Field = i
+			result = append(result, rspec)
+		}
+	}
+	return result
+}
+
+// Fields returns the names of the fields of a multi-value DS, nil
+// for a single value DS.
+func (ds *DataSource) Fields() []string { return ds.fields }
+
+// Field returns field n of a multi-value DS as a DataSourcer, or nil
+// if there is no such field. Field 0 of a single value DS is the DS
+// itself.
+func (ds *DataSource) Field(n int) DataSourcer {
+	if len(ds.fields) == 0 {
+		if n == 0 {
+			return ds
+		}
+		return nil
+	}
+	if n < 0 || n >= len(ds.fieldDSs) {
+		return nil
+	}
+	return ds.fieldDSs[n]
+}
+
+// FieldStates returns the state of every field of a multi-value DS,
+// nil for a single value DS.
+func (ds *DataSource) FieldStates() FieldStates {
+	if len(ds.fields) == 0 {
+		return nil
+	}
+	result := make(FieldStates, len(ds.fieldDSs))
+	for i, fds := range ds.fieldDSs {
+		result[i] = FieldState{
+			LastUpdate: fds.lastUpdate,
+			LastValue:  fds.lastValue,
+			Value:      fds.value,
+			Duration:   fds.duration,
+		}
+	}
+	return result
+}
+
+// ProcessFieldDataPoint is ProcessDataPoint for field n of a
+// multi-value DS.
+func (ds *DataSource) ProcessFieldDataPoint(n int, value float64, ts time.Time) error {
+	if len(ds.fields) == 0 {
+		return fmt.Errorf("Data source has no fields")
+	}
+	if n < 0 || n >= len(ds.fieldDSs) {
+		return fmt.Errorf("Data source has no field %d", n)
+	}
+	fds := ds.fieldDSs[n]
+	err := fds.ProcessDataPoint(value, ts)
+	if fds.lastUpdate.After(ds.lastUpdate) {
+		ds.lastUpdate = fds.lastUpdate
+	}
+	return err
+}
+
+// newFieldDSs creates the fields of a multi-value DS, initializing
+// their state from states (which may be shorter or nil).
+func (ds *DataSource) newFieldDSs(states FieldStates) {
+	ds.fieldDSs = make([]*DataSource, len(ds.fields))
+	for i := range ds.fields {
+		fds := &DataSource{
+			step:      ds.step,
+			heartbeat: ds.heartbeat,
+			fill:      ds.fill,
+			dsType:    ds.dsType,
+			min:       ds.min,
+			max:       ds.max,
+		}
+		if i < len(states) {
+			fds.lastUpdate, fds.lastValue = states[i].LastUpdate, states[i].LastValue
+			fds.value, fds.duration = states[i].Value, states[i].Duration
+		}
+		ds.fieldDSs[i] = fds
+	}
+}
+
+// setFieldRRAs distributes the RRAs of a multi-value DS among its
+// fields according to RRASpec.Field.
+func (ds *DataSource) setFieldRRAs() {
+	if len(ds.fields) == 0 {
+		return
+	}
+	for _, fds := range ds.fieldDSs {
+		fds.rras = nil
+	}
+	for _, rra := range ds.rras {
+		if n := rra.Spec().Field; n >= 0 && n < len(ds.fieldDSs) {
+			ds.fieldDSs[n].rras = append(ds.fieldDSs[n].rras, rra)
+		}
+	}
+	for _, fds := range ds.fieldDSs {
+		fds.checkLastUpdate()
+		if fds.lastUpdate.After(ds.lastUpdate) {
+			ds.lastUpdate = fds.lastUpdate
+		}
+	}
+}
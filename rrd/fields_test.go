@@ -0,0 +1,147 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_DataSource_Fields(t *testing.T) {
+	ds := NewDataSource(DSSpec{
+		Step:      10 * time.Second,
+		Heartbeat: time.Hour,
+		Fields:    []string{"rx", "tx"},
+		RRAs: []RRASpec{
+			RRASpec{Function: WMEAN, Step: 10 * time.Second, Span: 100 * time.Second},
+			RRASpec{Function: MAX, Step: 20 * time.Second, Span: 100 * time.Second},
+		},
+	})
+
+	// RRAs of the same spec are next to each other
+	if len(ds.RRAs()) != 4 {
+		t.Fatalf("len(RRAs()) should be 4, got %d", len(ds.RRAs()))
+	}
+	for i, rra := range ds.RRAs() {
+		if rra.Spec().Field != i%2 {
+			t.Errorf("RRA %d: Field should be %d, got %d", i, i%2, rra.Spec().Field)
+		}
+	}
+	for n := 0; n < 2; n++ {
+		for _, rra := range ds.Field(n).RRAs() {
+			if rra.Spec().Field != n {
+				t.Errorf("Field(%d) has an RRA of field %d", n, rra.Spec().Field)
+			}
+		}
+	}
+	if ds.Field(2) != nil || ds.Field(-1) != nil {
+		t.Errorf("Field() of a non-existent field should be nil")
+	}
+	if FieldIndex(ds.Fields(), "tx") != 1 || FieldIndex(ds.Fields(), "foo") != -1 {
+		t.Errorf("FieldIndex() returned wrong index")
+	}
+
+	if err := ds.ProcessDataPoint(1, time.Unix(100, 0)); err == nil {
+		t.Errorf("ProcessDataPoint() on a multi-value DS should be an error")
+	}
+
+	for i := int64(0); i <= 3; i++ {
+		ts := time.Unix(100+i*10, 0)
+		if err := ds.ProcessFieldDataPoint(0, 1, ts); err != nil {
+			t.Errorf("ProcessFieldDataPoint: %v", err)
+		}
+		if err := ds.ProcessFieldDataPoint(1, 2, ts); err != nil {
+			t.Errorf("ProcessFieldDataPoint: %v", err)
+		}
+	}
+	if err := ds.ProcessFieldDataPoint(2, 1, time.Unix(200, 0)); err == nil {
+		t.Errorf("ProcessFieldDataPoint() for a non-existent field should be an error")
+	}
+	// Field 0 only moves the DS last update
+	ds.ProcessFieldDataPoint(0, 1, time.Unix(135, 0))
+	if !ds.LastUpdate().Equal(time.Unix(135, 0)) || !ds.Field(1).LastUpdate().Equal(time.Unix(130, 0)) {
+		t.Errorf("LastUpdate: %v, Field(1).LastUpdate: %v", ds.LastUpdate(), ds.Field(1).LastUpdate())
+	}
+
+	expect := map[int]float64{0: 1, 1: 2}
+	for n, v := range expect {
+		rra := ds.Field(n).BestRRAByCF(time.Time{}, time.Time{}, 0, WMEAN)
+		if len(rra.DPs()) != 3 {
+			t.Errorf("Field(%d): expected 3 data points, got %v", n, rra.DPs())
+		}
+		for _, dp := range rra.DPs() {
+			if dp != v {
+				t.Errorf("Field(%d): expected %v, got %v", n, v, dp)
+			}
+		}
+	}
+	if ds.BestRRA(time.Time{}, time.Time{}, 0) != ds.Field(0).BestRRA(time.Time{}, time.Time{}, 0) {
+		t.Errorf("BestRRA() of a multi-value DS should be that of the first field")
+	}
+
+	// Spec() is the layout, a DS created from it has the same RRAs
+	spec := ds.Spec()
+	if len(spec.RRAs) != 2 || !reflect.DeepEqual(spec.Fields, ds.Fields()) {
+		t.Errorf("Spec(): unexpected RRAs or Fields: %#v", spec)
+	}
+	if len(NewDataSource(spec).RRAs()) != 4 {
+		t.Errorf("NewDataSource(ds.Spec()) should have 4 RRAs")
+	}
+
+	// Copy
+	cp := ds.Copy()
+	if !reflect.DeepEqual(cp.FieldStates(), ds.FieldStates()) {
+		t.Errorf("Copy(): FieldStates differ: %v != %v", cp.FieldStates(), ds.FieldStates())
+	}
+	cp.ProcessFieldDataPoint(1, 5, time.Unix(150, 0))
+	if ds.Field(1).LastUpdate().Equal(time.Unix(150, 0)) {
+		t.Errorf("Copy(): fields of the copy are not independent")
+	}
+	for n := 0; n < 2; n++ {
+		if len(cp.Field(n).RRAs()) != 2 || cp.Field(n).RRAs()[0] == ds.Field(n).RRAs()[0] {
+			t.Errorf("Copy(): Field(%d) should have 2 copied RRAs", n)
+		}
+	}
+}
+
+func Test_FieldStates_MarshalBinary(t *testing.T) {
+	states := FieldStates{
+		FieldState{LastUpdate: time.Unix(100, 5), LastValue: 1.5, Value: 2.5, Duration: 3 * time.Second},
+		FieldState{LastValue: math.Inf(1)},
+	}
+	data, err := states.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result FieldStates
+	if err := result.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(states, result) {
+		t.Errorf("UnmarshalBinary: expected %v, got %v", states, result)
+	}
+	if err := result.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Errorf("UnmarshalBinary of truncated data should be an error")
+	}
+
+	// The state is restored by NewDataSource
+	ds := NewDataSource(DSSpec{Step: time.Second, Fields: []string{"a", "b"}, FieldStates: states})
+	if !reflect.DeepEqual(ds.FieldStates(), states) {
+		t.Errorf("NewDataSource: expected FieldStates %v, got %v", states, ds.FieldStates())
+	}
+}
@@ -0,0 +1,130 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// FillPolicy determines what a DS records for a gap in the data,
+// i.e. when a data point arrives more than Heartbeat after the
+// previous one (or, with a 0 Heartbeat, for the steps skipped
+// between data points).
+type FillPolicy int
+
+const (
+	FillNaN      FillPolicy = iota // Unknown (the default)
+	FillPrevious                   // The value before the gap
+	FillZero                       // 0
+	FillLinear                     // Interpolated between the values before and after the gap
+)
+
+func (f FillPolicy) String() string {
+	switch f {
+	case FillNaN:
+		return "NaN"
+	case FillPrevious:
+		return "previous"
+	case FillZero:
+		return "zero"
+	case FillLinear:
+		return "linear"
+	}
+	return fmt.Sprintf("FillPolicy(%d)", int(f))
+}
+
+// ParseFillPolicy converts a (case-insensitive) string such as
+// "previous" to a FillPolicy. An empty string is FillNaN.
+func ParseFillPolicy(s string) (FillPolicy, error) {
+	switch strings.ToLower(s) {
+	case "nan", "":
+		return FillNaN, nil
+	case "previous":
+		return FillPrevious, nil
+	case "zero":
+		return FillZero, nil
+	case "linear":
+		return FillLinear, nil
+	}
+	return FillNaN, fmt.Errorf("Invalid fill policy: %q (must be NaN, previous, zero or linear)", s)
+}
+
+// fillGap updates the range from begin to end, which is a gap in the
+// data, according to the fill policy. prev and next are the
+// (converted) values before and after the gap. For types other than
+// GAUGE only the rate across the gap is known, which is what both
+// previous and linear fill with.
+func (ds *DataSource) fillGap(begin, end time.Time, prev, next float64) {
+	if ds.dsType != GAUGE {
+		prev = next
+	} else if ds.min < ds.max && (prev < ds.min || prev > ds.max) {
+		prev = math.NaN()
+	}
+
+	switch ds.fill {
+	case FillPrevious:
+		ds.updateRange(begin, end, prev)
+	case FillZero:
+		ds.updateRange(begin, end, 0)
+	case FillLinear:
+		from, to := begin, end
+		if ds.heartbeat == 0 {
+			// The values are those of the whole steps before and
+			// after the gap, i.e. of their middles.
+			from, to = begin.Add(-ds.step/2), end.Add(ds.step/2)
+		}
+		at := func(t time.Time) float64 {
+			return prev + (next-prev)*float64(t.Sub(from))/float64(to.Sub(from))
+		}
+		// Interpolating one PDP at a time is only worth it for what
+		// the RRAs still keep, anything older is done at once.
+		cur := begin
+		if keep := ds.rrasBegin(end).Truncate(ds.step); keep.After(cur) {
+			ds.updateRange(cur, keep, at(cur.Add(keep.Sub(cur)/2)))
+			cur = keep
+		}
+		for cur.Before(end) {
+			pdpEnd := cur.Truncate(ds.step).Add(ds.step)
+			if pdpEnd.After(end) {
+				pdpEnd = end
+			}
+			// The weighted mean of a linear function over a range is
+			// its value in the middle.
+			ds.updateRange(cur, pdpEnd, at(cur.Add(pdpEnd.Sub(cur)/2)))
+			cur = pdpEnd
+		}
+	default:
+		ds.updateRange(begin, end, math.NaN())
+	}
+}
+
+// rrasBegin returns the earliest time any of the RRAs would still
+// have data for if it were updated up to now, which includes the slot
+// just before the RRA begins (it is overwritten by the next slot to
+// come). Without RRAs it is now.
+func (ds *DataSource) rrasBegin(now time.Time) time.Time {
+	result := now
+	for _, rra := range ds.rras {
+		slots := rra.Slots()
+		if b := slots.Add(slots.Begins(now), -1); b.Before(result) {
+			result = b
+		}
+	}
+	return result
+}
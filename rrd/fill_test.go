@@ -0,0 +1,108 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_ParseFillPolicy(t *testing.T) {
+	for _, f := range []FillPolicy{FillNaN, FillPrevious, FillZero, FillLinear} {
+		if p, err := ParseFillPolicy(f.String()); err != nil || p != f {
+			t.Errorf("ParseFillPolicy(%q): %v %v", f.String(), p, err)
+		}
+	}
+	if p, err := ParseFillPolicy(""); err != nil || p != FillNaN {
+		t.Errorf(`ParseFillPolicy(""): %v %v`, p, err)
+	}
+	if _, err := ParseFillPolicy("Last"); err == nil {
+		t.Errorf("ParseFillPolicy(\"Last\") should be an error")
+	}
+}
+
+func Test_DataSource_ProcessDataPoint_Fill(t *testing.T) {
+	nan := math.NaN()
+	for _, c := range []struct {
+		fill  FillPolicy
+		dsTyp DSType
+		hb    time.Duration
+		dps   map[int64]float64 // slot ending at 120 is 2, etc.
+	}{
+		{FillNaN, GAUGE, 20 * time.Second, map[int64]float64{2: nan, 3: nan, 4: nan, 5: nan}},
+		{FillPrevious, GAUGE, 20 * time.Second, map[int64]float64{2: 5, 3: 5, 4: 5, 5: 5}},
+		{FillZero, GAUGE, 20 * time.Second, map[int64]float64{2: 0, 3: 0, 4: 0, 5: 0}},
+		{FillLinear, GAUGE, 20 * time.Second, map[int64]float64{2: 5.5, 3: 6.5, 4: 7.5, 5: 8.5}},
+		// Only the rate across the gap is known
+		{FillPrevious, DERIVE, 20 * time.Second, map[int64]float64{2: 0.1, 3: 0.1, 4: 0.1, 5: 0.1}},
+		{FillLinear, DERIVE, 20 * time.Second, map[int64]float64{2: 0.1, 3: 0.1, 4: 0.1, 5: 0.1}},
+		// With 0 HB a data point is the value of the step it is in and
+		// the skipped steps are filled
+		{FillNaN, GAUGE, 0, map[int64]float64{2: 5, 3: nan, 4: nan, 5: nan, 6: 9}},
+		{FillPrevious, GAUGE, 0, map[int64]float64{2: 5, 3: 5, 4: 5, 5: 5, 6: 9}},
+		{FillLinear, GAUGE, 0, map[int64]float64{2: 5, 3: 6, 4: 7, 5: 8, 6: 9}},
+	} {
+		ds := NewDataSource(DSSpec{
+			Step:      10 * time.Second,
+			Heartbeat: c.hb,
+			Type:      c.dsTyp,
+			Fill:      c.fill,
+			RRAs: []RRASpec{
+				RRASpec{Function: WMEAN, Step: 10 * time.Second, Span: 100 * time.Second},
+			},
+		})
+		if ds.Fill() != c.fill || ds.Spec().Fill != c.fill || ds.Copy().Fill() != c.fill {
+			t.Errorf("%v: Fill() mismatch", c.fill)
+		}
+		ds.ProcessDataPoint(4, time.Unix(100, 0))
+		ds.ProcessDataPoint(5, time.Unix(110, 0))
+		ds.ProcessDataPoint(9, time.Unix(150, 0))
+
+		dps := ds.RRAs()[0].DPs()
+		for i, exp := range c.dps {
+			v, ok := dps[i]
+			if math.IsNaN(exp) && (!ok || math.IsNaN(v)) {
+				continue // whole NaN slots are not kept
+			}
+			if !ok || v != exp {
+				t.Errorf("%v %v HB %v: slot %d should be %v, got %v (%v)", c.fill, c.dsTyp, c.hb, i, exp, v, dps)
+			}
+		}
+	}
+}
+
+func Test_DataSource_ProcessDataPoint_FillLinear_Long(t *testing.T) {
+	// A gap much longer than the RRAs only interpolates what is kept
+	ds := NewDataSource(DSSpec{
+		Step:      time.Second,
+		Heartbeat: time.Minute,
+		Fill:      FillLinear,
+		RRAs: []RRASpec{
+			RRASpec{Function: WMEAN, Step: 10 * time.Second, Span: 100 * time.Second},
+		},
+	})
+	ds.ProcessDataPoint(0, time.Unix(0, 0))
+	ds.ProcessDataPoint(1e6, time.Unix(1e6, 0))
+	dps := ds.RRAs()[0].DPs()
+	for end := int64(1e6 - 90); end <= 1e6; end += 10 {
+		// The value is the time, in the middle of the slot
+		i, exp := (end/10)%10, float64(end-5)
+		if v, ok := dps[i]; !ok || math.Abs(v-exp) > 1e-6 {
+			t.Errorf("FillLinear: slot %d should be %v, got %v", i, exp, v)
+		}
+	}
+}
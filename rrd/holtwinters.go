@@ -0,0 +1,206 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// Holt-Winters RRAs (HWPREDICT, SEASONAL, DEVSEASONAL and FAILURES)
+// maintain an additive Holt-Winters model of the data with the
+// aberrant behavior detection of Brutlag (2000), as RRDTool does. The
+// model is updated every time a slot is complete with the WMEAN of
+// the slot, the RRA stores one aspect of it (see below). Every such
+// RRA has a model of its own, they do not depend on each other.
+//
+// HWPREDICT:   the value predicted for the slot (before it was known)
+// SEASONAL:    the seasonal coefficient for the slot position in the season
+// DEVSEASONAL: the smoothed absolute deviation of the prediction
+// FAILURES:    1 if there were HWThreshold or more values outside of the
+//              prediction ± HWDelta deviations within the last
+//              HWWindow slots, otherwise 0
+
+// Holt-Winters model parameters, same as the RRDTool defaults.
+const (
+	HWAlpha     = 0.1    // level (intercept) smoothing
+	HWBeta      = 0.0035 // trend (slope) smoothing
+	HWGamma     = 0.1    // seasonal and deviation smoothing
+	HWDelta     = 2.0    // confidence band width, in deviations
+	HWWindow    = 9      // failure window, in slots
+	HWThreshold = 7      // violations in the window which make a failure
+)
+
+// DefaultSeason is the season of a Holt-Winters RRA whose spec has
+// none.
+const DefaultSeason = 24 * time.Hour
+
+// hwVersion is the first byte of a marshaled HoltWinters.
+const hwVersion = 1
+
+// HoltWinters is the state of the Holt-Winters model of an RRA.
+type HoltWinters struct {
+	level, trend float64
+	// Per position in the season, NaN until first seen.
+	seasonal, deviation []float64
+	// Bit 0 is set if the latest value was outside the confidence
+	// band, bit 1 for the one before, etc.
+	violations uint32
+}
+
+// NewHoltWinters returns a new model with seasonLen slots per season.
+func NewHoltWinters(seasonLen int) *HoltWinters {
+	if seasonLen < 1 {
+		seasonLen = 1
+	}
+	hw := &HoltWinters{
+		level:     math.NaN(),
+		seasonal:  make([]float64, seasonLen),
+		deviation: make([]float64, seasonLen),
+	}
+	for i := 0; i < seasonLen; i++ {
+		hw.seasonal[i], hw.deviation[i] = math.NaN(), math.NaN()
+	}
+	return hw
+}
+
+// SeasonLen is the number of slots in a season.
+func (hw *HoltWinters) SeasonLen() int { return len(hw.seasonal) }
+
+// IsHoltWinters tells whether c is one of the Holt-Winters CFs.
+func (c Consolidation) IsHoltWinters() bool {
+	return c == HWPREDICT || c == SEASONAL || c == DEVSEASONAL || c == FAILURES
+}
+
+// update the model with value y (NaN if unknown) at position p of the
+// season. Returns the prediction for y and whether this is a failure.
+func (hw *HoltWinters) update(p int, y float64) (float64, bool) {
+	pred := math.NaN()
+	if !math.IsNaN(hw.level) {
+		pred = hw.level + hw.trend
+		if s := hw.seasonal[p]; !math.IsNaN(s) {
+			pred += s
+		}
+	}
+
+	hw.violations <<= 1
+	if math.IsNaN(y) {
+		hw.level += hw.trend // NaN remains NaN
+		return pred, hw.failure()
+	}
+	if math.IsNaN(hw.level) {
+		hw.level, hw.trend = y, 0
+		hw.seasonal[p] = 0
+		return pred, false
+	}
+
+	s, d := hw.seasonal[p], hw.deviation[p]
+	if !math.IsNaN(d) && math.Abs(y-pred) > HWDelta*d {
+		hw.violations |= 1
+	}
+	if math.IsNaN(s) {
+		s = 0
+	}
+
+	level := HWAlpha*(y-s) + (1-HWAlpha)*(hw.level+hw.trend)
+	hw.trend = HWBeta*(level-hw.level) + (1-HWBeta)*hw.trend
+	hw.level = level
+
+	if math.IsNaN(hw.seasonal[p]) {
+		hw.seasonal[p] = y - level
+	} else {
+		hw.seasonal[p] = HWGamma*(y-level) + (1-HWGamma)*s
+	}
+	if math.IsNaN(d) {
+		hw.deviation[p] = math.Abs(y - pred)
+	} else {
+		hw.deviation[p] = HWGamma*math.Abs(y-pred) + (1-HWGamma)*d
+	}
+	return pred, hw.failure()
+}
+
+func (hw *HoltWinters) failure() bool {
+	return bits.OnesCount32(hw.violations&(1<<HWWindow-1)) >= HWThreshold
+}
+
+// updateHoltWinters updates the model with the PDP of the slot ending
+// at endOfSlot, which is then replaced by what the RRA stores.
+func (rra *RoundRobinArchive) updateHoltWinters(endOfSlot time.Time) {
+	p := int(rra.Slots().Number(endOfSlot) % int64(rra.hw.SeasonLen()))
+	pred, failure := rra.hw.update(p, rra.Value())
+	switch rra.cf {
+	case HWPREDICT:
+		rra.value = pred
+	case SEASONAL:
+		rra.value = rra.hw.seasonal[p]
+	case DEVSEASONAL:
+		rra.value = rra.hw.deviation[p]
+	case FAILURES:
+		rra.value = 0
+		if failure {
+			rra.value = 1
+		}
+	}
+}
+
+// Copy returns a copy of the model.
+func (hw *HoltWinters) Copy() *HoltWinters {
+	result := *hw
+	result.seasonal = append([]float64(nil), hw.seasonal...)
+	result.deviation = append([]float64(nil), hw.deviation...)
+	return &result
+}
+
+// MarshalBinary encodes the model as the version byte, level and trend
+// as 64-bit floats, the violations, the season length and the seasonal
+// and deviation coefficients.
+func (hw *HoltWinters) MarshalBinary() ([]byte, error) {
+	n := len(hw.seasonal)
+	buf := make([]byte, 1+8+8+4+4+16*n)
+	buf[0] = hwVersion
+	binary.LittleEndian.PutUint64(buf[1:], math.Float64bits(hw.level))
+	binary.LittleEndian.PutUint64(buf[9:], math.Float64bits(hw.trend))
+	binary.LittleEndian.PutUint32(buf[17:], hw.violations)
+	binary.LittleEndian.PutUint32(buf[21:], uint32(n))
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint64(buf[25+8*i:], math.Float64bits(hw.seasonal[i]))
+		binary.LittleEndian.PutUint64(buf[25+8*(n+i):], math.Float64bits(hw.deviation[i]))
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes what MarshalBinary encoded.
+func (hw *HoltWinters) UnmarshalBinary(data []byte) error {
+	if len(data) < 25 || data[0] != hwVersion {
+		return fmt.Errorf("invalid Holt-Winters data")
+	}
+	n := int(binary.LittleEndian.Uint32(data[21:]))
+	if n < 1 || len(data) != 25+16*n {
+		return fmt.Errorf("invalid Holt-Winters data length")
+	}
+	*hw = *NewHoltWinters(n)
+	hw.level = math.Float64frombits(binary.LittleEndian.Uint64(data[1:]))
+	hw.trend = math.Float64frombits(binary.LittleEndian.Uint64(data[9:]))
+	hw.violations = binary.LittleEndian.Uint32(data[17:])
+	for i := 0; i < n; i++ {
+		hw.seasonal[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[25+8*i:]))
+		hw.deviation[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[25+8*(n+i):]))
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var hwPattern = []float64{10, 20, 30, 20}
+
+func Test_HoltWinters_update(t *testing.T) {
+	hw := NewHoltWinters(len(hwPattern))
+	if pred, failure := hw.update(0, math.NaN()); !math.IsNaN(pred) || failure {
+		t.Errorf("update: expected NaN and no failure for an empty model, got %v %v", pred, failure)
+	}
+	for i := 0; i < 50*len(hwPattern); i++ {
+		p := i % len(hwPattern)
+		pred, failure := hw.update(p, hwPattern[p])
+		if failure {
+			t.Errorf("update: unexpected failure at %d", i)
+		}
+		if i >= 40*len(hwPattern) && math.Abs(pred-hwPattern[p]) > 1 {
+			t.Errorf("update: at %d expected prediction close to %v, got %v", i, hwPattern[p], pred)
+		}
+	}
+
+	// Aberrant behavior
+	var failed bool
+	for i := 0; i < HWWindow; i++ {
+		if _, failure := hw.update(i%len(hwPattern), 100); failure {
+			failed = true
+			if i+1 < HWThreshold {
+				t.Errorf("update: failure after only %d violations", i+1)
+			}
+		}
+	}
+	if !failed {
+		t.Errorf("update: expected a failure")
+	}
+}
+
+func Test_HoltWinters_MarshalBinary(t *testing.T) {
+	hw := NewHoltWinters(len(hwPattern))
+	for i := 0; i < 10; i++ {
+		hw.update(i%len(hwPattern), hwPattern[i%len(hwPattern)])
+	}
+	data, err := hw.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hw2 HoltWinters
+	if err := hw2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hw, &hw2) {
+		t.Errorf("UnmarshalBinary: expected %v, got %v", hw, hw2)
+	}
+	if err := hw2.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Errorf("UnmarshalBinary: expected an error for truncated data")
+	}
+}
+
+func Test_RoundRobinArchive_HoltWinters(t *testing.T) {
+	season := time.Duration(len(hwPattern)) * time.Second
+	var rras []RRASpec
+	for _, cf := range []Consolidation{HWPREDICT, SEASONAL, DEVSEASONAL, FAILURES} {
+		rras = append(rras, RRASpec{Function: cf, Step: time.Second, Span: time.Minute, Season: season})
+	}
+	rras = append(rras, RRASpec{Function: WMEAN, Step: time.Second, Span: time.Minute})
+	ds := NewDataSource(DSSpec{Step: time.Second, Heartbeat: time.Hour, RRAs: rras})
+
+	t0 := time.Unix(1500000000, 0)
+	n := 100 * len(hwPattern)
+	for k := 0; k <= n; k++ {
+		ts := t0.Add(time.Duration(k) * time.Second)
+		ds.ProcessDataPoint(hwPattern[SlotIndex(ts, time.Second, int64(len(hwPattern)))], ts)
+	}
+
+	latest := t0.Add(time.Duration(n) * time.Second)
+	slotN := SlotIndex(latest, time.Second, 60)
+	want := hwPattern[SlotIndex(latest, time.Second, int64(len(hwPattern)))]
+	dps := func(i int) float64 { return ds.RRAs()[i].DPs()[slotN] }
+	if got := dps(0); math.Abs(got-want) > 1 {
+		t.Errorf("HWPREDICT: expected close to %v, got %v", want, got)
+	}
+	if got := dps(3); got != 0 {
+		t.Errorf("FAILURES: expected 0, got %v", got)
+	}
+	if got := dps(2); got < 0 || got > 1 {
+		t.Errorf("DEVSEASONAL: expected a small deviation, got %v", got)
+	}
+	if ds.RRAs()[4].HoltWinters() != nil {
+		t.Errorf("HoltWinters: WMEAN RRA should have no model")
+	}
+	if got := ds.RRAs()[1].Spec().Season; got != season {
+		t.Errorf("Spec: expected season %v, got %v", season, got)
+	}
+	if rra := ds.BestRRAByCF(t0, latest, 0, MAX); rra.Spec().Function != WMEAN {
+		t.Errorf("BestRRAByCF: expected the WMEAN RRA, got %v", rra.Spec().Function)
+	}
+
+	cp := ds.RRAs()[0].Copy()
+	if !reflect.DeepEqual(cp.HoltWinters(), ds.RRAs()[0].HoltWinters()) {
+		t.Errorf("Copy: model not copied")
+	}
+	if NewRoundRobinArchive(RRASpec{Function: SEASONAL, Step: time.Hour, Span: 24 * time.Hour}).HoltWinters().SeasonLen() != 24 {
+		t.Errorf("NewRoundRobinArchive: expected the default season of 24 slots")
+	}
+}
@@ -140,6 +140,42 @@ func (p *Pdp) AddValueLast(val float64, dur time.Duration) {
 	}
 }
 
+// AddValueFirst keeps the current value unless the PDP is empty
+// (duration 0), in which case it is set to val. Like all others, this
+// is a noop if val is NaN or dur is 0.
+func (p *Pdp) AddValueFirst(val float64, dur time.Duration) {
+	if !math.IsNaN(val) && dur > 0 {
+		if math.IsNaN(p.value) || p.duration == 0 {
+			p.value = val
+		}
+		p.duration = p.duration + dur
+	}
+}
+
+// AddValueSum adds val as a rate per second, i.e. the value becomes
+// the total over the duration rather than an average.
+func (p *Pdp) AddValueSum(val float64, dur time.Duration) {
+	if !math.IsNaN(val) && dur > 0 {
+		if math.IsNaN(p.value) || p.duration == 0 {
+			p.value = 0
+		}
+		p.value += val * dur.Seconds()
+		p.duration = p.duration + dur
+	}
+}
+
+// AddValueCount adds n to the value if val is known. The value is
+// then the number of known data points that were added.
+func (p *Pdp) AddValueCount(val float64, dur time.Duration, n float64) {
+	if !math.IsNaN(val) && dur > 0 {
+		if math.IsNaN(p.value) || p.duration == 0 {
+			p.value = 0
+		}
+		p.value += n
+		p.duration = p.duration + dur
+	}
+}
+
 // Reset sets the value to zero value and returns the value of
 // the PDP before Reset.
 func (p *Pdp) Reset() float64 {
@@ -0,0 +1,181 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Resample returns a new RRA as specified by spec with the data of
+// the RRAs in srcs (which are normally all the RRAs of a DS, with
+// their data loaded) resampled into it. This is how a DS is changed
+// to a different set of RRAs without losing data.
+//
+// Every slot of the new RRA is computed from the highest resolution
+// source which covers it, preferring sources of the same CF (a MAX
+// RRA is best made from a finer MAX RRA). Otherwise WMEAN (or SKETCH)
+// sources are used, which is the only choice for STDDEV and the
+// Holt-Winters CFs (whose model is rebuilt from the resampled
+// values). The sketches of a SKETCH RRA are merged from the sketches
+// of SKETCH sources. The slots are filled in order by the same logic
+// as when the RRA is updated by a DS, thus XFF is observed as usual.
+//
+// The new RRA ends where the most recent source does, its PDP holds
+// whatever is known of the incomplete slot. dsStep is needed by the
+// COUNT CF to convert durations to numbers of data points. Only the
+// sources of the same field (of a multi-value DS) as spec are used.
+func Resample(spec RRASpec, dsStep time.Duration, srcs []RoundRobinArchiver) *RoundRobinArchive {
+	spec.Latest, spec.Value, spec.Duration, spec.M2 = time.Time{}, 0, 0, 0
+	spec.DPs, spec.Sketch, spec.Sketches, spec.HoltWinters = nil, nil, nil, nil
+	rra := NewRoundRobinArchive(spec)
+
+	var (
+		latest time.Time
+		fsrcs  []RoundRobinArchiver
+	)
+	for _, src := range srcs {
+		if src.Spec().Field != spec.Field {
+			continue
+		}
+		fsrcs = append(fsrcs, src)
+		if src.Latest().After(latest) {
+			latest = src.Latest()
+		}
+	}
+	if latest.IsZero() {
+		return rra
+	}
+	srcs = resampleSources(rra.cf, fsrcs)
+
+	slots := rra.Slots()
+	end := slots.Truncate(latest)
+	for slotEnd := slots.Add(end, 1-rra.size); !slotEnd.After(end); slotEnd = slots.Add(slotEnd, 1) {
+		rra.resampleSlot(slots.Add(slotEnd, -1), slotEnd, dsStep, srcs)
+		rra.movePdpToDps(slotEnd)
+	}
+	if end.Before(latest) {
+		rra.resampleSlot(end, latest, dsStep, srcs)
+	}
+	return rra
+}
+
+// resampleSources returns the sources the RRA of CF cf can be
+// resampled from, most preferable first.
+func resampleSources(cf Consolidation, srcs []RoundRobinArchiver) []RoundRobinArchiver {
+	var same, wmean []RoundRobinArchiver
+	for _, src := range srcs {
+		scf := src.Spec().Function
+		switch {
+		case scf == cf && cf != STDDEV && !cf.IsHoltWinters():
+			same = append(same, src)
+		case scf == WMEAN || scf == SKETCH:
+			wmean = append(wmean, src)
+		}
+	}
+	byStep := func(rras []RoundRobinArchiver) {
+		sort.SliceStable(rras, func(i, j int) bool { return rras[i].Step() < rras[j].Step() })
+	}
+	byStep(same)
+	byStep(wmean)
+	return append(same, wmean...)
+}
+
+// resampleSlot adds to the PDP the part of the best source which
+// overlaps the period from begin to end.
+func (rra *RoundRobinArchive) resampleSlot(begin, end time.Time, dsStep time.Duration, srcs []RoundRobinArchiver) {
+	rra.SetValue(math.NaN(), 0)
+	rra.sketch = nil
+
+	// The first source which covers the whole period, otherwise the
+	// first one which covers some of it.
+	var best RoundRobinArchiver
+	for _, src := range srcs {
+		if src.Latest().IsZero() {
+			continue
+		}
+		srcBegin := src.Slots().Add(src.Latest(), -src.Size())
+		if !srcBegin.After(begin) && !src.Latest().Before(end) {
+			best = src
+			break
+		}
+		if best == nil && srcBegin.Before(end) && src.Latest().After(begin) {
+			best = src
+		}
+	}
+	if best == nil {
+		return
+	}
+
+	scf, ss := best.Spec().Function, best.Slots()
+	srcBegin := ss.Add(best.Latest(), -best.Size())
+	for slotEnd := ss.Add(ss.Truncate(begin), 1); ; slotEnd = ss.Add(slotEnd, 1) {
+		slotBegin := ss.Add(slotEnd, -1)
+		if !slotBegin.Before(end) || slotEnd.After(best.Latest()) {
+			break
+		}
+		if !slotBegin.Before(srcBegin) {
+			n := ss.Index(slotEnd)
+			if v, ok := best.DPs()[n]; ok {
+				from, to := slotBegin, slotEnd
+				if from.Before(begin) {
+					from = begin
+				}
+				if to.After(end) {
+					to = end
+				}
+				rra.resampleValue(v, scf, to.Sub(from), slotEnd.Sub(slotBegin), dsStep)
+				if sk := best.Sketches()[n]; sk != nil && rra.cf == SKETCH {
+					if rra.sketch == nil {
+						rra.sketch = NewSketch(sk.Accuracy())
+					}
+					rra.sketch.Merge(sk)
+				}
+			}
+		}
+	}
+}
+
+// resampleValue adds the value v of a source slot of CF scf and
+// length srcLen, dur of which overlaps the current slot.
+func (rra *RoundRobinArchive) resampleValue(v float64, scf Consolidation, dur, srcLen, dsStep time.Duration) {
+	switch rra.cf {
+	case MAX:
+		rra.AddValueMax(v, dur)
+	case MIN:
+		rra.AddValueMin(v, dur)
+	case LAST:
+		rra.AddValueLast(v, dur)
+	case FIRST:
+		rra.AddValueFirst(v, dur)
+	case SUM:
+		if scf == SUM { // v is the total of the source slot
+			v = v / srcLen.Seconds()
+		}
+		rra.AddValueSum(v, dur)
+	case COUNT:
+		n := float64(dur) / float64(dsStep)
+		if scf == COUNT {
+			n = v * float64(dur) / float64(srcLen)
+		}
+		rra.AddValueCount(v, dur, n)
+	case STDDEV:
+		rra.addValueStdDev(v, dur)
+	default:
+		rra.AddValue(v, dur)
+	}
+}
@@ -0,0 +1,91 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_Resample(t *testing.T) {
+	ds := NewDataSource(DSSpec{
+		Step:      time.Minute,
+		Heartbeat: time.Hour,
+		RRAs: []RRASpec{
+			RRASpec{Function: WMEAN, Step: time.Minute, Span: time.Hour},
+			RRASpec{Function: MAX, Step: time.Minute, Span: time.Hour},
+			RRASpec{Function: WMEAN, Step: 10 * time.Minute, Span: 24 * time.Hour},
+		},
+	})
+	t0 := time.Unix(1500000000, 0).Truncate(24 * time.Hour)
+	n := 180 // three hours, the 1m RRAs only have the last one
+	for k := 1; k <= n; k++ {
+		ds.ProcessDataPoint(float64(k), t0.Add(time.Duration(k)*time.Minute))
+	}
+	end := t0.Add(time.Duration(n) * time.Minute)
+
+	// 10m slots from the 1m RRAs: mean, max and sum of 10 values
+	for _, c := range []struct {
+		cf   Consolidation
+		want float64 // of the last slot, which is 171 to 180
+	}{
+		{WMEAN, 175.5},
+		{MAX, 180},
+		{SUM, 1755 * 60},
+	} {
+		rra := Resample(RRASpec{Function: c.cf, Step: 10 * time.Minute, Span: time.Hour}, ds.Step(), ds.RRAs())
+		if !rra.Latest().Equal(end) {
+			t.Errorf("Resample %v: expected latest %v, got %v", c.cf, end, rra.Latest())
+		}
+		if got := rra.DPs()[SlotIndex(end, 10*time.Minute, 6)]; math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("Resample %v: expected %v, got %v", c.cf, c.want, got)
+		}
+		if len(rra.DPs()) != 6 {
+			t.Errorf("Resample %v: expected 6 points, got %d", c.cf, len(rra.DPs()))
+		}
+	}
+
+	// Longer retention at 1m: the older part comes from the 10m RRA
+	rra := Resample(RRASpec{Function: WMEAN, Step: time.Minute, Span: 4 * time.Hour}, ds.Step(), ds.RRAs())
+	if len(rra.DPs()) != n {
+		t.Errorf("Resample: expected %d points, got %d", n, len(rra.DPs()))
+	}
+	for _, c := range []struct {
+		minute int
+		want   float64
+	}{
+		{180, 180},   // 1m RRA
+		{121, 121},   // 1m RRA
+		{120, 115.5}, // 10m RRA, 111 to 120
+		{1, 6},       // 10m RRA, 2 to 10, the first point only sets lastupdate
+	} {
+		slotEnd := t0.Add(time.Duration(c.minute) * time.Minute)
+		if got := rra.DPs()[SlotIndex(slotEnd, time.Minute, 240)]; got != c.want {
+			t.Errorf("Resample: minute %d: expected %v, got %v", c.minute, c.want, got)
+		}
+	}
+
+	// An incomplete slot ends up in the PDP
+	rra = Resample(RRASpec{Function: WMEAN, Step: time.Hour, Span: 24 * time.Hour}, ds.Step(), ds.RRAs())
+	if !rra.Latest().Equal(end) || rra.Duration() != 0 {
+		t.Errorf("Resample: unexpected latest %v, duration %v", rra.Latest(), rra.Duration())
+	}
+	rra = Resample(RRASpec{Function: WMEAN, Step: 7 * time.Hour, Span: 70 * time.Hour}, ds.Step(), ds.RRAs())
+	if rra.Duration() == 0 || rra.Latest().After(end) {
+		t.Errorf("Resample: expected a partial PDP, got latest %v, duration %v", rra.Latest(), rra.Duration())
+	}
+}
@@ -16,19 +16,99 @@
 package rrd
 
 import (
+	"fmt"
 	"math"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/jdcio/tgres/misc"
 )
 
 type Consolidation int
 
 const (
-	WMEAN Consolidation = iota // Time-weighted average
-	MAX                        // Max
-	MIN                        // Min
-	LAST                       // Last
+	WMEAN       Consolidation = iota // Time-weighted average
+	MAX                              // Max
+	MIN                              // Min
+	LAST                             // Last
+	SUM                              // Total (rate times seconds)
+	COUNT                            // Number of known PDPs
+	FIRST                            // First
+	STDDEV                           // Time-weighted standard deviation
+	SKETCH                           // WMEAN plus a quantile sketch per slot
+	HWPREDICT                        // Holt-Winters prediction
+	SEASONAL                         // Holt-Winters seasonal coefficient
+	DEVSEASONAL                      // Holt-Winters seasonal deviation
+	FAILURES                         // Holt-Winters aberrant behavior (1 or 0)
 )
 
+func (c Consolidation) String() string {
+	switch c {
+	case WMEAN:
+		return "WMEAN"
+	case MAX:
+		return "MAX"
+	case MIN:
+		return "MIN"
+	case LAST:
+		return "LAST"
+	case SUM:
+		return "SUM"
+	case COUNT:
+		return "COUNT"
+	case FIRST:
+		return "FIRST"
+	case STDDEV:
+		return "STDDEV"
+	case SKETCH:
+		return "SKETCH"
+	case HWPREDICT:
+		return "HWPREDICT"
+	case SEASONAL:
+		return "SEASONAL"
+	case DEVSEASONAL:
+		return "DEVSEASONAL"
+	case FAILURES:
+		return "FAILURES"
+	}
+	return fmt.Sprintf("Consolidation(%d)", int(c))
+}
+
+// ParseConsolidation converts a (case-insensitive) string such as
+// "max" to a Consolidation.
+func ParseConsolidation(s string) (Consolidation, error) {
+	switch strings.ToUpper(s) {
+	case "WMEAN":
+		return WMEAN, nil
+	case "MAX":
+		return MAX, nil
+	case "MIN":
+		return MIN, nil
+	case "LAST":
+		return LAST, nil
+	case "SUM":
+		return SUM, nil
+	case "COUNT":
+		return COUNT, nil
+	case "FIRST":
+		return FIRST, nil
+	case "STDDEV":
+		return STDDEV, nil
+	case "SKETCH":
+		return SKETCH, nil
+	case "HWPREDICT":
+		return HWPREDICT, nil
+	case "SEASONAL":
+		return SEASONAL, nil
+	case "DEVSEASONAL":
+		return DEVSEASONAL, nil
+	case "FAILURES":
+		return FAILURES, nil
+	}
+	return WMEAN, fmt.Errorf("Invalid consolidation: %q (valid funcs: wmean, min, max, last, sum, count, first, stddev, sketch, hwpredict, seasonal, devseasonal, failures)", s)
+}
+
 // A Round Robin Archive and all its parameters.
 type RoundRobinArchive struct {
 	// Each RRA has its own PDP (duration and value). Note that
@@ -38,13 +118,18 @@ type RoundRobinArchive struct {
 	Pdp
 	// Consolidation function (CF). How data points from a
 	// higher-resolution RRA are aggregated into a lower-resolution
-	// one. Must be WMEAN, MAX, MIN, LAST. Note that since the DS PDP
+	// one. Must be WMEAN, MAX, MIN, LAST, SUM, COUNT, FIRST, STDDEV,
+	// SKETCH or one of the Holt-Winters CFs (HWPREDICT, SEASONAL,
+	// DEVSEASONAL, FAILURES, see holtwinters.go). Note that since the DS PDP
 	// is always WMEAN, the RRA CF is limited to that value. E.g. MAX
 	// is not a true maximum, but the maximum of the DS PDPs, which in
 	// turn, are WMEAN.
 	cf Consolidation
-	// The RRA step
+	// The RRA step, approximate if calendar is set.
 	step time.Duration
+	// Calendar slots (days, weeks or months) in location, see Slots.
+	calendar misc.CalendarInterval
+	location *time.Location
 	// Number of data points in the RRA.
 	size int64
 	// Time at which most recent data point and the RRA end. Latest
@@ -65,6 +150,24 @@ type RoundRobinArchive struct {
 	// contradicting any rules.
 	xff float32
 
+	// Weighted sum of squared deviations from the mean (which is the
+	// PDP value), only used by STDDEV.
+	m2 float64
+
+	// SKETCH only. The data points are the WMEAN, and every slot also
+	// has a Sketch of the data source values (not PDPs) which fell
+	// into it. sketch is for the current (incomplete) slot.
+	sketch   *Sketch
+	sketches map[int64]*Sketch
+
+	// Holt-Winters CFs only. The model, which is updated with the
+	// WMEAN of every slot, and the length of its season.
+	hw     *HoltWinters
+	season time.Duration
+
+	// The field of a multi-value DS this RRA belongs to.
+	field int
+
 	// The list of data points (as a map so that it's sparse). Slots in
 	// dps are time-aligned starting at zero time. This means that if
 	// Latest is defined, we can compute any slot's timestamp without
@@ -79,8 +182,13 @@ type RoundRobinArchiver interface {
 	Latest() time.Time
 	Step() time.Duration
 	Size() int64
+	Slots() Slots
 	PointCount() int
 	DPs() map[int64]float64
+	M2() float64
+	Sketch() *Sketch
+	Sketches() map[int64]*Sketch
+	HoltWinters() *HoltWinters
 	Copy() RoundRobinArchiver
 	Begins(now time.Time) time.Time
 	Spec() RRASpec
@@ -89,7 +197,8 @@ type RoundRobinArchiver interface {
 	// satisfy this interface by including this implementation
 	clear()
 	includes(t time.Time) bool
-	update(periodBegin, periodEnd time.Time, value float64, duration time.Duration)
+	update(periodBegin, periodEnd time.Time, value float64, duration, dsStep time.Duration)
+	addSketchValue(t time.Time, value float64)
 }
 
 // Latest returns the time on which the last slot ends.
@@ -101,44 +210,104 @@ func (rra *RoundRobinArchive) Step() time.Duration { return rra.step }
 // Number of data points in this RRA
 func (rra *RoundRobinArchive) Size() int64 { return rra.size }
 
+// Slots of this RRA, which are needed to compute the slot of a time
+// (and vice versa) if they are calendar slots.
+func (rra *RoundRobinArchive) Slots() Slots {
+	return Slots{Step: rra.step, Size: rra.size, Calendar: rra.calendar, Location: rra.location}
+}
+
 // Dps returns data points as a map of floats. It's a map rather than
 // a slice to be more space-efficient for sparse series.
 func (rra *RoundRobinArchive) DPs() map[int64]float64 { return rra.dps }
 
+// M2 is the STDDEV intermediate state, the weighted sum of squared
+// deviations from the mean in the current (incomplete) slot.
+func (rra *RoundRobinArchive) M2() float64 { return rra.m2 }
+
+// Sketch of the current (incomplete) slot of a SKETCH RRA, or nil.
+func (rra *RoundRobinArchive) Sketch() *Sketch { return rra.sketch }
+
+// Sketches of a SKETCH RRA, keyed by slot like DPs().
+func (rra *RoundRobinArchive) Sketches() map[int64]*Sketch { return rra.sketches }
+
+// HoltWinters model of a Holt-Winters RRA, or nil.
+func (rra *RoundRobinArchive) HoltWinters() *HoltWinters { return rra.hw }
+
 // Returns a new RRA in accordance with the provided RRASpec.
 func NewRoundRobinArchive(spec RRASpec) *RoundRobinArchive {
+	if spec.Calendar.Days > 0 || spec.Calendar.Months > 0 {
+		spec.Step = spec.Calendar.Approx()
+	}
 	result := &RoundRobinArchive{
 		cf:     spec.Function,
 		step:   spec.Step,
 		size:   spec.Span.Nanoseconds() / spec.Step.Nanoseconds(),
 		xff:    spec.Xff,
 		latest: spec.Latest,
+		m2:     spec.M2,
+		sketch: spec.Sketch,
+		field:  spec.Field,
 		Pdp: Pdp{
 			value:    spec.Value,
 			duration: spec.Duration,
 		},
 		dps: make(map[int64]float64),
 	}
+	if spec.Calendar.Days > 0 || spec.Calendar.Months > 0 {
+		result.calendar, result.location = spec.Calendar, spec.Location
+	}
 	if len(spec.DPs) > 0 {
 		result.dps = spec.DPs
 	}
+	if len(spec.Sketches) > 0 {
+		result.sketches = spec.Sketches
+	}
+	if spec.Function.IsHoltWinters() {
+		result.season = spec.Season
+		if result.season <= 0 {
+			result.season = DefaultSeason
+		}
+		seasonLen := int(result.season / result.step)
+		if spec.HoltWinters != nil && spec.HoltWinters.SeasonLen() == seasonLen {
+			result.hw = spec.HoltWinters
+		} else {
+			result.hw = NewHoltWinters(seasonLen)
+		}
+	}
 	return result
 }
 
 // Returns a complete copy of the RRA.
 func (rra *RoundRobinArchive) Copy() RoundRobinArchiver {
 	new_rra := &RoundRobinArchive{
-		Pdp:    Pdp{value: rra.value, duration: rra.duration},
-		cf:     rra.cf,
-		step:   rra.step,
-		size:   rra.size,
-		latest: rra.latest,
-		xff:    rra.xff,
-		dps:    make(map[int64]float64, len(rra.dps)),
+		Pdp:      Pdp{value: rra.value, duration: rra.duration},
+		cf:       rra.cf,
+		step:     rra.step,
+		size:     rra.size,
+		calendar: rra.calendar,
+		location: rra.location,
+		latest:   rra.latest,
+		xff:      rra.xff,
+		m2:       rra.m2,
+		season:   rra.season,
+		field:    rra.field,
+		dps:      make(map[int64]float64, len(rra.dps)),
 	}
 	for k, v := range rra.dps {
 		new_rra.dps[k] = v
 	}
+	if rra.sketch != nil {
+		new_rra.sketch = rra.sketch.Copy()
+	}
+	if len(rra.sketches) > 0 {
+		new_rra.sketches = make(map[int64]*Sketch, len(rra.sketches))
+		for k, v := range rra.sketches {
+			new_rra.sketches[k] = v.Copy()
+		}
+	}
+	if rra.hw != nil {
+		new_rra.hw = rra.hw.Copy()
+	}
 	return new_rra
 }
 
@@ -147,11 +316,7 @@ func (rra *RoundRobinArchive) Copy() RoundRobinArchiver {
 // approximately but not exactly the RRA length ago, because it is
 // aligned on the RRA step boundary.
 func (rra *RoundRobinArchive) Begins(now time.Time) time.Time {
-	rraStart := now.Add(-rra.step * time.Duration(rra.size)).Truncate(rra.step)
-	if now.Equal(now.Truncate(rra.step)) {
-		rraStart = rraStart.Add(rra.step)
-	}
-	return rraStart
+	return rra.Slots().Begins(now)
 }
 
 // PointCount returns the number of points in this RRA.
@@ -166,6 +331,10 @@ func (rra *RoundRobinArchive) Spec() RRASpec {
 		Step:     rra.step,
 		Span:     time.Duration(rra.size) * rra.step,
 		Xff:      rra.xff,
+		Season:   rra.season,
+		Calendar: rra.calendar,
+		Location: rra.location,
+		Field:    rra.field,
 	}
 }
 
@@ -176,7 +345,13 @@ func (rra *RoundRobinArchive) includes(t time.Time) bool {
 }
 
 // update the RRA. If duration is less than the period, then the difference is considered unknown.
-func (rra *RoundRobinArchive) update(periodBegin, periodEnd time.Time, value float64, duration time.Duration) {
+//
+// A period no longer than dsStep is a single DS PDP, duration being
+// its known part. A longer period is a number of whole PDPs of the
+// same value, duration being the known part of each (or of the whole
+// period if longer than dsStep), this is needed by CFs which care
+// about how much of the period falls into a slot (SUM, COUNT, STDDEV).
+func (rra *RoundRobinArchive) update(periodBegin, periodEnd time.Time, value float64, duration, dsStep time.Duration) {
 
 	// currentBegin is a cursor pointing at the beginning of the
 	// current slot, currentEnd points at its end. We start out
@@ -190,9 +365,10 @@ func (rra *RoundRobinArchive) update(periodBegin, periodEnd time.Time, value flo
 	}
 
 	// for each RRA slot before periodEnd
+	slots := rra.Slots()
 	for currentBegin.Before(periodEnd) {
 
-		endOfSlot := currentBegin.Truncate(rra.step).Add(rra.step)
+		endOfSlot := slots.Add(slots.Truncate(currentBegin), 1)
 
 		currentEnd := endOfSlot
 		if currentEnd.After(periodEnd) { // i.e. currentEnd < endOfSlot
@@ -200,11 +376,12 @@ func (rra *RoundRobinArchive) update(periodBegin, periodEnd time.Time, value flo
 		}
 
 		switch rra.cf {
-		case WMEAN:
-			if duration == rra.step && math.IsNaN(value) {
+		case WMEAN, SKETCH, HWPREDICT, SEASONAL, DEVSEASONAL, FAILURES:
+			if math.IsNaN(value) && duration == slots.Length(slots.Add(endOfSlot, -1)) {
 				// Special case, a whole NaN gets recorded as NaN. This
 				// happens when a period is filled with NaNs due to HB
-				// exceed, for example.
+				// exceed, for example. The slot length is that of the
+				// actual slot, since calendar slots vary.
 				rra.SetValue(value, 0)
 			} else {
 				rra.AddValue(value, duration)
@@ -215,6 +392,28 @@ func (rra *RoundRobinArchive) update(periodBegin, periodEnd time.Time, value flo
 			rra.AddValueMin(value, duration)
 		case LAST:
 			rra.AddValueLast(value, duration)
+		case FIRST:
+			rra.AddValueFirst(value, duration)
+		case SUM, COUNT, STDDEV:
+			// Only the known part of what falls into this slot
+			// counts. Over whole PDPs duration is what is known of
+			// each PDP, or of the entire period if it is longer.
+			known := duration
+			if span := periodEnd.Sub(periodBegin); span > dsStep {
+				whole := dsStep
+				if duration > dsStep {
+					whole = span
+				}
+				known = time.Duration(float64(currentEnd.Sub(currentBegin)) * float64(duration) / float64(whole))
+			}
+			switch rra.cf {
+			case SUM:
+				rra.AddValueSum(value, known)
+			case COUNT:
+				rra.AddValueCount(value, known, math.Ceil(float64(known)/float64(dsStep)))
+			case STDDEV:
+				rra.addValueStdDev(value, known)
+			}
 		}
 
 		// if end of slot, move PDP into its place in dps.
@@ -227,27 +426,75 @@ func (rra *RoundRobinArchive) update(periodBegin, periodEnd time.Time, value flo
 	}
 }
 
+// addValueStdDev updates the weighted mean (PDP value) and m2 using
+// the West (1979) incremental algorithm.
+func (rra *RoundRobinArchive) addValueStdDev(val float64, dur time.Duration) {
+	if math.IsNaN(val) || dur <= 0 {
+		return
+	}
+	if math.IsNaN(rra.value) || rra.duration == 0 {
+		rra.value, rra.m2 = val, 0
+		rra.duration = dur
+		return
+	}
+	w, total := float64(dur), float64(rra.duration+dur)
+	delta := val - rra.value
+	rra.value += delta * w / total
+	rra.m2 += w * delta * (val - rra.value)
+	rra.duration = rra.duration + dur
+}
+
 // movePdpToDps moves the PDP into its proper slot in the dps map and
 // resets the PDP.
 func (rra *RoundRobinArchive) movePdpToDps(endOfSlot time.Time) {
-	// Check XFF
-	known := float64(rra.duration) / float64(rra.step)
-	if known < float64(rra.xff) {
+	if rra.cf == STDDEV && rra.duration > 0 {
+		rra.value = math.Sqrt(rra.m2 / float64(rra.duration))
+	}
+	rra.m2 = 0
+
+	// The current sketch is of the slot following latest, unless
+	// slots were skipped (a gap longer than the RRA).
+	slots := rra.Slots()
+	sketch := rra.sketch
+	if sketch != nil && !rra.latest.IsZero() && !slots.Add(rra.latest, 1).Equal(endOfSlot) {
+		sketch = nil
+	}
+	rra.sketch = nil
+
+	// Check XFF. A SUM, COUNT or STDDEV of nothing known is NaN
+	// rather than 0 regardless of XFF.
+	known := float64(rra.duration) / float64(slots.Length(slots.Add(endOfSlot, -1)))
+	if known < float64(rra.xff) || (known == 0 && (rra.cf == SUM || rra.cf == COUNT || rra.cf == STDDEV)) {
 		rra.SetValue(math.NaN(), 0)
 	}
 
+	if rra.hw != nil {
+		rra.updateHoltWinters(endOfSlot)
+	}
+
 	if rra.dps == nil {
 		rra.dps = make(map[int64]float64)
 	}
 
-	slotN := SlotIndex(endOfSlot, rra.step, rra.size)
+	slotN := slots.Index(endOfSlot)
 	rra.latest = endOfSlot
 	if math.IsNaN(rra.value) {
 		// No value is better than storing a NaN
 		delete(rra.dps, slotN)
+		sketch = nil
 	} else {
 		rra.dps[slotN] = rra.value
 	}
+	if rra.cf == SKETCH {
+		if sketch != nil {
+			if rra.sketches == nil {
+				rra.sketches = make(map[int64]*Sketch)
+			}
+			rra.sketches[slotN] = sketch
+		} else {
+			delete(rra.sketches, slotN)
+		}
+	}
 
 	rra.Reset()
 }
@@ -257,6 +504,43 @@ func (rra *RoundRobinArchive) clear() {
 	if len(rra.dps) > 0 {
 		rra.dps = make(map[int64]float64)
 	}
+	if len(rra.sketches) > 0 {
+		rra.sketches = make(map[int64]*Sketch)
+	}
+}
+
+// addSketchValue adds a data source value at time t to the sketch of
+// the slot t is in. This is normally the current slot, but it can be
+// the latest one if t is exactly its end (or with a 0 heartbeat), in
+// which case it is only added if the slot is still in memory, since
+// its sketch would otherwise overwrite the stored one.
+func (rra *RoundRobinArchive) addSketchValue(t time.Time, value float64) {
+	if rra.cf != SKETCH || math.IsNaN(value) {
+		return
+	}
+	slots := rra.Slots()
+	slotEnd := slots.Truncate(t)
+	if !slotEnd.Equal(t) {
+		slotEnd = slots.Add(slotEnd, 1)
+	}
+	if !rra.latest.IsZero() && !slotEnd.After(rra.latest) {
+		slotN := slots.Index(slotEnd)
+		if _, ok := rra.dps[slotN]; !ok || !rra.includes(slotEnd) {
+			return
+		}
+		if rra.sketches[slotN] == nil {
+			if rra.sketches == nil {
+				rra.sketches = make(map[int64]*Sketch)
+			}
+			rra.sketches[slotN] = NewSketch(SketchAccuracy)
+		}
+		rra.sketches[slotN].Add(value)
+		return
+	}
+	if rra.sketch == nil {
+		rra.sketch = NewSketch(SketchAccuracy)
+	}
+	rra.sketch.Add(value)
 }
 
 // Given a slot timestamp, RRA step and size, return the slot's
@@ -292,5 +576,86 @@ type RRASpec struct {
 	Latest   time.Time
 	Value    float64
 	Duration time.Duration
+	M2       float64           // STDDEV only
 	DPs      map[int64]float64 // Careful, these are round-robin
+	Sketch   *Sketch           // SKETCH only, current slot
+	Sketches map[int64]*Sketch // SKETCH only, round-robin like DPs
+
+	// Holt-Winters CFs only. Season defaults to DefaultSeason.
+	Season      time.Duration
+	HoltWinters *HoltWinters
+
+	// Calendar slots (days, weeks or months) in Location (nil is
+	// UTC), see Slots. Step is then Calendar.Approx().
+	Calendar misc.CalendarInterval
+	Location *time.Location
+
+	// The field (index into DSSpec.Fields) of a multi-value DS this
+	// RRA belongs to, always 0 for a single value DS.
+	Field int
+}
+
+// ParseRRASpec parses an RRA specification in the config file format
+// "[cf:]step:span[:xff]", e.g. "max:10s:6h:0.5". The CF defaults to
+// WMEAN and the XFF to 0.5. A Holt-Winters CF can specify the season,
+// e.g. "hwpredict(1d)", and a step in days, weeks or months followed
+// by "@" and a time zone means calendar slots, e.g.
+// "1d@America/New_York". The span is not adjusted to be a multiple of
+// the step, this is up to the caller.
+func ParseRRASpec(s string) (RRASpec, error) {
+	spec := RRASpec{Xff: 0.5}
+	parts := strings.SplitN(s, ":", 4)
+
+	// If first character of first part is a digit, assume we're
+	// skipping CF and default to WMEAN.
+	if len(parts[0]) > 0 && strings.Contains("0123456789", string(parts[0][0])) {
+		parts = append([]string{"WMEAN"}, parts...)
+	}
+	if len(parts) < 3 || len(parts) > 4 {
+		return spec, fmt.Errorf("Invalid RRA specification (not enough or too many elements): %q", s)
+	}
+
+	// Holt-Winters CFs can specify the season, e.g. "hwpredict(1d)"
+	cf := parts[0]
+	if i := strings.Index(cf, "("); i > 0 && strings.HasSuffix(cf, ")") {
+		season, err := misc.BetterParseDuration(cf[i+1 : len(cf)-1])
+		if err != nil {
+			return spec, fmt.Errorf("Invalid Season: %q (%v)", cf[i+1:len(cf)-1], err)
+		}
+		cf, spec.Season = cf[:i], season
+	}
+
+	var err error
+	if spec.Function, err = ParseConsolidation(cf); err != nil {
+		return spec, err
+	}
+	if spec.Season != 0 && !spec.Function.IsHoltWinters() {
+		return spec, fmt.Errorf("Season is only valid for Holt-Winters functions: %q", parts[0])
+	}
+
+	// Calendar slots in a time zone, e.g. "1d@America/New_York"
+	if i := strings.Index(parts[1], "@"); i >= 0 {
+		if spec.Calendar, err = misc.ParseCalendarInterval(parts[1][:i]); err != nil || spec.Calendar.Dur != 0 {
+			return spec, fmt.Errorf("Invalid Step: %q (must be days, weeks or months)", parts[1])
+		}
+		if spec.Location, err = time.LoadLocation(parts[1][i+1:]); err != nil {
+			return spec, fmt.Errorf("Invalid Step: %q (%v)", parts[1], err)
+		}
+		spec.Step = spec.Calendar.Approx()
+	} else if spec.Step, err = misc.BetterParseDuration(parts[1]); err != nil {
+		return spec, fmt.Errorf("Invalid Step: %q (%v)", parts[1], err)
+	} else if spec.Step <= 0 {
+		return spec, fmt.Errorf("Invalid Step: %q", parts[1])
+	}
+	if spec.Span, err = misc.BetterParseDuration(parts[2]); err != nil {
+		return spec, fmt.Errorf("Invalid Size: %q (%v)", parts[2], err)
+	}
+	if len(parts) == 4 {
+		xff, err := strconv.ParseFloat(parts[3], 32)
+		if err != nil {
+			return spec, fmt.Errorf("Invalid XFF: %q (%v)", parts[3], err)
+		}
+		spec.Xff = float32(xff)
+	}
+	return spec, nil
 }
@@ -316,7 +316,7 @@ func Test_RoundRobinArchive_update(t *testing.T) {
 			rra.Reset()
 		}
 
-		rra.update(vals.begin, vals.end, vals.dsVal, vals.dsDur)
+		rra.update(vals.begin, vals.end, vals.dsVal, vals.dsDur, step)
 
 		// Stupid trick - replace NaNs with 999 (Since we do not store
 		// NaNs anymore, it is not really needed anymore)
@@ -343,3 +343,77 @@ func Test_RoundRobinArchive_update(t *testing.T) {
 	}
 
 }
+
+func Test_RoundRobinArchive_update_CFs(t *testing.T) {
+
+	step, size := 30*time.Second, int64(10)
+	expect := map[Consolidation][2]float64{ // slot ending 120, 150
+		SUM:    {60, 120},
+		COUNT:  {3, 3},
+		FIRST:  {1, 4},
+		STDDEV: {math.Sqrt(2.0 / 3), 0},
+	}
+	for cf, exp := range expect {
+		ds := NewDataSource(DSSpec{
+			Step:      10 * time.Second,
+			Heartbeat: time.Hour,
+			RRAs:      []RRASpec{RRASpec{Function: cf, Step: step, Span: step * time.Duration(size)}},
+		})
+		for _, dp := range [][2]int64{{0, 90}, {1, 100}, {2, 110}, {3, 120}, {4, 150}} {
+			ds.ProcessDataPoint(float64(dp[0]), time.Unix(dp[1], 0))
+		}
+		dps := ds.RRAs()[0].DPs()
+		for i, end := range []int64{120, 150} {
+			got := dps[SlotIndex(time.Unix(end, 0), step, size)]
+			if math.Abs(got-exp[i]) > 1e-9 {
+				t.Errorf("%v: slot ending %d: expected %v, got %v", cf, end, exp[i], got)
+			}
+		}
+	}
+
+	if cf, err := ParseConsolidation("stddev"); err != nil || cf != STDDEV {
+		t.Errorf("ParseConsolidation: expected STDDEV, got %v %v", cf, err)
+	}
+	if _, err := ParseConsolidation("bogus"); err == nil {
+		t.Errorf("ParseConsolidation: no error on invalid CF")
+	}
+}
+
+func Test_RoundRobinArchive_update_CFs_NaN(t *testing.T) {
+
+	// 10-20 is 1 and 45-70 is 3, 20-45 is NaN (HB exceeded), as is
+	// 70-180, i.e. the whole slot ending 180.
+	step, size := time.Minute, int64(10)
+	expect := map[Consolidation][2]float64{ // slot ending 60, 120
+		SUM:    {55, 30},
+		COUNT:  {3, 1},
+		STDDEV: {math.Sqrt(0.96), 0},
+	}
+	for cf, exp := range expect {
+		ds := NewDataSource(DSSpec{
+			Step:      10 * time.Second,
+			Heartbeat: 15 * time.Second,
+			RRAs:      []RRASpec{RRASpec{Function: cf, Step: step, Span: step * time.Duration(size)}},
+		})
+		for _, dp := range [][2]int64{{1, 10}, {1, 20}, {3, 45}, {3, 60}, {3, 70}, {3, 180}, {3, 190}} {
+			ds.ProcessDataPoint(float64(dp[0]), time.Unix(dp[1], 0))
+		}
+		dps := ds.RRAs()[0].DPs()
+		for i, end := range []int64{60, 120} {
+			got := dps[SlotIndex(time.Unix(end, 0), step, size)]
+			if math.Abs(got-exp[i]) > 1e-9 {
+				t.Errorf("%v: slot ending %d: expected %v, got %v", cf, end, exp[i], got)
+			}
+		}
+		if got, ok := dps[SlotIndex(time.Unix(180, 0), step, size)]; ok {
+			t.Errorf("%v: slot ending 180 is all NaN, expected no value, got %v", cf, got)
+		}
+	}
+
+	// Whole PDPs which are only half known count as half
+	rra := NewRoundRobinArchive(RRASpec{Function: SUM, Step: step, Span: step * time.Duration(size)})
+	rra.update(time.Unix(0, 0), time.Unix(60, 0), 2, 5*time.Second, 10*time.Second)
+	if got := rra.dps[SlotIndex(time.Unix(60, 0), step, size)]; got != 60 {
+		t.Errorf("SUM: half known PDPs: expected 60, got %v", got)
+	}
+}
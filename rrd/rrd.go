@@ -47,8 +47,13 @@
 // step they belong to. In this implementation a step cannot be
 // smaller than a millisecond.
 //
+// Field: A DS can have several named fields, each being a series of
+// its own which shares the step, heartbeat and RRA layout with the
+// other fields of the DS, see fields.go.
+//
 // DS Heartbeat (HB): Duration of time that can pass without data. A
-// gap in data which exceeds HB is filled with NaNs.
+// gap in data which exceeds HB is filled with NaNs, unless the DS
+// has a different fill policy (previous, zero or linear), see fill.go.
 //
 // Note that this package does not concern itself with loading a series
 // from storage for analysis.
@@ -0,0 +1,268 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// A Sketch is a mergeable summary of a distribution of values which
+// can estimate any quantile within a relative error, it is a DDSketch
+// (Masson, Rim & Lee, 2019). Values are counted in logarithmically
+// sized buckets, v > 0 is in bucket i such that gamma^(i-1) < v <=
+// gamma^i, where gamma is (1+accuracy)/(1-accuracy), negative values
+// have their own buckets. Merging two sketches of the same accuracy
+// amounts to adding up their bucket counts, which is what SKETCH RRAs
+// and the DSL sketchQuantile() rely on.
+type Sketch struct {
+	accuracy float64
+	lnGamma  float64
+	pos, neg map[int32]uint64 // bucket index => count
+	zero     uint64           // values too close to zero to be bucketed
+	count    uint64
+	min, max float64
+}
+
+// SketchAccuracy is the relative accuracy of the sketches kept by
+// SKETCH RRAs, i.e. a quantile is within 1% of the real value.
+const SketchAccuracy = 0.01
+
+// Values with an absolute value smaller than this count as zero.
+const sketchMinValue = 1e-9
+
+// sketchVersion is the first byte of a marshaled sketch.
+const sketchVersion = 1
+
+// NewSketch returns an empty sketch with the given relative accuracy,
+// which must be between 0 and 1 (exclusive).
+func NewSketch(accuracy float64) *Sketch {
+	return &Sketch{
+		accuracy: accuracy,
+		lnGamma:  math.Log((1 + accuracy) / (1 - accuracy)),
+		pos:      make(map[int32]uint64),
+		neg:      make(map[int32]uint64),
+		min:      math.Inf(1),
+		max:      math.Inf(-1),
+	}
+}
+
+// Accuracy of the sketch
+func (s *Sketch) Accuracy() float64 { return s.accuracy }
+
+// Count of the values added to the sketch
+func (s *Sketch) Count() uint64 { return s.count }
+
+func (s *Sketch) index(v float64) int32 {
+	return int32(math.Ceil(math.Log(v) / s.lnGamma))
+}
+
+// value is the estimate of the (positive) values in bucket i.
+func (s *Sketch) value(i int32) float64 {
+	gamma := math.Exp(s.lnGamma)
+	return 2 * math.Exp(float64(i)*s.lnGamma) / (gamma + 1)
+}
+
+// Add a value to the sketch. NaN and ±Inf are ignored.
+func (s *Sketch) Add(v float64) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+	switch {
+	case v > sketchMinValue:
+		s.pos[s.index(v)]++
+	case v < -sketchMinValue:
+		s.neg[s.index(-v)]++
+	default:
+		s.zero++
+	}
+	s.count++
+	if v < s.min {
+		s.min = v
+	}
+	if v > s.max {
+		s.max = v
+	}
+}
+
+// Merge adds the values of o to s. Both must be of the same accuracy.
+func (s *Sketch) Merge(o *Sketch) error {
+	if o.accuracy != s.accuracy {
+		return fmt.Errorf("cannot merge sketches of different accuracy: %v and %v", s.accuracy, o.accuracy)
+	}
+	for i, n := range o.pos {
+		s.pos[i] += n
+	}
+	for i, n := range o.neg {
+		s.neg[i] += n
+	}
+	s.zero += o.zero
+	s.count += o.count
+	if o.min < s.min {
+		s.min = o.min
+	}
+	if o.max > s.max {
+		s.max = o.max
+	}
+	return nil
+}
+
+// Quantile returns the estimate of the q (0 to 1) quantile, or NaN if
+// the sketch is empty.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+	if q == 0 {
+		return s.min
+	}
+	if q == 1 {
+		return s.max
+	}
+
+	rank := q * float64(s.count-1)
+	var result float64
+	n := float64(0)
+	found := false
+
+	// Negative buckets come first, those farthest from zero first.
+	for _, i := range sortedIndexes(s.neg, true) {
+		if n += float64(s.neg[i]); n > rank {
+			result, found = -s.value(i), true
+			break
+		}
+	}
+	if !found {
+		if n += float64(s.zero); n > rank {
+			found = true
+		}
+	}
+	if !found {
+		for _, i := range sortedIndexes(s.pos, false) {
+			if n += float64(s.pos[i]); n > rank {
+				result, found = s.value(i), true
+				break
+			}
+		}
+	}
+	if !found {
+		result = s.max
+	}
+
+	// The estimate can be a little outside the values seen
+	if result < s.min {
+		return s.min
+	}
+	if result > s.max {
+		return s.max
+	}
+	return result
+}
+
+func sortedIndexes(m map[int32]uint64, desc bool) []int32 {
+	result := make([]int32, 0, len(m))
+	for i := range m {
+		result = append(result, i)
+	}
+	sort.Slice(result, func(a, b int) bool {
+		if desc {
+			return result[a] > result[b]
+		}
+		return result[a] < result[b]
+	})
+	return result
+}
+
+// Copy returns a copy of the sketch
+func (s *Sketch) Copy() *Sketch {
+	result := NewSketch(s.accuracy)
+	result.Merge(s)
+	return result
+}
+
+// MarshalBinary encodes the sketch as the version byte, the accuracy,
+// min and max as 64-bit floats, the zero count followed by the number
+// of positive buckets and their index/count pairs as varints, and the
+// same for negative buckets.
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 1+3*8, 1+3*8+binary.MaxVarintLen64*(3+2*(len(s.pos)+len(s.neg))))
+	buf[0] = sketchVersion
+	binary.LittleEndian.PutUint64(buf[1:], math.Float64bits(s.accuracy))
+	binary.LittleEndian.PutUint64(buf[9:], math.Float64bits(s.min))
+	binary.LittleEndian.PutUint64(buf[17:], math.Float64bits(s.max))
+
+	tmp := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v uint64) {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, v)]...)
+	}
+	putUvarint(s.zero)
+	for _, m := range []map[int32]uint64{s.pos, s.neg} {
+		putUvarint(uint64(len(m)))
+		for _, i := range sortedIndexes(m, false) {
+			buf = append(buf, tmp[:binary.PutVarint(tmp, int64(i))]...)
+			putUvarint(m[i])
+		}
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes what MarshalBinary encoded.
+func (s *Sketch) UnmarshalBinary(data []byte) error {
+	if len(data) < 1+3*8 || data[0] != sketchVersion {
+		return fmt.Errorf("invalid sketch data")
+	}
+	accuracy := math.Float64frombits(binary.LittleEndian.Uint64(data[1:]))
+	if !(accuracy > 0 && accuracy < 1) {
+		return fmt.Errorf("invalid sketch accuracy: %v", accuracy)
+	}
+	*s = *NewSketch(accuracy)
+	s.min = math.Float64frombits(binary.LittleEndian.Uint64(data[9:]))
+	s.max = math.Float64frombits(binary.LittleEndian.Uint64(data[17:]))
+
+	data = data[25:]
+	var err error
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			err = fmt.Errorf("invalid sketch data")
+			return 0
+		}
+		data = data[n:]
+		return v
+	}
+	varint := func() int64 {
+		v, n := binary.Varint(data)
+		if n <= 0 {
+			err = fmt.Errorf("invalid sketch data")
+			return 0
+		}
+		data = data[n:]
+		return v
+	}
+
+	s.zero = uvarint()
+	s.count = s.zero
+	for _, m := range []map[int32]uint64{s.pos, s.neg} {
+		for n := uvarint(); n > 0 && err == nil; n-- {
+			i, c := int32(varint()), uvarint()
+			m[i] = c
+			s.count += c
+		}
+	}
+	return err
+}
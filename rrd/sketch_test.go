@@ -0,0 +1,95 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"math"
+	"testing"
+)
+
+func Test_Sketch_Quantile(t *testing.T) {
+	s := NewSketch(SketchAccuracy)
+	if !math.IsNaN(s.Quantile(0.5)) {
+		t.Errorf("Quantile: empty sketch should be NaN")
+	}
+	for i := 1; i <= 1000; i++ {
+		s.Add(float64(i))
+		s.Add(float64(-i))
+	}
+	s.Add(0)
+	s.Add(math.NaN())
+	if s.Count() != 2001 {
+		t.Errorf("Count: expected 2001, got %d", s.Count())
+	}
+	for _, c := range []struct{ q, expect float64 }{
+		{0, -1000}, {0.1, -800}, {0.5, 0}, {0.75, 500}, {0.99, 980}, {1, 1000},
+	} {
+		got := s.Quantile(c.q)
+		if math.Abs(got-c.expect) > math.Abs(c.expect)*SketchAccuracy+1e-9 {
+			t.Errorf("Quantile(%v): expected %v, got %v", c.q, c.expect, got)
+		}
+	}
+}
+
+func Test_Sketch_Merge(t *testing.T) {
+	a, b, all := NewSketch(SketchAccuracy), NewSketch(SketchAccuracy), NewSketch(SketchAccuracy)
+	for i := 1; i <= 100; i++ {
+		a.Add(float64(i))
+		b.Add(float64(i * 100))
+		all.Add(float64(i))
+		all.Add(float64(i * 100))
+	}
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []float64{0, 0.25, 0.5, 0.9, 1} {
+		if a.Quantile(q) != all.Quantile(q) {
+			t.Errorf("Merge: Quantile(%v) %v != %v", q, a.Quantile(q), all.Quantile(q))
+		}
+	}
+	if err := a.Merge(NewSketch(0.05)); err == nil {
+		t.Errorf("Merge: expected an error for different accuracy")
+	}
+}
+
+func Test_Sketch_MarshalBinary(t *testing.T) {
+	s := NewSketch(SketchAccuracy)
+	for _, v := range []float64{-3, 0, 1e-12, 0.5, 7, 1e9} {
+		s.Add(v)
+	}
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var u Sketch
+	if err := u.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if u.Count() != s.Count() || u.Accuracy() != s.Accuracy() {
+		t.Errorf("UnmarshalBinary: count/accuracy mismatch: %v %v", u.Count(), u.Accuracy())
+	}
+	for _, q := range []float64{0, 0.2, 0.5, 0.8, 1} {
+		if u.Quantile(q) != s.Quantile(q) {
+			t.Errorf("UnmarshalBinary: Quantile(%v) %v != %v", q, u.Quantile(q), s.Quantile(q))
+		}
+	}
+	if err := u.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Errorf("UnmarshalBinary: expected an error for truncated data")
+	}
+	if err := u.UnmarshalBinary([]byte{0}); err == nil {
+		t.Errorf("UnmarshalBinary: expected an error for invalid data")
+	}
+}
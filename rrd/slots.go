@@ -0,0 +1,143 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"time"
+
+	"github.com/jdcio/tgres/misc"
+)
+
+// Slots describes how time is divided into the Size slots of an
+// RRA. Normally slots are Step long and aligned on zero time (UTC).
+// Calendar slots are days, weeks or months in Location instead, they
+// begin at local midnight and vary in length (months have different
+// numbers of days, a day is 23 or 25 hours long across a DST change).
+// The Step of calendar slots is only approximate, see
+// misc.CalendarInterval.Approx().
+type Slots struct {
+	Step     time.Duration
+	Size     int64
+	Calendar misc.CalendarInterval // days or months, zero unless calendar slots
+	Location *time.Location        // of calendar slots, nil is UTC
+}
+
+// IsCalendar tells whether these are calendar slots.
+func (s Slots) IsCalendar() bool {
+	return s.Calendar.Days > 0 || s.Calendar.Months > 0
+}
+
+func (s Slots) location() *time.Location {
+	if s.Location == nil {
+		return time.UTC
+	}
+	return s.Location
+}
+
+// Number returns the number of the slot which begins at or contains
+// t, counting from the zero time (fixed steps), January 1st 1970
+// (days), Monday January 5th 1970 (weeks) or January of year 0
+// (months) as number 0.
+func (s Slots) Number(t time.Time) int64 {
+	if !s.IsCalendar() {
+		return (t.UnixNano() / 1e6) / (s.Step.Nanoseconds() / 1e6)
+	}
+	y, m, d := t.In(s.location()).Date()
+	if s.Calendar.Months > 0 {
+		return floorDiv(int64(y)*12+int64(m)-1, int64(s.Calendar.Months))
+	}
+	days := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+	if s.Calendar.Days%7 == 0 {
+		days -= 4
+	}
+	return floorDiv(days, int64(s.Calendar.Days))
+}
+
+// Truncate returns the beginning of the slot containing t.
+func (s Slots) Truncate(t time.Time) time.Time {
+	if !s.IsCalendar() {
+		return t.Truncate(s.Step)
+	}
+	return s.Calendar.Truncate(t.In(s.location()))
+}
+
+// Add returns the slot boundary n slots after (or before if n is
+// negative) the slot boundary t.
+func (s Slots) Add(t time.Time, n int64) time.Time {
+	if !s.IsCalendar() {
+		return t.Add(s.Step * time.Duration(n))
+	}
+	return s.Calendar.AddTo(t.In(s.location()), int(n))
+}
+
+// Index returns the (0-based) index in the data points of the slot
+// which ends at slotEnd.
+func (s Slots) Index(slotEnd time.Time) int64 {
+	if !s.IsCalendar() {
+		return SlotIndex(slotEnd, s.Step, s.Size)
+	}
+	return s.Number(slotEnd) % s.Size
+}
+
+// Time returns the time at which slot n ends given the end of the
+// latest slot.
+func (s Slots) Time(n int64, latest time.Time) time.Time {
+	if !s.IsCalendar() {
+		return SlotTime(n, latest, s.Step, s.Size)
+	}
+	return s.Add(latest, -IndexDistance(n, s.Index(latest), s.Size))
+}
+
+// Version returns the storage version of the slots up to and
+// including the latest one, which is the number of times the RRA has
+// wrapped around (modulo 32767). The slots after latest are of the
+// previous version.
+func (s Slots) Version(latest time.Time) int {
+	return int(floorDiv(s.Number(latest), s.Size) % 32767)
+}
+
+// Begins returns the beginning of the RRA assuming that the argument
+// "now" is within it.
+func (s Slots) Begins(now time.Time) time.Time {
+	if !s.IsCalendar() {
+		rraStart := now.Add(-s.Step * time.Duration(s.Size)).Truncate(s.Step)
+		if now.Equal(now.Truncate(s.Step)) {
+			rraStart = rraStart.Add(s.Step)
+		}
+		return rraStart
+	}
+	begin := s.Truncate(now)
+	if begin.Equal(now) {
+		return s.Add(begin, 1-s.Size)
+	}
+	return s.Add(begin, -s.Size)
+}
+
+// Length returns the length of the slot which begins at t.
+func (s Slots) Length(t time.Time) time.Duration {
+	if !s.IsCalendar() {
+		return s.Step
+	}
+	return s.Add(t, 1).Sub(t)
+}
+
+// floorDiv is a / b rounded down (for positive b).
+func floorDiv(a, b int64) int64 {
+	if a < 0 {
+		return (a - b + 1) / b
+	}
+	return a / b
+}
@@ -0,0 +1,188 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jdcio/tgres/misc"
+)
+
+func Test_Slots_Fixed(t *testing.T) {
+	s := Slots{Step: time.Minute, Size: 60}
+	latest := time.Unix(1500000000, 0).Truncate(time.Minute)
+	for n := int64(0); n < s.Size; n++ {
+		if s.Time(n, latest) != SlotTime(n, latest, s.Step, s.Size) {
+			t.Errorf("Time: slot %d differs from SlotTime()", n)
+		}
+	}
+	if s.Index(latest) != SlotIndex(latest, s.Step, s.Size) {
+		t.Errorf("Index: differs from SlotIndex()")
+	}
+	if v := s.Version(latest); v != int((latest.Unix()/3600)%32767) {
+		t.Errorf("Version: unexpected %d", v)
+	}
+	if b := s.Begins(latest); !b.Equal(latest.Add(-59 * time.Minute)) {
+		t.Errorf("Begins: unexpected %v", b)
+	}
+}
+
+func Test_Slots_Calendar(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	tm := func(s string) time.Time {
+		result, _ := time.Parse(time.RFC3339, s)
+		return result
+	}
+
+	days := Slots{Calendar: misc.CalendarInterval{Days: 1}, Location: ny, Step: 24 * time.Hour, Size: 10}
+	mar12 := tm("2017-03-12T05:00:00Z") // local midnight, a 23 hour day (DST)
+	if got := days.Truncate(tm("2017-03-12T20:00:00Z")); !got.Equal(mar12) {
+		t.Errorf("Truncate: expected %v, got %v", mar12, got)
+	}
+	if got := days.Length(mar12); got != 23*time.Hour {
+		t.Errorf("Length: expected 23h, got %v", got)
+	}
+	if got := days.Add(mar12, 1); !got.Equal(tm("2017-03-13T04:00:00Z")) {
+		t.Errorf("Add: unexpected %v", got)
+	}
+	latest := tm("2017-03-13T04:00:00Z")
+	for n := int64(0); n < days.Size; n++ {
+		st := days.Time(n, latest)
+		if days.Index(st) != n || !days.Truncate(st).Equal(st) {
+			t.Errorf("Time: slot %d ends at %v which is not slot %d", n, st, days.Index(st))
+		}
+	}
+	if got := days.Begins(latest); !got.Equal(tm("2017-03-04T05:00:00Z")) {
+		t.Errorf("Begins: unexpected %v", got)
+	}
+
+	weeks := Slots{Calendar: misc.CalendarInterval{Days: 7}, Step: 7 * 24 * time.Hour, Size: 4}
+	if got := weeks.Truncate(tm("2017-01-01T12:00:00Z")); !got.Equal(tm("2016-12-26T00:00:00Z")) {
+		t.Errorf("Truncate: weeks should begin on Monday, got %v", got)
+	}
+
+	months := Slots{Calendar: misc.CalendarInterval{Months: 1}, Step: 30 * 24 * time.Hour, Size: 12}
+	feb := tm("2017-02-01T00:00:00Z")
+	if got := months.Length(feb); got != 28*24*time.Hour {
+		t.Errorf("Length: expected 28 days, got %v", got)
+	}
+	if months.Number(feb) != 2017*12+1 || months.Index(feb) != 1 {
+		t.Errorf("Number: unexpected %d", months.Number(feb))
+	}
+	if months.Version(feb) != 2017 {
+		t.Errorf("Version: expected 2017, got %d", months.Version(feb))
+	}
+}
+
+func Test_RoundRobinArchive_Calendar(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	day := misc.CalendarInterval{Days: 1}
+	ds := NewDataSource(DSSpec{
+		Step:      time.Hour,
+		Heartbeat: 2 * time.Hour,
+		RRAs: []RRASpec{
+			RRASpec{Function: SUM, Calendar: day, Location: ny, Span: 10 * 24 * time.Hour},
+			RRASpec{Function: WMEAN, Calendar: day, Location: ny, Span: 10 * 24 * time.Hour},
+		},
+	})
+	start := time.Date(2017, 3, 11, 0, 0, 0, 0, ny)
+	for ts := start; !ts.After(start.Add(72 * time.Hour)); ts = ts.Add(time.Hour) {
+		ds.ProcessDataPoint(1, ts)
+	}
+
+	sum, wmean := ds.RRAs()[0], ds.RRAs()[1]
+	if sum.Step() != 24*time.Hour || sum.Size() != 10 {
+		t.Errorf("NewRoundRobinArchive: unexpected step %v and size %d", sum.Step(), sum.Size())
+	}
+	if latest := time.Date(2017, 3, 14, 0, 0, 0, 0, ny); !sum.Latest().Equal(latest) {
+		t.Errorf("Latest: expected %v, got %v", latest, sum.Latest())
+	}
+	slots := sum.Slots()
+	for _, c := range []struct {
+		end time.Time
+		sum float64
+	}{
+		{time.Date(2017, 3, 12, 0, 0, 0, 0, ny), 24 * 3600},
+		{time.Date(2017, 3, 13, 0, 0, 0, 0, ny), 23 * 3600}, // DST
+		{time.Date(2017, 3, 14, 0, 0, 0, 0, ny), 24 * 3600},
+	} {
+		if got := sum.DPs()[slots.Index(c.end)]; got != c.sum {
+			t.Errorf("SUM: day ending %v: expected %v, got %v", c.end, c.sum, got)
+		}
+		if got := wmean.DPs()[slots.Index(c.end)]; got != 1 {
+			t.Errorf("WMEAN: day ending %v: expected 1, got %v", c.end, got)
+		}
+	}
+	if spec := sum.Spec(); spec.Calendar != day || spec.Location != ny {
+		t.Errorf("Spec: calendar not preserved: %v %v", spec.Calendar, spec.Location)
+	}
+	if cp := sum.Copy(); cp.Slots() != slots {
+		t.Errorf("Copy: slots not copied")
+	}
+}
+
+func Test_RoundRobinArchive_Calendar_NaN(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// A WMEAN slot exceeded by the heartbeat is NaN, whatever the
+	// actual length of the slot (23 and 25 hour DST days, months).
+	for _, c := range []struct {
+		step     time.Duration
+		calendar misc.CalendarInterval
+		gaps     [][2]time.Time
+	}{
+		{time.Hour, misc.CalendarInterval{Days: 1}, [][2]time.Time{
+			{time.Date(2017, 3, 12, 0, 0, 0, 0, ny), time.Date(2017, 3, 13, 0, 0, 0, 0, ny)},
+			{time.Date(2017, 11, 5, 0, 0, 0, 0, ny), time.Date(2017, 11, 6, 0, 0, 0, 0, ny)},
+		}},
+		{time.Hour, misc.CalendarInterval{Months: 1}, [][2]time.Time{
+			{time.Date(2017, 2, 1, 0, 0, 0, 0, ny), time.Date(2017, 3, 1, 0, 0, 0, 0, ny)},
+			{time.Date(2017, 3, 1, 0, 0, 0, 0, ny), time.Date(2017, 4, 1, 0, 0, 0, 0, ny)},
+		}},
+	} {
+		for _, gap := range c.gaps {
+			ds := NewDataSource(DSSpec{
+				Step:      c.step,
+				Heartbeat: 2 * c.step,
+				RRAs:      []RRASpec{RRASpec{Function: WMEAN, Calendar: c.calendar, Location: ny, Span: 100 * c.calendar.Approx()}},
+			})
+			for ts := gap[0].AddDate(0, 0, -3); !ts.After(gap[0]); ts = ts.Add(c.step) {
+				ds.ProcessDataPoint(1, ts)
+			}
+			for ts := gap[1]; !ts.After(gap[1].AddDate(0, 0, 3)); ts = ts.Add(c.step) {
+				ds.ProcessDataPoint(1, ts)
+			}
+			rra := ds.RRAs()[0]
+			slots := rra.Slots()
+			if got, ok := rra.DPs()[slots.Index(gap[1])]; ok {
+				t.Errorf("WMEAN: %v slot ending %v is all NaN, expected no value, got %v", c.calendar, gap[1], got)
+			}
+			if got := rra.DPs()[slots.Index(gap[0])]; got != 1 {
+				t.Errorf("WMEAN: %v slot ending %v: expected 1, got %v", c.calendar, gap[0], got)
+			}
+		}
+	}
+}
@@ -76,9 +76,15 @@ type dsRecord struct {
 	identJson  []byte
 	stepMs     int64
 	hbMs       int64
+	dsType     string
+	fill       string
+	min, max   *float64
 	lastupdate *time.Time
+	lastValue  *float64
 	value      *float64
 	durationMs *int64
+	fields     []string
+	fieldState []byte
 	seg        int64
 	idx        int64
 	created    bool
@@ -137,6 +137,10 @@ type rraRecord struct {
 	idx      int64
 	cf       string
 	xff      float32
+	seasonMs int64
+	calendar string
+	tz       string
+	field    int
 }
 
 type rraStateRecord struct {
@@ -145,4 +149,7 @@ type rraStateRecord struct {
 	latest     *time.Time
 	durationMs *int64
 	value      *float64
+	m2         *float64
+	sketch     []byte
+	hw         []byte
 }
@@ -16,6 +16,7 @@
 package serde
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -37,6 +38,7 @@ type dbSeries struct {
 	to   time.Time
 
 	// Db stuff
+	ctx  context.Context
 	db   *pgvSerDe
 	rows *sql.Rows
 
@@ -93,17 +95,13 @@ func (dps *dbSeries) Alias(s ...string) string {
 	return dps.alias
 }
 
-func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
-	var (
-		rows *sql.Rows
-		err  error
-	)
+// seriesQueryParams computes the beginning of the series aligned on
+// the group by interval, the RRA step and the group by interval,
+// which are the variable parameters of sqlSelectSeries.
+func (dps *dbSeries) seriesQueryParams() (alignedFrom time.Time, rraStepMs, finalGroupByMs int64) {
 
-	var (
-		finalGroupByMs int64
-		groupByMs      = dps.groupBy.Nanoseconds() / 1e6
-		rraStepMs      = dps.rra.Step().Nanoseconds() / 1e6
-	)
+	groupByMs := dps.groupBy.Nanoseconds() / 1e6
+	rraStepMs = dps.rra.Step().Nanoseconds() / 1e6
 
 	if dps.groupBy != 0 {
 		// Specific granularity was requested for alignment, we ignore maxPoints
@@ -121,28 +119,55 @@ func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
 		finalGroupByMs = 1000 // TODO Why would this happen (it did)?
 	}
 
+	alignedFrom = dps.from.Truncate(time.Duration(finalGroupByMs) * time.Millisecond)
+	return alignedFrom, rraStepMs, finalGroupByMs
+}
+
+// seriesQuerySql returns sqlSelectSeries with parameters substituted,
+// which is only useful for debugging.
+func (dps *dbSeries) seriesQuerySql(alignedFrom time.Time, rraStepMs, finalGroupByMs int64) string {
+	dbFormat := "2006-01-02 15:04:05 -0700"
+	return fmt.Sprintf(
+		"\nSELECT max(tg) mt, avg(r) ar\n"+
+			"   FROM generate_series('%[2]s', '%[3]s', ('%[4]s')::interval) AS tg\n"+
+			"   LEFT OUTER JOIN (SELECT t, r FROM %[1]stv tv WHERE ds_id = %[5]d AND rra_id = %[6]d\n"+
+			"     AND t >= '%[7]s' AND t <= '%[8]s') s ON tg = s.t\n"+
+			"   GROUP BY trunc((extract(epoch from tg)*1000-1))::bigint/%[9]d ORDER BY mt",
+		dps.db.prefix,
+		alignedFrom.Format(dbFormat), dps.to.Format(dbFormat), fmt.Sprintf("%d milliseconds", rraStepMs),
+		dps.ds.Id(), dps.rra.Id(), dps.from.Format(dbFormat), dps.to.Format(dbFormat),
+		finalGroupByMs)
+}
+
+// ExplainCursor describes the database query used to iterate over
+// the series without running it.
+func (dps *dbSeries) ExplainCursor() map[string]interface{} {
+	alignedFrom, rraStepMs, finalGroupByMs := dps.seriesQueryParams()
+	return map[string]interface{}{
+		"sql":          dps.seriesQuerySql(alignedFrom, rraStepMs, finalGroupByMs),
+		"ds_id":        dps.ds.Id(),
+		"rra_id":       dps.rra.Id(),
+		"aligned_from": alignedFrom,
+		"from":         dps.from,
+		"to":           dps.to,
+		"step_ms":      rraStepMs,
+		"group_by_ms":  finalGroupByMs,
+	}
+}
+
+func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
+
+	aligned_from, rraStepMs, finalGroupByMs := dps.seriesQueryParams()
+
 	// Ensure that the true group by interval is reflected in the series.
 	if finalGroupByMs != dps.groupBy.Nanoseconds()/1e6 {
 		dps.groupBy = time.Duration(finalGroupByMs) * time.Millisecond
 	}
 
-	aligned_from := dps.from.Truncate(time.Duration(finalGroupByMs) * time.Millisecond)
-
 	if debug {
-		dbFormat := "2006-01-02 15:04:05 -0700"
-		sqlStatement := fmt.Sprintf(
-			"\nSELECT max(tg) mt, avg(r) ar\n"+
-				"   FROM generate_series('%[2]s', '%[3]s', ('%[4]s')::interval) AS tg\n"+
-				"   LEFT OUTER JOIN (SELECT t, r FROM %[1]stv tv WHERE ds_id = %[5]d AND rra_id = %[6]d\n"+
-				"     AND t >= '%[7]s' AND t <= '%[8]s') s ON tg = s.t\n"+
-				"   GROUP BY trunc((extract(epoch from tg)*1000-1))::bigint/%[9]d ORDER BY mt",
-			dps.db.prefix,
-			aligned_from.Format(dbFormat), dps.to.Format(dbFormat), fmt.Sprintf("%d milliseconds", rraStepMs),
-			dps.ds.Id(), dps.rra.Id(), dps.from.Format(dbFormat), dps.to.Format(dbFormat),
-			finalGroupByMs)
-		log.Printf("seriesQuerySqlUsingViewAndSeries() sqlSelectSeries -- " + sqlStatement)
-	}
-	rows, err = dps.db.sqlSelectSeries.Query(aligned_from, dps.to, fmt.Sprintf("%d milliseconds", rraStepMs), dps.ds.Id(), dps.rra.Id(), dps.from, dps.to, finalGroupByMs)
+		log.Printf("seriesQuerySqlUsingViewAndSeries() sqlSelectSeries -- " + dps.seriesQuerySql(aligned_from, rraStepMs, finalGroupByMs))
+	}
+	rows, err := dps.db.sqlSelectSeries.QueryContext(dps.ctx, aligned_from, dps.to, fmt.Sprintf("%d milliseconds", rraStepMs), dps.ds.Id(), dps.rra.Id(), dps.from, dps.to, finalGroupByMs)
 
 	if err != nil {
 		log.Printf("seriesQuery(): error %v", err)
@@ -154,6 +179,10 @@ func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
 
 func (dps *dbSeries) Next() bool {
 
+	if dps.ctx.Err() != nil {
+		return false // canceled or timed out, caller should check ctx
+	}
+
 	if dps.rows == nil { // First Next()
 		rows, err := dps.seriesQuerySqlUsingViewAndSeries()
 		if err == nil {
@@ -16,6 +16,8 @@
 package serde
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"time"
 
@@ -25,8 +27,9 @@ import (
 
 type memSerDe struct {
 	*sync.RWMutex
-	byIdent map[string]*DbDataSource
-	lastId  int64
+	byIdent   map[string]*DbDataSource
+	lastId    int64
+	listeners []func(Ident)
 }
 
 // Returns a SerDe which keeps everything in memory.
@@ -45,17 +48,29 @@ func (m *memSerDe) EventListener() EventListener { return m }
 //func (m *memSerDe) DbAddresser() DbAddresser     { return m }
 
 func (m *memSerDe) RegisterDeleteListener(handler func(Ident)) error {
+	m.Lock()
+	defer m.Unlock()
+	m.listeners = append(m.listeners, handler)
 	return nil
 }
 
-func (m *memSerDe) FlushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (sqlOps int, err error) {
+func (m *memSerDe) notify(ident Ident) {
+	m.RLock()
+	listeners := m.listeners
+	m.RUnlock()
+	for _, handler := range listeners {
+		handler(ident)
+	}
+}
+
+func (m *memSerDe) FlushDSStates(seg int64, lastupdate, lastvalue, value, duration, fields map[int64]interface{}) (sqlOps int, err error) {
 	return 0, nil
 }
-func (m *memSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (sqlOps int, err error) {
+func (m *memSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers, sketches map[int64]interface{}) (sqlOps int, err error) {
 	return 0, nil
 }
 
-func (m *memSerDe) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (sqlOps int, err error) {
+func (m *memSerDe) FlushRRAStates(bundle_id, seg int64, latests, value, duration, m2, sketch, hw map[int64]interface{}) (sqlOps int, err error) {
 	return 0, nil
 }
 
@@ -88,8 +103,12 @@ func (m *memSerDe) Search(_ SearchQuery) (SearchResult, error) {
 	return sr, nil
 }
 
-func (*memSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
-	return series.NewRRASeries(ds.RRAs()[0]), nil
+func (*memSerDe) FetchSeries(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	fds := FieldDataSource(ctx, ds)
+	if fds == nil {
+		return nil, fmt.Errorf("FetchSeries: DS has no field %q", FieldFromContext(ctx))
+	}
+	return series.NewContextSeries(ctx, series.NewRRASeries(fds.RRAs()[0])), nil
 }
 
 func (m *memSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
@@ -109,8 +128,137 @@ func (m *memSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 	if ds, ok := m.byIdent[ident.String()]; ok {
 		return ds, nil
 	}
+	if dsSpec == nil {
+		return nil, nil // not found, and not creating
+	}
 	m.lastId++
 	ds := NewDbDataSource(m.lastId, ident, 0, 0, rrd.NewDataSource(*dsSpec))
 	m.byIdent[ident.String()] = ds
 	return ds, nil
 }
+
+func (m *memSerDe) DeleteDataSource(ident Ident) (rrd.DataSourcer, error) {
+	m.Lock()
+	ds, ok := m.byIdent[ident.String()]
+	delete(m.byIdent, ident.String())
+	m.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	m.notify(ident)
+	return ds, nil
+}
+
+func (m *memSerDe) SetHeartbeat(ident Ident, hb time.Duration) (rrd.DataSourcer, error) {
+	return m.changeDataSource(ident, func(spec *rrd.DSSpec, rras []rrd.RoundRobinArchiver) ([]rrd.RoundRobinArchiver, bool) {
+		spec.Heartbeat = hb
+		return rras, true
+	})
+}
+
+func (m *memSerDe) AddRRA(ident Ident, rraSpec rrd.RRASpec) (rrd.DataSourcer, error) {
+	return m.changeDataSource(ident, func(spec *rrd.DSSpec, rras []rrd.RoundRobinArchiver) ([]rrd.RoundRobinArchiver, bool) {
+		// Every field of a multi-value DS gets the RRA
+	specs:
+		for _, rraSpec := range (rrd.DSSpec{Fields: spec.Fields, RRAs: []rrd.RRASpec{rraSpec}}).FieldRRAs() {
+			for _, rra := range rras {
+				if sameRRASpec(rra.Spec(), rraSpec) {
+					continue specs
+				}
+			}
+			rras = append(rras, rrd.NewRoundRobinArchive(rraSpec))
+		}
+		return rras, true
+	})
+}
+
+func (m *memSerDe) RemoveRRA(ident Ident, rraSpec rrd.RRASpec) (rrd.DataSourcer, error) {
+	return m.changeDataSource(ident, func(spec *rrd.DSSpec, rras []rrd.RoundRobinArchiver) ([]rrd.RoundRobinArchiver, bool) {
+		result := make([]rrd.RoundRobinArchiver, 0, len(rras))
+		for _, rra := range rras {
+			spec := rra.Spec()
+			spec.Field = rraSpec.Field // removed from every field
+			if !sameRRASpec(spec, rraSpec) {
+				result = append(result, rra)
+			}
+		}
+		return result, len(result) < len(rras)
+	})
+}
+
+func (m *memSerDe) MigrateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	m.RLock()
+	old, ok := m.byIdent[ident.String()]
+	m.RUnlock()
+	if ok && !sameFields(old.Fields(), dsSpec.Fields) {
+		return nil, fmt.Errorf("MigrateDataSource: fields cannot be changed from %v to %v", old.Fields(), dsSpec.Fields)
+	}
+	return m.changeDataSource(ident, func(spec *rrd.DSSpec, rras []rrd.RoundRobinArchiver) ([]rrd.RoundRobinArchiver, bool) {
+		result := make([]rrd.RoundRobinArchiver, 0, len(rras))
+	specs:
+		for _, rraSpec := range dsSpec.FieldRRAs() {
+			for _, rra := range rras {
+				if sameRRASpec(rra.Spec(), rraSpec) {
+					result = append(result, rra)
+					continue specs
+				}
+			}
+			result = append(result, rrd.Resample(rraSpec, spec.Step, rras))
+		}
+		if spec.Step != dsSpec.Step {
+			spec.Value, spec.Duration = 0, 0 // the PDP is for the old step
+			for i := range spec.FieldStates {
+				spec.FieldStates[i].Value, spec.FieldStates[i].Duration = 0, 0
+			}
+		}
+		spec.Step, spec.Heartbeat, spec.Type, spec.Fill = dsSpec.Step, dsSpec.Heartbeat, dsSpec.Type, dsSpec.Fill
+		spec.Min, spec.Max = dsSpec.Min, dsSpec.Max
+		return result, true
+	})
+}
+
+// changeDataSource replaces the DS with a new one created from the
+// (possibly modified by change) spec and RRAs of the existing DS,
+// thereby preserving the data.
+func (m *memSerDe) changeDataSource(ident Ident, change func(*rrd.DSSpec, []rrd.RoundRobinArchiver) ([]rrd.RoundRobinArchiver, bool)) (rrd.DataSourcer, error) {
+	m.Lock()
+	old, ok := m.byIdent[ident.String()]
+	if !ok {
+		m.Unlock()
+		return nil, nil
+	}
+	spec := old.Spec()
+	spec.LastUpdate, spec.Value, spec.Duration = old.LastUpdate(), old.Value(), old.Duration()
+	spec.FieldStates = old.FieldStates()
+	rras, ok := change(&spec, old.Copy().RRAs())
+	if !ok {
+		m.Unlock()
+		return nil, nil
+	}
+	spec.RRAs = nil
+	nds := rrd.NewDataSource(spec)
+	nds.SetRRAs(rras)
+	ds := NewDbDataSource(old.Id(), ident, old.Seg(), old.Idx(), nds)
+	m.byIdent[ident.String()] = ds
+	m.Unlock()
+
+	m.notify(ident)
+	return ds, nil
+}
+
+func sameRRASpec(a, b rrd.RRASpec) bool {
+	return a.Function == b.Function && a.Step == b.Step && a.Span == b.Span &&
+		a.Calendar == b.Calendar && a.Location.String() == b.Location.String() && a.Field == b.Field
+}
+
+func sameFields(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdcio/tgres/rrd"
+)
+
+func Test_memSerDe_MigrateDataSource(t *testing.T) {
+	latest := time.Unix(1500000000, 0) // a multiple of 5m
+	rspec := rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour, Latest: latest, DPs: make(map[int64]float64)}
+	for k := int64(0); k < 60; k++ {
+		rspec.DPs[rrd.SlotIndex(latest.Add(-time.Duration(k)*time.Minute), time.Minute, 60)] = float64(k)
+	}
+	spec := &rrd.DSSpec{Step: time.Minute, Heartbeat: 2 * time.Minute, LastUpdate: latest, RRAs: []rrd.RRASpec{rspec}}
+
+	db := NewMemSerDe()
+	ident := Ident{"name": "mig.a"}
+	if _, err := db.FetchOrCreateDataSource(ident, spec); err != nil {
+		t.Fatal(err)
+	}
+	var notified []string
+	db.RegisterDeleteListener(func(ident Ident) { notified = append(notified, ident["name"]) })
+
+	nspec := &rrd.DSSpec{
+		Step:      time.Minute,
+		Heartbeat: 10 * time.Minute,
+		Type:      rrd.GAUGE,
+		Fill:      rrd.FillPrevious,
+		Min:       0,
+		Max:       100,
+		RRAs: []rrd.RRASpec{
+			{Function: rrd.WMEAN, Step: 5 * time.Minute, Span: time.Hour},
+			{Function: rrd.WMEAN, Step: time.Minute, Span: 30 * time.Minute},
+		},
+	}
+	ds, err := db.MigrateDataSource(ident, nspec)
+	if err != nil || ds == nil {
+		t.Fatalf("MigrateDataSource: %v %v", ds, err)
+	}
+	if len(notified) != 1 || notified[0] != "mig.a" {
+		t.Errorf("expected a notification for mig.a, got %v", notified)
+	}
+	fetched, _ := db.FetchOrCreateDataSource(ident, nil)
+	if fetched != ds {
+		t.Errorf("expected the migrated DS to replace the old one")
+	}
+	got := ds.Spec()
+	if got.Heartbeat != 10*time.Minute || got.Fill != rrd.FillPrevious || got.Min != 0 || got.Max != 100 || len(got.RRAs) != 2 {
+		t.Errorf("unexpected spec: %+v", got)
+	}
+	if !ds.LastUpdate().Equal(latest) {
+		t.Errorf("expected last update %v, got %v", latest, ds.LastUpdate())
+	}
+
+	// 5m slots are the mean of five 1m slots: (5j + 5j+4) / 2
+	rra5m := ds.RRAs()[0]
+	if rra5m.Step() != 5*time.Minute || !rra5m.Latest().Equal(latest) {
+		t.Fatalf("5m RRA: unexpected step %v latest %v", rra5m.Step(), rra5m.Latest())
+	}
+	for j := int64(0); j < 12; j++ {
+		end := latest.Add(-time.Duration(j) * 5 * time.Minute)
+		if v, ok := rra5m.DPs()[rrd.SlotIndex(end, 5*time.Minute, 12)]; !ok || v != float64(5*j+2) {
+			t.Errorf("5m RRA at %v: expected %v, got %v (%v)", end, 5*j+2, v, ok)
+		}
+	}
+	// 1m slots for half the span are unchanged
+	rra1m := ds.RRAs()[1]
+	if rra1m.Size() != 30 {
+		t.Fatalf("1m RRA: expected size 30, got %d", rra1m.Size())
+	}
+	for k := int64(0); k < 30; k++ {
+		end := latest.Add(-time.Duration(k) * time.Minute)
+		if v := rra1m.DPs()[rrd.SlotIndex(end, time.Minute, 30)]; v != float64(k) {
+			t.Errorf("1m RRA at %v: expected %v, got %v", end, k, v)
+		}
+	}
+
+	// fields cannot change, the DS is left alone
+	nspec.Fields = []string{"a", "b"}
+	if _, err := db.MigrateDataSource(ident, nspec); err == nil || !strings.Contains(err.Error(), "fields cannot be changed") {
+		t.Errorf("fields: expected an error, got %v", err)
+	}
+	if fetched, _ := db.FetchOrCreateDataSource(ident, nil); fetched != ds {
+		t.Errorf("fields: the DS should not have changed")
+	}
+
+	if ds, err := db.MigrateDataSource(Ident{"name": "mig.nosuch"}, nspec); ds != nil || err != nil {
+		t.Errorf("not found: expected nil, nil, got %v %v", ds, err)
+	}
+}
@@ -32,6 +32,7 @@
 package serde
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -40,9 +41,11 @@ import (
 	"math/rand"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/lib/pq"
+	"github.com/jdcio/tgres/misc"
 	"github.com/jdcio/tgres/rrd"
 	"github.com/jdcio/tgres/series"
 )
@@ -53,6 +56,9 @@ type pgvSerDe struct {
 	prefix  string
 	listen  *pq.Listener
 
+	lmu             sync.Mutex
+	deleteListeners []func(Ident)
+
 	sqlSelectSeries              *sql.Stmt
 	sqlSelectDSByIdent           *sql.Stmt
 	sqlInsertDS                  *sql.Stmt
@@ -177,9 +183,10 @@ func (p *pgvSerDe) prepareSqlStatements() error {
 		return err
 	}
 	if p.sqlSelectDSByIdent, err = p.dbConn.Prepare(fmt.Sprintf(
-		"SELECT id, ident, step_ms, heartbeat_ms, ds.seg, ds.idx, "+
-			"dsst.lastupdate[ds.idx] AS lastupdate, dsst.value[ds.idx] AS value, dsst.duration_ms[ds.idx] AS duration_ms, "+
-			"false AS created "+
+		"SELECT id, ident, step_ms, heartbeat_ms, type, fill, min_value, max_value, ds.seg, ds.idx, "+
+			"dsst.lastupdate[ds.idx] AS lastupdate, dsst.last_value[ds.idx] AS last_value, "+
+			"dsst.value[ds.idx] AS value, dsst.duration_ms[ds.idx] AS duration_ms, "+
+			"ds.fields, dsst.fields[ds.idx] AS field_state, false AS created "+
 			"FROM %[1]sds ds JOIN %[1]sds_state dsst ON ds.seg = dsst.seg "+
 			"WHERE ident = $1",
 		p.prefix)); err != nil {
@@ -187,11 +194,11 @@ func (p *pgvSerDe) prepareSqlStatements() error {
 	}
 	if p.sqlInsertDS, err = p.dbConn.Prepare(fmt.Sprintf(
 		// Here created is a trick to determine whether this was an INSERT or an UPDATE
-		"INSERT INTO %[1]sds AS ds (ident, step_ms, heartbeat_ms) VALUES ($1, $2, $3) "+
+		"INSERT INTO %[1]sds AS ds (ident, step_ms, heartbeat_ms, type, fill, min_value, max_value, fields) VALUES ($1, $2, $3, $4, $5, $6, $7, COALESCE($8::TEXT[], '{}')) "+
 			"ON CONFLICT (ident) DO UPDATE SET created = false "+
-			"RETURNING id, ident, step_ms, heartbeat_ms, seg, idx, "+
-			"NULL::TIMESTAMPTZ AS lastupdate, 'NaN'::DOUBLE PRECISION AS value, "+
-			"0::BIGINT AS duration_ms, created", p.prefix)); err != nil {
+			"RETURNING id, ident, step_ms, heartbeat_ms, type, fill, min_value, max_value, seg, idx, "+
+			"NULL::TIMESTAMPTZ AS lastupdate, 'NaN'::DOUBLE PRECISION AS last_value, 'NaN'::DOUBLE PRECISION AS value, "+
+			"0::BIGINT AS duration_ms, fields, NULL::BYTEA AS field_state, created", p.prefix)); err != nil {
 		return err
 	}
 	if p.sqlInsertDSState, err = p.dbConn.Prepare(fmt.Sprintf(
@@ -200,13 +207,13 @@ func (p *pgvSerDe) prepareSqlStatements() error {
 		return err
 	}
 	if p.sqlInsertRRA, err = p.dbConn.Prepare(fmt.Sprintf(
-		"INSERT INTO %[1]srra AS rra (ds_id, rra_bundle_id, pos, seg, idx, cf, xff) VALUES ($1, $2, $3, $4, $5, $6, $7) "+
-			"ON CONFLICT (ds_id, rra_bundle_id, cf) DO UPDATE SET ds_id = rra.ds_id "+
-			"RETURNING id, ds_id, rra_bundle_id, pos, seg, idx, cf, xff", p.prefix)); err != nil {
+		"INSERT INTO %[1]srra AS rra (ds_id, rra_bundle_id, pos, seg, idx, cf, xff, season_ms, calendar, tz, field) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) "+
+			"ON CONFLICT (ds_id, rra_bundle_id, cf, calendar, tz, field) DO UPDATE SET ds_id = rra.ds_id "+
+			"RETURNING id, ds_id, rra_bundle_id, pos, seg, idx, cf, xff, season_ms, calendar, tz, field", p.prefix)); err != nil {
 		return err
 	}
 	if p.sqlSelectRRAsByDsId, err = p.dbConn.Prepare(fmt.Sprintf(
-		"SELECT id, ds_id, rra_bundle_id, pos, seg, idx, cf, xff FROM %[1]srra rra WHERE ds_id = $1 ",
+		"SELECT id, ds_id, rra_bundle_id, pos, seg, idx, cf, xff, season_ms, calendar, tz, field FROM %[1]srra rra WHERE ds_id = $1 ",
 		p.prefix)); err != nil {
 		return err
 	}
@@ -227,7 +234,7 @@ func (p *pgvSerDe) prepareSqlStatements() error {
 		return err
 	}
 	if p.sqlSelectRRAState, err = p.dbConn.Prepare(fmt.Sprintf(
-		"SELECT latest[$3], value[$3], duration_ms[$3] AS latest FROM %[1]srra_state AS rl WHERE rl.rra_bundle_id = $1 AND rl.seg = $2",
+		"SELECT latest[$3], value[$3], duration_ms[$3], m2[$3], sketch[$3], hw[$3] AS latest FROM %[1]srra_state AS rl WHERE rl.rra_bundle_id = $1 AND rl.seg = $2",
 		p.prefix)); err != nil {
 		return err
 	}
@@ -249,6 +256,9 @@ func (p *pgvSerDe) createTablesIfNotExist() error {
        ident JSONB NOT NULL DEFAULT '{}' CONSTRAINT nonempty_ident CHECK (ident <> '{}'),
        step_ms BIGINT NOT NULL,
        heartbeat_ms BIGINT NOT NULL,
+       type TEXT NOT NULL DEFAULT 'GAUGE',
+       min_value DOUBLE PRECISION,
+       max_value DOUBLE PRECISION,
        seg INT NOT NULL DEFAULT (lastval()-1) / %[2]d,
        idx INT NOT NULL DEFAULT mod(lastval()-1, %[2]d)+1,
        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
@@ -260,6 +270,7 @@ func (p *pgvSerDe) createTablesIfNotExist() error {
        CREATE TABLE IF NOT EXISTS %[1]sds_state (
        seg INT NOT NULL PRIMARY KEY,
        lastupdate TIMESTAMPTZ[] NOT NULL DEFAULT '{}',
+       last_value DOUBLE PRECISION[] NOT NULL DEFAULT '{}',
        duration_ms BIGINT[] NOT NULL DEFAULT '{}',
        value DOUBLE PRECISION[] NOT NULL DEFAULT '{}');
 
@@ -277,7 +288,10 @@ func (p *pgvSerDe) createTablesIfNotExist() error {
        seg INT NOT NULL,
        latest TIMESTAMPTZ[] NOT NULL DEFAULT '{}',
        duration_ms BIGINT[] NOT NULL DEFAULT '{}',
-       value DOUBLE PRECISION[] NOT NULL DEFAULT '{}');
+       value DOUBLE PRECISION[] NOT NULL DEFAULT '{}',
+       m2 DOUBLE PRECISION[] NOT NULL DEFAULT '{}',
+       sketch BYTEA[] NOT NULL DEFAULT '{}',
+       hw BYTEA[] NOT NULL DEFAULT '{}');
 
        CREATE UNIQUE INDEX IF NOT EXISTS %[1]sidx_rra_state_bundle_id_seg ON %[1]srra_state (rra_bundle_id, seg);
 
@@ -290,17 +304,19 @@ func (p *pgvSerDe) createTablesIfNotExist() error {
        seg INT NOT NULL,
        idx INT NOT NULL,
        xff REAL NOT NULL DEFAULT 0,
+       season_ms BIGINT NOT NULL DEFAULT 0,
+       calendar TEXT NOT NULL DEFAULT '',
+       tz TEXT NOT NULL DEFAULT '',
        value DOUBLE PRECISION NOT NULL DEFAULT 'NaN',
        duration_ms BIGINT NOT NULL DEFAULT 0);
 
-       CREATE UNIQUE INDEX IF NOT EXISTS %[1]sidx_rra_rra_bundle_id ON %[1]srra (ds_id, rra_bundle_id, cf);
-
        CREATE TABLE IF NOT EXISTS %[1]sts (
        rra_bundle_id INT NOT NULL REFERENCES %[1]srra_bundle(id) ON DELETE CASCADE,
        seg INT NOT NULL,
        i INT NOT NULL,
        dp DOUBLE PRECISION[] NOT NULL DEFAULT '{}',
-       ver SMALLINT[] NOT NULL DEFAULT '{}');
+       ver SMALLINT[] NOT NULL DEFAULT '{}',
+       sk BYTEA[] NOT NULL DEFAULT '{}');
 
        CREATE UNIQUE INDEX IF NOT EXISTS %[1]sidx_ts_rra_bundle_id_seg_i ON %[1]sts (rra_bundle_id, seg, i);
 
@@ -389,6 +405,62 @@ $$;
 		return err
 	}
 
+	// DS type and the last value it requires, DS min/max, RRA STDDEV
+	// state, SKETCH RRA state and sketches, Holt-Winters RRA season
+	// and state, RRA calendar slots, multi-value DS fields and their
+	// state (calendar and field are part of the RRA unique index), DS
+	// fill policy
+	migrate_sql = `
+DO $$
+BEGIN
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]sds' and column_name='type') = 0 THEN
+    ALTER TABLE %[1]sds ADD COLUMN type TEXT NOT NULL DEFAULT 'GAUGE';
+  END IF;
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]sds_state' and column_name='last_value') = 0 THEN
+    ALTER TABLE %[1]sds_state ADD COLUMN last_value DOUBLE PRECISION[] NOT NULL DEFAULT '{}';
+  END IF;
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]sds' and column_name='min_value') = 0 THEN
+    ALTER TABLE %[1]sds ADD COLUMN min_value DOUBLE PRECISION;
+    ALTER TABLE %[1]sds ADD COLUMN max_value DOUBLE PRECISION;
+  END IF;
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]srra_state' and column_name='m2') = 0 THEN
+    ALTER TABLE %[1]srra_state ADD COLUMN m2 DOUBLE PRECISION[] NOT NULL DEFAULT '{}';
+  END IF;
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]srra_state' and column_name='sketch') = 0 THEN
+    ALTER TABLE %[1]srra_state ADD COLUMN sketch BYTEA[] NOT NULL DEFAULT '{}';
+  END IF;
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]sts' and column_name='sk') = 0 THEN
+    ALTER TABLE %[1]sts ADD COLUMN sk BYTEA[] NOT NULL DEFAULT '{}';
+  END IF;
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]srra' and column_name='season_ms') = 0 THEN
+    ALTER TABLE %[1]srra ADD COLUMN season_ms BIGINT NOT NULL DEFAULT 0;
+  END IF;
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]srra_state' and column_name='hw') = 0 THEN
+    ALTER TABLE %[1]srra_state ADD COLUMN hw BYTEA[] NOT NULL DEFAULT '{}';
+  END IF;
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]srra' and column_name='calendar') = 0 THEN
+    ALTER TABLE %[1]srra ADD COLUMN calendar TEXT NOT NULL DEFAULT '';
+    ALTER TABLE %[1]srra ADD COLUMN tz TEXT NOT NULL DEFAULT '';
+  END IF;
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]sds' and column_name='fields') = 0 THEN
+    ALTER TABLE %[1]sds ADD COLUMN fields TEXT[] NOT NULL DEFAULT '{}';
+    ALTER TABLE %[1]sds_state ADD COLUMN fields BYTEA[] NOT NULL DEFAULT '{}';
+    ALTER TABLE %[1]srra ADD COLUMN field INT NOT NULL DEFAULT 0;
+  END IF;
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]sds' and column_name='fill') = 0 THEN
+    ALTER TABLE %[1]sds ADD COLUMN fill TEXT NOT NULL DEFAULT 'NaN';
+  END IF;
+  DROP INDEX IF EXISTS %[1]sidx_rra_rra_bundle_id;
+  DROP INDEX IF EXISTS %[1]sidx_rra_ds_id_rra_bundle_id;
+  CREATE UNIQUE INDEX IF NOT EXISTS %[1]sidx_rra_ds_id_rra_bundle_id_field ON %[1]srra (ds_id, rra_bundle_id, cf, calendar, tz, field);
+END
+$$;
+`
+	if _, err := p.dbConn.Exec(fmt.Sprintf(migrate_sql, p.prefix)); err != nil {
+		log.Printf("ERROR: migrate failed: %v", err)
+		return err
+	}
+
 	// NB: BEGIN > DROP > CREATE > COMMIT is the equivalent of CREATE OR REPLACE
 	// See https://wiki.postgresql.org/wiki/Transactional_DDL_in_PostgreSQL:_A_Competitive_Analysis
 
@@ -398,8 +470,9 @@ BEGIN;
 -- a view do simplify looking at DSs
 DROP VIEW IF EXISTS %[1]sdsv;
 CREATE VIEW %[1]sdsv AS
-  SELECT id, ident, step_ms, heartbeat_ms, created_at,
+  SELECT id, ident, step_ms, heartbeat_ms, type, fill, min_value, max_value, fields, created_at,
          dss.lastupdate[ds.idx] AS lastupdate,
+         dss.last_value[ds.idx] AS last_value,
          dss.value[ds.idx] AS value,
          dss.duration_ms[ds.idx] AS duration_ms,
          ds.seg, idx
@@ -410,7 +483,7 @@ CREATE VIEW %[1]sdsv AS
 -- a view to simplify looking at RRAs
 DROP VIEW IF EXISTS %[1]srrav;
 CREATE VIEW %[1]srrav AS
-  SELECT rra.id, ds_id, cf, xff, size,
+  SELECT rra.id, ds_id, field, cf, xff, season_ms, calendar, tz, size,
          '00:00:00.001'::interval * step_ms AS step,
          '00:00:00.001'::interval * step_ms * size AS span,
          rs.latest[rra.idx] AS latest,
@@ -546,7 +619,7 @@ func rraBundleRecordFromRow(rows *sql.Rows) (*rraBundleRecord, error) {
 func rraRecordFromRow(rows *sql.Rows) (*rraRecord, error) {
 
 	var rra rraRecord
-	err := rows.Scan(&rra.id, &rra.dsId, &rra.bundleId, &rra.pos, &rra.seg, &rra.idx, &rra.cf, &rra.xff)
+	err := rows.Scan(&rra.id, &rra.dsId, &rra.bundleId, &rra.pos, &rra.seg, &rra.idx, &rra.cf, &rra.xff, &rra.seasonMs, &rra.calendar, &rra.tz, &rra.field)
 	if err != nil {
 		log.Printf("rraRecordFromRow(): error scanning row: %v", err)
 		return nil, err
@@ -574,22 +647,39 @@ func rraFromRRARecordStateAndBundle(rraRec *rraRecord, stateRec *rraStateRecord,
 		Step:     time.Duration(bundle.stepMs) * time.Millisecond,
 		Span:     time.Duration(bundle.stepMs*bundle.size) * time.Millisecond,
 		Xff:      rraRec.xff,
+		Season:   time.Duration(rraRec.seasonMs) * time.Millisecond,
 		Latest:   *stateRec.latest,
 		Value:    *stateRec.value,
 		Duration: time.Duration(*stateRec.durationMs) * time.Millisecond,
+		Field:    rraRec.field,
+	}
+	if stateRec.m2 != nil {
+		spec.M2 = *stateRec.m2
+	}
+	if len(stateRec.sketch) > 0 {
+		spec.Sketch = new(rrd.Sketch)
+		if err := spec.Sketch.UnmarshalBinary(stateRec.sketch); err != nil {
+			return nil, fmt.Errorf("rraFromRRARecordAndBundle(): %v", err)
+		}
+	}
+	if len(stateRec.hw) > 0 {
+		spec.HoltWinters = new(rrd.HoltWinters)
+		if err := spec.HoltWinters.UnmarshalBinary(stateRec.hw); err != nil {
+			return nil, fmt.Errorf("rraFromRRARecordAndBundle(): %v", err)
+		}
 	}
 
-	switch strings.ToUpper(rraRec.cf) {
-	case "WMEAN":
-		spec.Function = rrd.WMEAN
-	case "MIN":
-		spec.Function = rrd.MIN
-	case "MAX":
-		spec.Function = rrd.MAX
-	case "LAST":
-		spec.Function = rrd.LAST
-	default:
-		return nil, fmt.Errorf("rraFromRRARecordAndBundle(): Invalid cf: %q (valid funcs: wmean, min, max, last)", rraRec.cf)
+	var err error
+	if spec.Function, err = rrd.ParseConsolidation(rraRec.cf); err != nil {
+		return nil, fmt.Errorf("rraFromRRARecordAndBundle(): %v", err)
+	}
+	if rraRec.calendar != "" {
+		if spec.Calendar, err = misc.ParseCalendarInterval(rraRec.calendar); err != nil {
+			return nil, fmt.Errorf("rraFromRRARecordAndBundle(): %v", err)
+		}
+		if spec.Location, err = time.LoadLocation(rraRec.tz); err != nil {
+			return nil, fmt.Errorf("rraFromRRARecordAndBundle(): %v", err)
+		}
 	}
 
 	rra, err := newDbRoundRobinArchive(rraRec.id, bundle.width, bundle.id, rraRec.pos, spec)
@@ -629,31 +719,41 @@ func (p *pgvSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
 	// I'm not exactly sure why.
 	const sql = `
 WITH rra AS (
-  SELECT rra.id, rra.ds_id, rra.rra_bundle_id, rra.pos, rra.seg, rra.idx, rra.cf, rra.xff,
+  SELECT rra.id, rra.ds_id, rra.rra_bundle_id, rra.pos, rra.seg, rra.idx, rra.cf, rra.xff, rra.season_ms, rra.calendar, rra.tz, rra.field,
          rs.latest[rra.idx] AS latest, rs.value[rra.idx] AS value, rs.duration_ms[rra.idx] AS duration_ms,
+         rs.m2[rra.idx] AS m2, rs.sketch[rra.idx] AS sketch, rs.hw[rra.idx] AS hw,
          b.step_ms, b.size, b.width
     FROM %[1]srra
     JOIN %[1]srra_bundle b ON b.id = rra.rra_bundle_id
     LEFT OUTER JOIN %[1]srra_state AS rs ON rs.rra_bundle_id = rra.rra_bundle_id AND rs.seg = rra.seg
 ), ds AS (
   SELECT ds.id, ds.ident, ds.step_ms,
-         ds.heartbeat_ms, ds.seg, ds.idx,
+         ds.heartbeat_ms, ds.type, ds.fill, ds.min_value, ds.max_value, ds.seg, ds.idx,
          dsst.lastupdate[ds.idx] AS lastupdate,
+         dsst.last_value[ds.idx] AS last_value,
          dsst.value[ds.idx] AS ds_value,
-         dsst.duration_ms[ds.idx] AS ds_duration_ms
+         dsst.duration_ms[ds.idx] AS ds_duration_ms,
+         ds.fields,
+         dsst.fields[ds.idx] AS field_state
    FROM %[1]sds ds
    LEFT OUTER JOIN %[1]sds_state dsst ON ds.seg = dsst.seg
 )
 SELECT ds.id, ds.ident, ds.step_ms,
-           ds.heartbeat_ms, ds.seg, ds.idx,
+           ds.heartbeat_ms, ds.type, ds.fill, ds.min_value, ds.max_value, ds.seg, ds.idx,
            ds.lastupdate,
+           ds.last_value,
            ds.ds_value,
            ds.ds_duration_ms,
-           rra.id, rra.rra_bundle_id, rra.pos, rra.seg, rra.idx, rra.cf, rra.xff,
+           ds.fields,
+           ds.field_state,
+           rra.id, rra.rra_bundle_id, rra.pos, rra.seg, rra.idx, rra.cf, rra.xff, rra.season_ms, rra.calendar, rra.tz, rra.field,
            rra.step_ms, rra.size, rra.width,
            rra.latest,
            rra.value,
-           rra.duration_ms
+           rra.duration_ms,
+           rra.m2,
+           rra.sketch,
+           rra.hw
     FROM ds ds
     JOIN rra rra ON rra.ds_id = ds.id
     ORDER BY ds.id;
@@ -687,10 +787,11 @@ SELECT ds.id, ds.ident, ds.step_ms,
 		)
 
 		err = rows.Scan(
-			&dsr.id, &dsr.identJson, &dsr.stepMs, &dsr.hbMs, &dsr.seg, &dsr.idx, &dsr.lastupdate, &dsr.value, &dsr.durationMs, // DS
-			&rrar.id, &rrar.bundleId, &rrar.pos, &rrar.seg, &rrar.idx, &rrar.cf, &rrar.xff, // RRA
+			&dsr.id, &dsr.identJson, &dsr.stepMs, &dsr.hbMs, &dsr.dsType, &dsr.fill, &dsr.min, &dsr.max, &dsr.seg, &dsr.idx, &dsr.lastupdate, &dsr.lastValue, &dsr.value, &dsr.durationMs, // DS
+			pq.Array(&dsr.fields), &dsr.fieldState, // DS fields
+			&rrar.id, &rrar.bundleId, &rrar.pos, &rrar.seg, &rrar.idx, &rrar.cf, &rrar.xff, &rrar.seasonMs, &rrar.calendar, &rrar.tz, &rrar.field, // RRA
 			&bundle.stepMs, &bundle.size, &bundle.width, // Bundle
-			&state.latest, &state.value, &state.durationMs) // RRA State
+			&state.latest, &state.value, &state.durationMs, &state.m2, &state.sketch, &state.hw) // RRA State
 		if err != nil {
 			return nil, fmt.Errorf("error scanning: %v", err)
 		}
@@ -809,7 +910,7 @@ func (p *pgvSerDe) fetchRRAState(bundleId, seg, idx int64) (*rraStateRecord, err
 
 	if rows.Next() {
 		var state rraStateRecord
-		if err := rows.Scan(&state.latest, &state.value, &state.durationMs); err != nil {
+		if err := rows.Scan(&state.latest, &state.value, &state.durationMs, &state.m2, &state.sketch, &state.hw); err != nil {
 			log.Printf("fetchRRAState(): error scanning: %v", err)
 			return nil, err
 		}
@@ -863,11 +964,13 @@ func (p *pgvSerDe) fetchRoundRobinArchives(ds *DbDataSource) ([]rrd.RoundRobinAr
 	return rras, nil
 }
 
-func (p *pgvSerDe) FlushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (sqlOps int, err error) {
+func (p *pgvSerDe) FlushDSStates(seg int64, lastupdate, lastvalue, value, duration, fields map[int64]interface{}) (sqlOps int, err error) {
 
 	luChunks := arrayUpdateChunks(lastupdate)
+	lvChunks := arrayUpdateChunks(lastvalue)
 	durChunks := arrayUpdateChunks(duration)
 	valChunks := arrayUpdateChunks(value)
+	fldChunks := arrayUpdateChunks(byteaElems(fields))
 
 	offset := 2
 	dest1, args := singleStmtUpdateArgs(luChunks, "lastupdate", offset, []interface{}{seg})
@@ -875,8 +978,12 @@ func (p *pgvSerDe) FlushDSStates(seg int64, lastupdate, value, duration map[int6
 	dest2, args := singleStmtUpdateArgs(valChunks, "value", offset, args)
 	offset += 3 * len(valChunks)
 	dest3, args := singleStmtUpdateArgs(durChunks, "duration_ms", offset, args)
+	offset += 3 * len(durChunks)
+	dest4, args := singleStmtUpdateArgs(lvChunks, "last_value", offset, args)
+	offset += 3 * len(lvChunks)
+	dest5, args := singleStmtUpdateArgs(fldChunks, "fields", offset, args)
 
-	stmt := fmt.Sprintf("UPDATE %[1]sds_state AS dss SET %s, %s, %s WHERE seg = $1", p.prefix, dest1, dest2, dest3)
+	stmt := fmt.Sprintf("UPDATE %[1]sds_state AS dss SET %s, %s, %s, %s, %s WHERE seg = $1", p.prefix, dest1, dest2, dest3, dest4, dest5)
 	res, err := p.dbConn.Exec(stmt, args...)
 	if err != nil {
 		return 0, err
@@ -898,7 +1005,22 @@ func (p *pgvSerDe) FlushDSStates(seg int64, lastupdate, value, duration map[int6
 	return sqlOps, nil
 }
 
-func (p *pgvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (sqlOps int, err error) {
+func (p *pgvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers, sketches map[int64]interface{}) (sqlOps int, err error) {
+	if sqlOps, err = p.flushDataPoints(bundle_id, seg, i, dps, vers); err != nil || len(sketches) == 0 {
+		return sqlOps, err
+	}
+
+	// Sketches are only in slots which have a data point, so the row
+	// exists by now, and the version is that of the data point.
+	dest, args := singleStmtUpdateArgs(arrayUpdateChunks(byteaElems(sketches)), "sk", 4, []interface{}{bundle_id, seg, i})
+	stmt := fmt.Sprintf("UPDATE %[1]sts AS ts SET %s WHERE rra_bundle_id = $1 AND seg = $2 AND i = $3", p.prefix, dest)
+	if _, err = p.dbConn.Exec(stmt, args...); err != nil {
+		return sqlOps, err
+	}
+	return sqlOps + 1, nil
+}
+
+func (p *pgvSerDe) flushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (sqlOps int, err error) {
 	// Due to the way PG array syntax works, we use two different
 	// methods of updating data points. When the data points updated
 	// are *one* contiguous chunk, we can use the form array[a:b] =
@@ -990,11 +1112,14 @@ func (p *pgvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]
 	}
 }
 
-func (p *pgvSerDe) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (sqlOps int, err error) {
+func (p *pgvSerDe) FlushRRAStates(bundle_id, seg int64, latests, value, duration, m2, sketch, hw map[int64]interface{}) (sqlOps int, err error) {
 
 	latChunks := arrayUpdateChunks(latests)
 	valChunks := arrayUpdateChunks(value)
 	durChunks := arrayUpdateChunks(duration)
+	m2Chunks := arrayUpdateChunks(m2)
+	skChunks := arrayUpdateChunks(byteaElems(sketch))
+	hwChunks := arrayUpdateChunks(byteaElems(hw))
 
 	offset := 3
 	dest1, args := singleStmtUpdateArgs(latChunks, "latest", offset, []interface{}{bundle_id, seg})
@@ -1002,8 +1127,14 @@ func (p *pgvSerDe) FlushRRAStates(bundle_id, seg int64, latests, value, duration
 	dest2, args := singleStmtUpdateArgs(valChunks, "value", offset, args)
 	offset += 3 * len(valChunks)
 	dest3, args := singleStmtUpdateArgs(durChunks, "duration_ms", offset, args)
-
-	stmt := fmt.Sprintf("UPDATE %[1]srra_state AS rra_state SET %s, %s, %s WHERE rra_bundle_id = $1 AND seg = $2", p.prefix, dest1, dest2, dest3)
+	offset += 3 * len(durChunks)
+	dest4, args := singleStmtUpdateArgs(m2Chunks, "m2", offset, args)
+	offset += 3 * len(m2Chunks)
+	dest5, args := singleStmtUpdateArgs(skChunks, "sketch", offset, args)
+	offset += 3 * len(skChunks)
+	dest6, args := singleStmtUpdateArgs(hwChunks, "hw", offset, args)
+
+	stmt := fmt.Sprintf("UPDATE %[1]srra_state AS rra_state SET %s, %s, %s, %s, %s, %s WHERE rra_bundle_id = $1 AND seg = $2", p.prefix, dest1, dest2, dest3, dest4, dest5, dest6)
 	res, err := p.dbConn.Exec(stmt, args...)
 	if err != nil {
 		return 0, err
@@ -1068,12 +1199,16 @@ func (p *pgvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 	if err != nil {
 		return nil, err
 	}
-	if ds != nil || dsSpec == nil {
-		return ds, err
+	if ds != nil {
+		return ds, nil
+	}
+	if dsSpec == nil {
+		return nil, nil // not found, and not creating
 	}
 
 	// Now try INSERT
-	rows, err = p.sqlInsertDS.Query(ident.String(), dsSpec.Step.Nanoseconds()/1000000, dsSpec.Heartbeat.Nanoseconds()/1000000)
+	rows, err = p.sqlInsertDS.Query(ident.String(), dsSpec.Step.Nanoseconds()/1000000, dsSpec.Heartbeat.Nanoseconds()/1000000, dsSpec.Type.String(),
+		dsSpec.Fill.String(), boundArg(dsSpec.Min, dsSpec.Max, dsSpec.Min), boundArg(dsSpec.Min, dsSpec.Max, dsSpec.Max), pq.Array(dsSpec.Fields))
 	if err != nil {
 		log.Printf("FetchOrCreateDataSource(): error querying database: %v", err)
 		return nil, err
@@ -1106,78 +1241,15 @@ func (p *pgvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 		return nil, err
 	}
 
-	// RRAs
+	// RRAs (for every field of a multi-value DS)
 	var rras []rrd.RoundRobinArchiver
-	for _, rraSpec := range dsSpec.RRAs {
-		stepMs := rraSpec.Step.Nanoseconds() / 1000000
-		size := rraSpec.Span.Nanoseconds() / rraSpec.Step.Nanoseconds()
-		var cf string
-		switch rraSpec.Function {
-		case rrd.WMEAN:
-			cf = "WMEAN"
-		case rrd.MIN:
-			cf = "MIN"
-		case rrd.MAX:
-			cf = "MAX"
-		case rrd.LAST:
-			cf = "LAST"
-		}
-
-		// rra_bundle
-		var bundle *rraBundleRecord
-		bundle, err = p.fetchOrCreateRRABundle(tx, stepMs, size)
-		if err != nil {
-			log.Printf("FetchOrCreateDataSource(): error creating RRA bundle: %v", err)
-			tx.Rollback()
-			return nil, err
-		}
-
-		// Get the next position for this bundle TODO: If the DS was
-		// not created (upsert), there is a possibity that we're
-		// incrementing this in vain, the position will be wasted if
-		// the rra already exists.
-		pos, err := p.rraBundleIncrPos(tx, bundle.id)
-		if err != nil {
-			log.Printf("FetchOrCreateDataSource(): error incrementing last_pos in RRA bundle: %v", err)
-			tx.Rollback()
-			return nil, err
-		}
-
-		// rra
-		var rraRows *sql.Rows
-		seg, idx := segIdxFromPosWidth(pos, bundle.width)
-		rraRows, err = tx.Stmt(p.sqlInsertRRA).Query(ds.Id(), bundle.id, pos, seg, idx, cf, rraSpec.Xff)
-		if err != nil {
-			log.Printf("FetchOrCreateDataSource(): error creating RRAs: %v", err)
-			tx.Rollback()
-			return nil, err
-		}
-		rraRows.Next()
-
-		var rraRec *rraRecord
-		rraRec, err = rraRecordFromRow(rraRows)
-		rraRows.Close()
-		if err != nil {
-			log.Printf("FetchOrCreateDataSource(): error2: %v", err)
-			tx.Rollback()
-			return nil, err
-		}
-
-		dur := rraSpec.Duration.Nanoseconds() / 1e6
-		rraState := &rraStateRecord{
-			latest:     &rraSpec.Latest,
-			durationMs: &dur,
-			value:      &rraSpec.Value,
-		}
-
+	for _, rraSpec := range dsSpec.FieldRRAs() {
 		var rra *DbRoundRobinArchive
-		rra, err = rraFromRRARecordStateAndBundle(rraRec, rraState, bundle)
-		if err != nil {
-			log.Printf("FetchOrCreateDataSource(): error3: %v", err)
+		if rra, err = p.createRRA(tx, ds.Id(), rraSpec); err != nil {
+			log.Printf("FetchOrCreateDataSource(): error creating RRA: %v", err)
 			tx.Rollback()
 			return nil, err
 		}
-
 		rras = append(rras, rra)
 	}
 	ds.SetRRAs(rras)
@@ -1190,18 +1262,101 @@ func (p *pgvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 	return ds, nil
 }
 
-func (p *pgvSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+// rraCalendar returns the calendar and tz columns of an RRA, both
+// empty unless the RRA has calendar slots.
+func rraCalendar(rraSpec rrd.RRASpec) (calendar, tz string) {
+	if rraSpec.Calendar.Days > 0 || rraSpec.Calendar.Months > 0 {
+		return rraSpec.Calendar.String(), rraSpec.Location.String()
+	}
+	return "", ""
+}
+
+// createRRA creates an RRA for the DS given by dsId as part of the
+// transaction tx. The RRA state is not written to the database, it is
+// up to the flusher to do that.
+func (p *pgvSerDe) createRRA(tx *sql.Tx, dsId int64, rraSpec rrd.RRASpec) (*DbRoundRobinArchive, error) {
+	stepMs := rraSpec.Step.Nanoseconds() / 1000000
+	size := rraSpec.Span.Nanoseconds() / rraSpec.Step.Nanoseconds()
+	cf := rraSpec.Function.String()
+	calendar, tz := rraCalendar(rraSpec)
+
+	// rra_bundle
+	bundle, err := p.fetchOrCreateRRABundle(tx, stepMs, size)
+	if err != nil {
+		log.Printf("createRRA(): error creating RRA bundle: %v", err)
+		return nil, err
+	}
+
+	// Get the next position for this bundle TODO: If the DS was
+	// not created (upsert), there is a possibity that we're
+	// incrementing this in vain, the position will be wasted if
+	// the rra already exists.
+	pos, err := p.rraBundleIncrPos(tx, bundle.id)
+	if err != nil {
+		log.Printf("createRRA(): error incrementing last_pos in RRA bundle: %v", err)
+		return nil, err
+	}
+
+	// rra
+	seg, idx := segIdxFromPosWidth(pos, bundle.width)
+	rraRows, err := tx.Stmt(p.sqlInsertRRA).Query(dsId, bundle.id, pos, seg, idx, cf, rraSpec.Xff, rraSpec.Season.Nanoseconds()/1e6, calendar, tz, rraSpec.Field)
+	if err != nil {
+		log.Printf("createRRA(): error creating RRAs: %v", err)
+		return nil, err
+	}
+	rraRows.Next()
+
+	rraRec, err := rraRecordFromRow(rraRows)
+	rraRows.Close()
+	if err != nil {
+		log.Printf("createRRA(): error2: %v", err)
+		return nil, err
+	}
+
+	dur := rraSpec.Duration.Nanoseconds() / 1e6
+	rraState := &rraStateRecord{
+		latest:     &rraSpec.Latest,
+		durationMs: &dur,
+		value:      &rraSpec.Value,
+	}
+
+	rra, err := rraFromRRARecordStateAndBundle(rraRec, rraState, bundle)
+	if err != nil {
+		log.Printf("createRRA(): error3: %v", err)
+		return nil, err
+	}
+	return rra, nil
+}
+
+func (p *pgvSerDe) FetchSeries(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
 
 	dbds, ok := ds.(DbDataSourcer)
 	if !ok {
 		return nil, fmt.Errorf("FetchSeries: ds must be a DbDataSourcer")
 	}
 
-	rra := dbds.BestRRA(from, to, maxPoints)
+	fds := FieldDataSource(ctx, dbds)
+	if fds == nil {
+		return nil, fmt.Errorf("FetchSeries: DS id: %v has no field %q", dbds.Id(), FieldFromContext(ctx))
+	}
+	rra := fds.BestRRAByCF(from, to, maxPoints, ConsolidationFromContext(ctx))
 	if rra == nil {
 		return nil, fmt.Errorf("FetchSeries: No adequate RRA found for DS id: %v from: %v to: %v maxPoints: %v", dbds.Id(), from, to, maxPoints)
 	}
 
+	// The tv view cannot compute the time of calendar slots, the
+	// data is loaded and served from memory instead.
+	if rra.Slots().IsCalendar() {
+		if rra, err := p.LoadRRAData(rra); err != nil {
+			return nil, err
+		} else {
+			s := series.NewRRASeries(rra)
+			s.TimeRange(from, to)
+			s.MaxPoints(maxPoints)
+			return series.NewContextSeries(ctx, s), nil
+		}
+	}
+
 	// If from/to are nil - assign the rra boundaries
 	rraEarliest := rra.Begins(rra.Latest())
 
@@ -1214,10 +1369,40 @@ func (p *pgvSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints
 		return nil, fmt.Errorf("FetchSeries: rra must be a DbRoundRobinArchive")
 	}
 
-	dps := &dbSeries{db: p, ds: dbds, rra: dbrra, from: from, to: to, maxPoints: maxPoints}
+	dps := &dbSeries{ctx: ctx, db: p, ds: dbds, rra: dbrra, from: from, to: to, maxPoints: maxPoints}
 	return dps, nil
 }
 
+// rraVersions returns the latest slot index and the versions of the
+// slots up to it and after it (which are from the previous round).
+func rraVersions(rra rrd.RoundRobinArchiver) (latest_i int64, latestVer, prevVer int) {
+	slots := rra.Slots()
+	latest_i = slots.Index(rra.Latest())
+	latestVer = slots.Version(rra.Latest())
+	prevVer = latestVer - 1
+	if prevVer == -1 {
+		prevVer = 32767
+	}
+	return latest_i, latestVer, prevVer
+}
+
+// FetchSketches returns the SKETCH RRA of ds best suited for the time
+// range and maxPoints, with its sketches loaded.
+func (p *pgvSerDe) FetchSketches(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (rrd.RoundRobinArchiver, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fds := FieldDataSource(ctx, ds)
+	if fds == nil {
+		return nil, fmt.Errorf("FetchSketches: DS has no field %q", FieldFromContext(ctx))
+	}
+	rra := fds.BestRRAByCF(from, to, maxPoints, rrd.SKETCH)
+	if rra == nil || rra.Spec().Function != rrd.SKETCH {
+		return nil, fmt.Errorf("FetchSketches: DS has no SKETCH RRA")
+	}
+	return p.LoadRRAData(rra)
+}
+
 func (p *pgvSerDe) loadRRADps(rra *DbRoundRobinArchive) (map[int64]float64, error) {
 	// the subselect apparently encourages index scan
 	stmt := `
@@ -1227,15 +1412,7 @@ func (p *pgvSerDe) loadRRADps(rra *DbRoundRobinArchive) (map[int64]float64, erro
            WHERE rra_bundle_id = $2 AND seg = $3 AND dp[$1] IS NOT NULL AND dp[$1] <> 'NaN') x
     WHERE (i <= $4) AND v = $5 OR (i > $4) AND v = $6
 `
-	// TODO There should be a centralized place for version calculation
-	latest_i := rrd.SlotIndex(rra.Latest(), rra.Step(), rra.Size())
-	span_ms := (rra.Step().Nanoseconds() / 1e6) * rra.Size()
-	latest_ms := rra.Latest().UnixNano() / 1e6
-	latestVer := int((latest_ms / span_ms) % 32767)
-	prevVer := latestVer - 1
-	if prevVer == -1 {
-		prevVer = 32767
-	}
+	latest_i, latestVer, prevVer := rraVersions(rra)
 
 	rows, err := p.dbConn.Query(fmt.Sprintf(stmt, p.prefix), rra.Idx(), rra.BundleId(), rra.Seg(), latest_i, latestVer, prevVer)
 	if err != nil {
@@ -1262,13 +1439,51 @@ func (p *pgvSerDe) loadRRADps(rra *DbRoundRobinArchive) (map[int64]float64, erro
 	return dps, nil
 }
 
+func (p *pgvSerDe) loadRRASketches(rra *DbRoundRobinArchive) (map[int64]*rrd.Sketch, error) {
+	stmt := `
+  SELECT i, s
+    FROM (SELECT i, sk[$1] AS s, ver[$1] AS v
+            FROM %[1]sts ts
+           WHERE rra_bundle_id = $2 AND seg = $3 AND sk[$1] IS NOT NULL) x
+    WHERE (i <= $4) AND v = $5 OR (i > $4) AND v = $6
+`
+	latest_i, latestVer, prevVer := rraVersions(rra)
+
+	rows, err := p.dbConn.Query(fmt.Sprintf(stmt, p.prefix), rra.Idx(), rra.BundleId(), rra.Seg(), latest_i, latestVer, prevVer)
+	if err != nil {
+		log.Printf("loadRRASketches: error %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	sketches := make(map[int64]*rrd.Sketch)
+	for rows.Next() {
+		var (
+			i    int64
+			data []byte
+		)
+		if err = rows.Scan(&i, &data); err != nil {
+			log.Printf("loadRRASketches: error scanning %v", err)
+			return nil, err
+		}
+		sk := new(rrd.Sketch)
+		if err = sk.UnmarshalBinary(data); err != nil {
+			log.Printf("loadRRASketches: slot %d: %v", i, err)
+			continue
+		}
+		sketches[i] = sk
+	}
+	return sketches, nil
+}
+
 // Returns a *new* RRA based on the one passed in, containing all the data.
 // If the database is behind and data has not been saved yet, the version system
 // will correct for it, latest does not have to be spot on accurate.
 func (p *pgvSerDe) LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error) {
 	var (
-		dps map[int64]float64
-		err error
+		dps      map[int64]float64
+		sketches map[int64]*rrd.Sketch
+		err      error
 	)
 
 	dbrra, ok := rra.(*DbRoundRobinArchive)
@@ -1281,13 +1496,27 @@ func (p *pgvSerDe) LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiv
 			log.Printf("LoadRRAData: error loading data points %v", err)
 			return nil, err
 		}
+		if dbrra.Spec().Function == rrd.SKETCH {
+			if sketches, err = p.loadRRASketches(dbrra); err != nil {
+				log.Printf("LoadRRAData: error loading sketches %v", err)
+				return nil, err
+			}
+		}
 	}
 
 	spec := dbrra.Spec()
 	spec.Latest = dbrra.Latest()
 	spec.Value = dbrra.Value()
 	spec.Duration = dbrra.Duration()
+	spec.M2 = dbrra.M2()
 	spec.DPs = dps // could be nil if latest is zero
+	spec.Sketches = sketches
+	if sk := dbrra.Sketch(); sk != nil {
+		spec.Sketch = sk.Copy()
+	}
+	if hw := dbrra.HoltWinters(); hw != nil {
+		spec.HoltWinters = hw.Copy()
+	}
 
 	newrra, err := newDbRoundRobinArchive(dbrra.id, dbrra.width, dbrra.bundleId, dbrra.pos, spec)
 	if err != nil {
@@ -1341,18 +1570,297 @@ func (p *pgvSerDe) rraBundleIncrPos(tx *sql.Tx, id int64) (int64, error) {
 	return 0, fmt.Errorf("rraBundleIncrPos: could not increment pos?")
 }
 
+// DS admin (serde.DataSourceAdmin)
+
+// DeleteDataSource deletes the DS along with its RRAs. The delete
+// notification is sent by the ds_delete_trigger.
+func (p *pgvSerDe) DeleteDataSource(ident Ident) (rrd.DataSourcer, error) {
+	ds, err := p.fetchDataSource(ident)
+	if err != nil || ds == nil {
+		return nil, err
+	}
+	stmt := fmt.Sprintf("DELETE FROM %[1]sds WHERE id = $1", p.prefix)
+	if _, err := p.dbConn.Exec(stmt, ds.Id()); err != nil {
+		log.Printf("DeleteDataSource(): %v", err)
+		return nil, err
+	}
+	return ds, nil
+}
+
+func (p *pgvSerDe) SetHeartbeat(ident Ident, hb time.Duration) (rrd.DataSourcer, error) {
+	return p.changeDataSource(ident, func(tx *sql.Tx, ds *DbDataSource) (bool, error) {
+		stmt := fmt.Sprintf("UPDATE %[1]sds SET heartbeat_ms = $2 WHERE id = $1", p.prefix)
+		_, err := tx.Exec(stmt, ds.Id(), hb.Nanoseconds()/1000000)
+		return true, err
+	})
+}
+
+func (p *pgvSerDe) AddRRA(ident Ident, spec rrd.RRASpec) (rrd.DataSourcer, error) {
+	return p.changeDataSource(ident, func(tx *sql.Tx, ds *DbDataSource) (bool, error) {
+		// Every field of a multi-value DS gets the RRA
+		specs := rrd.DSSpec{Fields: ds.Fields(), RRAs: []rrd.RRASpec{spec}}.FieldRRAs()
+	specs:
+		for _, spec := range specs {
+			for _, rra := range ds.RRAs() {
+				if sameRRASpec(rra.Spec(), spec) {
+					continue specs // already there
+				}
+			}
+			if _, err := p.createRRA(tx, ds.Id(), spec); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+}
+
+func (p *pgvSerDe) RemoveRRA(ident Ident, spec rrd.RRASpec) (rrd.DataSourcer, error) {
+	return p.changeDataSource(ident, func(tx *sql.Tx, ds *DbDataSource) (bool, error) {
+		// The RRA is removed from every field, there can be at most
+		// one per field.
+		fields := make([]int64, len(ds.Fields()))
+		for i := range fields {
+			fields[i] = int64(i)
+		}
+		if len(fields) == 0 {
+			fields = []int64{0}
+		}
+		calendar, tz := rraCalendar(spec)
+		stmt := fmt.Sprintf("DELETE FROM %[1]srra rra USING %[1]srra_bundle rb "+
+			"WHERE rra.rra_bundle_id = rb.id AND rra.ds_id = $1 AND rra.cf = $2 AND rb.step_ms = $3 AND rb.size = $4 "+
+			"AND rra.calendar = $5 AND rra.tz = $6 AND rra.field = ANY($7)", p.prefix)
+		res, err := tx.Exec(stmt, ds.Id(), spec.Function.String(),
+			spec.Step.Nanoseconds()/1000000, spec.Span.Nanoseconds()/spec.Step.Nanoseconds(),
+			calendar, tz, pq.Array(fields))
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		if err == nil && n > int64(len(fields)) {
+			err = fmt.Errorf("RemoveRRA: %d RRAs match %v:%v:%v for fields %v, expected at most %d", n, spec.Function, spec.Step, spec.Span, fields, len(fields))
+		}
+		return n > 0, err
+	})
+}
+
+// MigrateDataSource changes the DS to spec within one transaction. The
+// data of new RRAs is resampled from the existing RRAs as last
+// flushed, and written directly to the ts and rra_state tables.
+func (p *pgvSerDe) MigrateDataSource(ident Ident, spec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	return p.changeDataSource(ident, func(tx *sql.Tx, ds *DbDataSource) (bool, error) {
+		if !sameFields(ds.Fields(), spec.Fields) {
+			return false, fmt.Errorf("MigrateDataSource: fields cannot be changed from %v to %v", ds.Fields(), spec.Fields)
+		}
+
+		var srcs []rrd.RoundRobinArchiver
+		for _, rra := range ds.RRAs() {
+			rra, err := p.LoadRRAData(rra)
+			if err != nil {
+				return false, err
+			}
+			srcs = append(srcs, rra)
+		}
+
+		stmt := fmt.Sprintf("UPDATE %[1]sds SET step_ms = $2, heartbeat_ms = $3, type = $4, fill = $5, min_value = $6, max_value = $7 WHERE id = $1", p.prefix)
+		if _, err := tx.Exec(stmt, ds.Id(), spec.Step.Nanoseconds()/1000000, spec.Heartbeat.Nanoseconds()/1000000,
+			spec.Type.String(), spec.Fill.String(), boundArg(spec.Min, spec.Max, spec.Min), boundArg(spec.Min, spec.Max, spec.Max)); err != nil {
+			return false, err
+		}
+		if spec.Step != ds.Step() {
+			// The PDP accumulated so far is for the old step.
+			stmt := fmt.Sprintf("UPDATE %[1]sds_state SET duration_ms[$2] = 0, value[$2] = 0 WHERE seg = $1", p.prefix)
+			if _, err := tx.Exec(stmt, ds.Seg(), ds.Idx()); err != nil {
+				return false, err
+			}
+			if states := ds.FieldStates(); len(states) > 0 {
+				for i := range states {
+					states[i].Value, states[i].Duration = 0, 0
+				}
+				b, err := states.MarshalBinary()
+				if err != nil {
+					return false, err
+				}
+				stmt := fmt.Sprintf("UPDATE %[1]sds_state SET fields[$2] = $3 WHERE seg = $1", p.prefix)
+				if _, err := tx.Exec(stmt, ds.Seg(), ds.Idx(), b); err != nil {
+					return false, err
+				}
+			}
+		}
+
+		keep := make([]bool, len(srcs))
+	specs:
+		for _, rraSpec := range spec.FieldRRAs() {
+			for n, rra := range srcs {
+				if sameRRASpec(rra.Spec(), rraSpec) {
+					keep[n] = true
+					continue specs
+				}
+			}
+			dbrra, err := p.createRRA(tx, ds.Id(), rraSpec)
+			if err != nil {
+				return false, err
+			}
+			if err := p.writeRRAData(tx, dbrra, rrd.Resample(rraSpec, ds.Step(), srcs)); err != nil {
+				return false, err
+			}
+		}
+
+		stmt = fmt.Sprintf("DELETE FROM %[1]srra WHERE id = $1", p.prefix)
+		for n, rra := range srcs {
+			if !keep[n] {
+				if _, err := tx.Exec(stmt, rra.(*DbRoundRobinArchive).Id()); err != nil {
+					return false, err
+				}
+			}
+		}
+		return true, nil
+	})
+}
+
+// writeRRAData writes the data points, sketches and state of rra (a
+// plain RRA, e.g. the result of rrd.Resample) to the position of
+// dbrra as part of the transaction tx.
+func (p *pgvSerDe) writeRRAData(tx *sql.Tx, dbrra *DbRoundRobinArchive, rra rrd.RoundRobinArchiver) error {
+	if rra.Latest().IsZero() {
+		return nil // no data
+	}
+
+	stmt := fmt.Sprintf("INSERT INTO %[1]sts AS ts (rra_bundle_id, seg, i) SELECT $1, $2, generate_series(0, $3 - 1) "+
+		"ON CONFLICT(rra_bundle_id, seg, i) DO NOTHING", p.prefix)
+	if _, err := tx.Exec(stmt, dbrra.BundleId(), dbrra.Seg(), rra.Size()); err != nil {
+		return err
+	}
+
+	latest_i, latestVer, prevVer := rraVersions(rra)
+	var (
+		is       []int64
+		dps      []float64
+		vers     []int64
+		skIs     []int64
+		sketches [][]byte
+	)
+	for i, dp := range rra.DPs() {
+		ver := latestVer
+		if i > latest_i {
+			ver = prevVer
+		}
+		is, dps, vers = append(is, i), append(dps, dp), append(vers, int64(ver))
+		if sk := rra.Sketches()[i]; sk != nil {
+			b, err := sk.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			skIs, sketches = append(skIs, i), append(sketches, b)
+		}
+	}
+	stmt = fmt.Sprintf("UPDATE %[1]sts AS ts SET dp[$3] = u.dp, ver[$3] = u.ver "+
+		"FROM unnest($4::INT[], $5::DOUBLE PRECISION[], $6::SMALLINT[]) AS u(i, dp, ver) "+
+		"WHERE ts.rra_bundle_id = $1 AND ts.seg = $2 AND ts.i = u.i", p.prefix)
+	if _, err := tx.Exec(stmt, dbrra.BundleId(), dbrra.Seg(), dbrra.Idx(), pq.Array(is), pq.Array(dps), pq.Array(vers)); err != nil {
+		return err
+	}
+	if len(sketches) > 0 {
+		stmt = fmt.Sprintf("UPDATE %[1]sts AS ts SET sk[$3] = u.sk "+
+			"FROM unnest($4::INT[], $5::BYTEA[]) AS u(i, sk) "+
+			"WHERE ts.rra_bundle_id = $1 AND ts.seg = $2 AND ts.i = u.i", p.prefix)
+		if _, err := tx.Exec(stmt, dbrra.BundleId(), dbrra.Seg(), dbrra.Idx(), pq.Array(skIs), pq.Array(sketches)); err != nil {
+			return err
+		}
+	}
+
+	var sketch, hw interface{}
+	if sk := rra.Sketch(); sk != nil {
+		b, err := sk.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		sketch = b
+	}
+	if h := rra.HoltWinters(); h != nil {
+		b, err := h.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		hw = b
+	}
+	if _, err := tx.Stmt(p.sqlInsertRRAState).Exec(dbrra.BundleId(), dbrra.Seg()); err != nil {
+		return err
+	}
+	stmt = fmt.Sprintf("UPDATE %[1]srra_state AS rra_state SET latest[$3] = $4, value[$3] = $5, duration_ms[$3] = $6, "+
+		"m2[$3] = $7, sketch[$3] = $8, hw[$3] = $9 WHERE rra_bundle_id = $1 AND seg = $2", p.prefix)
+	_, err := tx.Exec(stmt, dbrra.BundleId(), dbrra.Seg(), dbrra.Idx(), rra.Latest(), rra.Value(),
+		rra.Duration().Nanoseconds()/1000000, rra.M2(), sketch, hw)
+	return err
+}
+
+// changeDataSource runs change within a transaction which also sends
+// a notification to all the delete listeners, so that they reload the
+// DS. If change returns false, the transaction is rolled back and nil
+// is returned. The DS returned is re-read from the database.
+func (p *pgvSerDe) changeDataSource(ident Ident, change func(*sql.Tx, *DbDataSource) (bool, error)) (rrd.DataSourcer, error) {
+	ds, err := p.fetchDataSource(ident)
+	if err != nil || ds == nil {
+		return nil, err
+	}
+
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	found, err := change(tx, ds)
+	if err != nil || !found {
+		tx.Rollback()
+		if err != nil {
+			log.Printf("changeDataSource(): %v", err)
+		}
+		return nil, err
+	}
+	// NOTIFY is delivered on COMMIT
+	if _, err := tx.Exec("SELECT pg_notify($1, $2)", fmt.Sprintf("%[1]sds_delete_event", p.prefix), ds.Ident().String()); err != nil {
+		log.Printf("changeDataSource(): notify: %v", err)
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("changeDataSource(): commit: %v", err)
+		return nil, err
+	}
+
+	if ds, err = p.fetchDataSource(ident); err != nil || ds == nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
 // DS delete LISTEN/NOTIFY
 
 func (p *pgvSerDe) RegisterDeleteListener(handler func(Ident)) error {
-	err := p.listen.Listen(fmt.Sprintf("%[1]sds_delete_event", p.prefix))
-	if err != nil {
-		return err
+	p.lmu.Lock()
+	defer p.lmu.Unlock()
+
+	if len(p.deleteListeners) == 0 {
+		err := p.listen.Listen(fmt.Sprintf("%[1]sds_delete_event", p.prefix))
+		if err != nil {
+			return err
+		}
+		go handleDeleteNotifications(p.listen, p.notifyDeleteListeners)
 	}
 
-	go handleDeleteNotifications(p.listen, handler)
+	p.deleteListeners = append(p.deleteListeners, handler)
 	return nil
 }
 
+// notifyDeleteListeners passes the ident to every registered listener.
+func (p *pgvSerDe) notifyDeleteListeners(ident Ident) {
+	p.lmu.Lock()
+	listeners := p.deleteListeners
+	p.lmu.Unlock()
+
+	for _, handler := range listeners {
+		handler(ident)
+	}
+}
+
 func handleDeleteNotifications(l *pq.Listener, handler func(Ident)) {
 	for {
 		select {
@@ -1367,6 +1875,7 @@ func handleDeleteNotifications(l *pq.Listener, handler func(Ident)) {
 			err := json.Unmarshal([]byte(n.Extra), &ident)
 			if err != nil {
 				log.Printf("handleDeleteNotifications(): error unmarshalling ident: %v", err)
+				continue
 			}
 			handler(ident)
 		case <-time.After(30 * time.Second):
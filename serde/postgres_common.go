@@ -17,9 +17,11 @@ package serde
 
 import (
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"strings"
 	"time"
 
@@ -38,22 +40,65 @@ func dataSourceFromDsRec(dsr *dsRecord) (*DbDataSource, error) {
 	if dsr.durationMs == nil {
 		dsr.durationMs = new(int64)
 	}
+	if dsr.lastValue == nil {
+		dsr.lastValue = new(float64)
+		*dsr.lastValue = math.NaN()
+	}
+
+	// NULL min/max is an open end of the range
+	min, max := math.Inf(-1), math.Inf(1)
+	if dsr.min != nil {
+		min = *dsr.min
+	}
+	if dsr.max != nil {
+		max = *dsr.max
+	}
+
+	dsType, err := rrd.ParseDSType(dsr.dsType)
+	if err != nil {
+		log.Printf("dataSourceFromRow(): %v", err)
+		return nil, err
+	}
+
+	fill, err := rrd.ParseFillPolicy(dsr.fill)
+	if err != nil {
+		log.Printf("dataSourceFromRow(): %v", err)
+		return nil, err
+	}
 
 	var ident Ident
-	err := json.Unmarshal(dsr.identJson, &ident)
+	err = json.Unmarshal(dsr.identJson, &ident)
 	if err != nil {
 		log.Printf("dataSourceFromRow(): error unmarshalling ident: %v", err)
 		return nil, err
 	}
 
+	var states rrd.FieldStates
+	if len(dsr.fieldState) > 0 {
+		if err := states.UnmarshalBinary(dsr.fieldState); err != nil {
+			log.Printf("dataSourceFromRow(): error unmarshalling field state: %v", err)
+			return nil, err
+		}
+	}
+	if len(dsr.fields) == 0 {
+		dsr.fields = nil
+	}
+
 	ds := NewDbDataSource(dsr.id, ident, dsr.seg, dsr.idx,
 		rrd.NewDataSource(
 			rrd.DSSpec{
-				Step:       time.Duration(dsr.stepMs) * time.Millisecond,
-				Heartbeat:  time.Duration(dsr.hbMs) * time.Millisecond,
-				LastUpdate: *dsr.lastupdate,
-				Value:      *dsr.value,
-				Duration:   time.Duration(*dsr.durationMs) * time.Millisecond,
+				Step:        time.Duration(dsr.stepMs) * time.Millisecond,
+				Heartbeat:   time.Duration(dsr.hbMs) * time.Millisecond,
+				Type:        dsType,
+				Fill:        fill,
+				Min:         min,
+				Max:         max,
+				LastUpdate:  *dsr.lastupdate,
+				LastValue:   *dsr.lastValue,
+				Value:       *dsr.value,
+				Duration:    time.Duration(*dsr.durationMs) * time.Millisecond,
+				Fields:      dsr.fields,
+				FieldStates: states,
 			},
 		),
 	)
@@ -63,9 +108,37 @@ func dataSourceFromDsRec(dsr *dsRecord) (*DbDataSource, error) {
 	return ds, nil
 }
 
+// boundArg returns the SQL argument for bound, which is one end of
+// the min/max range. An unenforced range or an infinite end is NULL.
+func boundArg(min, max, bound float64) interface{} {
+	if !(min < max) || math.IsInf(bound, 0) {
+		return nil
+	}
+	return bound
+}
+
+// byteaElems converts the []byte values of m to the hex format
+// strings PostgreSQL expects as elements of a BYTEA[] (pq.Array does
+// not), nil stays NULL.
+func byteaElems(m map[int64]interface{}) map[int64]interface{} {
+	if len(m) == 0 {
+		return nil
+	}
+	result := make(map[int64]interface{}, len(m))
+	for k, v := range m {
+		if b, ok := v.([]byte); ok && b != nil {
+			result[k] = "\\x" + hex.EncodeToString(b)
+		} else {
+			result[k] = nil
+		}
+	}
+	return result
+}
+
 func dsRecordFromRow(rows *sql.Rows) (*dsRecord, error) {
 	var dsr dsRecord
-	err := rows.Scan(&dsr.id, &dsr.identJson, &dsr.stepMs, &dsr.hbMs, &dsr.seg, &dsr.idx, &dsr.lastupdate, &dsr.value, &dsr.durationMs, &dsr.created)
+	err := rows.Scan(&dsr.id, &dsr.identJson, &dsr.stepMs, &dsr.hbMs, &dsr.dsType, &dsr.fill, &dsr.min, &dsr.max, &dsr.seg, &dsr.idx, &dsr.lastupdate, &dsr.lastValue, &dsr.value, &dsr.durationMs,
+		pq.Array(&dsr.fields), &dsr.fieldState, &dsr.created)
 	return &dsr, err
 }
 
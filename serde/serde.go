@@ -19,6 +19,7 @@ package serde
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"sort"
@@ -62,18 +63,95 @@ type Fetcher interface {
 	// series.Series. This may include selecting the most suitable RRA
 	// of the DS to satisfy span and resolution requested, as well as
 	// setting up a database cursor which will be used to iterate over
-	// the series.
-	FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error)
+	// the series. The cursor is bound to ctx, once ctx is done, the
+	// series stops iterating.
+	FetchSeries(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error)
+}
+
+type consolidationKey struct{}
+
+// WithConsolidation returns a copy of ctx which asks FetchSeries to
+// prefer an RRA with the consolidation function cf, see
+// rrd.DataSource.BestRRAByCF().
+func WithConsolidation(ctx context.Context, cf rrd.Consolidation) context.Context {
+	return context.WithValue(ctx, consolidationKey{}, cf)
+}
+
+// ConsolidationFromContext returns the consolidation function set by
+// WithConsolidation, WMEAN if none was.
+func ConsolidationFromContext(ctx context.Context) rrd.Consolidation {
+	if cf, ok := ctx.Value(consolidationKey{}).(rrd.Consolidation); ok {
+		return cf
+	}
+	return rrd.WMEAN
+}
+
+type fieldKey struct{}
+
+// WithField returns a copy of ctx which asks FetchSeries (and
+// FetchSketches) for the field named field of a multi-value DS, see
+// rrd.DataSource.Field().
+func WithField(ctx context.Context, field string) context.Context {
+	return context.WithValue(ctx, fieldKey{}, field)
+}
+
+// FieldFromContext returns the field set by WithField, "" if none was.
+func FieldFromContext(ctx context.Context) string {
+	field, _ := ctx.Value(fieldKey{}).(string)
+	return field
+}
+
+// FieldDataSource returns the field of ds set by WithField, which is
+// nil if ds has no such field. Without a field it returns ds, whose
+// data is that of the first field for a multi-value DS.
+func FieldDataSource(ctx context.Context, ds rrd.DataSourcer) rrd.DataSourcer {
+	if field := FieldFromContext(ctx); field != "" {
+		return ds.Field(rrd.FieldIndex(ds.Fields(), field))
+	}
+	return ds
+}
+
+// SketchFetcher is implemented by a Fetcher which can return the
+// quantile sketches of a DS. The RRA returned is the SKETCH RRA (see
+// rrd.SKETCH) best suited for the time range and resolution, it is a
+// copy with all its sketches (keyed by slot) loaded.
+type SketchFetcher interface {
+	FetchSketches(ctx context.Context, ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (rrd.RoundRobinArchiver, error)
+}
+
+// DataSourceAdmin is implemented by a SerDe which supports changing
+// existing data sources. Every successful change (including a delete)
+// is announced to all the delete listeners (on every node connected to
+// the same database), which should discard whatever copy of the DS
+// they hold and reload it if needed. All methods return the DS as it
+// was (for delete) or is after the change, a nil DS (and nil error)
+// means that the DS (or the RRA in RemoveRRA) does not exist.
+type DataSourceAdmin interface {
+	DeleteDataSource(ident Ident) (rrd.DataSourcer, error)
+	SetHeartbeat(ident Ident, hb time.Duration) (rrd.DataSourcer, error)
+	AddRRA(ident Ident, spec rrd.RRASpec) (rrd.DataSourcer, error)
+	// The RRA is identified by its consolidation function, step,
+	// span and calendar, it is removed from every field of a
+	// multi-value DS.
+	RemoveRRA(ident Ident, spec rrd.RRASpec) (rrd.DataSourcer, error)
+	// MigrateDataSource changes the step, heartbeat, type, bounds
+	// and RRAs of the DS to those of spec. RRAs present in both
+	// are kept as is, new RRAs are populated by resampling the
+	// existing data (see rrd.Resample), the rest are removed. The
+	// fields of a multi-value DS cannot be changed.
+	MigrateDataSource(ident Ident, spec *rrd.DSSpec) (rrd.DataSourcer, error)
 }
 
 type EventListener interface {
+	// The listener is called whenever a DS is deleted or changed.
+	// More than one listener can be registered.
 	RegisterDeleteListener(func(Ident)) error
 }
 
 type Flusher interface {
-	FlushDataPoints(bunlde_id, seg, i int64, dps, vers map[int64]interface{}) (int, error)
-	FlushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (int, error)
-	FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error)
+	FlushDataPoints(bunlde_id, seg, i int64, dps, vers, sketches map[int64]interface{}) (int, error)
+	FlushDSStates(seg int64, lastupdate, lastvalue, value, duration, fields map[int64]interface{}) (int, error)
+	FlushRRAStates(bundle_id, seg int64, latests, value, duration, m2, sketch, hw map[int64]interface{}) (int, error)
 }
 
 type SerDe interface {
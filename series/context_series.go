@@ -0,0 +1,38 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package series
+
+import "context"
+
+// ContextSeries is a Series which stops iterating once its context
+// is done (canceled or timed out). It is up to the caller to check
+// the context error to tell it apart from a series which simply came
+// to its end.
+type ContextSeries struct {
+	Series
+	ctx context.Context
+}
+
+func NewContextSeries(ctx context.Context, s Series) *ContextSeries {
+	return &ContextSeries{Series: s, ctx: ctx}
+}
+
+func (s *ContextSeries) Next() bool {
+	if s.ctx.Err() != nil {
+		return false
+	}
+	return s.Series.Next()
+}
@@ -34,6 +34,7 @@ type RRASeries struct {
 	latest    time.Time
 	step      time.Duration
 	size      int64
+	slots     rrd.Slots
 	pos       int64
 	tim       time.Time // if timeRange was set
 	alias     string
@@ -53,6 +54,7 @@ func NewRRASeries(rra rrd.RoundRobinArchiver) *RRASeries {
 		latest: rra.Latest(),
 		step:   rra.Step(),
 		size:   rra.Size(),
+		slots:  rra.Slots(),
 	}
 	if srra, ok := rra.(RLocker); ok {
 		result.lck = srra
@@ -65,7 +67,7 @@ func (s *RRASeries) Next() bool {
 	if s.pos == -1 {
 		// Set initial values to from/to if they were not set by TimeRange()
 		if s.from.IsZero() && s.to.IsZero() && !s.latest.IsZero() {
-			s.from = s.latest.Add(-s.step * time.Duration(s.size))
+			s.from = s.slots.Add(s.latest, -s.size)
 			s.to = s.latest
 		}
 	}
@@ -111,18 +113,18 @@ func (s *RRASeries) advance() bool {
 	if s.tim.IsZero() {
 		s.tim = s.from
 	} else if s.tim.Before(s.to) {
-		s.tim = s.tim.Add(s.step)
+		s.tim = s.slots.Add(s.tim, 1)
 	} else {
 		s.tim = time.Time{}
 		s.pos = -1
 		return false
 	}
 
-	if s.latest.IsZero() || s.tim.After(s.latest) || s.tim.Before(s.latest.Add(-s.step*time.Duration(s.size))) {
+	if s.latest.IsZero() || s.tim.After(s.latest) || s.tim.Before(s.slots.Add(s.latest, -s.size)) {
 		// pos is invalid, but we're still returning true, because we can advance
 		s.pos = -1
 	} else {
-		s.pos = rrd.SlotIndex(s.tim, s.step, s.size)
+		s.pos = s.slots.Index(s.tim)
 	}
 	return true
 }
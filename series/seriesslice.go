@@ -201,6 +201,29 @@ func (sl SeriesSlice) Avg() float64 {
 	return sl.Sum() / float64(len(sl))
 }
 
+// Returns the (population) standard deviation of all the current
+// values in the series in the slice. NaNs are ignored, if all values
+// are NaN, the result is NaN.
+func (sl SeriesSlice) StdDev() float64 {
+	var sum float64
+	values := make([]float64, 0, len(sl))
+	for _, series := range sl {
+		if val := series.CurrentValue(); !math.IsNaN(val) {
+			values = append(values, val)
+			sum += val
+		}
+	}
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	avg := sum / float64(len(values))
+	sum = 0
+	for _, val := range values {
+		sum += (val - avg) * (val - avg)
+	}
+	return math.Sqrt(sum / float64(len(values)))
+}
+
 // Returns the max of all the current values in the series in the
 // slice.
 func (sl SeriesSlice) Max() float64 {